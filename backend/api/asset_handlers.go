@@ -0,0 +1,356 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/db_models"
+)
+
+// errAssetOnLoan is returned by assetBindings when a unit is already lent out.
+var errAssetOnLoan = errors.New("asset is already on loan")
+
+func validCondition(condition string) bool {
+	switch condition {
+	case db_models.ConditionNew, db_models.ConditionGood, db_models.ConditionWorn,
+		db_models.ConditionBroken, db_models.ConditionLost:
+		return true
+	}
+	return false
+}
+
+// @Summary List the assets of an item
+// @Description List the individually tracked units of a serialized inventory item
+// @Tags items
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Success 200 {array} api_objects.Asset
+// @Router /organisations/{orgId}/items/{id}/assets [get]
+func (h *Handler) GetAssets(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	var assets []db_models.Asset
+	err = h.DB.Model(&assets).Where("inventory_id = ?", itemId).Order("id").Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	onLoan, err := h.assetsOnLoan(assets)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.Asset, 0, len(assets))
+	for _, a := range assets {
+		res = append(res, toAsset(a, onLoan[a.ID]))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary Add an asset to an item
+// @Description Add an individually tracked unit to an inventory item, which makes the item serialized. The item's amount follows the number of assets.
+// @Tags items
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Param asset body api_objects.AssetRequest true "Asset"
+// @Success 201 {object} api_objects.Asset
+// @Router /organisations/{orgId}/items/{id}/assets [post]
+func (h *Handler) CreateAsset(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	var req api_objects.AssetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Condition == "" {
+		req.Condition = db_models.ConditionGood
+	}
+	if !validCondition(req.Condition) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid condition " + req.Condition})
+		return
+	}
+
+	var inv db_models.Inventory
+	err = h.DB.Model(&inv).Column("id", "is_consumable").Where("id = ?", itemId).Select()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if inv.IsConsumable {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "consumable items cannot have assets"})
+		return
+	}
+
+	asset := db_models.Asset{
+		InventoryID:  itemId,
+		SerialNumber: req.SerialNumber,
+		AssetTag:     req.AssetTag,
+		Condition:    req.Condition,
+		Note:         req.Note,
+		CreatedAt:    time.Now(),
+	}
+	if req.PurchaseDate != nil {
+		asset.PurchaseDate = *req.PurchaseDate
+	}
+	if _, err := h.DB.Model(&asset).Insert(); err != nil {
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "asset tag already in use"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.syncAssetAmount(itemId); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "asset", EntityID: asset.ID,
+		Organisation: h.itemOrganisation(asset.InventoryID), After: asset,
+	})
+	c.JSON(http.StatusCreated, toAsset(asset, false))
+}
+
+// @Summary Update an asset
+// @Description Update the serial number, asset tag, condition, purchase date or note of a unit
+// @Tags items
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Param assetId path int true "Asset ID"
+// @Param asset body api_objects.UpdateAssetRequest true "Update details"
+// @Success 200 {object} api_objects.Asset
+// @Router /organisations/{orgId}/items/{id}/assets/{assetId} [put]
+func (h *Handler) UpdateAsset(c *gin.Context) {
+	asset, ok := h.itemAsset(c)
+	if !ok {
+		return
+	}
+	var req api_objects.UpdateAssetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Condition != nil && !validCondition(*req.Condition) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid condition " + *req.Condition})
+		return
+	}
+
+	before := asset
+	if req.SerialNumber != nil {
+		asset.SerialNumber = *req.SerialNumber
+	}
+	if req.AssetTag != nil {
+		asset.AssetTag = *req.AssetTag
+	}
+	if req.Condition != nil {
+		asset.Condition = *req.Condition
+	}
+	if req.PurchaseDate != nil {
+		asset.PurchaseDate = *req.PurchaseDate
+	}
+	if req.Note != nil {
+		asset.Note = *req.Note
+	}
+	if _, err := h.DB.Model(&asset).WherePK().Update(); err != nil {
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "asset tag already in use"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "asset", EntityID: asset.ID,
+		Organisation: h.itemOrganisation(asset.InventoryID), Before: before, After: asset,
+	})
+	onLoan, err := h.assetsOnLoan([]db_models.Asset{asset})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, toAsset(asset, onLoan[asset.ID]))
+}
+
+// @Summary Delete an asset
+// @Description Remove a unit from an item. Units that are on loan cannot be removed; mark them lost instead.
+// @Tags items
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Param assetId path int true "Asset ID"
+// @Success 204
+// @Router /organisations/{orgId}/items/{id}/assets/{assetId} [delete]
+func (h *Handler) DeleteAsset(c *gin.Context) {
+	asset, ok := h.itemAsset(c)
+	if !ok {
+		return
+	}
+	loans, err := h.DB.Model((*db_models.Loans)(nil)).Where("asset_id = ?", asset.ID).Count()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if loans > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "asset has loans", "details": "mark it lost or broken instead"})
+		return
+	}
+	if _, err := h.DB.Model(&asset).WherePK().Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.syncAssetAmount(asset.InventoryID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "asset", EntityID: asset.ID,
+		Organisation: h.itemOrganisation(asset.InventoryID), Before: asset,
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// itemAsset loads the :assetId of the item :id. It writes the error response itself.
+func (h *Handler) itemAsset(c *gin.Context) (db_models.Asset, bool) {
+	var asset db_models.Asset
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return asset, false
+	}
+	assetId, err := strconv.Atoi(c.Param("assetId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid asset id"})
+		return asset, false
+	}
+	err = h.DB.Model(&asset).Where("id = ?", assetId).Where("inventory_id = ?", itemId).Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "asset not found"})
+		return asset, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return asset, false
+	}
+	return asset, true
+}
+
+// syncAssetAmount keeps the amount of a serialized item equal to its number of assets.
+func (h *Handler) syncAssetAmount(itemId int) error {
+	_, err := h.DB.Model((*db_models.Inventory)(nil)).
+		Set("amount = (SELECT count(*) FROM asset WHERE asset.inventory_id = ?)", itemId).
+		Set("update_date = ?", time.Now()).
+		Where("id = ?", itemId).
+		Update()
+	return err
+}
+
+// assetsOnLoan reports which of assets are bound to a loan that has not been returned.
+func (h *Handler) assetsOnLoan(assets []db_models.Asset) (map[int]bool, error) {
+	onLoan := map[int]bool{}
+	if len(assets) == 0 {
+		return onLoan, nil
+	}
+	ids := make([]int, len(assets))
+	for i, a := range assets {
+		ids[i] = a.ID
+	}
+	var busy []int
+	err := h.DB.Model((*db_models.Loans)(nil)).
+		Column("asset_id").
+		Where("asset_id IN (?)", pg.In(ids)).
+		Where("returned = false").
+		Select(&busy)
+	for _, id := range busy {
+		onLoan[id] = true
+	}
+	return onLoan, err
+}
+
+// assetBindings checks the units chosen when approving a request and groups them
+// by the request item they are lent out for. Every serialized item that gets units
+// must get exactly as many as were requested.
+func (h *Handler) assetBindings(requestId int, assetIDs []int) (map[int][]db_models.Asset, error) {
+	var items []db_models.RequestItems
+	err := h.DB.Model(&items).Where("request_id = ?", requestId).Order("id").Select()
+	if err != nil {
+		return nil, err
+	}
+	// A request can hold the same item more than once, e.g. on its own and as
+	// part of a kit, so every inventory item maps to all of its rows.
+	itemsFor := map[int][]db_models.RequestItems{}
+	for _, it := range items {
+		itemsFor[it.InventoryID] = append(itemsFor[it.InventoryID], it)
+	}
+
+	var assets []db_models.Asset
+	err = h.DB.Model(&assets).Where("id IN (?)", pg.In(assetIDs)).Order("id").Select()
+	if err != nil {
+		return nil, err
+	}
+	found := map[int]bool{}
+	for _, a := range assets {
+		found[a.ID] = true
+	}
+	for _, id := range assetIDs {
+		if !found[id] {
+			return nil, fmt.Errorf("asset %d not found", id)
+		}
+	}
+	if len(found) != len(assetIDs) {
+		return nil, errors.New("an asset is listed twice")
+	}
+
+	onLoan, err := h.assetsOnLoan(assets)
+	if err != nil {
+		return nil, err
+	}
+	units := map[int][]db_models.Asset{}
+	for _, a := range assets {
+		if _, ok := itemsFor[a.InventoryID]; !ok {
+			return nil, fmt.Errorf("asset %d is not a unit of a requested item", a.ID)
+		}
+		if !a.Usable() {
+			return nil, fmt.Errorf("asset %d is %s", a.ID, a.Condition)
+		}
+		if onLoan[a.ID] {
+			return nil, fmt.Errorf("%w: %d", errAssetOnLoan, a.ID)
+		}
+		units[a.InventoryID] = append(units[a.InventoryID], a)
+	}
+
+	// Deal the units of each item out to its rows in turn.
+	bindings := map[int][]db_models.Asset{}
+	for inventoryID, free := range units {
+		needed := 0
+		for _, it := range itemsFor[inventoryID] {
+			needed += it.Amount
+		}
+		if len(free) != needed {
+			return nil, fmt.Errorf("item %d needs %d assets, got %d", inventoryID, needed, len(free))
+		}
+		for _, it := range itemsFor[inventoryID] {
+			bindings[it.ID] = free[:it.Amount:it.Amount]
+			free = free[it.Amount:]
+		}
+	}
+	return bindings, nil
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db_models"
+)
+
+func TestSerializedAssets(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Asset Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+	reviewer := &db_models.User{Email: "asset-reviewer@example.com", Name: "Asset Reviewer"}
+	requester := &db_models.User{Email: "asset-requester@example.com", Name: "Asset Requester"}
+	_, err = dbCon.Model(reviewer, requester).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Inventory.IsConsumable = false
+	hier.Inventory.Name = "Oscilloscope"
+	_, err = dbCon.Model(hier.Inventory).WherePK().Update()
+	assert.NoError(t, err)
+
+	var requestIDs, itemIDs []int
+	newRequest := func(amounts ...int) (*db_models.Request, *db_models.RequestItems) {
+		request := &db_models.Request{
+			UserID:           requester.ID,
+			StartDate:        time.Now().Add(24 * time.Hour),
+			EndDate:          time.Now().Add(48 * time.Hour),
+			State:            "requested",
+			OrganisationName: org.Name,
+		}
+		_, err := dbCon.Model(request).Insert()
+		assert.NoError(t, err)
+		requestIDs = append(requestIDs, request.ID)
+		var item *db_models.RequestItems
+		for _, amount := range amounts {
+			item = &db_models.RequestItems{RequestID: request.ID, InventoryID: hier.Inventory.ID, Amount: amount}
+			_, err = dbCon.Model(item).Insert()
+			assert.NoError(t, err)
+			itemIDs = append(itemIDs, item.ID)
+		}
+		return request, item
+	}
+	first, firstItem := newRequest(2)
+	second, _ := newRequest(1)
+
+	defer func() {
+		_, _ = dbCon.Model((*db_models.Loans)(nil)).Where("request_item_id IN (?)", pg.In(itemIDs)).Delete()
+		_, _ = dbCon.Model((*db_models.RequestReview)(nil)).Where("request_id IN (?)", pg.In(requestIDs)).Delete()
+		_, _ = dbCon.Model((*db_models.RequestItems)(nil)).Where("id IN (?)", pg.In(itemIDs)).Delete()
+		_, _ = dbCon.Model((*db_models.Request)(nil)).Where("id IN (?)", pg.In(requestIDs)).Delete()
+		_, _ = dbCon.Model((*db_models.Asset)(nil)).Where("inventory_id = ?", hier.Inventory.ID).Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model((*db_models.User)(nil)).Where("id IN (?)", pg.In([]int{reviewer.ID, requester.ID})).Delete()
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.GET("/organisations/:orgId/items/:id/assets", h.GetAssets)
+	router.POST("/organisations/:orgId/items/:id/assets", h.CreateAsset)
+	router.PUT("/organisations/:orgId/items/:id/assets/:assetId", h.UpdateAsset)
+	router.DELETE("/organisations/:orgId/items/:id/assets/:assetId", h.DeleteAsset)
+	router.POST("/requests/:id/review", withUser(reviewer), h.RequestReview)
+
+	base := "/organisations/" + org.Name + "/items/" + strconv.Itoa(hier.Inventory.ID) + "/assets"
+	send := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var assets []api_objects.Asset
+	t.Run("Create assets", func(t *testing.T) {
+		testCases := []struct {
+			name           string
+			payload        string
+			expectedStatus int
+		}{
+			{name: "With tag", payload: `{"serialNumber": "SN-1", "assetTag": "VIS-OSC-1", "purchaseDate": "2023-05-01T00:00:00Z"}`, expectedStatus: http.StatusCreated},
+			{name: "Without tag", payload: `{"serialNumber": "SN-2"}`, expectedStatus: http.StatusCreated},
+			{name: "Worn", payload: `{"serialNumber": "SN-3", "condition": "worn"}`, expectedStatus: http.StatusCreated},
+			{name: "Duplicate tag", payload: `{"assetTag": "VIS-OSC-1"}`, expectedStatus: http.StatusConflict},
+			{name: "Invalid condition", payload: `{"condition": "shiny"}`, expectedStatus: http.StatusBadRequest},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w := send("POST", base, tc.payload)
+				if !assert.Equal(t, tc.expectedStatus, w.Code) {
+					t.Log("Response body:", w.Body.String())
+				}
+				if w.Code == http.StatusCreated {
+					var a api_objects.Asset
+					assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &a))
+					assets = append(assets, a)
+				}
+			})
+		}
+		assert.Equal(t, "good", assets[1].Condition)
+	})
+	if !assert.Len(t, assets, 3) {
+		return
+	}
+
+	var inv db_models.Inventory
+	assert.NoError(t, dbCon.Model(&inv).Where("id = ?", hier.Inventory.ID).Select())
+	assert.Equal(t, 3, inv.Amount, "the amount follows the number of assets")
+
+	start, end := time.Now().Add(72*time.Hour), time.Now().Add(96*time.Hour)
+	available, err := h.GetAvailable(hier.Inventory.ID, start, end)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, available)
+
+	w := send("PUT", base+"/"+strconv.Itoa(assets[2].ID), `{"condition": "broken"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	available, err = h.GetAvailable(hier.Inventory.ID, start, end)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, available, "broken units are not available")
+
+	review := func(request *db_models.Request, ids ...int) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(api_objects.RequestReview{Outcome: "approved", AssetIDs: ids})
+		return send("POST", "/requests/"+strconv.Itoa(request.ID)+"/review", string(body))
+	}
+
+	t.Run("Approve binds loans to units", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, review(first, assets[0].ID).Code, "two units were requested")
+		assert.Equal(t, http.StatusBadRequest, review(first, assets[0].ID, assets[2].ID).Code, "unit is broken")
+
+		w := review(first, assets[0].ID, assets[1].ID)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var loans []db_models.Loans
+		assert.NoError(t, dbCon.Model(&loans).Where("request_item_id = ?", firstItem.ID).Order("asset_id").Select())
+		if assert.Len(t, loans, 2) {
+			assert.Equal(t, assets[0].ID, loans[0].AssetID)
+			assert.Equal(t, assets[1].ID, loans[1].AssetID)
+		}
+
+		w = review(second, assets[0].ID)
+		assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	})
+
+	t.Run("List shows units on loan", func(t *testing.T) {
+		w := send("GET", base, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var listed []api_objects.Asset
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+		if assert.Len(t, listed, 3) {
+			assert.True(t, listed[0].OnLoan)
+			assert.True(t, listed[1].OnLoan)
+			assert.False(t, listed[2].OnLoan)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, send("DELETE", base+"/"+strconv.Itoa(assets[0].ID), "").Code)
+		assert.Equal(t, http.StatusNoContent, send("DELETE", base+"/"+strconv.Itoa(assets[2].ID), "").Code)
+		assert.Equal(t, http.StatusNotFound, send("DELETE", base+"/"+strconv.Itoa(assets[2].ID), "").Code)
+
+		assert.NoError(t, dbCon.Model(&inv).Where("id = ?", hier.Inventory.ID).Select())
+		assert.Equal(t, 2, inv.Amount)
+	})
+
+	t.Run("Same item on two rows of a request", func(t *testing.T) {
+		var fresh []int
+		for _, sn := range []string{"SN-4", "SN-5"} {
+			w := send("POST", base, `{"serialNumber": "`+sn+`"}`)
+			assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+			var a api_objects.Asset
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &a))
+			fresh = append(fresh, a.ID)
+		}
+		request, _ := newRequest(1, 1)
+		rows := itemIDs[len(itemIDs)-2:]
+
+		assert.Equal(t, http.StatusBadRequest, review(request, fresh[0]).Code, "both rows need a unit")
+		w := review(request, fresh...)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var loans []db_models.Loans
+		assert.NoError(t, dbCon.Model(&loans).
+			Where("request_item_id IN (?)", pg.In(rows)).
+			Order("request_item_id").
+			Select())
+		if assert.Len(t, loans, 2) {
+			assert.NotEqual(t, loans[0].RequestItemID, loans[1].RequestItemID)
+			assert.ElementsMatch(t, fresh, []int{loans[0].AssetID, loans[1].AssetID})
+		}
+	})
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/db_models"
+	"lagertool.com/main/storage"
+)
+
+// thumbnailSize is the longest side of a thumbnail in pixels.
+const thumbnailSize = 320
+
+// attachmentTypes are the content types that may be uploaded, as detected from
+// the file itself; the value says whether a thumbnail is generated.
+var attachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      false,
+	"application/pdf": false,
+	"text/plain":      false,
+}
+
+// detectContentType sniffs the type of an upload instead of trusting the
+// client's Content-Type header.
+func detectContentType(data []byte) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "", false
+	}
+	_, ok := attachmentTypes[mediaType]
+	return mediaType, ok
+}
+
+// cleanFileName keeps the base name of an uploaded file, which browsers may
+// send with a path.
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.TrimSpace(name)
+	if name == "." || name == "/" || name == "" {
+		return "file"
+	}
+	if len(name) > 255 {
+		name = name[len(name)-255:]
+	}
+	return name
+}
+
+func attachmentURL(org string, a db_models.Attachment, file string) string {
+	return fmt.Sprintf("/organisations/%s/items/%d/attachments/%d/%s", url.PathEscape(org), a.InventoryID, a.ID, file)
+}
+
+// @Summary List the attachments of an item
+// @Description List the photos and documents attached to an inventory item
+// @Tags items
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Success 200 {array} api_objects.Attachment
+// @Router /organisations/{orgId}/items/{id}/attachments [get]
+func (h *Handler) GetAttachments(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	attachments, err := h.itemAttachments(itemId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		res = append(res, toAttachment(a, c.Param("orgId")))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) itemAttachments(itemID int) ([]db_models.Attachment, error) {
+	var attachments []db_models.Attachment
+	err := h.DB.Model(&attachments).Where("inventory_id = ?", itemID).Order("id").Select()
+	return attachments, err
+}
+
+// @Summary Upload an attachment
+// @Description Attach a photo (JPEG, PNG, GIF, WebP) or a document (PDF, plain text) to an inventory item. The type is detected from the content; images get a thumbnail.
+// @Tags items
+// @Accept  multipart/form-data
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Param file formData file true "The file"
+// @Success 201 {object} api_objects.Attachment
+// @Failure 413 {object} map[string]string
+// @Failure 415 {object} map[string]string
+// @Router /organisations/{orgId}/items/{id}/attachments [post]
+func (h *Handler) UploadAttachment(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	exists, err := h.DB.Model((*db_models.Inventory)(nil)).Where("id = ?", itemId).Exists()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+
+	tooLarge := gin.H{"error": "file too large", "details": fmt.Sprintf("at most %d MB", h.maxUpload>>20)}
+	// Leave room for the multipart framing around the file.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.maxUpload+1<<20)
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing file", "details": err.Error()})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, h.maxUpload+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if int64(len(data)) > h.maxUpload {
+		c.JSON(http.StatusRequestEntityTooLarge, tooLarge)
+		return
+	}
+	if len(data) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty file"})
+		return
+	}
+	contentType, ok := detectContentType(data)
+	if !ok {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported file type", "details": contentType})
+		return
+	}
+
+	key := fmt.Sprintf("attachments/%d/%s", itemId, uuid.New().String())
+	attachment := db_models.Attachment{
+		InventoryID: itemId,
+		FileName:    cleanFileName(header.Filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		StorageKey:  key,
+		CreatedAt:   time.Now(),
+	}
+	if user, ok := currentUser(c); ok {
+		attachment.UploadedBy = user.ID
+	}
+
+	ctx := c.Request.Context()
+	if err := h.Files.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if attachmentTypes[contentType] {
+		// An image we cannot decode is still kept, just without a thumbnail.
+		if thumb, err := storage.Thumbnail(data, thumbnailSize); err != nil {
+			log.Printf("attachments: no thumbnail for %s: %v", key, err)
+		} else if err := h.Files.Put(ctx, key+"-thumb", bytes.NewReader(thumb)); err != nil {
+			log.Printf("attachments: storing thumbnail for %s: %v", key, err)
+		} else {
+			attachment.ThumbnailKey = key + "-thumb"
+		}
+	}
+	if _, err := h.DB.Model(&attachment).Insert(); err != nil {
+		h.deleteAttachmentFiles(c, attachment)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "attachment", EntityID: attachment.ID,
+		Organisation: h.itemOrganisation(attachment.InventoryID), After: attachment,
+	})
+	c.JSON(http.StatusCreated, toAttachment(attachment, c.Param("orgId")))
+}
+
+func (h *Handler) itemAttachment(c *gin.Context) (db_models.Attachment, bool) {
+	var attachment db_models.Attachment
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return attachment, false
+	}
+	attachmentId, err := strconv.Atoi(c.Param("attachmentId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid attachment id"})
+		return attachment, false
+	}
+	err = h.DB.Model(&attachment).Where("id = ?", attachmentId).Where("inventory_id = ?", itemId).Select()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "attachment not found"})
+		return attachment, false
+	}
+	return attachment, true
+}
+
+// @Summary Download an attachment
+// @Description Download the file of an attachment. Images and PDFs are shown inline, everything else is downloaded.
+// @Tags items
+// @Produce  octet-stream
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Param attachmentId path int true "Attachment ID"
+// @Success 200 {file} file
+// @Router /organisations/{orgId}/items/{id}/attachments/{attachmentId}/file [get]
+func (h *Handler) GetAttachmentFile(c *gin.Context) {
+	attachment, ok := h.itemAttachment(c)
+	if !ok {
+		return
+	}
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") || attachment.ContentType == "application/pdf" {
+		disposition = "inline"
+	}
+	h.serveFile(c, attachment.StorageKey, attachment.ContentType, attachment.Size,
+		mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}))
+}
+
+// @Summary Get the thumbnail of an attachment
+// @Description Get a small JPEG preview of an image attachment
+// @Tags items
+// @Produce  jpeg
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Param attachmentId path int true "Attachment ID"
+// @Success 200 {file} file
+// @Router /organisations/{orgId}/items/{id}/attachments/{attachmentId}/thumbnail [get]
+func (h *Handler) GetAttachmentThumbnail(c *gin.Context) {
+	attachment, ok := h.itemAttachment(c)
+	if !ok {
+		return
+	}
+	if attachment.ThumbnailKey == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "attachment has no thumbnail"})
+		return
+	}
+	h.serveFile(c, attachment.ThumbnailKey, storage.ThumbnailContentType, -1, "inline")
+}
+
+func (h *Handler) serveFile(c *gin.Context, key, contentType string, size int64, disposition string) {
+	f, err := h.Files.Open(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	c.DataFromReader(http.StatusOK, size, contentType, f, map[string]string{
+		"Content-Disposition":    disposition,
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=86400",
+	})
+}
+
+// @Summary Delete an attachment
+// @Description Delete an attachment and its files
+// @Tags items
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Param attachmentId path int true "Attachment ID"
+// @Success 204
+// @Router /organisations/{orgId}/items/{id}/attachments/{attachmentId} [delete]
+func (h *Handler) DeleteAttachment(c *gin.Context) {
+	attachment, ok := h.itemAttachment(c)
+	if !ok {
+		return
+	}
+	if _, err := h.DB.Model(&attachment).WherePK().Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.deleteAttachmentFiles(c, attachment)
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "attachment", EntityID: attachment.ID,
+		Organisation: h.itemOrganisation(attachment.InventoryID), Before: attachment,
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// deleteAttachmentFiles removes the stored files of an attachment. A file left
+// behind only wastes space, so failures are logged rather than returned.
+func (h *Handler) deleteAttachmentFiles(c *gin.Context, a db_models.Attachment) {
+	for _, key := range []string{a.StorageKey, a.ThumbnailKey} {
+		if key == "" {
+			continue
+		}
+		if err := h.Files.Delete(c.Request.Context(), key); err != nil {
+			log.Printf("attachments: deleting %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db_models"
+	"lagertool.com/main/storage"
+)
+
+func TestDetectContentType(t *testing.T) {
+	var pngData bytes.Buffer
+	_ = png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+
+	testCases := []struct {
+		name string
+		data []byte
+		want string
+		ok   bool
+	}{
+		{name: "png", data: pngData.Bytes(), want: "image/png", ok: true},
+		{name: "pdf", data: []byte("%PDF-1.7\n"), want: "application/pdf", ok: true},
+		{name: "text", data: []byte("Safety sheet"), want: "text/plain", ok: true},
+		{name: "html", data: []byte("<html><script>alert(1)</script></html>"), want: "text/html", ok: false},
+		{name: "zip", data: []byte("PK\x03\x04"), want: "application/zip", ok: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := detectContentType(tc.data)
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.ok, ok)
+		})
+	}
+}
+
+func TestCleanFileName(t *testing.T) {
+	assert.Equal(t, "manual.pdf", cleanFileName("manual.pdf"))
+	assert.Equal(t, "manual.pdf", cleanFileName(`C:\Users\vis\manual.pdf`))
+	assert.Equal(t, "passwd", cleanFileName("../../etc/passwd"))
+	assert.Equal(t, "file", cleanFileName(""))
+}
+
+func TestAttachments(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	hier := createTestHierarchy(t, dbCon)
+	defer func() {
+		_, _ = dbCon.Model((*db_models.Attachment)(nil)).Where("inventory_id = ?", hier.Inventory.ID).Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+	}()
+
+	h := NewHandler(dbCon, nil)
+	h.Files = storage.NewLocal(t.TempDir())
+	h.maxUpload = 64 << 10
+	base := "/organisations/VIS/items/" + strconv.Itoa(hier.Inventory.ID) + "/attachments"
+	router.GET("/organisations/:orgId/items/:id", h.GetItem)
+	router.GET("/organisations/:orgId/items/:id/attachments", h.GetAttachments)
+	router.POST("/organisations/:orgId/items/:id/attachments", h.UploadAttachment)
+	router.GET("/organisations/:orgId/items/:id/attachments/:attachmentId/file", h.GetAttachmentFile)
+	router.GET("/organisations/:orgId/items/:id/attachments/:attachmentId/thumbnail", h.GetAttachmentThumbnail)
+	router.DELETE("/organisations/:orgId/items/:id/attachments/:attachmentId", h.DeleteAttachment)
+
+	upload := func(name string, content []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", name)
+		_, _ = fw.Write(content)
+		_ = mw.Close()
+		req, _ := http.NewRequest("POST", base, &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var photo bytes.Buffer
+	assert.NoError(t, png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 640, 480))))
+
+	var uploaded []api_objects.Attachment
+	t.Run("Upload", func(t *testing.T) {
+		testCases := []struct {
+			name           string
+			fileName       string
+			content        []byte
+			expectedStatus int
+		}{
+			{name: "Photo", fileName: "front.png", content: photo.Bytes(), expectedStatus: http.StatusCreated},
+			{name: "Manual", fileName: "manual.pdf", content: []byte("%PDF-1.7\n%%EOF"), expectedStatus: http.StatusCreated},
+			{name: "HTML", fileName: "page.pdf", content: []byte("<html></html>"), expectedStatus: http.StatusUnsupportedMediaType},
+			{name: "Too large", fileName: "big.txt", content: bytes.Repeat([]byte("a"), 65<<10), expectedStatus: http.StatusRequestEntityTooLarge},
+			{name: "Empty", fileName: "empty.txt", content: nil, expectedStatus: http.StatusBadRequest},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w := upload(tc.fileName, tc.content)
+				assert.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+				if w.Code == http.StatusCreated {
+					var a api_objects.Attachment
+					assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &a))
+					uploaded = append(uploaded, a)
+				}
+			})
+		}
+	})
+	if !assert.Len(t, uploaded, 2) {
+		return
+	}
+	photoAttachment, manual := uploaded[0], uploaded[1]
+	assert.Equal(t, "image/png", photoAttachment.ContentType)
+	assert.NotEmpty(t, photoAttachment.ThumbnailURL)
+	assert.Equal(t, "application/pdf", manual.ContentType)
+	assert.Empty(t, manual.ThumbnailURL)
+
+	t.Run("Download", func(t *testing.T) {
+		w := get(manual.URL)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "%PDF-1.7\n%%EOF", w.Body.String())
+		assert.Equal(t, `inline; filename=manual.pdf`, w.Header().Get("Content-Disposition"))
+
+		w = get(photoAttachment.ThumbnailURL)
+		assert.Equal(t, http.StatusOK, w.Code)
+		cfg, format, err := image.DecodeConfig(w.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "jpeg", format)
+		assert.Equal(t, thumbnailSize, cfg.Width)
+
+		assert.Equal(t, http.StatusNotFound, get(base+"/"+strconv.Itoa(manual.ID)+"/thumbnail").Code)
+	})
+
+	t.Run("Listed with the item", func(t *testing.T) {
+		w := get("/organisations/VIS/items/" + strconv.Itoa(hier.Inventory.ID) + "?start=2030-01-01&end=2030-01-02")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var item api_objects.InventoryItemWithShelf
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &item))
+		assert.Len(t, item.Attachments, 2)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", base+"/"+strconv.Itoa(photoAttachment.ID), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, http.StatusNotFound, get(photoAttachment.URL).Code)
+
+		w = get(base)
+		var remaining []api_objects.Attachment
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &remaining))
+		assert.Equal(t, []int{manual.ID}, []int{remaining[0].ID})
+	})
+}
@@ -0,0 +1,407 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/db_models"
+)
+
+// categoryAncestry selects the ids of a category and all of its ancestors.
+const categoryAncestry = `WITH RECURSIVE up AS (
+	SELECT id, parent_id FROM category WHERE id = ?
+	UNION ALL
+	SELECT category.id, category.parent_id FROM category JOIN up ON category.id = up.parent_id
+) SELECT id FROM up`
+
+// attributeKeyPattern keeps keys usable as attr.<key> query parameters.
+var attributeKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// attributeDefinitions returns the attributes that apply to items of a category:
+// its own and those inherited from its ancestors.
+func (h *Handler) attributeDefinitions(categoryID int) ([]db_models.AttributeDefinition, error) {
+	var defs []db_models.AttributeDefinition
+	if categoryID == 0 {
+		return defs, nil
+	}
+	err := h.DB.Model(&defs).
+		Where("category_id IN ("+categoryAncestry+")", categoryID).
+		Order("key").
+		Select()
+	return defs, err
+}
+
+func validateDefinition(def db_models.AttributeDefinition) error {
+	if !attributeKeyPattern.MatchString(def.Key) {
+		return errors.New("key must start with a lowercase letter and contain only a-z, 0-9 and _")
+	}
+	switch def.Type {
+	case db_models.AttributeString, db_models.AttributeNumber, db_models.AttributeBoolean:
+		if len(def.Options) > 0 {
+			return errors.New("only enum attributes can have options")
+		}
+	case db_models.AttributeEnum:
+		if len(def.Options) == 0 {
+			return errors.New("enum attributes need at least one option")
+		}
+	default:
+		return fmt.Errorf("invalid type %q", def.Type)
+	}
+	if def.Unit != "" && def.Type != db_models.AttributeNumber {
+		return errors.New("only number attributes can have a unit")
+	}
+	return nil
+}
+
+// validateAttributes checks item values against the definitions of its category.
+// Unknown keys, values of the wrong type and missing required values are
+// rejected. It returns nil when there are no values.
+func validateAttributes(defs []db_models.AttributeDefinition, values map[string]interface{}) (map[string]interface{}, error) {
+	byKey := make(map[string]db_models.AttributeDefinition, len(defs))
+	for _, def := range defs {
+		byKey[def.Key] = def
+	}
+	var errs []error
+	res := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		def, ok := byKey[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown attribute", key))
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		if err := checkAttributeValue(def, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		res[key] = value
+	}
+	for _, def := range defs {
+		if _, ok := res[def.Key]; def.Required && !ok {
+			errs = append(errs, fmt.Errorf("%s: required", def.Key))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return nil, errors.Join(errs...)
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+func checkAttributeValue(def db_models.AttributeDefinition, value interface{}) error {
+	switch def.Type {
+	case db_models.AttributeString:
+		if _, ok := value.(string); !ok {
+			return errors.New("must be a string")
+		}
+	case db_models.AttributeNumber:
+		if _, ok := value.(float64); !ok {
+			return errors.New("must be a number")
+		}
+	case db_models.AttributeBoolean:
+		if _, ok := value.(bool); !ok {
+			return errors.New("must be true or false")
+		}
+	case db_models.AttributeEnum:
+		s, _ := value.(string)
+		for _, option := range def.Options {
+			if s == option {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(def.Options, ", "))
+	}
+	return nil
+}
+
+// itemAttributes validates the attribute values of an item in categoryID. It
+// answers the request itself and returns false when they are invalid.
+func (h *Handler) itemAttributes(c *gin.Context, categoryID int, values map[string]interface{}) (map[string]interface{}, bool) {
+	defs, err := h.attributeDefinitions(categoryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	res, err := validateAttributes(defs, values)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid attributes", "details": err.Error()})
+		return nil, false
+	}
+	return res, true
+}
+
+// withoutUndefined drops the values that no definition of the category covers,
+// e.g. after an item moved to another category.
+func (h *Handler) withoutUndefined(categoryID int, values map[string]interface{}) (map[string]interface{}, error) {
+	defs, err := h.attributeDefinitions(categoryID)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]interface{}, len(values))
+	for _, def := range defs {
+		if v, ok := values[def.Key]; ok {
+			res[def.Key] = v
+		}
+	}
+	return res, nil
+}
+
+// attributeFilter is one attr.<key>=X, attr.<key>.min=X or attr.<key>.max=X
+// query parameter of the inventory listing.
+type attributeFilter struct {
+	key   string
+	op    string // "=", ">=" or "<="
+	value string
+	num   float64
+}
+
+func parseAttributeFilters(query url.Values) ([]attributeFilter, error) {
+	var filters []attributeFilter
+	for param, values := range query {
+		rest, ok := strings.CutPrefix(param, "attr.")
+		if !ok {
+			continue
+		}
+		f := attributeFilter{key: rest, op: "="}
+		if key, ok := strings.CutSuffix(rest, ".min"); ok {
+			f.key, f.op = key, ">="
+		} else if key, ok := strings.CutSuffix(rest, ".max"); ok {
+			f.key, f.op = key, "<="
+		}
+		if !attributeKeyPattern.MatchString(f.key) {
+			return nil, fmt.Errorf("invalid attribute filter %s", param)
+		}
+		for _, v := range values {
+			f.value = v
+			if f.op != "=" {
+				n, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s must be a number", param)
+				}
+				f.num = n
+			}
+			filters = append(filters, f)
+		}
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].key+filters[i].op < filters[j].key+filters[j].op })
+	return filters, nil
+}
+
+func (f attributeFilter) apply(q *orm.Query) *orm.Query {
+	if f.op == "=" {
+		return q.Where("inventory.attributes ->> ? = ?", f.key, f.value)
+	}
+	// The CASE keeps the cast away from values that are not numbers.
+	return q.Where("CASE WHEN jsonb_typeof(inventory.attributes -> ?) = 'number' THEN (inventory.attributes ->> ?)::numeric END "+f.op+" ?",
+		f.key, f.key, f.num)
+}
+
+// @Summary List the attributes of a category
+// @Description List the attribute definitions that apply to items of a category, including those inherited from parent categories
+// @Tags categories
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param categoryId path int true "Category ID"
+// @Success 200 {array} api_objects.AttributeDefinition
+// @Router /organisations/{orgId}/categories/{categoryId}/attributes [get]
+func (h *Handler) GetAttributeDefinitions(c *gin.Context) {
+	category, ok := h.orgCategory(c)
+	if !ok {
+		return
+	}
+	defs, err := h.attributeDefinitions(category.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.AttributeDefinition, 0, len(defs))
+	for _, def := range defs {
+		res = append(res, toAttributeDefinition(def))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary Define an attribute
+// @Description Define a typed attribute for the items of a category and its subcategories
+// @Tags categories
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param categoryId path int true "Category ID"
+// @Param attribute body api_objects.AttributeDefinitionRequest true "Attribute definition"
+// @Success 201 {object} api_objects.AttributeDefinition
+// @Router /organisations/{orgId}/categories/{categoryId}/attributes [post]
+func (h *Handler) CreateAttributeDefinition(c *gin.Context) {
+	category, ok := h.orgCategory(c)
+	if !ok {
+		return
+	}
+	var req api_objects.AttributeDefinitionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	def := db_models.AttributeDefinition{
+		CategoryID: category.ID,
+		Key:        req.Key,
+		Label:      req.Label,
+		Type:       req.Type,
+		Unit:       req.Unit,
+		Options:    req.Options,
+		Required:   req.Required,
+	}
+	if def.Label == "" {
+		def.Label = def.Key
+	}
+	if err := validateDefinition(def); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A key must be unique along every path of the tree, or an item would get two definitions for it.
+	taken, err := h.DB.Model((*db_models.AttributeDefinition)(nil)).
+		Where("key = ?", def.Key).
+		Where("category_id IN ("+categoryAncestry+") OR category_id IN ("+categorySubtree+")", category.ID, category.ID).
+		Exists()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "attribute " + def.Key + " is already defined for this category, a parent or a subcategory"})
+		return
+	}
+	if _, err := h.DB.Model(&def).Insert(); err != nil {
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "attribute " + def.Key + " is already defined for this category"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "attribute_definition", EntityID: def.ID,
+		Organisation: category.OrganisationName, After: def,
+	})
+	c.JSON(http.StatusCreated, toAttributeDefinition(def))
+}
+
+func (h *Handler) categoryAttribute(c *gin.Context) (db_models.Category, db_models.AttributeDefinition, bool) {
+	var def db_models.AttributeDefinition
+	category, ok := h.orgCategory(c)
+	if !ok {
+		return category, def, false
+	}
+	id, err := strconv.Atoi(c.Param("attributeId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid attribute id"})
+		return category, def, false
+	}
+	err = h.DB.Model(&def).Where("id = ?", id).Where("category_id = ?", category.ID).Select()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "attribute not found"})
+		return category, def, false
+	}
+	return category, def, true
+}
+
+// @Summary Update an attribute
+// @Description Update the label, unit, options or required flag of an attribute. Its key and type cannot change.
+// @Tags categories
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param categoryId path int true "Category ID"
+// @Param attributeId path int true "Attribute ID"
+// @Param attribute body api_objects.UpdateAttributeDefinitionRequest true "Update details"
+// @Success 200 {object} api_objects.AttributeDefinition
+// @Router /organisations/{orgId}/categories/{categoryId}/attributes/{attributeId} [put]
+func (h *Handler) UpdateAttributeDefinition(c *gin.Context) {
+	category, def, ok := h.categoryAttribute(c)
+	if !ok {
+		return
+	}
+	var req api_objects.UpdateAttributeDefinitionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before := def
+	if req.Label != nil {
+		def.Label = *req.Label
+	}
+	if req.Unit != nil {
+		def.Unit = *req.Unit
+	}
+	if req.Options != nil {
+		def.Options = req.Options
+	}
+	if req.Required != nil {
+		def.Required = *req.Required
+	}
+	if err := validateDefinition(def); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := h.DB.Model(&def).WherePK().Update(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "attribute_definition", EntityID: def.ID,
+		Organisation: category.OrganisationName, Before: before, After: def,
+	})
+	c.JSON(http.StatusOK, toAttributeDefinition(def))
+}
+
+// @Summary Delete an attribute
+// @Description Delete an attribute definition together with the values items in the category hold for it
+// @Tags categories
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param categoryId path int true "Category ID"
+// @Param attributeId path int true "Attribute ID"
+// @Success 204
+// @Router /organisations/{orgId}/categories/{categoryId}/attributes/{attributeId} [delete]
+func (h *Handler) DeleteAttributeDefinition(c *gin.Context) {
+	category, def, ok := h.categoryAttribute(c)
+	if !ok {
+		return
+	}
+	err := h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		if _, err := tx.Model(&def).WherePK().Delete(); err != nil {
+			return err
+		}
+		_, err := tx.Model((*db_models.Inventory)(nil)).
+			Set("attributes = attributes - ?", def.Key).
+			Where("attributes IS NOT NULL").
+			Where("category_id IN ("+categorySubtree+")", category.ID).
+			Update()
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "attribute_definition", EntityID: def.ID,
+		Organisation: category.OrganisationName, Before: def,
+	})
+	c.Status(http.StatusNoContent)
+}
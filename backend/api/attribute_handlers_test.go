@@ -0,0 +1,248 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db_models"
+)
+
+func TestValidateAttributes(t *testing.T) {
+	defs := []db_models.AttributeDefinition{
+		{Key: "length", Type: db_models.AttributeNumber, Unit: "m", Required: true},
+		{Key: "connector", Type: db_models.AttributeEnum, Options: []string{"XLR", "jack"}},
+		{Key: "shielded", Type: db_models.AttributeBoolean},
+		{Key: "colour", Type: db_models.AttributeString},
+	}
+
+	testCases := []struct {
+		name    string
+		values  map[string]interface{}
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:   "all valid",
+			values: map[string]interface{}{"length": 2.5, "connector": "XLR", "shielded": true, "colour": "black"},
+			want:   map[string]interface{}{"length": 2.5, "connector": "XLR", "shielded": true, "colour": "black"},
+		},
+		{name: "null drops the value", values: map[string]interface{}{"length": 1.0, "colour": nil}, want: map[string]interface{}{"length": 1.0}},
+		{name: "missing required", values: map[string]interface{}{"colour": "red"}, wantErr: "length: required"},
+		{name: "unknown key", values: map[string]interface{}{"length": 1.0, "weight": 3.0}, wantErr: "weight: unknown attribute"},
+		{name: "number as string", values: map[string]interface{}{"length": "2"}, wantErr: "length: must be a number"},
+		{name: "unknown option", values: map[string]interface{}{"length": 1.0, "connector": "USB"}, wantErr: "must be one of XLR, jack"},
+		{name: "boolean as string", values: map[string]interface{}{"length": 1.0, "shielded": "yes"}, wantErr: "shielded: must be true or false"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := validateAttributes(defs, tc.values)
+			if tc.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.wantErr)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	got, err := validateAttributes(nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, got, "no values are stored as NULL")
+}
+
+func TestValidateDefinition(t *testing.T) {
+	testCases := []struct {
+		name    string
+		def     db_models.AttributeDefinition
+		wantErr bool
+	}{
+		{name: "number with unit", def: db_models.AttributeDefinition{Key: "voltage", Type: "number", Unit: "V"}},
+		{name: "enum", def: db_models.AttributeDefinition{Key: "lens_mount", Type: "enum", Options: []string{"EF", "E"}}},
+		{name: "enum without options", def: db_models.AttributeDefinition{Key: "lens_mount", Type: "enum"}, wantErr: true},
+		{name: "options on a string", def: db_models.AttributeDefinition{Key: "colour", Type: "string", Options: []string{"red"}}, wantErr: true},
+		{name: "unit on a boolean", def: db_models.AttributeDefinition{Key: "shielded", Type: "boolean", Unit: "m"}, wantErr: true},
+		{name: "unknown type", def: db_models.AttributeDefinition{Key: "colour", Type: "colour"}, wantErr: true},
+		{name: "key with a dot", def: db_models.AttributeDefinition{Key: "a.b", Type: "string"}, wantErr: true},
+		{name: "uppercase key", def: db_models.AttributeDefinition{Key: "Length", Type: "number"}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateDefinition(tc.def)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseAttributeFilters(t *testing.T) {
+	query, _ := url.ParseQuery("start=2030-01-01&attr.connector=XLR&attr.length.min=2&attr.length.max=10")
+	filters, err := parseAttributeFilters(query)
+	assert.NoError(t, err)
+	assert.Equal(t, []attributeFilter{
+		{key: "connector", op: "=", value: "XLR"},
+		{key: "length", op: "<=", value: "10", num: 10},
+		{key: "length", op: ">=", value: "2", num: 2},
+	}, filters)
+
+	for _, q := range []string{"attr.length.min=long", "attr.Bad=1", "attr.=1"} {
+		query, _ := url.ParseQuery(q)
+		_, err := parseAttributeFilters(query)
+		assert.Error(t, err, q)
+	}
+}
+
+func TestAttributeDefinitions(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Attribute Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+	cables := &db_models.Category{Name: "Cables", OrganisationName: org.Name}
+	_, err = dbCon.Model(cables).Insert()
+	assert.NoError(t, err)
+	audio := &db_models.Category{Name: "Audio cables", OrganisationName: org.Name, ParentID: cables.ID}
+	_, err = dbCon.Model(audio).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+
+	defer func() {
+		_, _ = dbCon.Model((*db_models.AttributeDefinition)(nil)).Where("category_id IN (?, ?)", cables.ID, audio.ID).Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model(audio).WherePK().Delete()
+		_, _ = dbCon.Model(cables).WherePK().Delete()
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.GET("/organisations/:orgId/categories/:categoryId/attributes", h.GetAttributeDefinitions)
+	router.POST("/organisations/:orgId/categories/:categoryId/attributes", h.CreateAttributeDefinition)
+	router.DELETE("/organisations/:orgId/categories/:categoryId/attributes/:attributeId", h.DeleteAttributeDefinition)
+	router.PUT("/organisations/:orgId/items/:id", h.UpdateItem)
+	router.GET("/organisations/:orgId/inventory", h.GetInventory)
+
+	send := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	attributesURL := func(categoryID int) string {
+		return "/organisations/" + org.Name + "/categories/" + strconv.Itoa(categoryID) + "/attributes"
+	}
+
+	var created []api_objects.AttributeDefinition
+	t.Run("Define", func(t *testing.T) {
+		testCases := []struct {
+			name           string
+			categoryID     int
+			payload        string
+			expectedStatus int
+		}{
+			{name: "Length on cables", categoryID: cables.ID, payload: `{"key": "length", "type": "number", "unit": "m", "required": true}`, expectedStatus: http.StatusCreated},
+			{name: "Connector on audio", categoryID: audio.ID, payload: `{"key": "connector", "type": "enum", "options": ["XLR", "jack"]}`, expectedStatus: http.StatusCreated},
+			{name: "Length again below", categoryID: audio.ID, payload: `{"key": "length", "type": "number"}`, expectedStatus: http.StatusConflict},
+			{name: "Connector again above", categoryID: cables.ID, payload: `{"key": "connector", "type": "string"}`, expectedStatus: http.StatusConflict},
+			{name: "Invalid type", categoryID: cables.ID, payload: `{"key": "weight", "type": "mass"}`, expectedStatus: http.StatusBadRequest},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w := send("POST", attributesURL(tc.categoryID), tc.payload)
+				assert.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+				if w.Code == http.StatusCreated {
+					var def api_objects.AttributeDefinition
+					assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &def))
+					created = append(created, def)
+				}
+			})
+		}
+	})
+	if !assert.Len(t, created, 2) {
+		return
+	}
+
+	w := send("GET", attributesURL(audio.ID), "")
+	var inherited []api_objects.AttributeDefinition
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &inherited))
+	assert.Equal(t, created[1:], inherited[:1], "own and inherited, sorted by key")
+	assert.Equal(t, created[:1], inherited[1:])
+
+	itemURL := "/organisations/" + org.Name + "/items/" + strconv.Itoa(hier.Inventory.ID)
+	t.Run("Item values", func(t *testing.T) {
+		testCases := []struct {
+			name           string
+			payload        string
+			expectedStatus int
+		}{
+			{name: "Missing required", payload: `{"categoryId": ` + strconv.Itoa(audio.ID) + `, "attributes": {"connector": "XLR"}}`, expectedStatus: http.StatusBadRequest},
+			{name: "Wrong option", payload: `{"categoryId": ` + strconv.Itoa(audio.ID) + `, "attributes": {"length": 5, "connector": "USB"}}`, expectedStatus: http.StatusBadRequest},
+			{name: "Valid", payload: `{"categoryId": ` + strconv.Itoa(audio.ID) + `, "attributes": {"length": 5, "connector": "XLR"}}`, expectedStatus: http.StatusOK},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w := send("PUT", itemURL, tc.payload)
+				assert.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			})
+		}
+	})
+
+	t.Run("Filter inventory", func(t *testing.T) {
+		testCases := []struct {
+			query string
+			found bool
+		}{
+			{query: "attr.connector=XLR", found: true},
+			{query: "attr.connector=jack", found: false},
+			{query: "attr.length=5", found: true},
+			{query: "attr.length.min=3&attr.length.max=10", found: true},
+			{query: "attr.length.min=6", found: false},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.query, func(t *testing.T) {
+				w := send("GET", "/organisations/"+org.Name+"/inventory?start=2030-01-01&end=2030-01-02&"+tc.query, "")
+				assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+				var items []api_objects.InventorySorted
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+				assert.Equal(t, tc.found, len(items) == 1)
+				if tc.found {
+					assert.Equal(t, map[string]interface{}{"length": 5.0, "connector": "XLR"}, items[0].Attributes)
+				}
+			})
+		}
+	})
+
+	t.Run("Moving the item keeps inherited values", func(t *testing.T) {
+		w := send("PUT", itemURL, `{"categoryId": `+strconv.Itoa(cables.ID)+`}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var inv db_models.Inventory
+		assert.NoError(t, dbCon.Model(&inv).Where("id = ?", hier.Inventory.ID).Select())
+		assert.Equal(t, map[string]interface{}{"length": 5.0}, inv.Attributes)
+	})
+
+	t.Run("Deleting a definition removes the values", func(t *testing.T) {
+		w := send("DELETE", attributesURL(cables.ID)+"/"+strconv.Itoa(created[0].ID), "")
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		var inv db_models.Inventory
+		assert.NoError(t, dbCon.Model(&inv).Where("id = ?", hier.Inventory.ID).Select())
+		assert.Empty(t, inv.Attributes)
+	})
+}
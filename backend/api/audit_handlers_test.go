@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/config"
+	"lagertool.com/main/db_models"
+)
+
+func TestGetAuditLog(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Audit Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+	actor := &db_models.User{Email: "audit@example.com", Name: "Audit Admin"}
+	_, err = dbCon.Model(actor).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+	defer func() {
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model(actor).WherePK().Delete()
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.PUT("/organisations/:orgId/items/:id", withUser(actor), h.UpdateItem)
+	router.GET("/organisations/:orgId/audit", h.GetAuditLog)
+
+	base := "/organisations/" + org.Name
+	itemID := strconv.Itoa(hier.Inventory.ID)
+
+	req, _ := http.NewRequest("PUT", base+"/items/"+itemID, strings.NewReader(`{"amount": 42}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	today := time.Now().UTC().Format("2006-01-02")
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+
+	testCases := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedCount  int
+	}{
+		{name: "All entries", query: "", expectedStatus: http.StatusOK, expectedCount: 1},
+		{name: "By actor", query: "?actor=" + strconv.Itoa(actor.ID), expectedStatus: http.StatusOK, expectedCount: 1},
+		{name: "By other actor", query: "?actor=999999", expectedStatus: http.StatusOK, expectedCount: 0},
+		{name: "By entity", query: "?entity=inventory&entityId=" + itemID, expectedStatus: http.StatusOK, expectedCount: 1},
+		{name: "By other entity", query: "?entity=shelf", expectedStatus: http.StatusOK, expectedCount: 0},
+		{name: "Today", query: "?from=" + today + "&to=" + today, expectedStatus: http.StatusOK, expectedCount: 1},
+		{name: "Until yesterday", query: "?to=" + yesterday, expectedStatus: http.StatusOK, expectedCount: 0},
+		{name: "Invalid actor", query: "?actor=abc", expectedStatus: http.StatusBadRequest},
+		{name: "Invalid from", query: "?from=yesterday", expectedStatus: http.StatusBadRequest},
+		{name: "Invalid limit", query: "?limit=0", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", base+"/audit"+tc.query, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if !assert.Equal(t, tc.expectedStatus, w.Code) {
+				t.Log("Response body:", w.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			var entries []api_objects.AuditEntry
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+			assert.Len(t, entries, tc.expectedCount)
+		})
+	}
+
+	t.Run("Entry records the change", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", base+"/audit", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var entries []api_objects.AuditEntry
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		if !assert.Len(t, entries, 1) {
+			return
+		}
+		e := entries[0]
+		assert.Equal(t, "update", e.Action)
+		assert.Equal(t, actor.ID, e.ActorID)
+		assert.Equal(t, actor.Name, e.ActorName)
+
+		var before, after db_models.Inventory
+		assert.NoError(t, json.Unmarshal(e.Before, &before))
+		assert.NoError(t, json.Unmarshal(e.After, &after))
+		assert.Equal(t, 10, before.Amount)
+		assert.Equal(t, 42, after.Amount)
+	})
+
+	t.Run("Entry follows the item, not the path", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", "/organisations/Someone%20Else/items/"+itemID, strings.NewReader(`{"amount": 43}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		req, _ = http.NewRequest("GET", base+"/audit", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var entries []api_objects.AuditEntry
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		assert.Len(t, entries, 2)
+	})
+}
+
+func TestGetUnscopedAuditLog(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	root := &db_models.User{Email: "root-audit@example.com", Name: "Root"}
+	admin := &db_models.User{Email: "admin-audit@example.com", Name: "Org Admin"}
+	_, err := dbCon.Model(root, admin).Insert()
+	assert.NoError(t, err)
+	login := &db_models.AuditLog{ActorID: admin.ID, Action: "login", Entity: "session", CreatedAt: time.Now()}
+	_, err = dbCon.Model(login).Insert()
+	assert.NoError(t, err)
+	defer func() {
+		_, _ = dbCon.Model(login).WherePK().Delete()
+		_, _ = dbCon.Model(root).WherePK().Delete()
+		_, _ = dbCon.Model(admin).WherePK().Delete()
+	}()
+
+	cfg := &config.Config{Auth: config.AuthConfig{SuperAdmins: []string{"ROOT-audit@example.com"}}}
+	h := NewHandler(dbCon, cfg)
+	router.GET("/root/audit", withUser(root), h.RequireSuperAdmin(true), h.GetUnscopedAuditLog)
+	router.GET("/admin/audit", withUser(admin), h.RequireSuperAdmin(true), h.GetUnscopedAuditLog)
+
+	req, _ := http.NewRequest("GET", "/root/audit?actor="+strconv.Itoa(admin.ID), nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var entries []api_objects.AuditEntry
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "login", entries[0].Action)
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/audit", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+}
+
+func TestParseTimeParam(t *testing.T) {
+	ts, wholeDay, err := parseTimeParam("2025-03-01T12:30:00Z")
+	assert.NoError(t, err)
+	assert.False(t, wholeDay)
+	assert.Equal(t, time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC), ts)
+
+	ts, wholeDay, err = parseTimeParam("2025-03-01")
+	assert.NoError(t, err)
+	assert.True(t, wholeDay)
+	assert.Equal(t, time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), ts)
+
+	_, _, err = parseTimeParam("March 1st")
+	assert.Error(t, err)
+}
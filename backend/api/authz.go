@@ -0,0 +1,514 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"lagertool.com/main/auth"
+	"lagertool.com/main/db_models"
+)
+
+// errNotFound is returned by an orgResolver when the entity named in the path does not exist.
+var errNotFound = errors.New("not found")
+
+// orgResolver works out which organisation a request acts on, either straight from
+// the path or by following the targeted request, loan or item to its owner.
+type orgResolver func(c *gin.Context, con *pg.DB) (string, error)
+
+// currentUser returns the user stored in the context by auth.AuthMiddleware.
+func currentUser(c *gin.Context) (*db_models.User, bool) {
+	v, ok := c.Get("user")
+	if !ok {
+		return nil, false
+	}
+	user, ok := v.(*db_models.User)
+	if !ok || user == nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// currentUserID is the ID of the authenticated user, or 0 when there is none.
+func currentUserID(c *gin.Context) int {
+	if user, ok := currentUser(c); ok {
+		return user.ID
+	}
+	return 0
+}
+
+func abortForbidden(c *gin.Context, organisation string) {
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"error":        "forbidden",
+		"details":      "missing special rights for organisation",
+		"organisation": organisation,
+	})
+}
+
+func (h *Handler) hasSpecialRights(userID int, organisation string) (bool, error) {
+	return h.DB.Model((*db_models.HasSpecialRightsFor)(nil)).
+		Where("user_id = ?", userID).
+		Where("organisation_name = ?", organisation).
+		Exists()
+}
+
+// RequireOrgAdmin only lets the request through if the session user holds a
+// has_special_rights_for row for the organisation returned by resolve. Requests
+// made with an API token additionally need its org-admin scope.
+// Like AuthMiddleware it is a no-op when auth is disabled.
+func (h *Handler) RequireOrgAdmin(usingAuth bool, resolve orgResolver) gin.HandlerFunc {
+	if !usingAuth {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+			return
+		}
+		org, err := resolve(c, h.DB)
+		if errors.Is(err, errNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "resource not found"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !auth.TokenAllowsOrgAdmin(c, org) {
+			abortForbidden(c, org)
+			return
+		}
+		allowed, err := h.hasSpecialRights(user.ID, org)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !allowed {
+			abortForbidden(c, org)
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireRequestParticipant lets the owner of a borrow request through, as well as
+// admins of the organisation the request was made to.
+func (h *Handler) RequireRequestParticipant(usingAuth bool, param string) gin.HandlerFunc {
+	if !usingAuth {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+			return
+		}
+		id, err := strconv.Atoi(c.Param(param))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid request id"})
+			return
+		}
+		var request db_models.Request
+		err = h.DB.Model(&request).Column("id", "user_id", "organisation_name").Where("id = ?", id).Select()
+		if errors.Is(err, pg.ErrNoRows) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "resource not found"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if request.UserID == user.ID {
+			c.Next()
+			return
+		}
+		if !auth.TokenAllowsOrgAdmin(c, request.OrganisationName) {
+			abortForbidden(c, request.OrganisationName)
+			return
+		}
+		allowed, err := h.hasSpecialRights(user.ID, request.OrganisationName)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !allowed {
+			abortForbidden(c, request.OrganisationName)
+			return
+		}
+		c.Next()
+	}
+}
+
+// orgFromParam takes the organisation from a path parameter such as :orgId.
+func orgFromParam(param string) orgResolver {
+	return func(c *gin.Context, _ *pg.DB) (string, error) {
+		return c.Param(param), nil
+	}
+}
+
+// orgOfRequest resolves the organisation a borrow request was made to.
+func orgOfRequest(param string) orgResolver {
+	return func(c *gin.Context, con *pg.DB) (string, error) {
+		id, err := strconv.Atoi(c.Param(param))
+		if err != nil {
+			return "", errors.New("invalid request id")
+		}
+		var org string
+		err = con.Model((*db_models.Request)(nil)).
+			Column("organisation_name").
+			Where("id = ?", id).
+			Select(pg.Scan(&org))
+		if errors.Is(err, pg.ErrNoRows) {
+			return "", errNotFound
+		}
+		return org, err
+	}
+}
+
+// requestOrganisation returns the organisation of a borrow request for the audit
+// log, or "" if it cannot be found.
+func (h *Handler) requestOrganisation(requestID int) string {
+	var org string
+	_ = h.DB.Model((*db_models.Request)(nil)).
+		Column("organisation_name").
+		Where("id = ?", requestID).
+		Select(pg.Scan(&org))
+	return org
+}
+
+// orgOfLoan resolves the organisation of the request a loan belongs to.
+func orgOfLoan(param string) orgResolver {
+	return func(c *gin.Context, con *pg.DB) (string, error) {
+		id, err := strconv.Atoi(c.Param(param))
+		if err != nil {
+			return "", errors.New("invalid loan id")
+		}
+		var org string
+		err = con.Model((*db_models.Loans)(nil)).
+			ColumnExpr("request.organisation_name").
+			Join("JOIN request_items ON request_items.id = loans.request_item_id").
+			Join("JOIN request ON request.id = request_items.request_id").
+			Where("loans.id = ?", id).
+			Select(pg.Scan(&org))
+		if errors.Is(err, pg.ErrNoRows) {
+			return "", errNotFound
+		}
+		return org, err
+	}
+}
+
+// orgOfItem resolves the organisation owning the shelf an inventory item sits on.
+func orgOfItem(param string) orgResolver {
+	return func(c *gin.Context, con *pg.DB) (string, error) {
+		id, err := strconv.Atoi(c.Param(param))
+		if err != nil {
+			return "", errors.New("invalid item id")
+		}
+		var org string
+		err = con.Model((*db_models.Inventory)(nil)).
+			ColumnExpr("shelf.owned_by").
+			Join("JOIN shelf ON shelf.id = inventory.shelf_id").
+			Where("inventory.id = ?", id).
+			Select(pg.Scan(&org))
+		if errors.Is(err, pg.ErrNoRows) {
+			return "", errNotFound
+		}
+		return org, err
+	}
+}
+
+// itemOrganisation returns the organisation owning an inventory item for the audit
+// log, or "" if it cannot be found. The :orgId in the path is not checked against
+// the item, so item-scoped entries take the owner from here.
+func (h *Handler) itemOrganisation(itemID int) string {
+	var org string
+	_ = h.DB.Model((*db_models.Inventory)(nil)).
+		ColumnExpr("shelf.owned_by").
+		Join("JOIN shelf ON shelf.id = inventory.shelf_id").
+		Where("inventory.id = ?", itemID).
+		Select(pg.Scan(&org))
+	return org
+}
+
+// orgOfShelfInBody resolves the organisation owning the shelf referenced by the
+// "shelfId" field of a JSON body. The body is cached so the handler can bind it again.
+func orgOfShelfInBody(c *gin.Context, con *pg.DB) (string, error) {
+	var body struct {
+		ShelfID string `json:"shelfId"`
+	}
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		return "", err
+	}
+	var org string
+	err := con.Model((*db_models.Shelf)(nil)).
+		Column("owned_by").
+		Where("id = ?", body.ShelfID).
+		Select(pg.Scan(&org))
+	if errors.Is(err, pg.ErrNoRows) {
+		return "", errNotFound
+	}
+	return org, err
+}
+
+// sessionUser is currentUser for handlers that act on behalf of the caller; it
+// answers 401 itself when nobody is logged in.
+func sessionUser(c *gin.Context) (*db_models.User, bool) {
+	user, ok := currentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+	}
+	return user, ok
+}
+
+// adminOrganisations lists the organisations a user holds special rights for.
+func (h *Handler) adminOrganisations(userID int) ([]string, error) {
+	var orgs []string
+	err := h.DB.Model((*db_models.HasSpecialRightsFor)(nil)).
+		Column("organisation_name").
+		Where("user_id = ?", userID).
+		Select(&orgs)
+	return orgs, err
+}
+
+// RequireAnyOrgAdmin lets the request through if the session user is an admin of
+// at least one organisation. It guards the routes that act on other users' data.
+func (h *Handler) RequireAnyOrgAdmin(usingAuth bool) gin.HandlerFunc {
+	if !usingAuth {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+			return
+		}
+		orgs, err := h.adminOrganisations(user.ID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(orgs) == 0 || !auth.TokenAllowsAnyOrgAdmin(c) {
+			abortForbidden(c, "")
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireCartAccess guards the /users/:userId/cart routes. The owner of the cart
+// is always let through; anyone else has to be an admin of every organisation
+// whose items or kits are in the cart or named by the request.
+func (h *Handler) RequireCartAccess(usingAuth bool) gin.HandlerFunc {
+	if !usingAuth {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+			return
+		}
+		owner, err := strconv.Atoi(c.Param("userId"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+			return
+		}
+		if owner == user.ID {
+			c.Next()
+			return
+		}
+		orgs, err := h.cartOrganisations(c, owner)
+		if errors.Is(err, errNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "resource not found"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(orgs) == 0 {
+			// Nothing to protect yet, but only admins may look at other users' carts.
+			admin, err := h.adminOrganisations(user.ID)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if len(admin) == 0 || !auth.TokenAllowsAnyOrgAdmin(c) {
+				abortForbidden(c, "")
+				return
+			}
+		}
+		for _, org := range orgs {
+			if !auth.TokenAllowsOrgAdmin(c, org) {
+				abortForbidden(c, org)
+				return
+			}
+			allowed, err := h.hasSpecialRights(user.ID, org)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !allowed {
+				abortForbidden(c, org)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// cartOrganisations collects the organisations a cart request touches: the owners
+// of everything already in the cart plus the item or kit named in the path or,
+// for POST, in the body. The body is cached so the handler can bind it again.
+func (h *Handler) cartOrganisations(c *gin.Context, owner int) ([]string, error) {
+	inCart := func() *orm.Query {
+		return h.DB.Model((*db_models.ShoppingCartItem)(nil)).
+			Join("JOIN shopping_cart ON shopping_cart.id = shopping_cart_item.shopping_cart_id").
+			Where("shopping_cart.user_id = ?", owner)
+	}
+	var orgs, kitOrgs []string
+	err := inCart().
+		ColumnExpr("DISTINCT shelf.owned_by").
+		Join(`JOIN "Inventory" AS inventory ON inventory.id = shopping_cart_item.inventory_id`).
+		Join("JOIN shelf ON shelf.id = inventory.shelf_id").
+		Select(&orgs)
+	if err != nil {
+		return nil, err
+	}
+	err = inCart().
+		ColumnExpr("DISTINCT kit.organisation_name").
+		Join("JOIN kit ON kit.id = shopping_cart_item.kit_id").
+		Select(&kitOrgs)
+	if err != nil {
+		return nil, err
+	}
+	orgs = append(orgs, kitOrgs...)
+
+	itemID, kitID := c.Param("itemId"), c.Param("kitId")
+	if c.Request.Method == http.MethodPost && strings.HasSuffix(c.FullPath(), "/cart/items") {
+		var body struct {
+			ID    int `json:"id"`
+			KitID int `json:"kitId"`
+		}
+		if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+			return nil, err
+		}
+		if body.ID != 0 {
+			itemID = strconv.Itoa(body.ID)
+		}
+		if body.KitID != 0 {
+			kitID = strconv.Itoa(body.KitID)
+		}
+	}
+
+	var org string
+	switch {
+	case itemID != "":
+		id, err := strconv.Atoi(itemID)
+		if err != nil {
+			return nil, errors.New("invalid item id")
+		}
+		err = h.DB.Model((*db_models.Inventory)(nil)).
+			ColumnExpr("shelf.owned_by").
+			Join("JOIN shelf ON shelf.id = inventory.shelf_id").
+			Where("inventory.id = ?", id).
+			Select(pg.Scan(&org))
+		if errors.Is(err, pg.ErrNoRows) {
+			return nil, errNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	case kitID != "":
+		id, err := strconv.Atoi(kitID)
+		if err != nil {
+			return nil, errors.New("invalid kit id")
+		}
+		err = h.DB.Model((*db_models.Kit)(nil)).
+			Column("organisation_name").
+			Where("id = ?", id).
+			Select(pg.Scan(&org))
+		if errors.Is(err, pg.ErrNoRows) {
+			return nil, errNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return orgs, nil
+	}
+	return append(orgs, org), nil
+}
+
+// isSuperAdmin reports whether the user is listed in the SUPER_ADMINS setting.
+func (h *Handler) isSuperAdmin(user *db_models.User) bool {
+	if h.Cfg == nil {
+		return false
+	}
+	for _, email := range h.Cfg.Auth.SuperAdmins {
+		if strings.EqualFold(email, user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireSuperAdmin only lets configured super-admins through; API tokens also
+// need the super-admin scope.
+func (h *Handler) RequireSuperAdmin(usingAuth bool) gin.HandlerFunc {
+	if !usingAuth {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+			return
+		}
+		if !h.isSuperAdmin(user) || !auth.TokenAllowsSuperAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "details": "super-admin only"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireOrgCreator guards creating organisations, as the creator becomes their
+// admin. Super-admins and admins of an existing organisation may create them.
+func (h *Handler) RequireOrgCreator(usingAuth bool) gin.HandlerFunc {
+	anyOrgAdmin := h.RequireAnyOrgAdmin(usingAuth)
+	if !usingAuth {
+		return anyOrgAdmin
+	}
+	return func(c *gin.Context) {
+		if user, ok := currentUser(c); ok && h.isSuperAdmin(user) && auth.TokenAllowsSuperAdmin(c) {
+			c.Next()
+			return
+		}
+		anyOrgAdmin(c)
+	}
+}
+
+// actingUserID returns the :userId path parameter on the admin routes and the
+// session user on the /me routes. It writes the error response itself.
+func actingUserID(c *gin.Context) (int, bool) {
+	if param := c.Param("userId"); param != "" {
+		id, err := strconv.Atoi(param)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+			return 0, false
+		}
+		return id, true
+	}
+	user, ok := sessionUser(c)
+	if !ok {
+		return 0, false
+	}
+	return user.ID, true
+}
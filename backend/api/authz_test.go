@@ -0,0 +1,297 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/auth"
+	"lagertool.com/main/config"
+	"lagertool.com/main/db_models"
+)
+
+// testSessions maps the cookie values handed out by newTestSession to their sessions.
+var testSessions = map[string]*db_models.Session{}
+
+// newTestSession inserts a session for user and returns the matching session cookie.
+func newTestSession(t *testing.T, dbCon *pg.DB, user *db_models.User) *http.Cookie {
+	token, tokenHash, handle, err := auth.NewSessionToken()
+	assert.NoError(t, err)
+	session := &db_models.Session{
+		TokenHash: tokenHash,
+		Handle:    handle,
+		UserID:    user.ID,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+		UserIP:    net.ParseIP("127.0.0.1"),
+	}
+	_, err = dbCon.Model(session).Insert()
+	assert.NoError(t, err)
+	testSessions[token] = session
+	return &http.Cookie{Name: "user_session", Value: token}
+}
+
+// newTestAuthHandler builds the auth handler from the test configuration.
+func newTestAuthHandler(t *testing.T, dbCon *pg.DB) *auth.AuthHandler {
+	authHandler, err := auth.NewAuthHandler(dbCon, config.Load().Auth)
+	assert.NoError(t, err)
+	return authHandler
+}
+
+// addSession authenticates req with the session cookie and the matching CSRF token.
+func addSession(req *http.Request, authHandler *auth.AuthHandler, cookie *http.Cookie) {
+	req.AddCookie(cookie)
+	if session, ok := testSessions[cookie.Value]; ok {
+		req.Header.Set("X-CSRF-Token", authHandler.CSRFToken(session.ID))
+	}
+}
+
+// withUser stands in for auth.AuthMiddleware in tests that register handlers directly.
+func withUser(user *db_models.User) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+func TestOrgAdminAuthorization(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+	authHandler := newTestAuthHandler(t, dbCon)
+	SetupRoutes(router, dbCon, nil, authHandler, true)
+
+	org := &db_models.Organisation{Name: "Authz Test Org"}
+	otherOrg := &db_models.Organisation{Name: "Authz Other Org"}
+	_, err := dbCon.Model(org, otherOrg).Insert()
+	assert.NoError(t, err)
+
+	admin := &db_models.User{Email: "admin-authz@example.com", Name: "Authz Admin"}
+	borrower := &db_models.User{Email: "borrower-authz@example.com", Name: "Authz Borrower"}
+	outsider := &db_models.User{Email: "outsider-authz@example.com", Name: "Authz Outsider"}
+	_, err = dbCon.Model(admin, borrower, outsider).Insert()
+	assert.NoError(t, err)
+
+	rights := &db_models.HasSpecialRightsFor{OrganisationName: org.Name, UserID: admin.ID}
+	_, err = dbCon.Model(rights).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+
+	otherShelf := &db_models.Shelf{ID: "AUTHZ-S-2", Name: "Other Shelf", RoomID: hier.Room.ID, OwnedBy: otherOrg.Name, UpdateDate: time.Now()}
+	_, err = dbCon.Model(otherShelf).Insert()
+	assert.NoError(t, err)
+
+	request := &db_models.Request{
+		UserID:           borrower.ID,
+		StartDate:        time.Now().Add(24 * time.Hour),
+		EndDate:          time.Now().Add(48 * time.Hour),
+		State:            "requested",
+		OrganisationName: org.Name,
+	}
+	_, err = dbCon.Model(request).Insert()
+	assert.NoError(t, err)
+	reqItem := &db_models.RequestItems{RequestID: request.ID, InventoryID: hier.Inventory.ID, Amount: 1}
+	_, err = dbCon.Model(reqItem).Insert()
+	assert.NoError(t, err)
+	loan := &db_models.Loans{RequestItemID: reqItem.ID}
+	_, err = dbCon.Model(loan).Insert()
+	assert.NoError(t, err)
+
+	adminCookie := newTestSession(t, dbCon, admin)
+	borrowerCookie := newTestSession(t, dbCon, borrower)
+	outsiderCookie := newTestSession(t, dbCon, outsider)
+
+	defer func() {
+		_, _ = dbCon.Model((*db_models.UserRequestMessage)(nil)).Where("request_id = ?", request.ID).Delete()
+		_, _ = dbCon.Model(loan).WherePK().Delete()
+		_, _ = dbCon.Model(reqItem).WherePK().Delete()
+		_, _ = dbCon.Model(request).WherePK().Delete()
+		_, _ = dbCon.Model(otherShelf).WherePK().Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model((*db_models.Session)(nil)).Where("user_id IN (?)", pg.In([]int{admin.ID, borrower.ID, outsider.ID})).Delete()
+		_, _ = dbCon.Model(rights).Where("user_id = ?", admin.ID).Delete()
+		_, _ = dbCon.Model((*db_models.User)(nil)).Where("id IN (?)", pg.In([]int{admin.ID, borrower.ID, outsider.ID})).Delete()
+		_, _ = dbCon.Model((*db_models.Organisation)(nil)).Where("name IN (?)", pg.In([]string{org.Name, otherOrg.Name})).Delete()
+	}()
+
+	orgBase := "/organisations/" + org.Name
+	requestURL := "/requests/" + strconv.Itoa(request.ID)
+
+	// Payloads are deliberately invalid where possible so that allowed calls stop at
+	// validation (400) instead of mutating the fixtures.
+	routes := []struct {
+		name    string
+		method  string
+		url     string
+		payload string
+	}{
+		{"create building", "POST", orgBase + "/buildings", `{}`},
+		{"create room", "POST", orgBase + "/buildings/" + strconv.Itoa(hier.Building.ID) + "/rooms", `{}`},
+		{"create shelf", "POST", orgBase + "/buildings/" + strconv.Itoa(hier.Building.ID) + "/rooms/" + strconv.Itoa(hier.Room.ID) + "/shelves", `{}`},
+		{"create item", "POST", orgBase + "/items", `{"shelfId": "` + hier.Shelf.ID + `"}`},
+		{"update item", "PUT", orgBase + "/items/" + strconv.Itoa(hier.Inventory.ID), `{"amount": `},
+		{"update loan", "PUT", "/loans/" + strconv.Itoa(loan.ID), `{"returnedAt": `},
+		{"update request", "PUT", requestURL, `{"outcome": `},
+		{"bulk update loans", "PUT", requestURL + "/loans", `{"returnedAt": `},
+		{"review request", "POST", requestURL + "/review", `{"outcome": `},
+		{"post message", "POST", requestURL + "/messages", `{"message": `},
+		{"audit log", "GET", orgBase + "/audit", ``},
+	}
+
+	send := func(method, url, payload string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		addSession(req, authHandler, cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, rt := range routes {
+		t.Run(rt.name+" allowed for org admin", func(t *testing.T) {
+			w := send(rt.method, rt.url, rt.payload, adminCookie)
+			assert.NotEqual(t, http.StatusForbidden, w.Code, w.Body.String())
+			assert.NotEqual(t, http.StatusUnauthorized, w.Code, w.Body.String())
+		})
+		t.Run(rt.name+" denied for outsider", func(t *testing.T) {
+			w := send(rt.method, rt.url, rt.payload, outsiderCookie)
+			assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+
+			var body map[string]string
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, "forbidden", body["error"])
+			assert.Equal(t, org.Name, body["organisation"])
+		})
+	}
+
+	t.Run("post message allowed for request owner", func(t *testing.T) {
+		w := send("POST", requestURL+"/messages", `{"message": `, borrowerCookie)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	})
+
+	t.Run("create item denied on a shelf of another organisation", func(t *testing.T) {
+		w := send("POST", orgBase+"/items", `{"shelfId": "`+otherShelf.ID+`"}`, adminCookie)
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	})
+
+	t.Run("request owner is not an org admin", func(t *testing.T) {
+		w := send("POST", requestURL+"/review", `{"outcome": `, borrowerCookie)
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	})
+}
+
+func TestCartAccessAuthorization(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+	authHandler := newTestAuthHandler(t, dbCon)
+	SetupRoutes(router, dbCon, nil, authHandler, true)
+
+	org := &db_models.Organisation{Name: "Cart Authz Org"}
+	otherOrg := &db_models.Organisation{Name: "Cart Authz Other Org"}
+	_, err := dbCon.Model(org, otherOrg).Insert()
+	assert.NoError(t, err)
+
+	owner := &db_models.User{Email: "owner-cart-authz@example.com", Name: "Cart Owner"}
+	admin := &db_models.User{Email: "admin-cart-authz@example.com", Name: "Cart Admin"}
+	otherAdmin := &db_models.User{Email: "other-cart-authz@example.com", Name: "Other Cart Admin"}
+	_, err = dbCon.Model(owner, admin, otherAdmin).Insert()
+	assert.NoError(t, err)
+
+	rights := []db_models.HasSpecialRightsFor{
+		{OrganisationName: org.Name, UserID: admin.ID},
+		{OrganisationName: otherOrg.Name, UserID: otherAdmin.ID},
+	}
+	_, err = dbCon.Model(&rights).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+
+	cart := &db_models.ShoppingCart{UserID: owner.ID}
+	_, err = dbCon.Model(cart).Insert()
+	assert.NoError(t, err)
+	cartItem := &db_models.ShoppingCartItem{ShoppingCartID: cart.ID, InventoryID: hier.Inventory.ID, Amount: 1}
+	_, err = dbCon.Model(cartItem).Insert()
+	assert.NoError(t, err)
+
+	ownerCookie := newTestSession(t, dbCon, owner)
+	adminCookie := newTestSession(t, dbCon, admin)
+	otherAdminCookie := newTestSession(t, dbCon, otherAdmin)
+	userIDs := []int{owner.ID, admin.ID, otherAdmin.ID}
+
+	defer func() {
+		_, _ = dbCon.Model((*db_models.ShoppingCartItem)(nil)).Where("shopping_cart_id = ?", cart.ID).Delete()
+		_, _ = dbCon.Model(cart).WherePK().Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model((*db_models.Session)(nil)).Where("user_id IN (?)", pg.In(userIDs)).Delete()
+		_, _ = dbCon.Model((*db_models.HasSpecialRightsFor)(nil)).Where("user_id IN (?)", pg.In(userIDs)).Delete()
+		_, _ = dbCon.Model((*db_models.User)(nil)).Where("id IN (?)", pg.In(userIDs)).Delete()
+		_, _ = dbCon.Model((*db_models.Organisation)(nil)).Where("name IN (?)", pg.In([]string{org.Name, otherOrg.Name})).Delete()
+	}()
+
+	cartURL := "/users/" + strconv.Itoa(owner.ID) + "/cart"
+	itemURL := cartURL + "/items/" + strconv.Itoa(hier.Inventory.ID)
+
+	testCases := []struct {
+		name         string
+		method       string
+		url          string
+		payload      string
+		cookie       *http.Cookie
+		expectedCode int
+	}{
+		{"owner reads own cart", "GET", cartURL, ``, ownerCookie, http.StatusOK},
+		{"admin of the item's organisation reads cart", "GET", cartURL, ``, adminCookie, http.StatusOK},
+		{"admin of another organisation cannot read cart", "GET", cartURL, ``, otherAdminCookie, http.StatusForbidden},
+		{"admin of another organisation cannot update item", "PUT", itemURL, `{"amount": `, otherAdminCookie, http.StatusForbidden},
+		{"admin of another organisation cannot add item", "POST", cartURL + "/items", `{"id": ` + strconv.Itoa(hier.Inventory.ID) + `}`, otherAdminCookie, http.StatusForbidden},
+		{"admin of the item's organisation reaches validation", "POST", cartURL + "/items", `{"id": ` + strconv.Itoa(hier.Inventory.ID) + `}`, adminCookie, http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.payload))
+			req.Header.Set("Content-Type", "application/json")
+			addSession(req, authHandler, tc.cookie)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestProtectedRoutesRateLimitedBeforeAuth(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+	authHandler := newTestAuthHandler(t, dbCon)
+	cfg := &config.Config{RateLimit: config.RateLimitConfig{APIByIP: "2/1m"}}
+	SetupRoutes(router, dbCon, cfg, authHandler, true)
+
+	get := func(cookie string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.RemoteAddr = "198.51.100.7:1234"
+		req.AddCookie(&http.Cookie{Name: "user_session", Value: cookie})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("guess-1").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("guess-2").Code)
+	w := get("guess-3")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "guessing is throttled before the session is looked up")
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
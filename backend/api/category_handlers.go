@@ -0,0 +1,270 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+// categorySubtree selects the ids of a category and all of its descendants.
+const categorySubtree = `WITH RECURSIVE sub AS (
+	SELECT id FROM category WHERE id = ?
+	UNION ALL
+	SELECT category.id FROM category JOIN sub ON category.parent_id = sub.id
+) SELECT id FROM sub`
+
+// normalizeTags lowercases and trims tags, dropping empty ones and duplicates,
+// so that filtering by tag does not depend on how it was typed.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	var res []string
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		res = append(res, t)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// categoryBelongsTo reports whether categoryID is 0 (no category) or a category
+// of organisation.
+func (h *Handler) categoryBelongsTo(categoryID int, organisation string) (bool, error) {
+	if categoryID == 0 {
+		return true, nil
+	}
+	return h.DB.Model((*db_models.Category)(nil)).
+		Where("id = ?", categoryID).
+		Where("organisation_name = ?", organisation).
+		Exists()
+}
+
+func (h *Handler) orgCategory(c *gin.Context) (db_models.Category, bool) {
+	var category db_models.Category
+	id, err := strconv.Atoi(c.Param("categoryId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid category id"})
+		return category, false
+	}
+	err = h.DB.Model(&category).
+		Where("id = ?", id).
+		Where("organisation_name = ?", c.Param("orgId")).
+		Select()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "category not found"})
+		return category, false
+	}
+	return category, true
+}
+
+// @Summary Get the category tree of an organisation
+// @Description Get all categories of an organisation as a tree, sorted by name
+// @Tags categories
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Success 200 {array} api_objects.Category
+// @Router /organisations/{orgId}/categories [get]
+func (h *Handler) GetCategories(c *gin.Context) {
+	var categories []db_models.Category
+	err := h.DB.Model(&categories).
+		Where("organisation_name = ?", c.Param("orgId")).
+		Order("name").
+		Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, categoryTree(categories))
+}
+
+// categoryTree nests categories under their parents, keeping the given order
+// among siblings.
+func categoryTree(categories []db_models.Category) []api_objects.Category {
+	children := make(map[int][]db_models.Category)
+	for _, cat := range categories {
+		children[cat.ParentID] = append(children[cat.ParentID], cat)
+	}
+	var build func(parentID int) []api_objects.Category
+	build = func(parentID int) []api_objects.Category {
+		res := []api_objects.Category{}
+		for _, cat := range children[parentID] {
+			node := toCategory(cat)
+			node.Children = build(cat.ID)
+			res = append(res, node)
+		}
+		return res
+	}
+	return build(0)
+}
+
+// @Summary Create a category
+// @Description Create a category, optionally below a parent category of the same organisation
+// @Tags categories
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param category body api_objects.CategoryRequest true "Category"
+// @Success 201 {object} api_objects.Category
+// @Router /organisations/{orgId}/categories [post]
+func (h *Handler) CreateCategory(c *gin.Context) {
+	orgId := c.Param("orgId")
+	var req api_objects.CategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ok, err := h.categoryBelongsTo(req.ParentID, orgId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "parent category not found"})
+		return
+	}
+	category, err := db.CreateCategory(h.DB, strings.TrimSpace(req.Name), orgId, req.ParentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "category", EntityID: category.ID,
+		Organisation: orgId, After: category,
+	})
+	c.JSON(http.StatusCreated, toCategory(*category))
+}
+
+// @Summary Update a category
+// @Description Rename a category or move it below another parent. A category cannot be moved below itself or one of its descendants.
+// @Tags categories
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param categoryId path int true "Category ID"
+// @Param category body api_objects.UpdateCategoryRequest true "Update details"
+// @Success 200 {object} api_objects.Category
+// @Router /organisations/{orgId}/categories/{categoryId} [put]
+func (h *Handler) UpdateCategory(c *gin.Context) {
+	category, ok := h.orgCategory(c)
+	if !ok {
+		return
+	}
+	var req api_objects.UpdateCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before := category
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name cannot be empty"})
+			return
+		}
+		category.Name = name
+	}
+	if req.ParentID != nil && *req.ParentID != category.ParentID {
+		ok, err := h.categoryBelongsTo(*req.ParentID, category.OrganisationName)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "parent category not found"})
+			return
+		}
+		var cycle bool
+		if *req.ParentID != 0 {
+			cycle, err = h.DB.Model((*db_models.Category)(nil)).
+				Where("id = ?", *req.ParentID).
+				Where("id IN ("+categorySubtree+")", category.ID).
+				Exists()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if cycle {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a category cannot be moved below itself or its descendants"})
+			return
+		}
+		category.ParentID = *req.ParentID
+	}
+
+	if _, err := h.DB.Model(&category).WherePK().Update(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "category", EntityID: category.ID,
+		Organisation: category.OrganisationName, Before: before, After: category,
+	})
+	c.JSON(http.StatusOK, toCategory(category))
+}
+
+// @Summary Delete a category
+// @Description Delete a category. Categories that still have subcategories or items cannot be deleted.
+// @Tags categories
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param categoryId path int true "Category ID"
+// @Success 204
+// @Router /organisations/{orgId}/categories/{categoryId} [delete]
+func (h *Handler) DeleteCategory(c *gin.Context) {
+	category, ok := h.orgCategory(c)
+	if !ok {
+		return
+	}
+	hasChildren, err := h.DB.Model((*db_models.Category)(nil)).Where("parent_id = ?", category.ID).Exists()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if hasChildren {
+		c.JSON(http.StatusConflict, gin.H{"error": "category has subcategories"})
+		return
+	}
+	hasItems, err := h.DB.Model((*db_models.Inventory)(nil)).Where("category_id = ?", category.ID).Exists()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if hasItems {
+		c.JSON(http.StatusConflict, gin.H{"error": "category still has items"})
+		return
+	}
+	if _, err := h.DB.Model(&category).WherePK().Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "category", EntityID: category.ID,
+		Organisation: category.OrganisationName, Before: category,
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// parseCategoryFilter reads the optional category query parameter of the inventory listing.
+func parseCategoryFilter(c *gin.Context) (int, error) {
+	v := c.Query("category")
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil || id <= 0 {
+		return 0, errors.New("invalid category")
+	}
+	return id, nil
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db_models"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	testCases := []struct {
+		name string
+		tags []string
+		want []string
+	}{
+		{name: "nil", tags: nil, want: nil},
+		{name: "trim and lowercase", tags: []string{" Cable ", "HDMI"}, want: []string{"cable", "hdmi"}},
+		{name: "duplicates and empty", tags: []string{"hdmi", "", "HDMI", "  "}, want: []string{"hdmi"}},
+		{name: "sorted", tags: []string{"xlr", "audio"}, want: []string{"audio", "xlr"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, normalizeTags(tc.tags))
+		})
+	}
+}
+
+func TestCategoriesAndTags(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Category Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+
+	defer func() {
+		_, _ = dbCon.Model((*db_models.Inventory)(nil)).Set("category_id = NULL").Where("id = ?", hier.Inventory.ID).Update()
+		_, _ = dbCon.Model((*db_models.Category)(nil)).Where("organisation_name = ?", org.Name).Where("parent_id IS NOT NULL").Delete()
+		_, _ = dbCon.Model((*db_models.Category)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.GET("/organisations/:orgId/categories", h.GetCategories)
+	router.POST("/organisations/:orgId/categories", h.CreateCategory)
+	router.PUT("/organisations/:orgId/categories/:categoryId", h.UpdateCategory)
+	router.DELETE("/organisations/:orgId/categories/:categoryId", h.DeleteCategory)
+	router.PUT("/organisations/:orgId/items/:id", h.UpdateItem)
+	router.GET("/organisations/:orgId/inventory", h.GetInventory)
+
+	base := "/organisations/" + org.Name + "/categories"
+	send := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	create := func(payload string) api_objects.Category {
+		w := send("POST", base, payload)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var cat api_objects.Category
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &cat))
+		return cat
+	}
+
+	electronics := create(`{"name": "Electronics"}`)
+	measurement := create(`{"name": "Measurement", "parentId": ` + strconv.Itoa(electronics.ID) + `}`)
+	furniture := create(`{"name": "Furniture"}`)
+	assert.Equal(t, http.StatusBadRequest, send("POST", base, `{"name": "Orphan", "parentId": 999999}`).Code)
+
+	t.Run("Tree", func(t *testing.T) {
+		w := send("GET", base, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var tree []api_objects.Category
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tree))
+		if assert.Len(t, tree, 2) {
+			assert.Equal(t, "Electronics", tree[0].Name)
+			assert.Equal(t, []api_objects.Category{{ID: measurement.ID, Name: "Measurement", ParentID: electronics.ID}}, tree[0].Children)
+			assert.Equal(t, "Furniture", tree[1].Name)
+		}
+	})
+
+	t.Run("Move", func(t *testing.T) {
+		testCases := []struct {
+			name           string
+			id             int
+			payload        string
+			expectedStatus int
+		}{
+			{name: "Below itself", id: electronics.ID, payload: `{"parentId": ` + strconv.Itoa(electronics.ID) + `}`, expectedStatus: http.StatusBadRequest},
+			{name: "Below descendant", id: electronics.ID, payload: `{"parentId": ` + strconv.Itoa(measurement.ID) + `}`, expectedStatus: http.StatusBadRequest},
+			{name: "Rename", id: furniture.ID, payload: `{"name": "Furniture & Fittings"}`, expectedStatus: http.StatusOK},
+			{name: "Unknown category", id: 999999, payload: `{"name": "Nope"}`, expectedStatus: http.StatusNotFound},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w := send("PUT", base+"/"+strconv.Itoa(tc.id), tc.payload)
+				assert.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			})
+		}
+	})
+
+	itemURL := "/organisations/" + org.Name + "/items/" + strconv.Itoa(hier.Inventory.ID)
+	w := send("PUT", itemURL, `{"categoryId": `+strconv.Itoa(measurement.ID)+`, "tags": ["Scope", "lab ", "scope"]}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var inv db_models.Inventory
+	assert.NoError(t, dbCon.Model(&inv).Where("id = ?", hier.Inventory.ID).Select())
+	assert.Equal(t, measurement.ID, inv.CategoryID)
+	assert.Equal(t, []string{"lab", "scope"}, inv.Tags)
+
+	t.Run("Filter inventory", func(t *testing.T) {
+		testCases := []struct {
+			name   string
+			query  string
+			wantID []int
+		}{
+			{name: "No filter", query: "", wantID: []int{hier.Inventory.ID}},
+			{name: "Category", query: "&category=" + strconv.Itoa(measurement.ID), wantID: []int{hier.Inventory.ID}},
+			{name: "Parent category", query: "&category=" + strconv.Itoa(electronics.ID), wantID: []int{hier.Inventory.ID}},
+			{name: "Other category", query: "&category=" + strconv.Itoa(furniture.ID), wantID: nil},
+			{name: "Tag", query: "&tag=Scope", wantID: []int{hier.Inventory.ID}},
+			{name: "All tags", query: "&tag=scope&tag=lab", wantID: []int{hier.Inventory.ID}},
+			{name: "Missing tag", query: "&tag=scope&tag=audio", wantID: nil},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w := send("GET", "/organisations/"+org.Name+"/inventory?start=2030-01-01&end=2030-01-02"+tc.query, "")
+				assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+				var items []api_objects.InventorySorted
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+				var ids []int
+				for _, item := range items {
+					ids = append(ids, item.ID)
+					assert.Equal(t, "Measurement", item.Category.Name)
+					assert.Equal(t, []string{"lab", "scope"}, item.Tags)
+				}
+				assert.Equal(t, tc.wantID, ids)
+			})
+		}
+		assert.Equal(t, http.StatusBadRequest, send("GET", "/organisations/"+org.Name+"/inventory?start=2030-01-01&end=2030-01-02&category=x", "").Code)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, send("DELETE", base+"/"+strconv.Itoa(electronics.ID), "").Code, "has subcategories")
+		assert.Equal(t, http.StatusConflict, send("DELETE", base+"/"+strconv.Itoa(measurement.ID), "").Code, "has items")
+		assert.Equal(t, http.StatusNoContent, send("DELETE", base+"/"+strconv.Itoa(furniture.ID), "").Code)
+	})
+}
@@ -1,26 +1,51 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/auth"
 	"lagertool.com/main/config"
 	"lagertool.com/main/db_models"
+	"lagertool.com/main/storage"
 	"lagertool.com/main/util"
 )
 
+var errItemCommitted = errors.New("item is reserved or on loan")
+
 type Handler struct {
-	DB  *pg.DB
-	Cfg *config.Config
+	DB    *pg.DB
+	Cfg   *config.Config
+	Files storage.Store
+
+	maxUpload int64 // bytes
 }
 
+// NewHandler keeps attachments as configured in cfg.Storage. Without a config
+// (in tests) they go to a directory below os.TempDir.
 func NewHandler(db *pg.DB, cfg *config.Config) *Handler {
-	return &Handler{DB: db, Cfg: cfg}
+	h := &Handler{DB: db, Cfg: cfg}
+	if cfg != nil {
+		h.Files = storage.NewLocal(cfg.Storage.Dir)
+		h.maxUpload = int64(cfg.Storage.MaxUploadMB) << 20
+	} else {
+		h.Files = storage.NewLocal(filepath.Join(os.TempDir(), "lagertool-uploads"))
+		h.maxUpload = 10 << 20
+	}
+	return h
 }
 
 // @Summary Get all organisations
@@ -112,10 +137,46 @@ func (h *Handler) GetItem(c *gin.Context) {
 		return
 	}
 
+	var assets []db_models.Asset
+	err = h.DB.Model(&assets).Where("inventory_id = ?", id).Order("id").Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	onLoan, err := h.assetsOnLoan(assets)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	attachments, err := h.itemAttachments(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var defs []db_models.AttributeDefinition
+	if invItem.Category != nil {
+		defs, err = h.attributeDefinitions(invItem.Category.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	res := api_objects.InventoryItemWithShelf{
 		InventoryItem: invItem,
 		Shelf:         shelfObj,
 	}
+	for _, a := range assets {
+		res.Assets = append(res.Assets, toAsset(a, onLoan[a.ID]))
+	}
+	for _, d := range defs {
+		res.AttributeDefinitions = append(res.AttributeDefinitions, toAttributeDefinition(d))
+	}
+	for _, a := range attachments {
+		res.Attachments = append(res.Attachments, toAttachment(a, shelf.OwnedBy))
+	}
 	c.JSON(http.StatusOK, res)
 }
 
@@ -129,9 +190,8 @@ func (h *Handler) GetItem(c *gin.Context) {
 // @Success 200 {object} map[string][]api_objects.CartItem
 // @Router /users/{userId}/cart [get]
 func (h *Handler) GetShoppingCart(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("userId"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+	id, ok := actingUserID(c)
+	if !ok {
 		return
 	}
 	start, err := time.Parse("2006-01-02", c.Query("start"))
@@ -165,7 +225,6 @@ func (h *Handler) GetMessages(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request id"})
 		return
 	}
-	var res []api_objects.Message
 	var dbResAdmin []db_models.RequestReview
 	var dbResMember []db_models.UserRequestMessage
 
@@ -178,12 +237,19 @@ func (h *Handler) GetMessages(c *gin.Context) {
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 	}
-	for _, admin := range dbResAdmin {
-		res = append(res, api_objects.Message{ID: admin.ID, AuthorName: admin.User.Name, Message: admin.Note, IsAdmin: true, TimeStamp: admin.TimeStamp})
+	c.JSON(http.StatusOK, toMessages(dbResAdmin, dbResMember))
+}
+
+// toMessages merges admin reviews and member messages into one list sorted by timestamp.
+func toMessages(admins []db_models.RequestReview, members []db_models.UserRequestMessage) []api_objects.Message {
+	var res []api_objects.Message
+	for _, admin := range admins {
+		res = append(res, api_objects.Message{ID: admin.ID, RequestID: admin.RequestID, AuthorName: admin.User.Name, Message: admin.Note, IsAdmin: true, TimeStamp: admin.TimeStamp})
 	}
-	for _, member := range dbResMember {
+	for _, member := range members {
 		res = append(res, api_objects.Message{
 			ID:         member.ID,
+			RequestID:  member.RequestID,
 			AuthorName: member.User.Name,
 			Message:    member.Message,
 			IsAdmin:    false,
@@ -193,11 +259,11 @@ func (h *Handler) GetMessages(c *gin.Context) {
 	sort.Slice(res, func(i, j int) bool {
 		return res[i].TimeStamp.Before(res[j].TimeStamp)
 	})
-	c.JSON(http.StatusOK, res)
+	return res
 }
 
 // @Summary List borrow requests
-// @Description List borrow requests. Without query params returns all (admin view); with ?userId=N returns only that user's.
+// @Description List borrow requests of the organisations the caller administers; with ?userId=N returns only that user's.
 // @Tags requests
 // @Produce  json
 // @Param userId query int false "Filter to requests owned by this user"
@@ -205,14 +271,7 @@ func (h *Handler) GetMessages(c *gin.Context) {
 // @Router /borrow_requests [get]
 func (h *Handler) GetBorrowRequests(c *gin.Context) {
 	var requests []db_models.Request
-	// NB: keep this relation chain shallow. go-pg builds composite column aliases like
-	// `request_items__inventory__shelf_unit__column__shelf__room__building__update_date`
-	// and silently truncates them at ~63 chars, which then fails to round-trip. We
-	// resolve the inventory + shelf hierarchy per item below via GetInventoryItemHelper.
-	q := h.DB.Model(&requests).
-		Relation("User").
-		Relation("RequestItems").
-		Order("created_at DESC")
+	q := h.borrowRequestQuery(&requests)
 
 	if userIdStr := c.Query("userId"); userIdStr != "" {
 		userId, err := strconv.Atoi(userIdStr)
@@ -223,13 +282,60 @@ func (h *Handler) GetBorrowRequests(c *gin.Context) {
 		q = q.Where("request.user_id = ?", userId)
 	}
 
+	// Without a session user auth is disabled, so the admin view stays unscoped.
+	if user, ok := currentUser(c); ok {
+		orgs, err := h.adminOrganisations(user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		orgs = slices.DeleteFunc(orgs, func(org string) bool { return !auth.TokenAllowsOrgAdmin(c, org) })
+		if len(orgs) == 0 {
+			c.JSON(http.StatusOK, []api_objects.BorrowRequest{})
+			return
+		}
+		q = q.Where("request.organisation_name IN (?)", pg.In(orgs))
+	}
+
+	h.respondBorrowRequests(c, q, &requests)
+}
+
+// @Summary List my borrow requests
+// @Description List the borrow requests of the logged-in user
+// @Tags me
+// @Produce  json
+// @Success 200 {array} api_objects.BorrowRequest
+// @Router /me/requests [get]
+func (h *Handler) GetMyBorrowRequests(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	var requests []db_models.Request
+	q := h.borrowRequestQuery(&requests).Where("request.user_id = ?", user.ID)
+	h.respondBorrowRequests(c, q, &requests)
+}
+
+func (h *Handler) borrowRequestQuery(requests *[]db_models.Request) *orm.Query {
+	// NB: keep this relation chain shallow. go-pg builds composite column aliases like
+	// `request_items__inventory__shelf_unit__column__shelf__room__building__update_date`
+	// and silently truncates them at ~63 chars, which then fails to round-trip. We
+	// resolve the inventory + shelf hierarchy per item below via GetInventoryItemHelper.
+	return h.DB.Model(requests).
+		Relation("User").
+		Relation("RequestItems").
+		Order("created_at DESC")
+}
+
+// respondBorrowRequests runs q, which must select into requests, and renders the result.
+func (h *Handler) respondBorrowRequests(c *gin.Context, q *orm.Query, requests *[]db_models.Request) {
 	if err := q.Select(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	res := make([]api_objects.BorrowRequest, 0, len(requests))
-	for _, r := range requests {
+	res := make([]api_objects.BorrowRequest, 0, len(*requests))
+	for _, r := range *requests {
 		br, err := h.buildBorrowRequest(r)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -414,6 +520,12 @@ func (h *Handler) GetBorrowHistory(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+// Limits of the unauthenticated search, which matches every item name in Go.
+const (
+	maxSearchTermLength = 100
+	maxSearchResults    = 50
+)
+
 // @Summary Fuzzy search for inventory items
 // @Description Search for inventory items by name using fuzzy matching
 // @Tags search
@@ -425,6 +537,10 @@ func (h *Handler) GetBorrowHistory(c *gin.Context) {
 // @Router /search/{searchTerm} [get]
 func (h *Handler) FuzzyFindItems(c *gin.Context) {
 	searchTerm := c.Param("searchTerm")
+	if len(searchTerm) > maxSearchTermLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "search term too long"})
+		return
+	}
 
 	start, err := time.Parse("2006-01-02", c.Query("start"))
 	if err != nil {
@@ -435,20 +551,46 @@ func (h *Handler) FuzzyFindItems(c *gin.Context) {
 		end = start
 	}
 
-	var dbAll []db_models.Inventory
-	err = h.DB.Model(&dbAll).
-		Column("inventory.*").
-		Relation("ShelfUnit.Column.Shelf.Room.Building").
-		Select()
+	// Match on the names alone and only load the location of the hits.
+	var names []db_models.Inventory
+	err = h.DB.Model(&names).Column("id", "name").Where("archived_at IS NULL").Select()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	matches := util.FindItemSearchTermsInDB(names, searchTerm)
+	if len(matches) > maxSearchResults {
+		matches = matches[:maxSearchResults]
+	}
 
-	matches := util.FindItemSearchTermsInDB(dbAll, searchTerm)
+	ids := make([]int, len(matches))
+	for i, m := range matches {
+		ids[i] = m.ID
+	}
+	var found []db_models.Inventory
+	if len(ids) > 0 {
+		err = h.DB.Model(&found).
+			Column("inventory.*").
+			Relation("ShelfUnit.Column.Shelf.Room.Building").
+			Relation("Category").
+			Where("inventory.id IN (?)", pg.In(ids)).
+			Select()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	byID := make(map[int]db_models.Inventory, len(found))
+	for _, item := range found {
+		byID[item.ID] = item
+	}
 
 	var res []api_objects.InventorySorted
-	for _, item := range matches {
+	for _, m := range matches {
+		item, ok := byID[m.ID]
+		if !ok {
+			continue
+		}
 		available, err := h.GetAvailable(item.ID, start, end)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -462,6 +604,9 @@ func (h *Handler) FuzzyFindItems(c *gin.Context) {
 			Room:           toRoom(*item.ShelfUnit.Column.Shelf.Room),
 			Building:       toBuilding(*item.ShelfUnit.Column.Shelf.Room.Building),
 			ShelfElementID: item.ShelfUnitID,
+			Category:       toCategoryRef(item.Category),
+			Tags:           item.Tags,
+			Attributes:     item.Attributes,
 		})
 	}
 	c.JSON(http.StatusOK, res)
@@ -476,12 +621,11 @@ func (h *Handler) FuzzyFindItems(c *gin.Context) {
 // @Router /users/{userId}/cart/items [delete]
 func (h *Handler) DeleteAllCartItems(c *gin.Context) {
 	var dbCI []db_models.ShoppingCartItem
-	userId, err := strconv.Atoi(c.Param("userId"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+	userId, ok := actingUserID(c)
+	if !ok {
 		return
 	}
-	err = h.DB.Model(&dbCI).Relation("ShoppingCart").Where("shopping_cart.user_id = ?", userId).Select()
+	err := h.DB.Model(&dbCI).Relation("ShoppingCart").Where("shopping_cart.user_id = ?", userId).Select()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -499,6 +643,12 @@ func (h *Handler) DeleteAllCartItems(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	for _, item := range dbCI {
+		audit.Record(h.DB, c, audit.Event{
+			Action: audit.ActionDelete, Entity: "shopping_cart_item", EntityID: item.ID,
+			Before: gin.H{"user_id": userId, "inventory_id": item.InventoryID, "amount": item.Amount},
+		})
+	}
 	c.JSON(http.StatusOK, dbCI)
 }
 
@@ -511,14 +661,19 @@ func (h *Handler) DeleteAllCartItems(c *gin.Context) {
 // @Success 200
 // @Router /users/{userId}/cart/items/{itemId} [delete]
 func (h *Handler) DeleteCartItem(c *gin.Context) {
-	itemId, err := strconv.Atoi(c.Param("itemId"))
+	h.deleteCartEntry(c, "inventory_id", "itemId")
+}
+
+// deleteCartEntry removes the cart entry whose column matches the path
+// parameter param, i.e. an item or a kit.
+func (h *Handler) deleteCartEntry(c *gin.Context, column string, param string) {
+	itemId, err := strconv.Atoi(c.Param(param))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + strings.TrimSuffix(param, "Id") + " id"})
 		return
 	}
-	userId, err := strconv.Atoi(c.Param("userId"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+	userId, ok := actingUserID(c)
+	if !ok {
 		return
 	}
 	var cart db_models.ShoppingCart
@@ -529,10 +684,83 @@ func (h *Handler) DeleteCartItem(c *gin.Context) {
 	}
 
 	var item db_models.ShoppingCartItem
-	res, err := h.DB.Model(&item).Where("inventory_id = ?", itemId).Where("shopping_cart_id = ?", cart.ID).Delete()
+	res, err := h.DB.Model(&item).Where("? = ?", pg.Ident(column), itemId).Where("shopping_cart_id = ?", cart.ID).Delete()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"could not delete item": err.Error()})
 		return
 	}
+	if res.RowsAffected() > 0 {
+		audit.Record(h.DB, c, audit.Event{
+			Action: audit.ActionDelete, Entity: "shopping_cart_item", EntityID: itemId,
+			Before: gin.H{"user_id": userId, column: itemId},
+		})
+	}
 	c.JSON(http.StatusOK, res)
 }
+
+// @Summary Archive an inventory item
+// @Description Archive (soft-delete) an item. It disappears from the inventory listing, search and shopping carts but stays in borrow history and can be restored. Refused while requests that were not rejected still hold the item, pending or approved, or its loans are not returned.
+// @Tags items
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Success 204
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/items/{id} [delete]
+func (h *Handler) DeleteItem(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	var inv db_models.Inventory
+	err = h.DB.Model(&inv).Where("id = ?", itemId).Select()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if inv.Archived() {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	before := inv
+	inv.ArchivedAt = time.Now()
+	var committed int
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		var locked db_models.Inventory
+		if err := tx.Model(&locked).Column("id").Where("id = ?", itemId).For("UPDATE").Select(); err != nil {
+			return err
+		}
+		// Pending requests would otherwise stay approvable for an item nobody can see.
+		var err error
+		if committed, err = committedAmount(tx, itemId); err != nil {
+			return err
+		}
+		if committed > 0 {
+			return errItemCommitted
+		}
+		if _, err := tx.Model(&inv).Set("archived_at = ?archived_at").WherePK().Update(); err != nil {
+			return err
+		}
+		// Nobody can check out an archived item, so drop it from every cart.
+		_, err = tx.Model((*db_models.ShoppingCartItem)(nil)).Where("inventory_id = ?", itemId).Delete()
+		return err
+	})
+	if errors.Is(err, errItemCommitted) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   err.Error(),
+			"details": fmt.Sprintf("%d units are reserved or on loan", committed),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "inventory", EntityID: inv.ID,
+		Organisation: h.itemOrganisation(inv.ID), Before: before, After: inv,
+	})
+	c.Status(http.StatusNoContent)
+}
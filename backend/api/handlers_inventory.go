@@ -10,8 +10,14 @@ import (
 	"lagertool.com/main/db_models"
 )
 
+// orgShelfUnits selects the ids of the shelf units on the shelves of an organisation.
+const orgShelfUnits = `SELECT shelf_unit.id FROM shelf_unit
+	JOIN "column" ON "column".id = shelf_unit.column_id
+	JOIN shelf ON shelf.id = "column".shelf_id
+	WHERE shelf.owned_by = ?`
+
 // @Summary Get all rooms for an organisation
-// @Description Get all rooms sorted by update date
+// @Description Get the rooms the organisation owns or has shelves in, sorted by update date
 // @Tags rooms
 // @Produce  json
 // @Param orgId path string true "Organisation name"
@@ -21,11 +27,9 @@ func (h *Handler) GetRooms(c *gin.Context) {
 	orgId := c.Param("orgId")
 	var dbRes []db_models.Room
 	err := h.DB.Model(&dbRes).
-		Column("room.*").
 		Relation("Building").
-		Join("JOIN shelf ON shelf.room_id = room.id").
-		Where("shelf.owned_by = ?", orgId).
-		GroupExpr("room.id, building.id").
+		Where("room.owned_by = ?", orgId).
+		WhereOr("room.id IN (SELECT shelf.room_id FROM shelf WHERE shelf.owned_by = ?)", orgId).
 		Order("room.update_date desc").
 		Select()
 	if err != nil {
@@ -40,7 +44,7 @@ func (h *Handler) GetRooms(c *gin.Context) {
 }
 
 // @Summary Get all buildings for an organisation
-// @Description Get all buildings sorted by update date
+// @Description Get the buildings the organisation owns or has rooms or shelves in, sorted by update date
 // @Tags buildings
 // @Produce  json
 // @Param orgId path string true "Organisation name"
@@ -50,10 +54,10 @@ func (h *Handler) GetBuildings(c *gin.Context) {
 	orgId := c.Param("orgId")
 	var dbRes []db_models.Building
 	err := h.DB.Model(&dbRes).
-		Join("JOIN room ON room.building_id = building.id").
-		Join("JOIN shelf ON shelf.room_id = room.id").
-		Where("shelf.owned_by = ?", orgId).
-		GroupExpr("building.id").
+		Where("building.owned_by = ?", orgId).
+		WhereOr("building.id IN (SELECT room.building_id FROM room WHERE room.owned_by = ?)", orgId).
+		WhereOr(`building.id IN (SELECT room.building_id FROM room
+			JOIN shelf ON shelf.room_id = room.id WHERE shelf.owned_by = ?)`, orgId).
 		Order("building.update_date desc").
 		Select()
 	if err != nil {
@@ -74,6 +78,10 @@ func (h *Handler) GetBuildings(c *gin.Context) {
 // @Param orgId path string true "Organisation name"
 // @Param start query string true "Start date in format 2006-01-02"
 // @Param end query string true "End date in format 2006-01-02"
+// @Param category query int false "Only items in this category or one of its subcategories"
+// @Param tag query []string false "Only items carrying all of these tags" collectionFormat(multi)
+// @Param archived query bool false "List archived items instead of active ones"
+// @Param attr.{key} query string false "Only items whose attribute equals the value; attr.{key}.min and attr.{key}.max compare numbers"
 // @Success 200 {array} api_objects.InventorySorted
 // @Router /organisations/{orgId}/inventory [get]
 func (h *Handler) GetInventory(c *gin.Context) {
@@ -88,15 +96,41 @@ func (h *Handler) GetInventory(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end date"})
 		return
 	}
+	categoryID, err := parseCategoryFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tags := normalizeTags(c.QueryArray("tag"))
+	attrFilters, err := parseAttributeFilters(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// First, find inventory IDs that belong to this org via shelf ownership
 	var inventoryIDs []int
-	err = h.DB.Model((*db_models.Inventory)(nil)).
+	q := h.DB.Model((*db_models.Inventory)(nil)).
 		Column("inventory.id").
 		Join("JOIN shelf_unit ON shelf_unit.id = inventory.shelf_unit_id").
 		Join("JOIN \"column\" ON \"column\".id = shelf_unit.column_id").
 		Join("JOIN shelf ON shelf.id = \"column\".shelf_id").
-		Where("shelf.owned_by = ?", orgId).
-		Select(&inventoryIDs)
+		Where("shelf.owned_by = ?", orgId)
+	if c.Query("archived") == "true" {
+		q = q.Where("inventory.archived_at IS NOT NULL")
+	} else {
+		q = q.Where("inventory.archived_at IS NULL")
+	}
+	if categoryID != 0 {
+		q = q.Where("inventory.category_id IN ("+categorySubtree+")", categoryID)
+	}
+	if len(tags) > 0 {
+		q = q.Where("inventory.tags @> ?", pg.Array(tags))
+	}
+	for _, f := range attrFilters {
+		q = f.apply(q)
+	}
+	err = q.Select(&inventoryIDs)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -111,6 +145,7 @@ func (h *Handler) GetInventory(c *gin.Context) {
 		Column("inventory.*").
 		Relation("ShelfUnit.Column.Shelf.Room.Building").
 		Relation("ShelfUnit.Column.Shelf.Room").
+		Relation("Category").
 		Where("inventory.id IN (?)", pg.In(inventoryIDs)).
 		Order("inventory.update_date desc").
 		Select()
@@ -128,7 +163,8 @@ func (h *Handler) GetInventory(c *gin.Context) {
 		res = append(res, api_objects.InventorySorted{
 			ID: item.ID, Name: item.Name, Amount: item.Amount, Available: available,
 			Room: toRoom(*item.ShelfUnit.Column.Shelf.Room), Building: toBuilding(*item.ShelfUnit.Column.Shelf.Room.Building),
-			ShelfElementID: item.ShelfUnitID,
+			ShelfElementID: item.ShelfUnitID, Category: toCategoryRef(item.Category), Tags: item.Tags,
+			Attributes: item.Attributes, ArchivedAt: archivedAt(item),
 		})
 	}
 	c.JSON(http.StatusOK, res)
@@ -82,8 +82,15 @@ func createTestHierarchy(t *testing.T, dbCon *pg.DB) *TestHierarchy {
 }
 
 // cleanupTestHierarchy deletes the data created by createTestHierarchy in the correct order.
+// Ledger rows and transfers of the item go first, as they reference it.
 func cleanupTestHierarchy(t *testing.T, dbCon *pg.DB, h *TestHierarchy) {
-	_, err := dbCon.Model(h.Inventory).Where("id = ?", h.Inventory.ID).Delete()
+	_, err := dbCon.Model((*db_models.StockMovement)(nil)).Where("inventory_id = ?", h.Inventory.ID).Delete()
+	assert.NoError(t, err)
+	_, err = dbCon.Model((*db_models.ItemTransfer)(nil)).
+		Where("inventory_id = ? OR target_inventory_id = ?", h.Inventory.ID, h.Inventory.ID).
+		Delete()
+	assert.NoError(t, err)
+	_, err = dbCon.Model(h.Inventory).Where("id = ?", h.Inventory.ID).Delete()
 	assert.NoError(t, err)
 	_, err = dbCon.Model(h.ShelfUnit).Where("id = ?", h.ShelfUnit.ID).Delete()
 	assert.NoError(t, err)
@@ -668,7 +675,6 @@ func TestRequestReview(t *testing.T) {
 	defer dbCon.Close()
 
 	h := NewHandler(dbCon, nil)
-	router.POST("/requests/:id/review", h.RequestReview)
 
 	// Create test organisation
 	org := &db_models.Organisation{Name: "Review Test Org"}
@@ -685,6 +691,8 @@ func TestRequestReview(t *testing.T) {
 	_, err = dbCon.Model(requester).Insert()
 	assert.NoError(t, err)
 
+	router.POST("/requests/:id/review", withUser(reviewer), h.RequestReview)
+
 	// Create request for rejection test
 	request := &db_models.Request{
 		UserID:           requester.ID,
@@ -717,7 +725,6 @@ func TestRequestReview(t *testing.T) {
 			name: "Successful Review - Rejected",
 			url:  "/requests/" + strconv.Itoa(request.ID) + "/review",
 			payload: `{
-				"user_id": ` + strconv.Itoa(reviewer.ID) + `,
 				"outcome": "rejected",
 				"note": "Not available"
 			}`,
@@ -726,7 +733,7 @@ func TestRequestReview(t *testing.T) {
 		{
 			name:           "Invalid JSON - Malformed",
 			url:            "/requests/" + strconv.Itoa(request.ID) + "/review",
-			payload:        `{"user_id": 1`,
+			payload:        `{"outcome": "rejected"`,
 			expectedStatus: http.StatusBadRequest,
 		},
 	}
@@ -749,6 +756,7 @@ func TestRequestReview(t *testing.T) {
 				err := dbCon.Model(&reviews).Where("request_id = ?", request.ID).Select()
 				assert.NoError(t, err)
 				assert.NotEmpty(t, reviews)
+				assert.Equal(t, reviewer.ID, reviews[0].UserID)
 			}
 		})
 	}
@@ -759,7 +767,6 @@ func TestRequestReviewSuccess(t *testing.T) {
 	defer dbCon.Close()
 
 	h := NewHandler(dbCon, nil)
-	router.POST("/requests/:id/review", h.RequestReview)
 
 	// Create test organisation
 	org := &db_models.Organisation{Name: "Review Success Test Org"}
@@ -776,6 +783,8 @@ func TestRequestReviewSuccess(t *testing.T) {
 	_, err = dbCon.Model(requester).Insert()
 	assert.NoError(t, err)
 
+	router.POST("/requests/:id/review", withUser(reviewer), h.RequestReview)
+
 	// Create building
 	building := &db_models.Building{Name: "Review Building", UpdateDate: time.Now()}
 	_, err = dbCon.Model(building).Insert()
@@ -875,7 +884,6 @@ func TestRequestReviewSuccess(t *testing.T) {
 
 	t.Run("Successful Review - Creates Loans and Consumed", func(t *testing.T) {
 		payload := `{
-			"user_id": ` + strconv.Itoa(reviewer.ID) + `,
 			"outcome": "approved",
 			"note": "approved"
 		}`
@@ -1184,6 +1192,30 @@ func TestUpdateItem(t *testing.T) {
 			}`,
 			expectedStatus: http.StatusOK,
 		},
+		{
+			name:           "Successful Update - Name and consumable",
+			url:            base + strconv.Itoa(hier.Inventory.ID),
+			payload:        `{"name": "  Renamed item ", "isConsumable": true}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Empty name",
+			url:            base + strconv.Itoa(hier.Inventory.ID),
+			payload:        `{"name": "   "}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Negative amount",
+			url:            base + strconv.Itoa(hier.Inventory.ID),
+			payload:        `{"amount": -1}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown shelf unit",
+			url:            base + strconv.Itoa(hier.Inventory.ID),
+			payload:        `{"shelfUnitId": "no-such-unit"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
 		{
 			name:           "Invalid ID",
 			url:            base + "notanumber",
@@ -1218,6 +1250,211 @@ func TestUpdateItem(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 50, updatedInv.Amount)
 	assert.Equal(t, "Updated note", updatedInv.Note)
+
+	put := func(payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", base+strconv.Itoa(hier.Inventory.ID), strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Amount below what is reserved", func(t *testing.T) {
+		user := &db_models.User{Email: "updateitem@example.com", Name: "UpdateItem Borrower"}
+		_, err := dbCon.Model(user).Insert()
+		assert.NoError(t, err)
+		request := &db_models.Request{
+			UserID:           user.ID,
+			StartDate:        time.Now().Add(24 * time.Hour),
+			EndDate:          time.Now().Add(48 * time.Hour),
+			State:            "requested",
+			OrganisationName: org.Name,
+		}
+		_, err = dbCon.Model(request).Insert()
+		assert.NoError(t, err)
+		reqItem := &db_models.RequestItems{RequestID: request.ID, InventoryID: hier.Inventory.ID, Amount: 40}
+		_, err = dbCon.Model(reqItem).Insert()
+		assert.NoError(t, err)
+		defer func() {
+			_, _ = dbCon.Model(reqItem).WherePK().Delete()
+			_, _ = dbCon.Model(request).WherePK().Delete()
+			_, _ = dbCon.Model(user).WherePK().Delete()
+		}()
+
+		w := put(`{"amount": 39}`)
+		assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+		w = put(`{"amount": 40}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("Shelf unit changes", func(t *testing.T) {
+		otherOrg := &db_models.Organisation{Name: "UpdateItem Other Org"}
+		_, err := dbCon.Model(otherOrg).Insert()
+		assert.NoError(t, err)
+		hier.Shelf.OwnedBy = org.Name
+		_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+		assert.NoError(t, err)
+
+		shelves := []*db_models.Shelf{
+			{ID: "UI-S-2", Name: "Second Shelf", RoomID: hier.Room.ID, OwnedBy: org.Name, UpdateDate: time.Now()},
+			{ID: "UI-S-3", Name: "Foreign Shelf", RoomID: hier.Room.ID, OwnedBy: otherOrg.Name, UpdateDate: time.Now()},
+		}
+		columns := []*db_models.Column{{ID: "UI-C-2", ShelfID: "UI-S-2"}, {ID: "UI-C-3", ShelfID: "UI-S-3"}}
+		units := []*db_models.ShelfUnit{{ID: "UI-SU-2", ColumnID: "UI-C-2"}, {ID: "UI-SU-3", ColumnID: "UI-C-3"}}
+		_, err = dbCon.Model(&shelves).Insert()
+		assert.NoError(t, err)
+		_, err = dbCon.Model(&columns).Insert()
+		assert.NoError(t, err)
+		_, err = dbCon.Model(&units).Insert()
+		assert.NoError(t, err)
+		defer func() {
+			_, _ = dbCon.Model(&units).WherePK().Delete()
+			_, _ = dbCon.Model(&columns).WherePK().Delete()
+			_, _ = dbCon.Model(&shelves).WherePK().Delete()
+			_, _ = dbCon.Model(otherOrg).WherePK().Delete()
+		}()
+
+		w := put(`{"shelfUnitId": "UI-SU-3"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+		w = put(`{"shelfUnitId": "UI-SU-2"}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var moved db_models.Inventory
+		assert.NoError(t, dbCon.Model(&moved).Where("id = ?", hier.Inventory.ID).Select())
+		assert.Equal(t, "UI-SU-2", moved.ShelfUnitID)
+		assert.Equal(t, "UI-S-2", moved.ShelfID, "the shelf follows the shelf unit")
+
+		// Move it back so the hierarchy can be cleaned up.
+		w = put(`{"shelfUnitId": "` + hier.ShelfUnit.ID + `"}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+}
+
+func TestDeleteItem(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	h := NewHandler(dbCon, nil)
+	router.DELETE("/organisations/:orgId/items/:id", h.DeleteItem)
+	router.POST("/organisations/:orgId/items/:id/restore", h.RestoreItem)
+	router.GET("/organisations/:orgId/inventory", h.GetInventory)
+	router.GET("/organisations/:orgId/items/:id", h.GetItem)
+	router.GET("/search/:searchTerm", h.FuzzyFindItems)
+	router.POST("/users/:userId/cart/items", h.CreateCartItem)
+
+	org := &db_models.Organisation{Name: "DeleteItem Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+	user := &db_models.User{Email: "archive@example.com", Name: "Archive Tester"}
+	_, err = dbCon.Model(user).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+
+	request := &db_models.Request{
+		UserID: user.ID, StartDate: time.Now().Add(-48 * time.Hour), EndDate: time.Now().Add(-24 * time.Hour),
+		State: "approved", OrganisationName: org.Name,
+	}
+	_, err = dbCon.Model(request).Insert()
+	assert.NoError(t, err)
+	requestItem := &db_models.RequestItems{RequestID: request.ID, InventoryID: hier.Inventory.ID, Amount: 1}
+	_, err = dbCon.Model(requestItem).Insert()
+	assert.NoError(t, err)
+	loan := &db_models.Loans{RequestItemID: requestItem.ID}
+	_, err = dbCon.Model(loan).Insert()
+	assert.NoError(t, err)
+	pending := &db_models.Request{
+		UserID: user.ID, StartDate: time.Now().Add(24 * time.Hour), EndDate: time.Now().Add(48 * time.Hour),
+		State: "requested", OrganisationName: org.Name,
+	}
+	_, err = dbCon.Model(pending).Insert()
+	assert.NoError(t, err)
+	pendingItem := &db_models.RequestItems{RequestID: pending.ID, InventoryID: hier.Inventory.ID, Amount: 1}
+	_, err = dbCon.Model(pendingItem).Insert()
+	assert.NoError(t, err)
+	_, err = db.CreateCartItem(dbCon, hier.Inventory.ID, 1, user.ID)
+	assert.NoError(t, err)
+
+	defer func() {
+		_, _ = dbCon.Model(loan).WherePK().Delete()
+		_, _ = dbCon.Model((*db_models.RequestItems)(nil)).Where("id IN (?)", pg.In([]int{requestItem.ID, pendingItem.ID})).Delete()
+		_, _ = dbCon.Model((*db_models.Request)(nil)).Where("id IN (?)", pg.In([]int{request.ID, pending.ID})).Delete()
+		_, _ = dbCon.Model((*db_models.ShoppingCartItem)(nil)).Where("inventory_id = ?", hier.Inventory.ID).Delete()
+		_, _ = dbCon.Model((*db_models.ShoppingCart)(nil)).Where("user_id = ?", user.ID).Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model(user).WherePK().Delete()
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	send := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	itemURL := "/organisations/" + org.Name + "/items/" + strconv.Itoa(hier.Inventory.ID)
+	listed := func(query string) bool {
+		w := send("GET", "/organisations/"+org.Name+"/inventory?start=2030-01-01&end=2030-01-02"+query, "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var items []api_objects.InventorySorted
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+		return len(items) == 1
+	}
+	found := func() bool {
+		w := send("GET", "/search/Hierarchy%20Item?start=2030-01-01&end=2030-01-02", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var items []api_objects.InventorySorted
+		_ = json.Unmarshal(w.Body.Bytes(), &items)
+		for _, item := range items {
+			if item.ID == hier.Inventory.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	assert.Equal(t, http.StatusConflict, send("DELETE", itemURL, "").Code, "loan not returned")
+	assert.Equal(t, http.StatusNotFound, send("DELETE", "/organisations/"+org.Name+"/items/999999", "").Code)
+
+	_, err = dbCon.Model(loan).Set("returned = true").WherePK().Update()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, send("DELETE", itemURL, "").Code, "pending request")
+
+	_, err = dbCon.Model(pending).Set("state = 'rejected'").WherePK().Update()
+	assert.NoError(t, err)
+	w := send("DELETE", itemURL, "")
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	t.Run("Archived item is hidden", func(t *testing.T) {
+		assert.False(t, listed(""))
+		assert.True(t, listed("&archived=true"))
+		assert.False(t, found())
+		inCart, err := dbCon.Model((*db_models.ShoppingCartItem)(nil)).Where("inventory_id = ?", hier.Inventory.ID).Exists()
+		assert.NoError(t, err)
+		assert.False(t, inCart, "removed from carts")
+		w := send("POST", "/users/"+strconv.Itoa(user.ID)+"/cart/items", `{"id": `+strconv.Itoa(hier.Inventory.ID)+`, "numSelected": 1}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Archived item can still be fetched", func(t *testing.T) {
+		w := send("GET", itemURL+"?start=2030-01-01&end=2030-01-02", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var item api_objects.InventoryItemWithShelf
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &item))
+		assert.NotNil(t, item.ArchivedAt)
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send("POST", itemURL+"/restore", "").Code)
+		assert.True(t, listed(""))
+		assert.False(t, listed("&archived=true"))
+		assert.True(t, found())
+	})
 }
 
 func TestCreateBuilding(t *testing.T) {
@@ -1453,7 +1690,6 @@ func TestPostMessage(t *testing.T) {
 	defer dbCon.Close()
 
 	h := NewHandler(dbCon, nil)
-	router.POST("/requests/:id/messages", h.PostMessage)
 
 	// Create test organisation
 	org := &db_models.Organisation{Name: "Message Test Org"}
@@ -1465,6 +1701,8 @@ func TestPostMessage(t *testing.T) {
 	_, err = dbCon.Model(user).Insert()
 	assert.NoError(t, err)
 
+	router.POST("/requests/:id/messages", withUser(user), h.PostMessage)
+
 	// Create request
 	request := &db_models.Request{
 		UserID:           user.ID,
@@ -1494,7 +1732,6 @@ func TestPostMessage(t *testing.T) {
 			name: "Successful Message",
 			url:  "/requests/" + strconv.Itoa(request.ID) + "/messages",
 			payload: `{
-				"userId": ` + strconv.Itoa(user.ID) + `,
 				"message": "Hello, can I borrow this?"
 			}`,
 			expectedStatus: http.StatusOK,
@@ -1502,13 +1739,13 @@ func TestPostMessage(t *testing.T) {
 		{
 			name:           "Invalid Request ID",
 			url:            "/requests/notanumber/messages",
-			payload:        `{"userId": 1, "message": "test"}`,
+			payload:        `{"message": "test"}`,
 			expectedStatus: http.StatusBadRequest,
 		},
 		{
 			name:           "Invalid JSON - Malformed",
 			url:            "/requests/" + strconv.Itoa(request.ID) + "/messages",
-			payload:        `{"userId": 1`,
+			payload:        `{"message": "test"`,
 			expectedStatus: http.StatusBadRequest,
 		},
 	}
@@ -0,0 +1,437 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+// loadKit loads a kit with its components in the order they were added.
+func (h *Handler) loadKit(id int) (db_models.Kit, error) {
+	var kit db_models.Kit
+	err := h.DB.Model(&kit).
+		Relation("Components", func(q *orm.Query) (*orm.Query, error) {
+			return q.Order("kit_component.id"), nil
+		}).
+		Relation("Components.Inventory").
+		Where("kit.id = ?", id).
+		Select()
+	return kit, err
+}
+
+func (h *Handler) orgKit(c *gin.Context) (db_models.Kit, bool) {
+	id, err := strconv.Atoi(c.Param("kitId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid kit id"})
+		return db_models.Kit{}, false
+	}
+	kit, err := h.loadKit(id)
+	if err != nil || kit.OrganisationName != c.Param("orgId") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "kit not found"})
+		return db_models.Kit{}, false
+	}
+	return kit, true
+}
+
+// kitComponents checks the requested components of a kit: every item must be
+// an unarchived item of the organisation and appear only once. It answers the
+// request itself when they are invalid.
+func (h *Handler) kitComponents(c *gin.Context, organisation string, reqs []api_objects.KitComponentRequest) ([]db_models.KitComponent, bool) {
+	invalid := func(details string) ([]db_models.KitComponent, bool) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid components", "details": details})
+		return nil, false
+	}
+	if len(reqs) == 0 {
+		return invalid("a kit needs at least one component")
+	}
+	ids := make([]int, 0, len(reqs))
+	seen := make(map[int]bool, len(reqs))
+	for _, r := range reqs {
+		if r.Amount < 1 {
+			return invalid(fmt.Sprintf("amount of item %d must be at least 1", r.ItemID))
+		}
+		if seen[r.ItemID] {
+			return invalid(fmt.Sprintf("item %d is listed twice", r.ItemID))
+		}
+		seen[r.ItemID] = true
+		ids = append(ids, r.ItemID)
+	}
+
+	var items []db_models.Inventory
+	err := h.DB.Model(&items).
+		Column("id", "archived_at").
+		Where("id IN (?)", pg.In(ids)).
+		Where("shelf_unit_id IN ("+orgShelfUnits+")", organisation).
+		Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	found := make(map[int]db_models.Inventory, len(items))
+	for _, inv := range items {
+		found[inv.ID] = inv
+	}
+	components := make([]db_models.KitComponent, 0, len(reqs))
+	for _, r := range reqs {
+		inv, ok := found[r.ItemID]
+		if !ok {
+			return invalid(fmt.Sprintf("item %d not found", r.ItemID))
+		}
+		if inv.Archived() {
+			return invalid(fmt.Sprintf("item %d is archived", r.ItemID))
+		}
+		components = append(components, db_models.KitComponent{InventoryID: r.ItemID, Amount: r.Amount})
+	}
+	return components, true
+}
+
+// toKit describes a kit with the availability of its components between start
+// and end. A kit is available as often as its scarcest component allows;
+// archived components make it unavailable.
+func (h *Handler) toKit(kit db_models.Kit, start, end time.Time) (api_objects.Kit, error) {
+	res := api_objects.Kit{
+		ID:          kit.ID,
+		Name:        kit.Name,
+		Description: kit.Description,
+		Components:  make([]api_objects.KitComponent, 0, len(kit.Components)),
+	}
+	for i, comp := range kit.Components {
+		component := api_objects.KitComponent{
+			ItemID:   comp.InventoryID,
+			Name:     comp.Inventory.Name,
+			Amount:   comp.Amount,
+			Archived: comp.Inventory.Archived(),
+		}
+		if !component.Archived {
+			available, err := h.GetAvailable(comp.InventoryID, start, end)
+			if err != nil {
+				return res, err
+			}
+			component.Available = available
+		}
+		kits := component.Available / comp.Amount
+		if i == 0 || kits < res.Available {
+			res.Available = kits
+		}
+		res.Components = append(res.Components, component)
+	}
+	return res, nil
+}
+
+// kitRequestItems expands count copies of a kit into one request item per component.
+func kitRequestItems(kit api_objects.Kit, count int) []db_models.RequestItems {
+	items := make([]db_models.RequestItems, 0, len(kit.Components))
+	for _, comp := range kit.Components {
+		items = append(items, db_models.RequestItems{
+			InventoryID: comp.ItemID,
+			Amount:      comp.Amount * count,
+			KitID:       kit.ID,
+		})
+	}
+	return items
+}
+
+// kitDateRange reads the optional start and end query parameters; without
+// them availability is computed for today.
+func kitDateRange(c *gin.Context) (time.Time, time.Time, bool) {
+	today := time.Now().Truncate(24 * time.Hour)
+	start, end := today, today
+	var err error
+	if v := c.Query("start"); v != "" {
+		if start, err = time.Parse("2006-01-02", v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start date"})
+			return start, end, false
+		}
+	}
+	if v := c.Query("end"); v != "" {
+		if end, err = time.Parse("2006-01-02", v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end date"})
+			return start, end, false
+		}
+	}
+	return start, end, true
+}
+
+// @Summary List the kits of an organisation
+// @Description List the kits of an organisation with their components and how many complete kits are free between start and end (today by default)
+// @Tags kits
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param start query string false "Start date in format 2006-01-02"
+// @Param end query string false "End date in format 2006-01-02"
+// @Success 200 {array} api_objects.Kit
+// @Router /organisations/{orgId}/kits [get]
+func (h *Handler) GetKits(c *gin.Context) {
+	start, end, ok := kitDateRange(c)
+	if !ok {
+		return
+	}
+	var ids []int
+	err := h.DB.Model((*db_models.Kit)(nil)).
+		Column("id").
+		Where("organisation_name = ?", c.Param("orgId")).
+		Order("name").
+		Select(&ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.Kit, 0, len(ids))
+	for _, id := range ids {
+		kit, err := h.loadKit(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		k, err := h.toKit(kit, start, end)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		res = append(res, k)
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary Get a kit
+// @Description Get a kit with its components and how many complete kits are free between start and end (today by default)
+// @Tags kits
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param kitId path int true "Kit ID"
+// @Param start query string false "Start date in format 2006-01-02"
+// @Param end query string false "End date in format 2006-01-02"
+// @Success 200 {object} api_objects.Kit
+// @Router /organisations/{orgId}/kits/{kitId} [get]
+func (h *Handler) GetKit(c *gin.Context) {
+	start, end, ok := kitDateRange(c)
+	if !ok {
+		return
+	}
+	kit, ok := h.orgKit(c)
+	if !ok {
+		return
+	}
+	res, err := h.toKit(kit, start, end)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary Create a kit
+// @Description Create a kit from items of the organisation, e.g. a camera body, two lenses and a bag. Each item may appear once, with the number of units one kit contains.
+// @Tags kits
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param kit body api_objects.KitRequest true "Kit"
+// @Success 201 {object} api_objects.Kit
+// @Router /organisations/{orgId}/kits [post]
+func (h *Handler) CreateKit(c *gin.Context) {
+	orgId := c.Param("orgId")
+	var req api_objects.KitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name cannot be empty"})
+		return
+	}
+	components, ok := h.kitComponents(c, orgId, req.Components)
+	if !ok {
+		return
+	}
+	kit := &db_models.Kit{
+		Name:             name,
+		Description:      req.Description,
+		OrganisationName: orgId,
+		Components:       components,
+	}
+	err := h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		return db.CreateKit(tx, kit)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "kit", EntityID: kit.ID,
+		Organisation: orgId, After: kit,
+	})
+	h.respondKit(c, http.StatusCreated, kit.ID)
+}
+
+// @Summary Update a kit
+// @Description Rename a kit or replace its components
+// @Tags kits
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param kitId path int true "Kit ID"
+// @Param kit body api_objects.UpdateKitRequest true "Update details"
+// @Success 200 {object} api_objects.Kit
+// @Router /organisations/{orgId}/kits/{kitId} [put]
+func (h *Handler) UpdateKit(c *gin.Context) {
+	kit, ok := h.orgKit(c)
+	if !ok {
+		return
+	}
+	var req api_objects.UpdateKitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before := kit
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name cannot be empty"})
+			return
+		}
+		kit.Name = name
+	}
+	if req.Description != nil {
+		kit.Description = *req.Description
+	}
+	if req.Components != nil {
+		components, ok := h.kitComponents(c, kit.OrganisationName, req.Components)
+		if !ok {
+			return
+		}
+		kit.Components = components
+	}
+	kit.UpdateDate = time.Now()
+
+	err := h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		if _, err := tx.Model(&kit).Column("name", "description", "update_date").WherePK().Update(); err != nil {
+			return err
+		}
+		if req.Components == nil {
+			return nil
+		}
+		return db.SetKitComponents(tx, &kit)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "kit", EntityID: kit.ID,
+		Organisation: kit.OrganisationName, Before: before, After: kit,
+	})
+	h.respondKit(c, http.StatusOK, kit.ID)
+}
+
+// @Summary Delete a kit
+// @Description Delete a kit and remove it from shopping carts. Requests made with the kit keep their items.
+// @Tags kits
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param kitId path int true "Kit ID"
+// @Success 204
+// @Router /organisations/{orgId}/kits/{kitId} [delete]
+func (h *Handler) DeleteKit(c *gin.Context) {
+	kit, ok := h.orgKit(c)
+	if !ok {
+		return
+	}
+	err := h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		if _, err := tx.Model((*db_models.ShoppingCartItem)(nil)).Where("kit_id = ?", kit.ID).Delete(); err != nil {
+			return err
+		}
+		if _, err := tx.Model((*db_models.KitComponent)(nil)).Where("kit_id = ?", kit.ID).Delete(); err != nil {
+			return err
+		}
+		_, err := tx.Model(&kit).WherePK().Delete()
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "kit", EntityID: kit.ID,
+		Organisation: kit.OrganisationName, Before: kit,
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// respondKit answers with the stored kit and its availability for today.
+func (h *Handler) respondKit(c *gin.Context, status int, id int) {
+	kit, err := h.loadKit(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	today := time.Now().Truncate(24 * time.Hour)
+	res, err := h.toKit(kit, today, today)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, res)
+}
+
+// createCartKit adds a kit to the cart of a user as one entry.
+func (h *Handler) createCartKit(c *gin.Context, userID int, req api_objects.CartRequest) {
+	kit, err := h.loadKit(req.KitID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "kit not found"})
+		return
+	}
+	for _, comp := range kit.Components {
+		if comp.Inventory.Archived() {
+			c.JSON(http.StatusConflict, gin.H{"error": "kit contains an archived item", "details": comp.Inventory.Name})
+			return
+		}
+	}
+	entry, err := db.CreateCartKit(h.DB, kit.ID, req.NumSelected, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "shopping_cart_item", EntityID: entry.ID, After: entry,
+	})
+	c.JSON(http.StatusCreated, entry)
+}
+
+// @Summary Delete a kit from the cart
+// @Description Remove a kit from a user's shopping cart
+// @Tags cart
+// @Produce  json
+// @Param userId path int true "User ID"
+// @Param kitId path int true "Kit ID"
+// @Success 200
+// @Router /users/{userId}/cart/kits/{kitId} [delete]
+func (h *Handler) DeleteCartKit(c *gin.Context) {
+	h.deleteCartEntry(c, "kit_id", "kitId")
+}
+
+// @Summary Update a kit in the cart
+// @Description Change how many copies of a kit are in a user's shopping cart
+// @Tags cart
+// @Accept  json
+// @Produce  json
+// @Param userId path int true "User ID"
+// @Param kitId path int true "Kit ID"
+// @Param item body api_objects.UpdateCartItem true "Update details"
+// @Success 200
+// @Router /users/{userId}/cart/kits/{kitId} [put]
+func (h *Handler) UpdateCartKit(c *gin.Context) {
+	h.updateCartEntry(c, "kit_id", "kitId")
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db_models"
+)
+
+func TestKitRequestItems(t *testing.T) {
+	kit := api_objects.Kit{ID: 7, Components: []api_objects.KitComponent{
+		{ItemID: 1, Amount: 1},
+		{ItemID: 2, Amount: 2},
+	}}
+	items := kitRequestItems(kit, 3)
+	assert.Equal(t, []db_models.RequestItems{
+		{InventoryID: 1, Amount: 3, KitID: 7},
+		{InventoryID: 2, Amount: 6, KitID: 7},
+	}, items)
+}
+
+func TestKits(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Kit Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+	user := &db_models.User{Email: "kit-borrower@example.com", Name: "Kit Borrower"}
+	_, err = dbCon.Model(user).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+	hier.Inventory.IsConsumable = false
+	hier.Inventory.Name = "Camera body"
+	hier.Inventory.Amount = 3
+	_, err = dbCon.Model(hier.Inventory).WherePK().Update()
+	assert.NoError(t, err)
+	lens := &db_models.Inventory{Name: "Lens", Amount: 5, ShelfUnitID: hier.ShelfUnit.ID, ShelfID: hier.Shelf.ID, UpdateDate: time.Now()}
+	_, err = dbCon.Model(lens).Insert()
+	assert.NoError(t, err)
+
+	var requestIDs []int
+	defer func() {
+		itemIDs := pg.In([]int{hier.Inventory.ID, lens.ID})
+		_, _ = dbCon.Model((*db_models.RequestItems)(nil)).Where("inventory_id IN (?)", itemIDs).Delete()
+		if len(requestIDs) > 0 {
+			_, _ = dbCon.Model((*db_models.Request)(nil)).Where("id IN (?)", pg.In(requestIDs)).Delete()
+		}
+		_, _ = dbCon.Model((*db_models.ShoppingCartItem)(nil)).
+			Where("shopping_cart_id IN (SELECT id FROM shopping_cart WHERE user_id = ?)", user.ID).Delete()
+		_, _ = dbCon.Model((*db_models.ShoppingCart)(nil)).Where("user_id = ?", user.ID).Delete()
+		_, _ = dbCon.Model((*db_models.KitComponent)(nil)).Where("inventory_id IN (?)", itemIDs).Delete()
+		_, _ = dbCon.Model((*db_models.Kit)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		_, _ = dbCon.Model(lens).WherePK().Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model(user).WherePK().Delete()
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.GET("/organisations/:orgId/kits", h.GetKits)
+	router.GET("/organisations/:orgId/kits/:kitId", h.GetKit)
+	router.POST("/organisations/:orgId/kits", h.CreateKit)
+	router.PUT("/organisations/:orgId/kits/:kitId", h.UpdateKit)
+	router.DELETE("/organisations/:orgId/kits/:kitId", h.DeleteKit)
+	me := router.Group("/me", withUser(user))
+	me.GET("/cart", h.GetShoppingCart)
+	me.POST("/cart/items", h.CreateCartItem)
+	me.PUT("/cart/kits/:kitId", h.UpdateCartKit)
+	me.POST("/cart/checkout", h.CheckoutCart)
+
+	base := "/organisations/" + org.Name + "/kits"
+	send := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	components := func(body, lenses int) string {
+		return `[{"itemId": ` + strconv.Itoa(hier.Inventory.ID) + `, "amount": ` + strconv.Itoa(body) + `},
+			{"itemId": ` + strconv.Itoa(lens.ID) + `, "amount": ` + strconv.Itoa(lenses) + `}]`
+	}
+
+	var kit api_objects.Kit
+	t.Run("Create", func(t *testing.T) {
+		testCases := []struct {
+			name           string
+			payload        string
+			expectedStatus int
+		}{
+			{name: "Camera kit", payload: `{"name": "Camera kit", "components": ` + components(1, 2) + `}`, expectedStatus: http.StatusCreated},
+			{name: "No components", payload: `{"name": "Empty", "components": []}`, expectedStatus: http.StatusBadRequest},
+			{name: "Zero amount", payload: `{"name": "Zero", "components": ` + components(1, 0) + `}`, expectedStatus: http.StatusBadRequest},
+			{name: "Duplicate item", payload: `{"name": "Twice", "components": [{"itemId": ` + strconv.Itoa(lens.ID) + `, "amount": 1}, {"itemId": ` + strconv.Itoa(lens.ID) + `, "amount": 1}]}`, expectedStatus: http.StatusBadRequest},
+			{name: "Unknown item", payload: `{"name": "Ghost", "components": [{"itemId": 999999, "amount": 1}]}`, expectedStatus: http.StatusBadRequest},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w := send("POST", base, tc.payload)
+				assert.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+				if w.Code == http.StatusCreated {
+					assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &kit))
+				}
+			})
+		}
+	})
+	if !assert.NotZero(t, kit.ID) {
+		return
+	}
+	assert.Len(t, kit.Components, 2)
+	assert.Equal(t, 2, kit.Available, "five lenses make two kits")
+
+	kitURL := base + "/" + strconv.Itoa(kit.ID)
+	t.Run("Update", func(t *testing.T) {
+		w := send("PUT", kitURL, `{"name": "Camera kit (wide)", "components": `+components(1, 1)+`}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &kit))
+		assert.Equal(t, "Camera kit (wide)", kit.Name)
+		assert.Equal(t, 3, kit.Available, "now the bodies are the limit")
+		assert.Equal(t, http.StatusNotFound, send("GET", "/organisations/Other/kits/"+strconv.Itoa(kit.ID), "").Code)
+	})
+
+	t.Run("Borrow through the cart", func(t *testing.T) {
+		w := send("POST", "/me/cart/items", `{"kitId": `+strconv.Itoa(kit.ID)+`, "numSelected": 1}`)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.Equal(t, http.StatusBadRequest, send("POST", "/me/cart/items", `{"numSelected": 1}`).Code)
+		w = send("PUT", "/me/cart/kits/"+strconv.Itoa(kit.ID), `{"amount": 2}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = send("GET", "/me/cart?start=2030-01-01&end=2030-01-02", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var cart map[string][]api_objects.CartItem
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &cart))
+		if assert.Len(t, cart[org.Name], 1) {
+			entry := cart[org.Name][0]
+			assert.NotNil(t, entry.Kit)
+			assert.Equal(t, 2, entry.AmountSelected)
+			assert.Equal(t, 3, entry.Available)
+		}
+
+		w = send("POST", "/me/cart/checkout", `{"startDate": "2030-01-01T00:00:00Z", "endDate": "2030-01-02T00:00:00Z"}`)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var items []db_models.RequestItems
+		err := dbCon.Model(&items).Where("kit_id = ?", kit.ID).Order("inventory_id").Select()
+		assert.NoError(t, err)
+		if assert.Len(t, items, 2) {
+			assert.Equal(t, 2, items[0].Amount)
+			assert.Equal(t, 2, items[1].Amount)
+			requestIDs = append(requestIDs, items[0].RequestID)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, send("DELETE", kitURL, "").Code)
+		assert.Equal(t, http.StatusNotFound, send("GET", kitURL, "").Code)
+	})
+}
@@ -0,0 +1,752 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/auth"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+// The shelves inside a building, a room or a single shelf. Deleting a location
+// empties and removes these shelves first.
+const (
+	buildingShelves = `SELECT shelf.id FROM shelf JOIN room ON room.id = shelf.room_id WHERE room.building_id = ?`
+	roomShelves     = `SELECT shelf.id FROM shelf WHERE shelf.room_id = ?`
+	singleShelf     = `SELECT shelf.id FROM shelf WHERE shelf.id = ?`
+)
+
+var (
+	errLocationNotEmpty = errors.New("location still holds inventory")
+	errItemsHaveHistory = errors.New("items with borrow or move history cannot be deleted, relocate them instead")
+)
+
+// removal says what happens to the items of a location that is deleted:
+// cascade deletes them, relocate moves them to another shelf unit.
+type removal struct {
+	cascade  bool
+	relocate *db_models.ShelfUnit
+}
+
+// parseRemoval reads the cascade and relocate query parameters of a delete and
+// checks the relocation target. It answers the request itself when they are
+// invalid.
+func (h *Handler) parseRemoval(c *gin.Context, shelves string, arg interface{}) (removal, bool) {
+	var r removal
+	if v := c.Query("cascade"); v != "" {
+		cascade, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cascade"})
+			return r, false
+		}
+		r.cascade = cascade
+	}
+	target := c.Query("relocate")
+	if target == "" {
+		return r, true
+	}
+	if r.cascade {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "use either cascade or relocate"})
+		return removal{}, false
+	}
+	var unit db_models.ShelfUnit
+	err := h.DB.Model(&unit).Relation("Column.Shelf").Where("shelf_unit.id = ?", target).Select()
+	if err != nil || unit.Column.Shelf.OwnedBy != c.Param("orgId") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "relocation target not found"})
+		return r, false
+	}
+	inside, err := h.DB.Model((*db_models.Shelf)(nil)).
+		Where("id = ?", unit.Column.ShelfID).
+		Where("id IN ("+shelves+")", arg).
+		Exists()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return r, false
+	}
+	if inside {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "relocation target is inside the location being deleted"})
+		return r, false
+	}
+	r.relocate = &unit
+	return r, true
+}
+
+// sharedWithOthers reports whether any of the shelves belongs to another
+// organisation. Other organisations may keep shelves in a building or room, so
+// even its owner may only change or delete it while it holds none of theirs.
+func (h *Handler) sharedWithOthers(shelves string, arg interface{}, organisation string) (bool, error) {
+	return h.DB.Model((*db_models.Shelf)(nil)).
+		Where("id IN ("+shelves+")", arg).
+		Where("owned_by <> ?", organisation).
+		Exists()
+}
+
+// clearShelves deletes the shelves selected by shelves with their columns and
+// shelf units. Items on them are moved or deleted as r says; otherwise it fails
+// with errLocationNotEmpty. It returns the attachments of deleted items, whose
+// files the caller removes once the transaction is committed.
+func clearShelves(tx *pg.Tx, shelves string, arg interface{}, r removal) ([]db_models.Attachment, error) {
+	var items []int
+	err := tx.Model((*db_models.Inventory)(nil)).
+		Column("inventory.id").
+		Join("JOIN shelf_unit ON shelf_unit.id = inventory.shelf_unit_id").
+		Join(`JOIN "column" ON "column".id = shelf_unit.column_id`).
+		Where(`"column".shelf_id IN (`+shelves+`)`, arg).
+		Select(&items)
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []db_models.Attachment
+	switch {
+	case len(items) == 0:
+	case r.relocate != nil:
+		_, err = tx.Model((*db_models.Inventory)(nil)).
+			Set("shelf_unit_id = ?", r.relocate.ID).
+			Set("shelf_id = ?", r.relocate.Column.ShelfID).
+			Set("update_date = ?", time.Now()).
+			Where("id IN (?)", pg.In(items)).
+			Update()
+		if err != nil {
+			return nil, err
+		}
+	case r.cascade:
+		if attachments, err = deleteItems(tx, items); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %d items", errLocationNotEmpty, len(items))
+	}
+
+	columns := `SELECT "column".id FROM "column" WHERE "column".shelf_id IN (` + shelves + `)`
+	if _, err := tx.Model((*db_models.ShelfUnit)(nil)).Where("column_id IN ("+columns+")", arg).Delete(); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Model((*db_models.Column)(nil)).Where("shelf_id IN ("+shelves+")", arg).Delete(); err != nil {
+		return nil, err
+	}
+	// Select the ids first: the subquery of a room or building reads the shelf table itself.
+	var ids []string
+	if _, err := tx.Query(&ids, shelves, arg); err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		if _, err := tx.Model((*db_models.Shelf)(nil)).Where("id IN (?)", pg.In(ids)).Delete(); err != nil {
+			return nil, err
+		}
+	}
+	return attachments, nil
+}
+
+// deleteItems removes items that were never borrowed or moved together with
+// the rows that only describe them.
+func deleteItems(tx *pg.Tx, ids []int) ([]db_models.Attachment, error) {
+	borrowed, err := tx.Model((*db_models.RequestItems)(nil)).Where("inventory_id IN (?)", pg.In(ids)).Exists()
+	if err != nil {
+		return nil, err
+	}
+	// Transfers are the audit trail of moves between organisations, so they are kept.
+	moved, err := tx.Model((*db_models.ItemTransfer)(nil)).
+		Where("inventory_id IN (?)", pg.In(ids)).
+		WhereOr("target_inventory_id IN (?)", pg.In(ids)).
+		Exists()
+	if err != nil {
+		return nil, err
+	}
+	if borrowed || moved {
+		return nil, errItemsHaveHistory
+	}
+	var attachments []db_models.Attachment
+	if err := tx.Model(&attachments).Where("inventory_id IN (?)", pg.In(ids)).Select(); err != nil {
+		return nil, err
+	}
+	for _, model := range []interface{}{
+		(*db_models.ShoppingCartItem)(nil),
+		(*db_models.KitComponent)(nil),
+		(*db_models.Asset)(nil),
+		(*db_models.Attachment)(nil),
+		(*db_models.StockMovement)(nil),
+	} {
+		if _, err := tx.Model(model).Where("inventory_id IN (?)", pg.In(ids)).Delete(); err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.Model((*db_models.Inventory)(nil)).Where("id IN (?)", pg.In(ids)).Delete()
+	return attachments, err
+}
+
+// removeLocation runs remove in a transaction and answers the request. Refusals
+// because of items inside are reported as conflicts.
+func (h *Handler) removeLocation(c *gin.Context, remove func(tx *pg.Tx) ([]db_models.Attachment, error)) bool {
+	var attachments []db_models.Attachment
+	err := h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		var err error
+		attachments, err = remove(tx)
+		return err
+	})
+	if errors.Is(err, errLocationNotEmpty) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "details": "pass cascade=true or relocate=<shelf unit id>"})
+		return false
+	}
+	if errors.Is(err, errItemsHaveHistory) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	for _, a := range attachments {
+		h.deleteAttachmentFiles(c, a)
+	}
+	return true
+}
+
+func nonEmpty(field string, v *string) (string, error) {
+	s := strings.TrimSpace(*v)
+	if s == "" {
+		return "", fmt.Errorf("%s cannot be empty", field)
+	}
+	return s, nil
+}
+
+func (h *Handler) loadBuilding(c *gin.Context) (db_models.Building, bool) {
+	var building db_models.Building
+	id, err := strconv.Atoi(c.Param("buildingId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid building id"})
+		return building, false
+	}
+	if err := h.DB.Model(&building).Where("id = ?", id).Select(); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "building not found"})
+		return building, false
+	}
+	return building, true
+}
+
+func (h *Handler) loadRoom(c *gin.Context) (db_models.Room, bool) {
+	var room db_models.Room
+	id, err := strconv.Atoi(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room id"})
+		return room, false
+	}
+	if err := h.DB.Model(&room).Relation("Building").Where("room.id = ?", id).Select(); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+		return room, false
+	}
+	return room, true
+}
+
+func (h *Handler) orgShelf(c *gin.Context) (db_models.Shelf, bool) {
+	var shelf db_models.Shelf
+	err := h.DB.Model(&shelf).
+		Where("id = ?", c.Param("shelfId")).
+		Where("owned_by = ?", c.Param("orgId")).
+		Select()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shelf not found"})
+		return shelf, false
+	}
+	return shelf, true
+}
+
+// checkOwner answers 403 when a building or room belongs to another
+// organisation. Those without an owner, which predate owned_by and could not be
+// backfilled, may only be changed by super-admins.
+func (h *Handler) checkOwner(c *gin.Context, what string, ownedBy string) bool {
+	if ownedBy == "" {
+		if user, ok := currentUser(c); ok && h.isSuperAdmin(user) && auth.TokenAllowsSuperAdmin(c) {
+			return true
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": what + " has no owner", "details": "super-admin only"})
+		return false
+	}
+	if ownedBy != c.Param("orgId") {
+		c.JSON(http.StatusForbidden, gin.H{"error": what + " belongs to another organisation", "organisation": ownedBy})
+		return false
+	}
+	return true
+}
+
+// checkNotShared answers 403 when the shelves hold shelves of another organisation.
+func (h *Handler) checkNotShared(c *gin.Context, what string, shelves string, arg interface{}) bool {
+	shared, err := h.sharedWithOthers(shelves, arg, c.Param("orgId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if shared {
+		c.JSON(http.StatusForbidden, gin.H{"error": what + " holds shelves of other organisations"})
+		return false
+	}
+	return true
+}
+
+// @Summary Get a building
+// @Description Get a single building
+// @Tags buildings
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param buildingId path int true "Building ID"
+// @Success 200 {object} api_objects.Building
+// @Router /organisations/{orgId}/buildings/{buildingId} [get]
+func (h *Handler) GetBuilding(c *gin.Context) {
+	building, ok := h.loadBuilding(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, toBuilding(building))
+}
+
+// @Summary Update a building
+// @Description Change the name, campus or GPS position of a building. Only the owner may change a building, and only while it holds no shelves of other organisations. Buildings without an owner can only be changed by super-admins.
+// @Tags buildings
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param buildingId path int true "Building ID"
+// @Param building body api_objects.UpdateBuildingRequest true "Update details"
+// @Success 200 {object} api_objects.Building
+// @Router /organisations/{orgId}/buildings/{buildingId} [patch]
+// @Router /organisations/{orgId}/buildings/{buildingId} [put]
+func (h *Handler) UpdateBuilding(c *gin.Context) {
+	building, ok := h.loadBuilding(c)
+	if !ok {
+		return
+	}
+	var req api_objects.UpdateBuildingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.checkOwner(c, "building", building.OwnedBy) || !h.checkNotShared(c, "building", buildingShelves, building.ID) {
+		return
+	}
+	before := building
+	if req.Name != nil {
+		name, err := nonEmpty("name", req.Name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		building.Name = name
+	}
+	if req.Campus != nil {
+		building.Campus = *req.Campus
+	}
+	if req.GPS != nil {
+		building.GPS = *req.GPS
+	}
+	building.UpdateDate = time.Now()
+	if _, err := h.DB.Model(&building).WherePK().Update(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "building", EntityID: building.ID,
+		Organisation: c.Param("orgId"), Before: before, After: building,
+	})
+	c.JSON(http.StatusOK, toBuilding(building))
+}
+
+// @Summary Delete a building
+// @Description Delete a building with its rooms and shelves. Refused while it holds rooms of other organisations, and while it holds inventory, unless cascade=true deletes the items (only those never borrowed or moved) or relocate moves them to another shelf unit of the organisation.
+// @Tags buildings
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param buildingId path int true "Building ID"
+// @Param cascade query bool false "Delete the items inside"
+// @Param relocate query string false "Shelf unit to move the items to"
+// @Success 204
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/buildings/{buildingId} [delete]
+func (h *Handler) DeleteBuilding(c *gin.Context) {
+	building, ok := h.loadBuilding(c)
+	if !ok {
+		return
+	}
+	if !h.checkOwner(c, "building", building.OwnedBy) || !h.checkNotShared(c, "building", buildingShelves, building.ID) {
+		return
+	}
+	othersRooms, err := h.DB.Model((*db_models.Room)(nil)).
+		Where("building_id = ?", building.ID).
+		Where("owned_by <> ?", c.Param("orgId")).
+		Exists()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if othersRooms {
+		c.JSON(http.StatusForbidden, gin.H{"error": "building holds rooms of other organisations"})
+		return
+	}
+	r, ok := h.parseRemoval(c, buildingShelves, building.ID)
+	if !ok {
+		return
+	}
+	ok = h.removeLocation(c, func(tx *pg.Tx) ([]db_models.Attachment, error) {
+		attachments, err := clearShelves(tx, buildingShelves, building.ID, r)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Model((*db_models.Room)(nil)).Where("building_id = ?", building.ID).Delete(); err != nil {
+			return nil, err
+		}
+		_, err = tx.Model(&building).WherePK().Delete()
+		return attachments, err
+	})
+	if !ok {
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "building", EntityID: building.ID,
+		Organisation: c.Param("orgId"), Before: building, After: removalAudit(r),
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Get a room
+// @Description Get a single room with its building
+// @Tags rooms
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param roomId path int true "Room ID"
+// @Success 200 {object} api_objects.Room
+// @Router /organisations/{orgId}/rooms/{roomId} [get]
+func (h *Handler) GetRoom(c *gin.Context) {
+	room, ok := h.loadRoom(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, toRoom(room))
+}
+
+// @Summary Update a room
+// @Description Change the name, floor or number of a room, or move it to another building. Only the owner may change a room, and only while it holds no shelves of other organisations. Rooms without an owner can only be changed by super-admins.
+// @Tags rooms
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param roomId path int true "Room ID"
+// @Param room body api_objects.UpdateRoomRequest true "Update details"
+// @Success 200 {object} api_objects.Room
+// @Router /organisations/{orgId}/rooms/{roomId} [patch]
+// @Router /organisations/{orgId}/rooms/{roomId} [put]
+func (h *Handler) UpdateRoom(c *gin.Context) {
+	room, ok := h.loadRoom(c)
+	if !ok {
+		return
+	}
+	var req api_objects.UpdateRoomRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.checkOwner(c, "room", room.OwnedBy) || !h.checkNotShared(c, "room", roomShelves, room.ID) {
+		return
+	}
+	before := room
+	for _, f := range []struct {
+		name  string
+		value *string
+		dst   *string
+	}{
+		{"floor", req.Floor, &room.Floor},
+		{"number", req.Number, &room.Number},
+	} {
+		if f.value == nil {
+			continue
+		}
+		v, err := nonEmpty(f.name, f.value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		*f.dst = v
+	}
+	if req.Name != nil {
+		room.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.BuildingID != nil && *req.BuildingID != room.BuildingID {
+		var building db_models.Building
+		if err := h.DB.Model(&building).Where("id = ?", *req.BuildingID).Select(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "building not found"})
+			return
+		}
+		room.BuildingID = building.ID
+		room.Building = &building
+	}
+	room.UpdateDate = time.Now()
+	if _, err := h.DB.Model(&room).WherePK().Update(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "room", EntityID: room.ID,
+		Organisation: c.Param("orgId"), Before: before, After: room,
+	})
+	c.JSON(http.StatusOK, toRoom(room))
+}
+
+// @Summary Delete a room
+// @Description Delete a room with its shelves. Refused while it holds inventory, unless cascade=true deletes the items (only those never borrowed or moved) or relocate moves them to another shelf unit of the organisation.
+// @Tags rooms
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param roomId path int true "Room ID"
+// @Param cascade query bool false "Delete the items inside"
+// @Param relocate query string false "Shelf unit to move the items to"
+// @Success 204
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/rooms/{roomId} [delete]
+func (h *Handler) DeleteRoom(c *gin.Context) {
+	room, ok := h.loadRoom(c)
+	if !ok {
+		return
+	}
+	if !h.checkOwner(c, "room", room.OwnedBy) || !h.checkNotShared(c, "room", roomShelves, room.ID) {
+		return
+	}
+	r, ok := h.parseRemoval(c, roomShelves, room.ID)
+	if !ok {
+		return
+	}
+	ok = h.removeLocation(c, func(tx *pg.Tx) ([]db_models.Attachment, error) {
+		attachments, err := clearShelves(tx, roomShelves, room.ID, r)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Model(&room).WherePK().Delete()
+		return attachments, err
+	})
+	if !ok {
+		return
+	}
+	room.Building = nil
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "room", EntityID: room.ID,
+		Organisation: c.Param("orgId"), Before: room, After: removalAudit(r),
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Get a shelf
+// @Description Get a shelf of the organisation with its columns and shelf units
+// @Tags shelves
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param shelfId path string true "Shelf ID"
+// @Success 200 {object} api_objects.Shelf
+// @Router /organisations/{orgId}/shelves/{shelfId} [get]
+func (h *Handler) GetShelf(c *gin.Context) {
+	shelf, err := h.GetShelfHelper(c.Param("shelfId"), c.Param("orgId"))
+	if errors.Is(err, pg.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shelf not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, shelf)
+}
+
+// @Summary Update a shelf
+// @Description Rename a shelf or move it to another room
+// @Tags shelves
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param shelfId path string true "Shelf ID"
+// @Param shelf body api_objects.UpdateShelfRequest true "Update details"
+// @Success 200 {object} api_objects.Shelf
+// @Router /organisations/{orgId}/shelves/{shelfId} [patch]
+// @Router /organisations/{orgId}/shelves/{shelfId} [put]
+func (h *Handler) UpdateShelf(c *gin.Context) {
+	shelf, ok := h.orgShelf(c)
+	if !ok {
+		return
+	}
+	var req api_objects.UpdateShelfRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before := shelf
+	if req.Name != nil {
+		name, err := nonEmpty("name", req.Name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		shelf.Name = name
+	}
+	if req.RoomID != nil {
+		exists, err := h.DB.Model((*db_models.Room)(nil)).Where("id = ?", *req.RoomID).Exists()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "room not found"})
+			return
+		}
+		shelf.RoomID = *req.RoomID
+	}
+	shelf.UpdateDate = time.Now()
+	if _, err := h.DB.Model(&shelf).Column("name", "room_id", "update_date").WherePK().Update(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "shelf", EntityID: shelf.ID,
+		Organisation: shelf.OwnedBy, Before: before, After: shelf,
+	})
+	h.GetShelf(c)
+}
+
+// @Summary Delete a shelf
+// @Description Delete a shelf with its columns and shelf units. Refused while it holds inventory, unless cascade=true deletes the items (only those never borrowed or moved) or relocate moves them to another shelf unit of the organisation.
+// @Tags shelves
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param shelfId path string true "Shelf ID"
+// @Param cascade query bool false "Delete the items on the shelf"
+// @Param relocate query string false "Shelf unit to move the items to"
+// @Success 204
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/shelves/{shelfId} [delete]
+func (h *Handler) DeleteShelf(c *gin.Context) {
+	shelf, ok := h.orgShelf(c)
+	if !ok {
+		return
+	}
+	r, ok := h.parseRemoval(c, singleShelf, shelf.ID)
+	if !ok {
+		return
+	}
+	ok = h.removeLocation(c, func(tx *pg.Tx) ([]db_models.Attachment, error) {
+		return clearShelves(tx, singleShelf, shelf.ID, r)
+	})
+	if !ok {
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "shelf", EntityID: shelf.ID,
+		Organisation: shelf.OwnedBy, Before: shelf, After: removalAudit(r),
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// removalAudit records what happened to the items of a deleted location.
+func removalAudit(r removal) gin.H {
+	if r.relocate != nil {
+		return gin.H{"relocated_to": r.relocate.ID}
+	}
+	return gin.H{"cascade": r.cascade}
+}
+
+// checkLayout validates a shelf layout before it is applied: IDs must be
+// unique and every element slim or high.
+func checkLayout(columns []api_objects.ColumnElementRequest) error {
+	seen := map[string]bool{}
+	for _, col := range columns {
+		if strings.TrimSpace(col.ID) == "" {
+			return errors.New("column id cannot be empty")
+		}
+		if seen["c:"+col.ID] {
+			return fmt.Errorf("column %s is listed twice", col.ID)
+		}
+		seen["c:"+col.ID] = true
+		for _, el := range col.Elements {
+			if strings.TrimSpace(el.ID) == "" {
+				return errors.New("shelf unit id cannot be empty")
+			}
+			if seen["u:"+el.ID] {
+				return fmt.Errorf("shelf unit %s is listed twice", el.ID)
+			}
+			seen["u:"+el.ID] = true
+			if el.Type != "slim" && el.Type != "high" {
+				return fmt.Errorf("shelf unit %s: type must be slim or high", el.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// @Summary Edit the layout of a shelf
+// @Description Replace the columns and shelf units of a shelf in one step. Units are listed top to bottom and keep their ID, so items stay on them when they are moved, reordered or change type. Columns and units left out are removed; removing a unit that still holds items is refused.
+// @Tags shelves
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param shelfId path string true "Shelf ID"
+// @Param layout body api_objects.ShelfLayoutRequest true "New layout"
+// @Success 200 {object} api_objects.Shelf
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/shelves/{shelfId}/layout [put]
+func (h *Handler) UpdateShelfLayout(c *gin.Context) {
+	var req api_objects.ShelfLayoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkLayout(req.Columns); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before, err := h.GetShelfHelper(c.Param("shelfId"), c.Param("orgId"))
+	if errors.Is(err, pg.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shelf not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	columns := make([]db.ColumnInput, len(req.Columns))
+	for i, col := range req.Columns {
+		elements := make([]db.ShelfElementInput, len(col.Elements))
+		for j, el := range col.Elements {
+			elements[j] = db.ShelfElementInput{ID: el.ID, Type: el.Type}
+		}
+		columns[i] = db.ColumnInput{ID: col.ID, Elements: elements}
+	}
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		return db.SetShelfLayout(tx, before.ID, columns)
+	})
+	if errors.Is(err, db.ErrUnitNotEmpty) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "details": "move the items to another shelf unit first"})
+		return
+	}
+	if errors.Is(err, db.ErrLayoutIDTaken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	after, err := h.GetShelfHelper(before.ID, c.Param("orgId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "shelf", EntityID: before.ID,
+		Organisation: c.Param("orgId"), Before: before.Columns, After: after.Columns,
+	})
+	c.JSON(http.StatusOK, after)
+}
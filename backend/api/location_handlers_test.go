@@ -0,0 +1,382 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/config"
+	"lagertool.com/main/db_models"
+)
+
+func TestParseRemoval(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	testCases := []struct {
+		name    string
+		query   string
+		ok      bool
+		cascade bool
+	}{
+		{"no options", "", true, false},
+		{"cascade", "?cascade=true", true, true},
+		{"cascade off", "?cascade=false", true, false},
+		{"invalid cascade", "?cascade=maybe", false, false},
+		{"cascade and relocate", "?cascade=true&relocate=SU-1", false, false},
+	}
+	h := NewHandler(nil, nil)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodDelete, "/"+tc.query, nil)
+			r, ok := h.parseRemoval(c, singleShelf, "S-1")
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.cascade, r.cascade)
+			if !tc.ok {
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
+
+func TestLocations(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Location Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+	for _, location := range []interface{}{hier.Building, hier.Room} {
+		_, err = dbCon.Model(location).Set("owned_by = ?", org.Name).WherePK().Update()
+		assert.NoError(t, err)
+	}
+
+	// A second room in the building whose shelf takes the items of the first.
+	room := &db_models.Room{Name: "Other Room", Floor: "1", Number: "101", OwnedBy: org.Name, BuildingID: hier.Building.ID, UpdateDate: time.Now()}
+	_, err = dbCon.Model(room).Insert()
+	assert.NoError(t, err)
+	shelf := &db_models.Shelf{ID: "L-S-2", Name: "Other Shelf", OwnedBy: org.Name, RoomID: room.ID, UpdateDate: time.Now()}
+	_, err = dbCon.Model(shelf).Insert()
+	assert.NoError(t, err)
+	column := &db_models.Column{ID: "L-C-2", ShelfID: shelf.ID}
+	_, err = dbCon.Model(column).Insert()
+	assert.NoError(t, err)
+	unit := &db_models.ShelfUnit{ID: "L-SU-2", ColumnID: column.ID}
+	_, err = dbCon.Model(unit).Insert()
+	assert.NoError(t, err)
+
+	defer func() {
+		_, _ = dbCon.Model((*db_models.Inventory)(nil)).Where("id = ?", hier.Inventory.ID).Delete()
+		_, _ = dbCon.Model(unit).WherePK().Delete()
+		_, _ = dbCon.Model(column).WherePK().Delete()
+		_, _ = dbCon.Model(shelf).WherePK().Delete()
+		_, _ = dbCon.Model(room).WherePK().Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.GET("/organisations/:orgId/buildings/:buildingId", h.GetBuilding)
+	router.PATCH("/organisations/:orgId/buildings/:buildingId", h.UpdateBuilding)
+	router.DELETE("/organisations/:orgId/buildings/:buildingId", h.DeleteBuilding)
+	router.PATCH("/organisations/:orgId/rooms/:roomId", h.UpdateRoom)
+	router.DELETE("/organisations/:orgId/rooms/:roomId", h.DeleteRoom)
+	router.PATCH("/organisations/:orgId/shelves/:shelfId", h.UpdateShelf)
+	router.DELETE("/organisations/:orgId/shelves/:shelfId", h.DeleteShelf)
+
+	base := "/organisations/" + org.Name
+	buildingURL := base + "/buildings/" + strconv.Itoa(hier.Building.ID)
+	testCases := []struct {
+		name         string
+		method       string
+		url          string
+		body         string
+		expectedCode int
+	}{
+		{"rename building", http.MethodPatch, buildingURL, `{"name": "Renamed Building", "gps": "47.37,8.54"}`, http.StatusOK},
+		{"empty building name", http.MethodPatch, buildingURL, `{"name": " "}`, http.StatusBadRequest},
+		{"unknown building", http.MethodPatch, base + "/buildings/0", `{"name": "x"}`, http.StatusNotFound},
+		{"room to unknown building", http.MethodPatch, base + "/rooms/" + strconv.Itoa(hier.Room.ID), `{"buildingId": 0}`, http.StatusBadRequest},
+		{"rename shelf", http.MethodPatch, base + "/shelves/" + hier.Shelf.ID, `{"name": "Renamed Shelf"}`, http.StatusOK},
+		{"shelf of another organisation", http.MethodPatch, "/organisations/Other/shelves/" + hier.Shelf.ID, `{"name": "x"}`, http.StatusNotFound},
+		{"delete shelf with items", http.MethodDelete, base + "/shelves/" + hier.Shelf.ID, "", http.StatusConflict},
+		{"relocate into the room itself", http.MethodDelete, base + "/rooms/" + strconv.Itoa(hier.Room.ID) + "?relocate=" + hier.ShelfUnit.ID, "", http.StatusBadRequest},
+		{"relocate to unknown unit", http.MethodDelete, base + "/rooms/" + strconv.Itoa(hier.Room.ID) + "?relocate=no-such-unit", "", http.StatusBadRequest},
+		{"delete room relocating items", http.MethodDelete, base + "/rooms/" + strconv.Itoa(hier.Room.ID) + "?relocate=" + unit.ID, "", http.StatusNoContent},
+		{"delete building with items", http.MethodDelete, buildingURL, "", http.StatusConflict},
+		{"delete building with its items", http.MethodDelete, buildingURL + "?cascade=true", "", http.StatusNoContent},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code, w.Body.String())
+		})
+		switch tc.name {
+		case "rename building":
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, buildingURL, nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			var building api_objects.Building
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &building))
+			assert.Equal(t, "Renamed Building", building.Name)
+			assert.Equal(t, "47.37,8.54", building.GPS)
+		case "delete room relocating items":
+			var inv db_models.Inventory
+			assert.NoError(t, dbCon.Model(&inv).Where("id = ?", hier.Inventory.ID).Select())
+			assert.Equal(t, unit.ID, inv.ShelfUnitID)
+			assert.Equal(t, shelf.ID, inv.ShelfID)
+			exists, err := dbCon.Model((*db_models.Shelf)(nil)).Where("id = ?", hier.Shelf.ID).Exists()
+			assert.NoError(t, err)
+			assert.False(t, exists)
+		}
+	}
+
+	count, err := dbCon.Model((*db_models.Inventory)(nil)).Where("id = ?", hier.Inventory.ID).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = dbCon.Model((*db_models.Room)(nil)).Where("building_id = ?", hier.Building.ID).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestCheckLayout(t *testing.T) {
+	col := func(id string, els ...api_objects.ShelfElementRequest) api_objects.ColumnElementRequest {
+		return api_objects.ColumnElementRequest{ID: id, Elements: els}
+	}
+	slim := func(id string) api_objects.ShelfElementRequest {
+		return api_objects.ShelfElementRequest{ID: id, Type: "slim"}
+	}
+	testCases := []struct {
+		name    string
+		columns []api_objects.ColumnElementRequest
+		ok      bool
+	}{
+		{"empty shelf", nil, true},
+		{"valid", []api_objects.ColumnElementRequest{col("C1", slim("U1"), api_objects.ShelfElementRequest{ID: "U2", Type: "high"}), col("C2")}, true},
+		{"duplicate column", []api_objects.ColumnElementRequest{col("C1"), col("C1")}, false},
+		{"unit in two columns", []api_objects.ColumnElementRequest{col("C1", slim("U1")), col("C2", slim("U1"))}, false},
+		{"unknown type", []api_objects.ColumnElementRequest{col("C1", api_objects.ShelfElementRequest{ID: "U1", Type: "wide"})}, false},
+		{"blank unit id", []api_objects.ColumnElementRequest{col("C1", slim(" "))}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkLayout(tc.columns)
+			if tc.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestShelfLayout(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Layout Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+
+	defer func() {
+		_, _ = dbCon.Model((*db_models.ShelfUnit)(nil)).Where("id IN ('H-SU-2', 'H-SU-3')").Delete()
+		_, _ = dbCon.Model((*db_models.Column)(nil)).Where("id = 'H-C-2'").Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.PUT("/organisations/:orgId/shelves/:shelfId/layout", h.UpdateShelfLayout)
+	url := "/organisations/" + org.Name + "/shelves/" + hier.Shelf.ID + "/layout"
+
+	testCases := []struct {
+		name         string
+		body         string
+		expectedCode int
+		expected     []api_objects.ShelfColumn
+	}{
+		{
+			name:         "add a column and insert units",
+			body:         `{"columns": [{"id": "H-C-1", "elements": [{"id": "H-SU-2", "type": "slim"}, {"id": "H-SU-1", "type": "slim"}]}, {"id": "H-C-2", "elements": [{"id": "H-SU-3", "type": "high"}]}]}`,
+			expectedCode: http.StatusOK,
+			expected: []api_objects.ShelfColumn{
+				{ID: "H-C-1", Elements: []api_objects.ShelfElement{{ID: "H-SU-2", Type: "slim"}, {ID: "H-SU-1", Type: "slim"}}},
+				{ID: "H-C-2", Elements: []api_objects.ShelfElement{{ID: "H-SU-3", Type: "high"}}},
+			},
+		},
+		{
+			name:         "remove a unit holding items",
+			body:         `{"columns": [{"id": "H-C-1", "elements": [{"id": "H-SU-2", "type": "slim"}]}]}`,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "reorder, retype and remove a column",
+			body:         `{"columns": [{"id": "H-C-1", "elements": [{"id": "H-SU-1", "type": "high"}, {"id": "H-SU-3", "type": "slim"}]}]}`,
+			expectedCode: http.StatusOK,
+			expected: []api_objects.ShelfColumn{
+				{ID: "H-C-1", Elements: []api_objects.ShelfElement{{ID: "H-SU-1", Type: "high"}, {ID: "H-SU-3", Type: "slim"}}},
+			},
+		},
+		{
+			name:         "invalid type",
+			body:         `{"columns": [{"id": "H-C-1", "elements": [{"id": "H-SU-1", "type": "wide"}]}]}`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code, w.Body.String())
+			if tc.expected != nil {
+				var shelf api_objects.Shelf
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &shelf))
+				assert.Equal(t, tc.expected, shelf.Columns)
+			}
+		})
+	}
+
+	// The item stayed on its unit through all the changes.
+	var inv db_models.Inventory
+	assert.NoError(t, dbCon.Model(&inv).Where("id = ?", hier.Inventory.ID).Select())
+	assert.Equal(t, hier.ShelfUnit.ID, inv.ShelfUnitID)
+}
+
+func TestLocationOwnership(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	owner := &db_models.Organisation{Name: "Owner Test Org"}
+	other := &db_models.Organisation{Name: "Other Test Org"}
+	_, err := dbCon.Model(owner, other).Insert()
+	assert.NoError(t, err)
+	defer func() {
+		_, _ = dbCon.Model((*db_models.Room)(nil)).Where("owned_by IN (?, ?)", owner.Name, other.Name).Delete()
+		_, _ = dbCon.Model((*db_models.Building)(nil)).Where("owned_by IN (?, ?)", owner.Name, other.Name).Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name IN (?, ?)", owner.Name, other.Name).Delete()
+		_, _ = dbCon.Model(owner).WherePK().Delete()
+		_, _ = dbCon.Model(other).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.GET("/organisations/:orgId/buildings", h.GetBuildings)
+	router.GET("/organisations/:orgId/rooms", h.GetRooms)
+	router.POST("/organisations/:orgId/buildings", h.CreateBuilding)
+	router.PATCH("/organisations/:orgId/buildings/:buildingId", h.UpdateBuilding)
+	router.POST("/organisations/:orgId/buildings/:buildingId/rooms", h.CreateRoom)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	ownerURL := "/organisations/" + url.PathEscape(owner.Name)
+	otherURL := "/organisations/" + url.PathEscape(other.Name)
+
+	w := do(http.MethodPost, ownerURL+"/buildings", `{"name": "Empty Building"}`)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var building api_objects.Building
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &building))
+	assert.Equal(t, owner.Name, building.OwnedBy)
+	buildingPath := "/buildings/" + strconv.Itoa(building.ID)
+
+	// The other organisation adds a room to the building.
+	w = do(http.MethodPost, otherURL+buildingPath+"/rooms", `{"floor": "2", "number": "201"}`)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = do(http.MethodPost, otherURL+"/buildings/0/rooms", `{"floor": "2", "number": "202"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	listed := func(base, what string, id int) bool {
+		w := do(http.MethodGet, base+"/"+what, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var res []struct {
+			ID int `json:"id"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		for _, r := range res {
+			if r.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	var room db_models.Room
+	assert.NoError(t, dbCon.Model(&room).Where("building_id = ?", building.ID).Select())
+	assert.Equal(t, other.Name, room.OwnedBy)
+
+	assert.True(t, listed(ownerURL, "buildings", building.ID))
+	assert.True(t, listed(otherURL, "buildings", building.ID), "buildings holding a room of the organisation are listed")
+	assert.True(t, listed(otherURL, "rooms", room.ID))
+	assert.False(t, listed(ownerURL, "rooms", room.ID))
+
+	w = do(http.MethodPatch, otherURL+buildingPath, `{"name": "Taken Over"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = do(http.MethodPatch, ownerURL+buildingPath, `{"campus": "North"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestUnownedLocations(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Unowned Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+	admin := &db_models.User{Email: "unowned-admin@example.com", Name: "Org Admin"}
+	root := &db_models.User{Email: "unowned-root@example.com", Name: "Root"}
+	_, err = dbCon.Model(admin, root).Insert()
+	assert.NoError(t, err)
+	building := &db_models.Building{Name: "Legacy Building", UpdateDate: time.Now()}
+	_, err = dbCon.Model(building).Insert()
+	assert.NoError(t, err)
+	defer func() {
+		_, _ = dbCon.Model(building).WherePK().Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		_, _ = dbCon.Model((*db_models.User)(nil)).Where("id IN (?, ?)", admin.ID, root.ID).Delete()
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, &config.Config{Auth: config.AuthConfig{SuperAdmins: []string{root.Email}}})
+	router.PATCH("/as/admin/organisations/:orgId/buildings/:buildingId", withUser(admin), h.UpdateBuilding)
+	router.PATCH("/as/root/organisations/:orgId/buildings/:buildingId", withUser(root), h.UpdateBuilding)
+
+	rename := func(as string) int {
+		w := httptest.NewRecorder()
+		path := "/as/" + as + "/organisations/" + url.PathEscape(org.Name) + "/buildings/" + strconv.Itoa(building.ID)
+		req, _ := http.NewRequest(http.MethodPatch, path, strings.NewReader(`{"name": "Claimed"}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusForbidden, rename("admin"), "organisations cannot take over unowned buildings")
+	assert.Equal(t, http.StatusOK, rename("root"))
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/auth"
+	"lagertool.com/main/db_models"
+)
+
+// @Summary Get my messages
+// @Description Get all messages (user and admin) on the logged-in user's requests, sorted by timestamp
+// @Tags me
+// @Produce  json
+// @Success 200 {array} api_objects.Message
+// @Router /me/messages [get]
+func (h *Handler) GetMyMessages(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	var dbResAdmin []db_models.RequestReview
+	var dbResMember []db_models.UserRequestMessage
+
+	err := h.DB.Model(&dbResMember).Relation("User").
+		Where("user_request_message.request_id IN (SELECT id FROM request WHERE user_id = ?)", user.ID).
+		Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = h.DB.Model(&dbResAdmin).Relation("User").
+		Where("request_review.request_id IN (SELECT id FROM request WHERE user_id = ?)", user.ID).
+		Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, toMessages(dbResAdmin, dbResMember))
+}
+
+// @Summary Get the logged-in user
+// @Description Get the profile of the logged-in user, the organisations they hold special rights for and their active sessions
+// @Tags me
+// @Produce  json
+// @Success 200 {object} api_objects.Me
+// @Router /me [get]
+func (h *Handler) GetMe(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	orgs, err := h.adminOrganisations(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var sessions []db_models.Session
+	err = h.DB.Model(&sessions).
+		Where("user_id = ?", user.ID).
+		Where("expires_at > ?", time.Now()).
+		Order("created_at DESC").
+		Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	current := ""
+	if v, ok := c.Get("session"); ok {
+		if s, ok := v.(*db_models.Session); ok {
+			current = s.Handle
+		}
+	}
+	res := api_objects.Me{
+		User:          *user,
+		Organisations: orgs,
+		Sessions:      make([]api_objects.SessionInfo, 0, len(sessions)),
+		CSRFToken:     c.GetString("csrfToken"),
+	}
+	if res.Organisations == nil {
+		res.Organisations = []string{}
+	}
+	for _, s := range sessions {
+		res.Sessions = append(res.Sessions, api_objects.SessionInfo{
+			ID:        s.Handle,
+			UserIP:    s.UserIP.String(),
+			UserAgent: s.UserAgent,
+			CreatedAt: s.CreatedAt,
+			ExpiresAt: s.ExpiresAt,
+			Current:   s.Handle == current,
+		})
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary Revoke one of my sessions
+// @Description Log out a device of the logged-in user by deleting its session
+// @Tags me
+// @Produce  json
+// @Param id path string true "Session handle from GET /me"
+// @Success 204
+// @Router /me/sessions/{id} [delete]
+func (h *Handler) DeleteMySession(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	handle := c.Param("id")
+	res, err := h.DB.Model((*db_models.Session)(nil)).
+		Where("handle = ?", handle).
+		Where("user_id = ?", user.ID).
+		Delete()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if res.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{Action: audit.ActionDelete, Entity: "session", EntityID: handle})
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Create an API token
+// @Description Create a personal access token for scripts and kiosks. Scopes are "read", "write" and "org-admin:<organisation>". The token is only returned in this response.
+// @Tags me
+// @Accept  json
+// @Produce  json
+// @Param token body api_objects.CreateAPIToken true "Token"
+// @Success 201 {object} api_objects.APIToken
+// @Router /me/tokens [post]
+func (h *Handler) CreateMyToken(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	if auth.APITokenFromContext(c) != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden", "details": "API tokens cannot create tokens"})
+		return
+	}
+	var req api_objects.CreateAPIToken
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid scope " + scope})
+			return
+		}
+		if org, ok := strings.CutPrefix(scope, auth.ScopeOrgAdminPrefix); ok {
+			allowed, err := h.hasSpecialRights(user.ID, org)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !allowed {
+				c.JSON(http.StatusForbidden, gin.H{"error": "forbidden", "details": "missing special rights for organisation", "organisation": org})
+				return
+			}
+		}
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+		return
+	}
+
+	plain, hash, err := auth.NewAPIToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not generate token"})
+		return
+	}
+	token := db_models.APIToken{
+		UserID:    user.ID,
+		Name:      req.Name,
+		TokenHash: hash,
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now(),
+	}
+	if req.ExpiresAt != nil {
+		token.ExpiresAt = *req.ExpiresAt
+	}
+	if _, err := h.DB.Model(&token).Insert(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := toAPIToken(token)
+	audit.Record(h.DB, c, audit.Event{Action: audit.ActionCreate, Entity: "api_token", EntityID: token.ID, After: res})
+	res.Token = plain
+	c.JSON(http.StatusCreated, res)
+}
+
+// @Summary List my API tokens
+// @Description List the personal access tokens of the logged-in user, without the secrets
+// @Tags me
+// @Produce  json
+// @Success 200 {array} api_objects.APIToken
+// @Router /me/tokens [get]
+func (h *Handler) GetMyTokens(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	var tokens []db_models.APIToken
+	err := h.DB.Model(&tokens).Where("user_id = ?", user.ID).Order("created_at DESC").Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.APIToken, 0, len(tokens))
+	for _, t := range tokens {
+		res = append(res, toAPIToken(t))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary Revoke an API token
+// @Description Delete one of the logged-in user's personal access tokens
+// @Tags me
+// @Produce  json
+// @Param id path int true "Token ID"
+// @Success 204
+// @Router /me/tokens/{id} [delete]
+func (h *Handler) DeleteMyToken(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	tokenId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+		return
+	}
+	res, err := h.DB.Model((*db_models.APIToken)(nil)).
+		Where("id = ?", tokenId).
+		Where("user_id = ?", user.ID).
+		Delete()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if res.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{Action: audit.ActionDelete, Entity: "api_token", EntityID: tokenId})
+	c.Status(http.StatusNoContent)
+}
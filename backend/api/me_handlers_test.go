@@ -0,0 +1,288 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db_models"
+)
+
+func TestMeScopedRoutes(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+	authHandler := newTestAuthHandler(t, dbCon)
+	SetupRoutes(router, dbCon, nil, authHandler, true)
+
+	org := &db_models.Organisation{Name: "Me Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+
+	alice := &db_models.User{Email: "alice-me@example.com", Name: "Alice Me"}
+	bob := &db_models.User{Email: "bob-me@example.com", Name: "Bob Me"}
+	_, err = dbCon.Model(alice, bob).Insert()
+	assert.NoError(t, err)
+
+	now := time.Now()
+	aliceReq := &db_models.Request{UserID: alice.ID, StartDate: now, EndDate: now.Add(24 * time.Hour), Note: "Alice request", State: "requested", CreatedAt: now, OrganisationName: org.Name}
+	bobReq := &db_models.Request{UserID: bob.ID, StartDate: now, EndDate: now.Add(24 * time.Hour), Note: "Bob request", State: "requested", CreatedAt: now, OrganisationName: org.Name}
+	_, err = dbCon.Model(aliceReq, bobReq).Insert()
+	assert.NoError(t, err)
+
+	aliceMsg := &db_models.UserRequestMessage{UserID: alice.ID, RequestID: aliceReq.ID, Message: "Mine", TimeStamp: now}
+	bobMsg := &db_models.UserRequestMessage{UserID: bob.ID, RequestID: bobReq.ID, Message: "Not mine", TimeStamp: now}
+	_, err = dbCon.Model(aliceMsg, bobMsg).Insert()
+	assert.NoError(t, err)
+
+	aliceCookie := newTestSession(t, dbCon, alice)
+
+	defer func() {
+		ids := []int{aliceReq.ID, bobReq.ID}
+		_, _ = dbCon.Model((*db_models.UserRequestMessage)(nil)).Where("request_id IN (?)", pg.In(ids)).Delete()
+		_, _ = dbCon.Model((*db_models.Request)(nil)).Where("id IN (?)", pg.In(ids)).Delete()
+		_, _ = dbCon.Model((*db_models.Session)(nil)).Where("user_id = ?", alice.ID).Delete()
+		_, _ = dbCon.Model((*db_models.User)(nil)).Where("id IN (?)", pg.In([]int{alice.ID, bob.ID})).Delete()
+		_, _ = dbCon.Model(org).Where("name = ?", org.Name).Delete()
+	}()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		addSession(req, authHandler, aliceCookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("my requests only contain my own", func(t *testing.T) {
+		w := get("/me/requests")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var res []api_objects.BorrowRequest
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		if assert.Len(t, res, 1) {
+			assert.Equal(t, aliceReq.ID, res[0].ID)
+		}
+	})
+
+	t.Run("my messages only cover my requests", func(t *testing.T) {
+		w := get("/me/messages")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var res []api_objects.Message
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		if assert.Len(t, res, 1) {
+			assert.Equal(t, "Mine", res[0].Message)
+			assert.Equal(t, aliceReq.ID, res[0].RequestID)
+		}
+	})
+
+	t.Run("my cart resolves without a user id", func(t *testing.T) {
+		w := get("/me/cart?start=2025-01-01&end=2025-01-02")
+		assert.NotEqual(t, http.StatusForbidden, w.Code, w.Body.String())
+		assert.NotEqual(t, http.StatusUnauthorized, w.Code, w.Body.String())
+	})
+
+	t.Run("another user's cart is admin only", func(t *testing.T) {
+		w := get("/users/" + strconv.Itoa(bob.ID) + "/cart?start=2025-01-01&end=2025-01-02")
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	})
+
+	t.Run("borrow requests by user id are admin only", func(t *testing.T) {
+		w := get("/borrow_requests?userId=" + strconv.Itoa(bob.ID))
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	})
+}
+
+func TestGetMeAndRevokeSession(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+	authHandler := newTestAuthHandler(t, dbCon)
+	SetupRoutes(router, dbCon, nil, authHandler, true)
+
+	org := &db_models.Organisation{Name: "Me Profile Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+
+	alice := &db_models.User{Email: "alice-profile@example.com", Name: "Alice Profile"}
+	bob := &db_models.User{Email: "bob-profile@example.com", Name: "Bob Profile"}
+	_, err = dbCon.Model(alice, bob).Insert()
+	assert.NoError(t, err)
+
+	rights := &db_models.HasSpecialRightsFor{OrganisationName: org.Name, UserID: alice.ID}
+	_, err = dbCon.Model(rights).Insert()
+	assert.NoError(t, err)
+
+	aliceCookie := newTestSession(t, dbCon, alice)
+	otherDevice := newTestSession(t, dbCon, alice)
+	bobCookie := newTestSession(t, dbCon, bob)
+
+	defer func() {
+		_, _ = dbCon.Model((*db_models.Session)(nil)).Where("user_id IN (?)", pg.In([]int{alice.ID, bob.ID})).Delete()
+		_, _ = dbCon.Model(rights).Where("user_id = ?", alice.ID).Delete()
+		_, _ = dbCon.Model((*db_models.User)(nil)).Where("id IN (?)", pg.In([]int{alice.ID, bob.ID})).Delete()
+		_, _ = dbCon.Model(org).Where("name = ?", org.Name).Delete()
+	}()
+
+	send := func(method, url string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		addSession(req, authHandler, cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("profile, organisations and sessions", func(t *testing.T) {
+		w := send("GET", "/me", aliceCookie)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var res api_objects.Me
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, alice.ID, res.User.ID)
+		assert.Equal(t, []string{org.Name}, res.Organisations)
+		assert.Len(t, res.Sessions, 2)
+		for _, s := range res.Sessions {
+			assert.Equal(t, s.ID == testSessions[aliceCookie.Value].Handle, s.Current)
+		}
+	})
+
+	t.Run("csrf token is issued", func(t *testing.T) {
+		w := send("GET", "/me", aliceCookie)
+		var res api_objects.Me
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, authHandler.CSRFToken(testSessions[aliceCookie.Value].ID), res.CSRFToken)
+	})
+
+	t.Run("revoking without csrf token is rejected", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", "/me/sessions/"+testSessions[otherDevice.Value].Handle, nil)
+		req.AddCookie(aliceCookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	})
+
+	t.Run("cannot revoke another user's session", func(t *testing.T) {
+		w := send("DELETE", "/me/sessions/"+testSessions[bobCookie.Value].Handle, aliceCookie)
+		assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	})
+
+	t.Run("revoke another device", func(t *testing.T) {
+		w := send("DELETE", "/me/sessions/"+testSessions[otherDevice.Value].Handle, aliceCookie)
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+		w = send("GET", "/me", otherDevice)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+	})
+}
+
+func TestAPITokens(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+	authHandler := newTestAuthHandler(t, dbCon)
+	SetupRoutes(router, dbCon, nil, authHandler, true)
+
+	org := &db_models.Organisation{Name: "Token Test Org"}
+	otherOrg := &db_models.Organisation{Name: "Token Other Org"}
+	_, err := dbCon.Model(org, otherOrg).Insert()
+	assert.NoError(t, err)
+
+	admin := &db_models.User{Email: "admin-token@example.com", Name: "Token Admin"}
+	_, err = dbCon.Model(admin).Insert()
+	assert.NoError(t, err)
+	rights := &db_models.HasSpecialRightsFor{OrganisationName: org.Name, UserID: admin.ID}
+	_, err = dbCon.Model(rights).Insert()
+	assert.NoError(t, err)
+
+	cookie := newTestSession(t, dbCon, admin)
+
+	defer func() {
+		_, _ = dbCon.Model((*db_models.APIToken)(nil)).Where("user_id = ?", admin.ID).Delete()
+		_, _ = dbCon.Model((*db_models.Session)(nil)).Where("user_id = ?", admin.ID).Delete()
+		_, _ = dbCon.Model(rights).Where("user_id = ?", admin.ID).Delete()
+		_, _ = dbCon.Model(admin).WherePK().Delete()
+		_, _ = dbCon.Model((*db_models.Organisation)(nil)).Where("name IN (?)", pg.In([]string{org.Name, otherOrg.Name})).Delete()
+	}()
+
+	send := func(method, url, payload string, authn func(*http.Request)) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		authn(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	withCookie := func(req *http.Request) { addSession(req, authHandler, cookie) }
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+	create := func(payload string) api_objects.APIToken {
+		w := send("POST", "/me/tokens", payload, withCookie)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var res api_objects.APIToken
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res
+	}
+
+	readToken := create(`{"name": "kiosk", "scopes": ["read"]}`)
+	writeToken := create(`{"name": "script", "scopes": ["write"]}`)
+	adminToken := create(`{"name": "stock sync", "scopes": ["org-admin:` + org.Name + `"]}`)
+	expired := create(`{"name": "old", "scopes": ["read"], "expiresAt": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`)
+	_, err = dbCon.Model((*db_models.APIToken)(nil)).Set("expires_at = ?", time.Now().Add(-time.Minute)).Where("id = ?", expired.ID).Update()
+	assert.NoError(t, err)
+
+	orgBuildings := "/organisations/" + org.Name + "/buildings"
+
+	testCases := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		status int
+	}{
+		{"read token can read", "GET", "/me", readToken.Token, http.StatusOK},
+		{"read token cannot write", "POST", orgBuildings, readToken.Token, http.StatusForbidden},
+		{"write token is not an org admin", "POST", orgBuildings, writeToken.Token, http.StatusForbidden},
+		{"org-admin token acts for its organisation", "POST", orgBuildings, adminToken.Token, http.StatusBadRequest},
+		{"org-admin token does not cover other organisations", "POST", "/organisations/" + otherOrg.Name + "/buildings", adminToken.Token, http.StatusForbidden},
+		{"tokens cannot mint tokens", "POST", "/me/tokens", writeToken.Token, http.StatusForbidden},
+		{"expired token", "GET", "/me", expired.Token, http.StatusUnauthorized},
+		{"unknown token", "GET", "/me", "lgt_nope", http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := send(tc.method, tc.url, `{}`, bearer(tc.token))
+			assert.Equal(t, tc.status, w.Code, w.Body.String())
+		})
+	}
+
+	t.Run("org-admin scope needs the rights", func(t *testing.T) {
+		w := send("POST", "/me/tokens", `{"name": "x", "scopes": ["org-admin:`+otherOrg.Name+`"]}`, withCookie)
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	})
+
+	t.Run("invalid scope", func(t *testing.T) {
+		w := send("POST", "/me/tokens", `{"name": "x", "scopes": ["admin"]}`, withCookie)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	})
+
+	t.Run("list hides the secret", func(t *testing.T) {
+		w := send("GET", "/me/tokens", "", withCookie)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var res []api_objects.APIToken
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Len(t, res, 4)
+		for _, tok := range res {
+			assert.Empty(t, tok.Token)
+		}
+	})
+
+	t.Run("revoked token stops working", func(t *testing.T) {
+		w := send("DELETE", "/me/tokens/"+strconv.Itoa(readToken.ID), "", withCookie)
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		w = send("GET", "/me", "", bearer(readToken.Token))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+	})
+}
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+// maxOrgNameLength keeps organisation names usable in paths and token scopes.
+const maxOrgNameLength = 100
+
+var errLastAdmin = errors.New("the last admin of an organisation cannot be removed")
+
+// checkOrgName trims an organisation name and checks that it can be used as a
+// path segment.
+func checkOrgName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", errors.New("name cannot be empty")
+	case len(name) > maxOrgNameLength:
+		return "", fmt.Errorf("name is longer than %d characters", maxOrgNameLength)
+	case strings.ContainsAny(name, "/?#%"):
+		return "", errors.New("name cannot contain / ? # or %")
+	}
+	return name, nil
+}
+
+// @Summary Create an organisation
+// @Description Create an organisation. The caller becomes its first admin. Only super-admins and admins of an existing organisation may create one.
+// @Tags organisations
+// @Accept  json
+// @Produce  json
+// @Param organisation body api_objects.OrganisationRequest true "Organisation"
+// @Success 201 {object} db_models.Organisation
+// @Failure 409 {object} map[string]string
+// @Router /organisations [post]
+func (h *Handler) CreateOrganisation(c *gin.Context) {
+	var req api_objects.OrganisationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name, err := checkOrgName(req.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var org *db_models.Organisation
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		var err error
+		org, err = db.CreateOrganisation(tx, name, currentUserID(c))
+		return err
+	})
+	if errors.Is(err, db.ErrOrganisationExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "organisation", EntityID: org.Name,
+		Organisation: org.Name, After: org,
+	})
+	c.JSON(http.StatusCreated, org)
+}
+
+// @Summary Rename an organisation
+// @Description Rename an organisation. Shelves, borrow requests, categories, kits, admin rights, the audit log and API token scopes move to the new name. Organisations created by the login claim mapping are recreated under their old name unless the mapping is changed too.
+// @Tags organisations
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param organisation body api_objects.OrganisationRequest true "New name"
+// @Success 200 {object} db_models.Organisation
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId} [patch]
+// @Router /organisations/{orgId} [put]
+func (h *Handler) RenameOrganisation(c *gin.Context) {
+	var req api_objects.OrganisationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name, err := checkOrgName(req.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from := c.Param("orgId")
+	org := db_models.Organisation{Name: name}
+	if name == from {
+		c.JSON(http.StatusOK, org)
+		return
+	}
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		return db.RenameOrganisation(tx, from, name)
+	})
+	if errors.Is(err, pg.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organisation not found"})
+		return
+	}
+	if errors.Is(err, db.ErrOrganisationExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "organisation", EntityID: name,
+		Organisation: name, Before: db_models.Organisation{Name: from}, After: org,
+	})
+	c.JSON(http.StatusOK, org)
+}
+
+// @Summary Delete an organisation
+// @Description Delete an organisation with its admin rights. Refused while it still owns shelves, borrow requests, categories or kits.
+// @Tags organisations
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Success 204
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId} [delete]
+func (h *Handler) DeleteOrganisation(c *gin.Context) {
+	name := c.Param("orgId")
+	err := h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		return db.DeleteOrganisation(tx, name)
+	})
+	if errors.Is(err, pg.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organisation not found"})
+		return
+	}
+	if errors.Is(err, db.ErrOrganisationInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "organisation", EntityID: name,
+		Organisation: name, Before: db_models.Organisation{Name: name},
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary List the admins of an organisation
+// @Description List the users holding special rights for an organisation
+// @Tags organisations
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Success 200 {array} api_objects.OrganisationAdmin
+// @Router /organisations/{orgId}/admins [get]
+func (h *Handler) GetOrganisationAdmins(c *gin.Context) {
+	var rights []db_models.HasSpecialRightsFor
+	err := h.DB.Model(&rights).
+		Relation("User").
+		Where("organisation_name = ?", c.Param("orgId")).
+		Order("user_id").
+		Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.OrganisationAdmin, 0, len(rights))
+	for _, r := range rights {
+		res = append(res, toOrganisationAdmin(r))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary Add an admin to an organisation
+// @Description Grant a user special rights for an organisation
+// @Tags organisations
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param admin body api_objects.OrganisationAdminRequest true "User to add"
+// @Success 201 {object} api_objects.OrganisationAdmin
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/admins [post]
+func (h *Handler) AddOrganisationAdmin(c *gin.Context) {
+	var req api_objects.OrganisationAdminRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	org := c.Param("orgId")
+	exists, err := h.DB.Model((*db_models.Organisation)(nil)).Where("name = ?", org).Exists()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organisation not found"})
+		return
+	}
+	var user db_models.User
+	if err := h.DB.Model(&user).Where("id = ?", req.UserID).Select(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user not found"})
+		return
+	}
+	isAdmin, err := h.hasSpecialRights(user.ID, org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if isAdmin {
+		c.JSON(http.StatusConflict, gin.H{"error": "user is already an admin of the organisation"})
+		return
+	}
+	rights := &db_models.HasSpecialRightsFor{OrganisationName: org, UserID: user.ID, User: &user}
+	if _, err := h.DB.Model(rights).Insert(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "has_special_rights_for", EntityID: user.ID,
+		Organisation: org, After: db_models.HasSpecialRightsFor{OrganisationName: org, UserID: user.ID},
+	})
+	c.JSON(http.StatusCreated, toOrganisationAdmin(*rights))
+}
+
+// @Summary Remove an admin from an organisation
+// @Description Revoke a user's special rights for an organisation. The last admin cannot be removed. Rights granted by the login claim mapping come back at the user's next login.
+// @Tags organisations
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param userId path int true "User ID"
+// @Success 204
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/admins/{userId} [delete]
+func (h *Handler) RemoveOrganisationAdmin(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	org := c.Param("orgId")
+	var rights db_models.HasSpecialRightsFor
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		// Lock the organisation so two admins cannot remove each other at once.
+		var locked db_models.Organisation
+		err := tx.Model(&locked).Where("name = ?", org).For("UPDATE").Select()
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&rights).
+			Where("organisation_name = ?", org).
+			Where("user_id = ?", userID).
+			Select()
+		if err != nil {
+			return err
+		}
+		count, err := tx.Model((*db_models.HasSpecialRightsFor)(nil)).Where("organisation_name = ?", org).Count()
+		if err != nil {
+			return err
+		}
+		if count == 1 {
+			return errLastAdmin
+		}
+		_, err = tx.Model(&rights).
+			Where("organisation_name = ?", org).
+			Where("user_id = ?", userID).
+			Delete()
+		return err
+	})
+	if errors.Is(err, pg.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user is not an admin of the organisation"})
+		return
+	}
+	if errors.Is(err, errLastAdmin) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionDelete, Entity: "has_special_rights_for", EntityID: userID,
+		Organisation: org, Before: rights,
+	})
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/config"
+	"lagertool.com/main/db_models"
+)
+
+func TestCheckOrgName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+		ok       bool
+	}{
+		{"plain", "Physics Lab", "Physics Lab", true},
+		{"trimmed", "  VSETH  ", "VSETH", true},
+		{"empty", "   ", "", false},
+		{"slash", "a/b", "", false},
+		{"query", "a?b", "", false},
+		{"too long", strings.Repeat("x", maxOrgNameLength+1), "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			name, err := checkOrgName(tc.input)
+			assert.Equal(t, tc.ok, err == nil)
+			assert.Equal(t, tc.expected, name)
+		})
+	}
+}
+
+func TestOrganisations(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	admin := &db_models.User{Email: "org-admin@example.com", Name: "Org Admin"}
+	_, err := dbCon.Model(admin).Insert()
+	assert.NoError(t, err)
+	other := &db_models.User{Email: "org-helper@example.com", Name: "Org Helper"}
+	_, err = dbCon.Model(other).Insert()
+	assert.NoError(t, err)
+	token := &db_models.APIToken{UserID: admin.ID, Name: "kiosk", TokenHash: "org-test-hash", Scopes: []string{"org-admin:Org Test"}, CreatedAt: time.Now()}
+	_, err = dbCon.Model(token).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	defer func() {
+		cleanupTestHierarchy(t, dbCon, hier)
+		for _, name := range []string{"Org Test", "Org Test Renamed"} {
+			_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", name).Delete()
+			_, _ = dbCon.Model((*db_models.HasSpecialRightsFor)(nil)).Where("organisation_name = ?", name).Delete()
+			_, _ = dbCon.Model((*db_models.Organisation)(nil)).Where("name = ?", name).Delete()
+		}
+		_, _ = dbCon.Model(token).WherePK().Delete()
+		_, _ = dbCon.Model(admin).WherePK().Delete()
+		_, _ = dbCon.Model(other).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	api := router.Group("/", withUser(admin))
+	api.POST("/organisations", h.CreateOrganisation)
+	api.PATCH("/organisations/:orgId", h.RenameOrganisation)
+	api.DELETE("/organisations/:orgId", h.DeleteOrganisation)
+	api.POST("/organisations/:orgId/admins", h.AddOrganisationAdmin)
+	api.DELETE("/organisations/:orgId/admins/:userId", h.RemoveOrganisationAdmin)
+
+	testCases := []struct {
+		name         string
+		method       string
+		url          string
+		body         string
+		expectedCode int
+	}{
+		{"create", http.MethodPost, "/organisations", `{"name": " Org Test "}`, http.StatusCreated},
+		{"create again", http.MethodPost, "/organisations", `{"name": "Org Test"}`, http.StatusConflict},
+		{"invalid name", http.MethodPost, "/organisations", `{"name": "a/b"}`, http.StatusBadRequest},
+		{"own a shelf", "", "", "", 0},
+		{"rename", http.MethodPatch, "/organisations/Org%20Test", `{"name": "Org Test Renamed"}`, http.StatusOK},
+		{"rename unknown", http.MethodPatch, "/organisations/Org%20Test", `{"name": "Org Test 2"}`, http.StatusNotFound},
+		{"add admin", http.MethodPost, "/organisations/Org%20Test%20Renamed/admins", `{"userId": ` + strconv.Itoa(other.ID) + `}`, http.StatusCreated},
+		{"add admin again", http.MethodPost, "/organisations/Org%20Test%20Renamed/admins", `{"userId": ` + strconv.Itoa(other.ID) + `}`, http.StatusConflict},
+		{"remove admin", http.MethodDelete, "/organisations/Org%20Test%20Renamed/admins/" + strconv.Itoa(other.ID), "", http.StatusNoContent},
+		{"remove last admin", http.MethodDelete, "/organisations/Org%20Test%20Renamed/admins/" + strconv.Itoa(admin.ID), "", http.StatusConflict},
+		{"delete while owning a shelf", http.MethodDelete, "/organisations/Org%20Test%20Renamed", "", http.StatusConflict},
+		{"give the shelf away", "", "", "", 0},
+		{"delete", http.MethodDelete, "/organisations/Org%20Test%20Renamed", "", http.StatusNoContent},
+	}
+
+	for _, tc := range testCases {
+		switch tc.name {
+		case "own a shelf":
+			hier.Shelf.OwnedBy = "Org Test"
+			_, err := dbCon.Model(hier.Shelf).WherePK().Update()
+			assert.NoError(t, err)
+			continue
+		case "give the shelf away":
+			_, err := dbCon.Model(hier.Shelf).Set("owned_by = NULL").WherePK().Update()
+			assert.NoError(t, err)
+			continue
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code, w.Body.String())
+		})
+		if tc.name == "rename" {
+			var shelf db_models.Shelf
+			assert.NoError(t, dbCon.Model(&shelf).Where("id = ?", hier.Shelf.ID).Select())
+			assert.Equal(t, "Org Test Renamed", shelf.OwnedBy)
+			isAdmin, err := h.hasSpecialRights(admin.ID, "Org Test Renamed")
+			assert.NoError(t, err)
+			assert.True(t, isAdmin)
+			assert.NoError(t, dbCon.Model(token).WherePK().Select())
+			assert.Equal(t, []string{"org-admin:Org Test Renamed"}, token.Scopes)
+		}
+	}
+
+	count, err := dbCon.Model((*db_models.HasSpecialRightsFor)(nil)).Where("organisation_name = ?", "Org Test Renamed").Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestOrganisationCreators(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	root := &db_models.User{Email: "org-root@example.com", Name: "Root"}
+	admin := &db_models.User{Email: "org-creator@example.com", Name: "Existing Admin"}
+	plain := &db_models.User{Email: "org-plain@example.com", Name: "Plain User"}
+	_, err := dbCon.Model(root, admin, plain).Insert()
+	assert.NoError(t, err)
+	existing := &db_models.Organisation{Name: "Creators Existing Org"}
+	_, err = dbCon.Model(existing).Insert()
+	assert.NoError(t, err)
+	rights := &db_models.HasSpecialRightsFor{OrganisationName: existing.Name, UserID: admin.ID}
+	_, err = dbCon.Model(rights).Insert()
+	assert.NoError(t, err)
+
+	created := []string{"Creators By Root", "Creators By Admin", "Creators By Plain", existing.Name}
+	userIDs := []int{root.ID, admin.ID, plain.ID}
+	defer func() {
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name IN (?)", pg.In(created)).Delete()
+		_, _ = dbCon.Model((*db_models.HasSpecialRightsFor)(nil)).Where("organisation_name IN (?)", pg.In(created)).Delete()
+		_, _ = dbCon.Model((*db_models.Organisation)(nil)).Where("name IN (?)", pg.In(created)).Delete()
+		_, _ = dbCon.Model((*db_models.User)(nil)).Where("id IN (?)", pg.In(userIDs)).Delete()
+	}()
+
+	h := NewHandler(dbCon, &config.Config{Auth: config.AuthConfig{SuperAdmins: []string{root.Email}}})
+	for prefix, user := range map[string]*db_models.User{"/root": root, "/admin": admin, "/plain": plain} {
+		router.POST(prefix+"/organisations", withUser(user), h.RequireOrgCreator(true), h.CreateOrganisation)
+	}
+
+	testCases := []struct {
+		name         string
+		url          string
+		body         string
+		expectedCode int
+	}{
+		{"super-admin", "/root/organisations", `{"name": "Creators By Root"}`, http.StatusCreated},
+		{"admin of another organisation", "/admin/organisations", `{"name": "Creators By Admin"}`, http.StatusCreated},
+		{"plain user", "/plain/organisations", `{"name": "Creators By Plain"}`, http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code, w.Body.String())
+		})
+	}
+
+	exists, err := dbCon.Model((*db_models.Organisation)(nil)).Where("name = ?", "Creators By Plain").Exists()
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
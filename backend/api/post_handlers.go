@@ -1,18 +1,25 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-pg/pg/v10"
 	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
 	"lagertool.com/main/db"
 	"lagertool.com/main/db_models"
 )
 
+var errAlreadyApproved = errors.New("request has already been approved")
+
 // @Summary Create a new building
-// @Description Create a new building for an organisation
+// @Description Create a new building owned by the organisation
 // @Tags buildings
 // @Accept  json
 // @Produce  json
@@ -27,16 +34,20 @@ func (h *Handler) CreateBuilding(c *gin.Context) {
 		return
 	}
 
-	newBuilding, err := db.CreateBuilding(h.DB, req.Name, req.Campus)
+	newBuilding, err := db.CreateBuilding(h.DB, req.Name, req.Campus, c.Param("orgId"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "building", EntityID: newBuilding.ID,
+		Organisation: c.Param("orgId"), After: newBuilding,
+	})
 	c.JSON(http.StatusCreated, toBuilding(*newBuilding))
 }
 
 // @Summary Create a new room
-// @Description Create a new room in a building
+// @Description Create a new room owned by the organisation. The building may belong to another organisation.
 // @Tags rooms
 // @Accept  json
 // @Produce  json
@@ -57,11 +68,25 @@ func (h *Handler) CreateRoom(c *gin.Context) {
 		return
 	}
 
-	newRoom, err := db.CreateRoom(h.DB, req.Name, req.Floor, req.Number, buildingId)
+	exists, err := h.DB.Model((*db_models.Building)(nil)).Where("id = ?", buildingId).Exists()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "building not found"})
+		return
+	}
+
+	newRoom, err := db.CreateRoom(h.DB, req.Name, req.Floor, req.Number, buildingId, c.Param("orgId"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "room", EntityID: newRoom.ID,
+		Organisation: c.Param("orgId"), After: newRoom,
+	})
 	c.JSON(http.StatusCreated, toRoom(*newRoom))
 }
 
@@ -75,20 +100,57 @@ func (h *Handler) CreateRoom(c *gin.Context) {
 // @Router /organisations/{orgId}/items [post]
 func (h *Handler) CreateItem(c *gin.Context) {
 	var req api_objects.InventoryItemRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	// The body may already have been read by orgOfShelfInBody.
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkReorderSettings(req.IsConsumable, req.MinStock, req.ReorderQuantity); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	newItem, err := db.CreateInventoryItem(h.DB, req.Name, req.Amount, req.ShelfUnitID, req.IsConsumable, req.Note, req.ShelfID)
+	shelfOrg, err := orgOfShelfInBody(c, h.DB)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "shelf not found"})
+		return
+	}
+	ok, err := h.categoryBelongsTo(req.CategoryID, shelfOrg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "category not found"})
+		return
+	}
+	attributes, ok := h.itemAttributes(c, req.CategoryID, req.Attributes)
+	if !ok {
+		return
+	}
+	var newItem *db_models.Inventory
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		var err error
+		newItem, err = db.CreateInventoryItem(tx, req.Name, req.Amount, req.ShelfUnitID, req.IsConsumable, req.Note, req.ShelfID,
+			req.CategoryID, normalizeTags(req.Tags), attributes, req.MinStock, req.ReorderQuantity)
+		if err != nil || !newItem.IsConsumable {
+			return err
+		}
+		// Consumables start their stock ledger with the initial amount.
+		return db.ReconcileStock(tx, newItem.ID, newItem.Amount, db_models.StockRestock, "initial stock", currentUserID(c))
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "inventory", EntityID: newItem.ID,
+		Organisation: c.Param("orgId"), After: newItem,
+	})
 	c.JSON(http.StatusCreated, newItem)
 }
 
 // @Summary Add an item to the shopping cart
-// @Description Add an item to the shopping cart
+// @Description Add an item (id) or a kit (kitId) to the shopping cart
 // @Tags cart
 // @Accept  json
 // @Produce  json
@@ -97,26 +159,46 @@ func (h *Handler) CreateItem(c *gin.Context) {
 // @Success 201 {object} db_models.ShoppingCartItem
 // @Router /users/{userId}/cart/items [post]
 func (h *Handler) CreateCartItem(c *gin.Context) {
-	userId, err := strconv.Atoi(c.Param("userId"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+	userId, ok := actingUserID(c)
+	if !ok {
 		return
 	}
 	var req api_objects.CartRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if (req.InvItemID == 0) == (req.KitID == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "either id or kitId is required"})
+		return
+	}
+	if req.KitID != 0 {
+		h.createCartKit(c, userId, req)
+		return
+	}
+	var inv db_models.Inventory
+	err := h.DB.Model(&inv).Column("id", "archived_at").Where("id = ?", req.InvItemID).Select()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if inv.Archived() {
+		c.JSON(http.StatusConflict, gin.H{"error": "item is archived"})
+		return
+	}
 	newCart, err := db.CreateCartItem(h.DB, req.InvItemID, req.NumSelected, userId)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "shopping_cart_item", EntityID: newCart.ID, After: newCart,
+	})
 	c.JSON(http.StatusCreated, newCart)
 }
 
 // @Summary Checkout shopping cart
-// @Description Checkout the user's shopping cart and create requests
+// @Description Checkout the user's shopping cart and create requests. Kits are expanded into one request item per component.
 // @Tags cart
 // @Accept  json
 // @Produce  json
@@ -125,9 +207,8 @@ func (h *Handler) CreateCartItem(c *gin.Context) {
 // @Success 201
 // @Router /users/{userId}/cart/checkout [post]
 func (h *Handler) CheckoutCart(c *gin.Context) {
-	userId, err := strconv.Atoi(c.Param("userId"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+	userId, ok := actingUserID(c)
+	if !ok {
 		return
 	}
 	var req api_objects.CheckoutRequest
@@ -155,17 +236,23 @@ func (h *Handler) CheckoutCart(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create request"})
 			return
 		}
+		audit.Record(h.DB, c, audit.Event{
+			Action: audit.ActionCreate, Entity: "request", EntityID: request.ID,
+			Organisation: request.OrganisationName, After: gin.H{"request": request, "items": v},
+		})
 		for _, item := range v {
-			reqItem := db_models.RequestItems{
-				RequestID:   request.ID,
-				InventoryID: item.ID,
-				Amount:      item.AmountSelected,
-				Request:     request,
+			reqItems := []db_models.RequestItems{{InventoryID: item.ID, Amount: item.AmountSelected}}
+			if item.Kit != nil {
+				reqItems = kitRequestItems(*item.Kit, item.AmountSelected)
 			}
-			err := db.CreateRequestItem(h.DB, reqItem)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create request item"})
-				return
+			for _, reqItem := range reqItems {
+				reqItem.RequestID = request.ID
+				reqItem.Request = request
+				err := db.CreateRequestItem(h.DB, reqItem)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create request item"})
+					return
+				}
 			}
 		}
 	}
@@ -173,7 +260,7 @@ func (h *Handler) CheckoutCart(c *gin.Context) {
 }
 
 // @Summary Review a request
-// @Description Review/approve/deny a borrow request
+// @Description Review/approve/deny a borrow request. The reviewer is the logged-in user. When approving, assetIds binds the loans of serialized items to specific units. A request that was already approved cannot be reviewed again (409).
 // @Tags requests
 // @Accept  json
 // @Produce  json
@@ -192,58 +279,140 @@ func (h *Handler) RequestReview(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	reviewer, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	var bindings map[int][]db_models.Asset
+	if req.Outcome == "approved" && len(req.AssetIDs) > 0 {
+		bindings, err = h.assetBindings(requestId, req.AssetIDs)
+		if errors.Is(err, errAssetOnLoan) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 	rev := &db_models.RequestReview{
-		UserID:    req.UserID,
+		UserID:    reviewer.ID,
 		RequestID: requestId,
 		Outcome:   req.Outcome,
 		Note:      req.Note,
+		TimeStamp: time.Now(),
 	}
-	err = db.CreateRequestReview(h.DB, rev)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+	var request db_models.Request
+	var events []audit.Event
+	// The review, the stock it consumes and the loans it opens are written
+	// together, and the request stays locked so it cannot be approved twice.
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		if err := tx.Model(&request).Where("id = ?", requestId).For("UPDATE").Select(); err != nil {
+			return err
+		}
+		approved, err := tx.Model((*db_models.RequestReview)(nil)).
+			Where("request_id = ?", requestId).
+			Where("outcome = ?", "approved").
+			Exists()
+		if err != nil {
+			return err
+		}
+		if approved {
+			return errAlreadyApproved
+		}
+		if rev.Outcome == "approved" {
+			if err := checkConsumableStock(tx, requestId); err != nil {
+				return err
+			}
+		}
+		if err := db.CreateRequestReview(tx, rev); err != nil {
+			return err
+		}
+		events = append(events, audit.Event{
+			Action: audit.ActionCreate, Entity: "request_review", EntityID: rev.ID,
+			Organisation: request.OrganisationName, After: rev,
+		})
+		if rev.Outcome != "approved" {
+			return nil
+		}
 
-	if rev.Outcome == "approved" {
-		var request db_models.Request
-		err := h.DB.Model(&request).
-			Relation("RequestItems.Inventory").
-			Where("id = ?", requestId).
+		var items []db_models.RequestItems
+		err = tx.Model(&items).
+			Relation("Inventory").
+			Where("request_id = ?", requestId).
+			Order("request_items.id").
 			Select()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return err
 		}
-
-		for _, rItem := range request.RequestItems {
+		for _, rItem := range items {
 			if rItem.Inventory.IsConsumable {
 				cons := &db_models.Consumed{
 					RequestItemID: rItem.ID,
 				}
-				err := db.Create_consumed(h.DB, cons)
-				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-					return
+				movement := &db_models.StockMovement{
+					InventoryID:   rItem.InventoryID,
+					Quantity:      -rItem.Amount,
+					Reason:        db_models.StockConsumed,
+					RequestItemID: rItem.ID,
+					UserID:        reviewer.ID,
+				}
+				if err := db.Create_consumed(tx, cons); err != nil {
+					return err
 				}
+				if err := db.PostStockMovement(tx, movement); err != nil {
+					return fmt.Errorf("%w: %s", err, rItem.Inventory.Name)
+				}
+				events = append(events,
+					audit.Event{
+						Action: audit.ActionCreate, Entity: "consumed", EntityID: cons.ID,
+						Organisation: request.OrganisationName, After: cons,
+					},
+					audit.Event{
+						Action: audit.ActionCreate, Entity: "stock_movement", EntityID: movement.ID,
+						Organisation: request.OrganisationName, After: movement,
+					})
 			} else {
-				l := &db_models.Loans{
-					RequestItemID: rItem.ID,
-					IsReturned:    false,
-					ReturnedAt:    time.Time{},
+				// Serialized items get one loan per bound unit, everything else one loan per item.
+				loans := []*db_models.Loans{{RequestItemID: rItem.ID}}
+				if assets, ok := bindings[rItem.ID]; ok {
+					loans = loans[:0]
+					for _, a := range assets {
+						loans = append(loans, &db_models.Loans{RequestItemID: rItem.ID, AssetID: a.ID})
+					}
 				}
-				err := db.Create_loans(h.DB, l)
-				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-					return
+				for _, l := range loans {
+					if err := db.Create_loans(tx, l); err != nil {
+						return err
+					}
+					events = append(events, audit.Event{
+						Action: audit.ActionCreate, Entity: "loans", EntityID: l.ID,
+						Organisation: request.OrganisationName, After: l,
+					})
 				}
 			}
 		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, pg.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "request not found"})
+		return
+	case errors.Is(err, errAlreadyApproved), errors.Is(err, db.ErrInsufficientStock):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, ev := range events {
+		audit.Record(h.DB, c, ev)
 	}
 	c.JSON(http.StatusOK, rev)
 }
 
 // @Summary Post a message to a request
-// @Description Post a user message on a borrow request
+// @Description Post a user message on a borrow request. The author is the logged-in user.
 // @Tags requests
 // @Accept  json
 // @Produce  json
@@ -262,8 +431,12 @@ func (h *Handler) PostMessage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error while parsing payload": err.Error()})
 		return
 	}
+	author, ok := sessionUser(c)
+	if !ok {
+		return
+	}
 	dbMsg := db_models.UserRequestMessage{
-		UserID:    msg.UserID,
+		UserID:    author.ID,
 		RequestID: requestId,
 		Message:   msg.Message,
 		TimeStamp: time.Now(),
@@ -271,7 +444,12 @@ func (h *Handler) PostMessage(c *gin.Context) {
 	err = db.CreateUserMessage(h.DB, &dbMsg)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "user_request_message", EntityID: dbMsg.ID,
+		Organisation: h.requestOrganisation(requestId), After: dbMsg,
+	})
 	c.JSON(http.StatusOK, msg)
 }
 
@@ -315,5 +493,47 @@ func (h *Handler) CreateShelf(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "shelf", EntityID: newShelf.ID,
+		Organisation: orgId, After: gin.H{"shelf": newShelf, "columns": req.Columns},
+	})
 	c.JSON(http.StatusCreated, newShelf)
 }
+
+// @Summary Restore an archived inventory item
+// @Description Bring an archived item back into the inventory listing, search and carts
+// @Tags items
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Success 200 {object} db_models.Inventory
+// @Router /organisations/{orgId}/items/{id}/restore [post]
+func (h *Handler) RestoreItem(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	var inv db_models.Inventory
+	err = h.DB.Model(&inv).Where("id = ?", itemId).Select()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if !inv.Archived() {
+		c.JSON(http.StatusOK, inv)
+		return
+	}
+	before := inv
+	inv.ArchivedAt = time.Time{}
+	_, err = h.DB.Model(&inv).Set("archived_at = NULL").WherePK().Update()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "inventory", EntityID: inv.ID,
+		Organisation: h.itemOrganisation(inv.ID), Before: before, After: inv,
+	})
+	c.JSON(http.StatusOK, inv)
+}
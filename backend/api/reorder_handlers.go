@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+// reorderCheckInterval is how often StartReorderCheck looks for low stock.
+const reorderCheckInterval = 15 * time.Minute
+
+// checkReorderSettings validates the minimum stock and reorder quantity of an
+// item. Only consumables can have them.
+func checkReorderSettings(consumable bool, minStock, reorderQuantity int) error {
+	if minStock < 0 || reorderQuantity < 0 {
+		return errors.New("minimum stock and reorder quantity cannot be negative")
+	}
+	if !consumable && (minStock > 0 || reorderQuantity > 0) {
+		return errors.New("only consumable items have a minimum stock")
+	}
+	return nil
+}
+
+// orderAmount suggests how much to order: at least the reorder quantity, and
+// enough to get back to the minimum stock.
+func orderAmount(inv db_models.Inventory) int {
+	return max(inv.ReorderQuantity, inv.MinStock-inv.Amount)
+}
+
+// StartReorderCheck periodically flags consumables that fell below their
+// minimum stock, until ctx is cancelled. Newly flagged items are logged.
+func StartReorderCheck(ctx context.Context, con *pg.DB) {
+	check := func() {
+		flagged, err := db.FlagLowStock(con)
+		if err != nil {
+			log.Printf("reorder check failed: %v", err)
+			return
+		}
+		for _, inv := range flagged {
+			log.Printf("reorder check: %s (#%d) is low on stock, %d left of a minimum of %d", inv.Name, inv.ID, inv.Amount, inv.MinStock)
+		}
+	}
+	go func() {
+		check()
+		ticker := time.NewTicker(reorderCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
+
+// @Summary List consumables to reorder
+// @Description List the consumables of an organisation whose stock is below their minimum, with a suggested order amount. format=csv downloads the list as a spreadsheet.
+// @Tags items
+// @Produce  json
+// @Produce  text/csv
+// @Param orgId path string true "Organisation name"
+// @Param format query string false "csv to download the report"
+// @Success 200 {array} api_objects.ReorderItem
+// @Router /organisations/{orgId}/reorder [get]
+func (h *Handler) GetReorderList(c *gin.Context) {
+	orgId := c.Param("orgId")
+	var items []db_models.Inventory
+	err := h.DB.Model(&items).
+		Column("inventory.*").
+		Relation("ShelfUnit.Column.Shelf.Room.Building").
+		Where("inventory.shelf_unit_id IN ("+orgShelfUnits+")", orgId).
+		Where("inventory.is_consumable = true").
+		Where("inventory.archived_at IS NULL").
+		Where("inventory.amount < COALESCE(inventory.min_stock, 0)").
+		Order("inventory.name").
+		Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.ReorderItem, 0, len(items))
+	for _, inv := range items {
+		res = append(res, toReorderItem(inv))
+	}
+
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, res)
+		return
+	}
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	_ = w.Write([]string{"id", "name", "amount", "min_stock", "reorder_quantity", "order_amount", "building", "room", "shelf_unit", "low_stock_since"})
+	for _, item := range res {
+		since := ""
+		if item.LowStockSince != nil {
+			since = item.LowStockSince.Format(time.RFC3339)
+		}
+		_ = w.Write([]string{
+			strconv.Itoa(item.ID), csvSafe(item.Name), strconv.Itoa(item.Amount), strconv.Itoa(item.MinStock),
+			strconv.Itoa(item.ReorderQuantity), strconv.Itoa(item.OrderAmount),
+			csvSafe(item.Building.Name), csvSafe(item.Room.Name), item.ShelfElementID, since,
+		})
+	}
+	w.Flush()
+	fileName := fmt.Sprintf("reorder-%s-%s.csv", cleanFileName(orgId), time.Now().Format("2006-01-02"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", []byte(b.String()))
+}
+
+// csvSafe keeps spreadsheets from evaluating user text as a formula.
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+func TestCheckReorderSettings(t *testing.T) {
+	assert.NoError(t, checkReorderSettings(true, 5, 20))
+	assert.NoError(t, checkReorderSettings(false, 0, 0))
+	assert.Error(t, checkReorderSettings(true, -1, 0))
+	assert.Error(t, checkReorderSettings(false, 5, 0), "only consumables")
+}
+
+func TestOrderAmount(t *testing.T) {
+	testCases := []struct {
+		name                    string
+		amount, minStock, batch int
+		want                    int
+	}{
+		{name: "batch covers the gap", amount: 3, minStock: 10, batch: 20, want: 20},
+		{name: "gap larger than batch", amount: 0, minStock: 50, batch: 20, want: 50},
+		{name: "no batch size", amount: 4, minStock: 10, batch: 0, want: 6},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inv := db_models.Inventory{Amount: tc.amount, MinStock: tc.minStock, ReorderQuantity: tc.batch}
+			assert.Equal(t, tc.want, orderAmount(inv))
+		})
+	}
+}
+
+func TestCsvSafe(t *testing.T) {
+	assert.Equal(t, "Cable ties", csvSafe("Cable ties"))
+	assert.Equal(t, "'=HYPERLINK(\"x\")", csvSafe("=HYPERLINK(\"x\")"))
+	assert.Equal(t, "'-5 V supply", csvSafe("-5 V supply"))
+	assert.Equal(t, "", csvSafe(""))
+}
+
+func TestReorderList(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Reorder Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = org.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+	hier.Inventory.IsConsumable = true
+	hier.Inventory.Name = "AA batteries"
+	hier.Inventory.Amount = 3
+	hier.Inventory.MinStock = 10
+	hier.Inventory.ReorderQuantity = 24
+	_, err = dbCon.Model(hier.Inventory).WherePK().Update()
+	assert.NoError(t, err)
+
+	defer func() {
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	flagged, err := db.FlagLowStock(dbCon)
+	assert.NoError(t, err)
+	var ids []int
+	for _, inv := range flagged {
+		ids = append(ids, inv.ID)
+	}
+	assert.Contains(t, ids, hier.Inventory.ID)
+
+	h := NewHandler(dbCon, nil)
+	router.GET("/organisations/:orgId/reorder", h.GetReorderList)
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		w := get("/organisations/" + org.Name + "/reorder")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var items []api_objects.ReorderItem
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, 24, items[0].OrderAmount)
+			assert.NotNil(t, items[0].LowStockSince)
+		}
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		w := get("/organisations/" + org.Name + "/reorder?format=csv")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), "text/csv")
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+		rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+		assert.NoError(t, err)
+		if assert.Len(t, rows, 2) {
+			assert.Equal(t, "order_amount", rows[0][5])
+			assert.Equal(t, []string{"AA batteries", "3", "10", "24", "24"}, rows[1][1:6])
+		}
+	})
+
+	t.Run("Restocked items drop off", func(t *testing.T) {
+		_, err := dbCon.Model(hier.Inventory).Set("amount = 30").WherePK().Update()
+		assert.NoError(t, err)
+		_, err = db.FlagLowStock(dbCon)
+		assert.NoError(t, err)
+		w := get("/organisations/" + org.Name + "/reorder")
+		assert.JSONEq(t, "[]", w.Body.String())
+	})
+}
@@ -5,52 +5,159 @@ import (
 	"github.com/go-pg/pg/v10"
 	"lagertool.com/main/auth"
 	"lagertool.com/main/config"
+	"lagertool.com/main/ratelimit"
 )
 
-func SetupRoutes(r *gin.Engine, dbCon *pg.DB, cfg *config.Config, using_auth bool) {
+func SetupRoutes(r *gin.Engine, dbCon *pg.DB, cfg *config.Config, authHandler *auth.AuthHandler, using_auth bool) {
 	h := NewHandler(dbCon, cfg)
-	authHandler := auth.NewAuthHandler(dbCon)
 
-	r.GET("/auth/eduid/login", authHandler.LoginHandler)
-	r.GET("/auth/eduid/callback", authHandler.CallbackHandler)
-	r.GET("/auth/eduid/logout", authHandler.LogoutHandler)
+	var limits config.RateLimitConfig
+	if cfg != nil {
+		limits = cfg.RateLimit
+	}
+
+	authRoutes := r.Group("/auth/:provider", rateLimit(limits.Auth, ratelimit.ByIP))
+	authRoutes.GET("/login", authHandler.LoginHandler)
+	authRoutes.GET("/callback", authHandler.CallbackHandler)
+	authRoutes.GET("/logout", authHandler.LogoutHandler)
 
-	r.GET("/search/:searchTerm", h.FuzzyFindItems)
+	r.GET("/search/:searchTerm", rateLimit(limits.Search, ratelimit.ByIP), h.FuzzyFindItems)
 
 	protected := r.Group("/")
-	protected.Use(authHandler.AuthMiddleware(using_auth))
+	protected.Use(
+		// Counted per IP before authentication too, so guessing credentials is throttled.
+		rateLimit(limits.APIByIP, ratelimit.ByIP),
+		authHandler.AuthMiddleware(using_auth),
+		rateLimit(limits.API, ratelimit.ByUser),
+		authHandler.CSRFMiddleware(using_auth),
+	)
+
+	// Org-admin guards, resolving the organisation from the path or the targeted entity.
+	orgAdmin := h.RequireOrgAdmin(using_auth, orgFromParam("orgId"))
+	requestAdmin := h.RequireOrgAdmin(using_auth, orgOfRequest("id"))
+	loanAdmin := h.RequireOrgAdmin(using_auth, orgOfLoan("id"))
+	itemAdmin := h.RequireOrgAdmin(using_auth, orgOfItem("id"))
+	shelfAdmin := h.RequireOrgAdmin(using_auth, orgOfShelfInBody)
+	requestParticipant := h.RequireRequestParticipant(using_auth, "id")
+	anyOrgAdmin := h.RequireAnyOrgAdmin(using_auth)
+	cartAccess := h.RequireCartAccess(using_auth)
+	superAdmin := h.RequireSuperAdmin(using_auth)
 	{
 		// Resources
 		protected.GET("/organisations", h.GetOrganisations)
+		protected.POST("/organisations", h.RequireOrgCreator(using_auth), h.CreateOrganisation)
 		protected.GET("/organisations/:orgId/buildings", h.GetBuildings)
 		protected.GET("/organisations/:orgId/rooms", h.GetRooms)
 		protected.GET("/organisations/:orgId/shelves", h.GetShelves)
-		protected.GET("/organisations/:orgId/inventory", h.GetInventory) // ?start=X&end=X
-		protected.POST("/organisations/:orgId/buildings", h.CreateBuilding)
-		protected.POST("/organisations/:orgId/buildings/:buildingId/rooms", h.CreateRoom)
-		protected.POST("/organisations/:orgId/buildings/:buildingId/rooms/:roomId/shelves", h.CreateShelf)
+		protected.GET("/organisations/:orgId/buildings/:buildingId", h.GetBuilding)
+		protected.GET("/organisations/:orgId/rooms/:roomId", h.GetRoom)
+		protected.GET("/organisations/:orgId/shelves/:shelfId", h.GetShelf)
+		protected.GET("/organisations/:orgId/inventory", h.GetInventory) // ?start=X&end=X&category=N&tag=X&tag=Y&attr.<key>[.min|.max]=X&archived=true
+		protected.GET("/organisations/:orgId/categories", h.GetCategories)
+		protected.POST("/organisations/:orgId/categories", orgAdmin, h.CreateCategory)
+		protected.PUT("/organisations/:orgId/categories/:categoryId", orgAdmin, h.UpdateCategory)
+		protected.DELETE("/organisations/:orgId/categories/:categoryId", orgAdmin, h.DeleteCategory)
+		protected.GET("/organisations/:orgId/categories/:categoryId/attributes", h.GetAttributeDefinitions)
+		protected.POST("/organisations/:orgId/categories/:categoryId/attributes", orgAdmin, h.CreateAttributeDefinition)
+		protected.PUT("/organisations/:orgId/categories/:categoryId/attributes/:attributeId", orgAdmin, h.UpdateAttributeDefinition)
+		protected.DELETE("/organisations/:orgId/categories/:categoryId/attributes/:attributeId", orgAdmin, h.DeleteAttributeDefinition)
+		protected.GET("/organisations/:orgId/kits", h.GetKits)       // ?start=X&end=X
+		protected.GET("/organisations/:orgId/kits/:kitId", h.GetKit) // ?start=X&end=X
+		protected.POST("/organisations/:orgId/kits", orgAdmin, h.CreateKit)
+		protected.PUT("/organisations/:orgId/kits/:kitId", orgAdmin, h.UpdateKit)
+		protected.DELETE("/organisations/:orgId/kits/:kitId", orgAdmin, h.DeleteKit)
+		protected.PUT("/organisations/:orgId", orgAdmin, h.RenameOrganisation)
+		protected.PATCH("/organisations/:orgId", orgAdmin, h.RenameOrganisation)
+		protected.DELETE("/organisations/:orgId", orgAdmin, h.DeleteOrganisation)
+		protected.GET("/organisations/:orgId/admins", orgAdmin, h.GetOrganisationAdmins)
+		protected.POST("/organisations/:orgId/admins", orgAdmin, h.AddOrganisationAdmin)
+		protected.DELETE("/organisations/:orgId/admins/:userId", orgAdmin, h.RemoveOrganisationAdmin)
+		protected.POST("/organisations/:orgId/buildings", orgAdmin, h.CreateBuilding)
+		protected.POST("/organisations/:orgId/buildings/:buildingId/rooms", orgAdmin, h.CreateRoom)
+		protected.POST("/organisations/:orgId/buildings/:buildingId/rooms/:roomId/shelves", orgAdmin, h.CreateShelf)
+		protected.PUT("/organisations/:orgId/buildings/:buildingId", orgAdmin, h.UpdateBuilding)
+		protected.PATCH("/organisations/:orgId/buildings/:buildingId", orgAdmin, h.UpdateBuilding)
+		protected.DELETE("/organisations/:orgId/buildings/:buildingId", orgAdmin, h.DeleteBuilding) // ?cascade=true or ?relocate=<shelfUnitId>
+		protected.PUT("/organisations/:orgId/rooms/:roomId", orgAdmin, h.UpdateRoom)
+		protected.PATCH("/organisations/:orgId/rooms/:roomId", orgAdmin, h.UpdateRoom)
+		protected.DELETE("/organisations/:orgId/rooms/:roomId", orgAdmin, h.DeleteRoom) // ?cascade=true or ?relocate=<shelfUnitId>
+		protected.PUT("/organisations/:orgId/shelves/:shelfId", orgAdmin, h.UpdateShelf)
+		protected.PATCH("/organisations/:orgId/shelves/:shelfId", orgAdmin, h.UpdateShelf)
+		protected.DELETE("/organisations/:orgId/shelves/:shelfId", orgAdmin, h.DeleteShelf) // ?cascade=true or ?relocate=<shelfUnitId>
+		protected.PUT("/organisations/:orgId/shelves/:shelfId/layout", orgAdmin, h.UpdateShelfLayout)
+		protected.GET("/organisations/:orgId/reorder", orgAdmin, h.GetReorderList) // ?format=csv
+		protected.GET("/organisations/:orgId/audit", orgAdmin, h.GetAuditLog)      // ?actor=N&entity=X&entityId=X&from=X&to=X&limit=N&offset=N
+		protected.GET("/audit", superAdmin, h.GetUnscopedAuditLog)                 // same filters; logins and other events without an organisation
 
 		// Items
 		protected.GET("/organisations/:orgId/items/:id", h.GetItem) // ?start=X&end=X
-		protected.POST("/organisations/:orgId/items", h.CreateItem)
-		protected.PUT("/organisations/:orgId/items/:id", h.UpdateItem)
+		protected.POST("/organisations/:orgId/items", orgAdmin, shelfAdmin, h.CreateItem)
+		protected.PATCH("/organisations/:orgId/items/:id", itemAdmin, h.UpdateItem)
+		protected.PUT("/organisations/:orgId/items/:id", itemAdmin, h.UpdateItem)
+		protected.DELETE("/organisations/:orgId/items/:id", itemAdmin, h.DeleteItem)
+		protected.POST("/organisations/:orgId/items/:id/restore", itemAdmin, h.RestoreItem)
 		protected.GET("/organisations/:orgId/items/:id/borrows", h.GetBorrowHistory)
+		protected.GET("/organisations/:orgId/items/:id/assets", h.GetAssets)
+		protected.POST("/organisations/:orgId/items/:id/assets", itemAdmin, h.CreateAsset)
+		protected.PUT("/organisations/:orgId/items/:id/assets/:assetId", itemAdmin, h.UpdateAsset)
+		protected.DELETE("/organisations/:orgId/items/:id/assets/:assetId", itemAdmin, h.DeleteAsset)
+		protected.GET("/organisations/:orgId/items/:id/stock-movements", h.GetStockMovements)
+		protected.POST("/organisations/:orgId/items/:id/stock-movements", itemAdmin, h.CreateStockMovement)
+		protected.GET("/organisations/:orgId/items/:id/transfers", h.GetItemTransfers)
+		protected.POST("/organisations/:orgId/items/:id/move", itemAdmin, h.MoveItem)
+		protected.GET("/organisations/:orgId/transfers", orgAdmin, h.GetTransfers) // ?state=pending
+		protected.POST("/organisations/:orgId/transfers/:transferId/approve", orgAdmin, h.ApproveTransfer)
+		protected.POST("/organisations/:orgId/transfers/:transferId/reject", orgAdmin, h.RejectTransfer)
+		protected.GET("/organisations/:orgId/items/:id/attachments", h.GetAttachments)
+		protected.POST("/organisations/:orgId/items/:id/attachments", itemAdmin, h.UploadAttachment)
+		protected.GET("/organisations/:orgId/items/:id/attachments/:attachmentId/file", h.GetAttachmentFile)
+		protected.GET("/organisations/:orgId/items/:id/attachments/:attachmentId/thumbnail", h.GetAttachmentThumbnail)
+		protected.DELETE("/organisations/:orgId/items/:id/attachments/:attachmentId", itemAdmin, h.DeleteAttachment)
+
+		// Me: everything here acts on the session user
+		protected.GET("/me", authHandler.IssueCSRF, h.GetMe)
+		protected.DELETE("/me/sessions/:id", h.DeleteMySession)
+		protected.GET("/me/tokens", h.GetMyTokens)
+		protected.POST("/me/tokens", h.CreateMyToken)
+		protected.DELETE("/me/tokens/:id", h.DeleteMyToken)
+		protected.GET("/me/cart", h.GetShoppingCart) // ?start=X&end=X
+		protected.POST("/me/cart/items", h.CreateCartItem)
+		protected.POST("/me/cart/checkout", h.CheckoutCart)
+		protected.DELETE("/me/cart/items", h.DeleteAllCartItems)
+		protected.DELETE("/me/cart/items/:itemId", h.DeleteCartItem)
+		protected.PUT("/me/cart/items/:itemId", h.UpdateCartItem)
+		protected.DELETE("/me/cart/kits/:kitId", h.DeleteCartKit)
+		protected.PUT("/me/cart/kits/:kitId", h.UpdateCartKit)
+		protected.GET("/me/requests", h.GetMyBorrowRequests)
+		protected.GET("/me/messages", h.GetMyMessages)
 
-		// Cart
-		protected.GET("/users/:userId/cart", h.GetShoppingCart) // ?start=X&end=X
-		protected.POST("/users/:userId/cart/items", h.CreateCartItem)
-		protected.POST("/users/:userId/cart/checkout", h.CheckoutCart)
-		protected.DELETE("/users/:userId/cart/items", h.DeleteAllCartItems)
-		protected.DELETE("/users/:userId/cart/items/:itemId", h.DeleteCartItem)
-		protected.PUT("/users/:userId/cart/items/:itemId", h.UpdateCartItem)
+		// Cart of any user, for its owner and the admins of the organisations involved
+		protected.GET("/users/:userId/cart", cartAccess, h.GetShoppingCart) // ?start=X&end=X
+		protected.POST("/users/:userId/cart/items", cartAccess, h.CreateCartItem)
+		protected.POST("/users/:userId/cart/checkout", cartAccess, h.CheckoutCart)
+		protected.DELETE("/users/:userId/cart/items", cartAccess, h.DeleteAllCartItems)
+		protected.DELETE("/users/:userId/cart/items/:itemId", cartAccess, h.DeleteCartItem)
+		protected.PUT("/users/:userId/cart/items/:itemId", cartAccess, h.UpdateCartItem)
+		protected.DELETE("/users/:userId/cart/kits/:kitId", cartAccess, h.DeleteCartKit)
+		protected.PUT("/users/:userId/cart/kits/:kitId", cartAccess, h.UpdateCartKit)
 
 		// Loans & Requests
-		protected.GET("/borrow_requests", h.GetBorrowRequests) // ?userId=N for personal scope
-		protected.PUT("/loans/:id", h.UpdateLoan)
-		protected.PUT("/requests/:id", h.UpdateRequest)
-		protected.PUT("/requests/:id/loans", h.UpdateLoanBulk)
-		protected.POST("/requests/:id/review", h.RequestReview)
-		protected.GET("/requests/:id/messages", h.GetMessages)
-		protected.POST("/requests/:id/messages", h.PostMessage)
+		protected.GET("/borrow_requests", anyOrgAdmin, h.GetBorrowRequests) // ?userId=N for a single user
+		protected.PUT("/loans/:id", loanAdmin, h.UpdateLoan)
+		protected.PUT("/requests/:id", requestAdmin, h.UpdateRequest)
+		protected.PUT("/requests/:id/loans", requestAdmin, h.UpdateLoanBulk)
+		protected.POST("/requests/:id/review", requestAdmin, h.RequestReview)
+		protected.GET("/requests/:id/messages", requestParticipant, h.GetMessages)
+		protected.POST("/requests/:id/messages", requestParticipant, h.PostMessage)
+	}
+}
+
+// rateLimit builds the limiter for one route group from its config.RateLimitConfig
+// value. An empty or invalid value (rejected by Config.Validate) disables it.
+func rateLimit(spec string, key ratelimit.KeyFunc) gin.HandlerFunc {
+	requests, per, err := config.ParseRate(spec)
+	if err != nil || requests == 0 {
+		return func(c *gin.Context) { c.Next() }
 	}
+	return ratelimit.Middleware(ratelimit.NewTokenBucket(requests, per), key)
 }
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+// checkMovement validates the reason of a stock movement against the direction
+// of its quantity: restocks add stock, consumption, losses and damage remove it,
+// and corrections and transfers go either way.
+func checkMovement(reason string, quantity int) error {
+	if quantity == 0 {
+		return errors.New("quantity cannot be zero")
+	}
+	switch reason {
+	case db_models.StockRestock:
+		if quantity < 0 {
+			return errors.New("a restock must add stock")
+		}
+	case db_models.StockConsumed, db_models.StockLost, db_models.StockDamaged:
+		if quantity > 0 {
+			return fmt.Errorf("%s stock must be removed with a negative quantity", reason)
+		}
+	case db_models.StockCorrection, db_models.StockTransfer:
+	default:
+		return fmt.Errorf("unknown reason %q", reason)
+	}
+	return nil
+}
+
+// checkConsumableStock makes sure every consumable of a request has enough
+// stock, so that approving it does not fail halfway. An item can be requested
+// on its own and as part of a kit, so the amounts are summed per item.
+func checkConsumableStock(con orm.DB, requestID int) error {
+	var items []db_models.RequestItems
+	err := con.Model(&items).
+		Relation("Inventory").
+		Where("request_id = ?", requestID).
+		Where("inventory.is_consumable = true").
+		Select()
+	if err != nil {
+		return err
+	}
+	requested := map[int]int{}
+	for _, item := range items {
+		requested[item.InventoryID] += item.Amount
+	}
+	for _, item := range items {
+		if amount := requested[item.InventoryID]; amount > item.Inventory.Amount {
+			return fmt.Errorf("%w: %d of %s requested, %d in stock",
+				db.ErrInsufficientStock, amount, item.Inventory.Name, item.Inventory.Amount)
+		}
+	}
+	return nil
+}
+
+// @Summary List the stock movements of an item
+// @Description List the stock ledger of a consumable item, oldest first, with the stock level after each movement
+// @Tags items
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Success 200 {array} api_objects.StockMovement
+// @Router /organisations/{orgId}/items/{id}/stock-movements [get]
+func (h *Handler) GetStockMovements(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	var movements []db_models.StockMovement
+	err = h.DB.Model(&movements).Where("inventory_id = ?", itemId).Order("id").Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.StockMovement, 0, len(movements))
+	balance := 0
+	for _, m := range movements {
+		balance += m.Quantity
+		res = append(res, toStockMovement(m, balance))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary Record a stock movement
+// @Description Add stock to or remove stock from a consumable item. The reason is one of restock, consumed, lost, damaged, correction or transfer; the stock cannot drop below zero.
+// @Tags items
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Param movement body api_objects.StockMovementRequest true "Movement"
+// @Success 201 {object} api_objects.StockMovement
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/items/{id}/stock-movements [post]
+func (h *Handler) CreateStockMovement(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	var req api_objects.StockMovementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkMovement(req.Reason, req.Quantity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid movement", "details": err.Error()})
+		return
+	}
+	var inv db_models.Inventory
+	if err := h.DB.Model(&inv).Where("id = ?", itemId).Select(); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if !inv.IsConsumable {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only consumable items have a stock ledger"})
+		return
+	}
+
+	movement := &db_models.StockMovement{
+		InventoryID: itemId,
+		Quantity:    req.Quantity,
+		Reason:      req.Reason,
+		Note:        req.Note,
+		UserID:      currentUserID(c),
+	}
+	var balance int
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		if err := db.PostStockMovement(tx, movement); err != nil {
+			return err
+		}
+		balance, err = db.StockLevel(tx, itemId)
+		return err
+	})
+	if errors.Is(err, db.ErrInsufficientStock) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "details": fmt.Sprintf("%d in stock", inv.Amount)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "stock_movement", EntityID: movement.ID,
+		Organisation: h.itemOrganisation(itemId), After: movement,
+	})
+	c.JSON(http.StatusCreated, toStockMovement(*movement, balance))
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+func TestCheckMovement(t *testing.T) {
+	testCases := []struct {
+		name     string
+		reason   string
+		quantity int
+		valid    bool
+	}{
+		{name: "restock", reason: "restock", quantity: 10, valid: true},
+		{name: "negative restock", reason: "restock", quantity: -1, valid: false},
+		{name: "lost", reason: "lost", quantity: -2, valid: true},
+		{name: "positive damage", reason: "damaged", quantity: 2, valid: false},
+		{name: "correction down", reason: "correction", quantity: -3, valid: true},
+		{name: "transfer in", reason: "transfer", quantity: 3, valid: true},
+		{name: "zero", reason: "correction", quantity: 0, valid: false},
+		{name: "unknown reason", reason: "stolen", quantity: -1, valid: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkMovement(tc.reason, tc.quantity)
+			assert.Equal(t, tc.valid, err == nil, err)
+		})
+	}
+}
+
+func TestStockLedger(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	org := &db_models.Organisation{Name: "Stock Test Org"}
+	_, err := dbCon.Model(org).Insert()
+	assert.NoError(t, err)
+	reviewer := &db_models.User{Email: "stock-reviewer@example.com", Name: "Stock Reviewer"}
+	_, err = dbCon.Model(reviewer).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Inventory.IsConsumable = true
+	hier.Inventory.Name = "Cable ties"
+	_, err = dbCon.Model(hier.Inventory).WherePK().Update()
+	assert.NoError(t, err)
+	assert.NoError(t, db.ReconcileStock(dbCon, hier.Inventory.ID, 10, db_models.StockCorrection, "opening balance", 0))
+
+	newRequest := func(amount int) (*db_models.Request, *db_models.RequestItems) {
+		request := &db_models.Request{
+			UserID:           reviewer.ID,
+			StartDate:        time.Now().Add(24 * time.Hour),
+			EndDate:          time.Now().Add(48 * time.Hour),
+			State:            "requested",
+			OrganisationName: org.Name,
+		}
+		_, err := dbCon.Model(request).Insert()
+		assert.NoError(t, err)
+		item := &db_models.RequestItems{RequestID: request.ID, InventoryID: hier.Inventory.ID, Amount: amount}
+		_, err = dbCon.Model(item).Insert()
+		assert.NoError(t, err)
+		return request, item
+	}
+	small, smallItem := newRequest(4)
+	large, largeItem := newRequest(50)
+	// The same item twice, e.g. on its own and in a kit; each row fits the stock, both together do not.
+	split, splitItem := newRequest(6)
+	splitKitItem := &db_models.RequestItems{RequestID: split.ID, InventoryID: hier.Inventory.ID, Amount: 6}
+	_, err = dbCon.Model(splitKitItem).Insert()
+	assert.NoError(t, err)
+
+	defer func() {
+		itemIDs := pg.In([]int{smallItem.ID, largeItem.ID, splitItem.ID, splitKitItem.ID})
+		requestIDs := pg.In([]int{small.ID, large.ID, split.ID})
+		_, _ = dbCon.Model((*db_models.StockMovement)(nil)).Where("inventory_id = ?", hier.Inventory.ID).Delete()
+		_, _ = dbCon.Model((*db_models.Consumed)(nil)).Where("request_item_id IN (?)", itemIDs).Delete()
+		_, _ = dbCon.Model((*db_models.RequestReview)(nil)).Where("request_id IN (?)", requestIDs).Delete()
+		_, _ = dbCon.Model((*db_models.RequestItems)(nil)).Where("id IN (?)", itemIDs).Delete()
+		_, _ = dbCon.Model((*db_models.Request)(nil)).Where("id IN (?)", requestIDs).Delete()
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name = ?", org.Name).Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model(reviewer).WherePK().Delete()
+		_, _ = dbCon.Model(org).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.GET("/organisations/:orgId/items/:id/stock-movements", h.GetStockMovements)
+	router.POST("/organisations/:orgId/items/:id/stock-movements", withUser(reviewer), h.CreateStockMovement)
+	router.POST("/requests/:id/review", withUser(reviewer), h.RequestReview)
+
+	base := "/organisations/" + org.Name + "/items/" + strconv.Itoa(hier.Inventory.ID) + "/stock-movements"
+	send := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	amount := func() int {
+		var inv db_models.Inventory
+		assert.NoError(t, dbCon.Model(&inv).Where("id = ?", hier.Inventory.ID).Select())
+		return inv.Amount
+	}
+
+	t.Run("Record movements", func(t *testing.T) {
+		testCases := []struct {
+			name           string
+			payload        string
+			expectedStatus int
+		}{
+			{name: "Restock", payload: `{"quantity": 5, "reason": "restock", "note": "delivery"}`, expectedStatus: http.StatusCreated},
+			{name: "Negative restock", payload: `{"quantity": -5, "reason": "restock"}`, expectedStatus: http.StatusBadRequest},
+			{name: "Unknown reason", payload: `{"quantity": -1, "reason": "stolen"}`, expectedStatus: http.StatusBadRequest},
+			{name: "More than in stock", payload: `{"quantity": -20, "reason": "lost"}`, expectedStatus: http.StatusConflict},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w := send("POST", base, tc.payload)
+				assert.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			})
+		}
+		assert.Equal(t, 15, amount())
+	})
+
+	t.Run("Approval consumes stock", func(t *testing.T) {
+		approve := func(request *db_models.Request) *httptest.ResponseRecorder {
+			return send("POST", "/requests/"+strconv.Itoa(request.ID)+"/review", `{"outcome": "approved"}`)
+		}
+		assert.Equal(t, http.StatusConflict, approve(large).Code)
+		assert.Equal(t, http.StatusOK, approve(small).Code)
+		assert.Equal(t, 11, amount())
+
+		w := approve(small)
+		assert.Equal(t, http.StatusConflict, w.Code, "a request is approved only once")
+		assert.Equal(t, 11, amount())
+
+		w = approve(split)
+		assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+		assert.Equal(t, 11, amount())
+		reviews, err := dbCon.Model((*db_models.RequestReview)(nil)).Where("request_id = ?", split.ID).Count()
+		assert.NoError(t, err)
+		assert.Zero(t, reviews, "a refused approval leaves no review behind")
+
+		available, err := h.GetAvailable(hier.Inventory.ID, time.Now(), time.Now().Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, 11, available)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		w := send("GET", base, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var movements []api_objects.StockMovement
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &movements))
+		if assert.Len(t, movements, 3) {
+			assert.Equal(t, []int{10, 15, 11}, []int{movements[0].Balance, movements[1].Balance, movements[2].Balance})
+			assert.Equal(t, "consumed", movements[2].Reason)
+			assert.Equal(t, smallItem.ID, movements[2].RequestItemID)
+		}
+	})
+}
@@ -0,0 +1,457 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/auth"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+var (
+	// errCannotMove is returned when a transfer cannot be carried out (any more).
+	errCannotMove      = errors.New("cannot move item")
+	errTransferClosed  = errors.New("transfer is no longer pending")
+	errNotTransferSide = errors.New("transfer does not involve the organisation")
+)
+
+// checkMoveAmount decides whether amount units of inv may move. Asset-backed
+// items only move as a whole, because the assets would have to be split as
+// well. Units held by requests stay behind, except when a whole item moves
+// within its organisation and its reservations simply move along.
+func checkMoveAmount(inv db_models.Inventory, amount int, committed int, assets int, crossOrg bool) error {
+	if amount <= 0 || amount > inv.Amount {
+		return fmt.Errorf("%w: amount must be between 1 and %d", errCannotMove, inv.Amount)
+	}
+	whole := amount == inv.Amount
+	if assets > 0 && !whole {
+		return fmt.Errorf("%w: items tracked by asset can only be moved as a whole", errCannotMove)
+	}
+	if whole && !crossOrg {
+		return nil
+	}
+	if inv.IsConsumable && !crossOrg {
+		return nil
+	}
+	if free := inv.Amount - committed; amount > free {
+		return fmt.Errorf("%w: %d units are reserved or on loan, %d can be moved", errCannotMove, committed, max(free, 0))
+	}
+	return nil
+}
+
+// targetShelfUnit loads a shelf unit with the shelf it belongs to.
+func targetShelfUnit(con *pg.DB, id string) (*db_models.ShelfUnit, error) {
+	var unit db_models.ShelfUnit
+	err := con.Model(&unit).Relation("Column.Shelf").Where("shelf_unit.id = ?", id).Select()
+	if err != nil {
+		return nil, err
+	}
+	return &unit, nil
+}
+
+// carryOut performs a transfer whose approvals are complete. A whole item is
+// moved; otherwise the units are split off into a new row on the target unit.
+// An item leaving its organisation loses the category, attributes, reorder
+// settings and kit memberships that belonged to the old one. Consumables post
+// the split to their stock ledgers.
+func carryOut(tx *pg.Tx, t *db_models.ItemTransfer, userID int) error {
+	var inv db_models.Inventory
+	if err := tx.Model(&inv).Where("id = ?", t.InventoryID).For("UPDATE").Select(); err != nil {
+		return err
+	}
+	if inv.Archived() {
+		return fmt.Errorf("%w: item is archived", errCannotMove)
+	}
+	if inv.ShelfUnitID != t.FromShelfUnitID {
+		return fmt.Errorf("%w: item is no longer on shelf unit %s", errCannotMove, t.FromShelfUnitID)
+	}
+	var unit db_models.ShelfUnit
+	err := tx.Model(&unit).Relation("Column.Shelf").Where("shelf_unit.id = ?", t.ToShelfUnitID).Select()
+	if errors.Is(err, pg.ErrNoRows) || (err == nil && unit.Column.Shelf.OwnedBy != t.ToOrganisation) {
+		return fmt.Errorf("%w: shelf unit %s no longer belongs to %s", errCannotMove, t.ToShelfUnitID, t.ToOrganisation)
+	}
+	if err != nil {
+		return err
+	}
+	crossOrg := t.FromOrganisation != t.ToOrganisation
+	committed, err := committedAmount(tx, inv.ID)
+	if err != nil {
+		return err
+	}
+	assets, err := tx.Model((*db_models.Asset)(nil)).Where("inventory_id = ?", inv.ID).Count()
+	if err != nil {
+		return err
+	}
+	if err := checkMoveAmount(inv, t.Amount, committed, assets, crossOrg); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	moved := inv
+	if t.Amount < inv.Amount {
+		moved.ID = 0
+		moved.Amount = t.Amount
+		moved.LowStockSince = time.Time{}
+		if inv.IsConsumable {
+			moved.Amount = 0 // set by the ledger below
+		}
+	}
+	moved.ShelfUnitID = unit.ID
+	moved.ShelfID = unit.Column.ShelfID
+	moved.UpdateDate = now
+	if crossOrg {
+		moved.CategoryID = 0
+		moved.Attributes = nil
+		moved.MinStock = 0
+		moved.ReorderQuantity = 0
+		moved.LowStockSince = time.Time{}
+	}
+
+	if moved.ID == 0 {
+		if _, err := tx.Model(&moved).Insert(); err != nil {
+			return err
+		}
+		if inv.IsConsumable {
+			for _, m := range []*db_models.StockMovement{
+				{InventoryID: inv.ID, Quantity: -t.Amount, Note: fmt.Sprintf("moved to item %d", moved.ID)},
+				{InventoryID: moved.ID, Quantity: t.Amount, Note: fmt.Sprintf("moved from item %d", inv.ID)},
+			} {
+				m.Reason = db_models.StockTransfer
+				m.UserID = userID
+				if err := db.PostStockMovement(tx, m); err != nil {
+					return err
+				}
+			}
+		} else {
+			_, err = tx.Model(&inv).
+				Set("amount = ?", inv.Amount-t.Amount).
+				Set("update_date = ?", now).
+				WherePK().
+				Update()
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		_, err = tx.Model(&moved).
+			Column("shelf_unit_id", "shelf_id", "update_date", "category_id", "attributes",
+				"min_stock", "reorder_quantity", "low_stock_since").
+			WherePK().
+			Update()
+		if err != nil {
+			return err
+		}
+		if crossOrg {
+			if _, err := tx.Model((*db_models.KitComponent)(nil)).Where("inventory_id = ?", inv.ID).Delete(); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.TargetInventoryID = moved.ID
+	t.State = db_models.TransferCompleted
+	t.CompletedAt = now
+	return nil
+}
+
+// @Summary Move an item to another shelf unit
+// @Description Move some or all units of an item to another shelf unit. A partial move splits the item into a new row on the target unit. Moves within the organisation happen at once; moves to a shelf unit of another organisation stay pending until an admin of that organisation approves them, unless the caller is one.
+// @Tags items
+// @Accept  json
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Param move body api_objects.MoveItemRequest true "Target and amount"
+// @Success 200 {object} api_objects.ItemTransfer "Moved"
+// @Success 202 {object} api_objects.ItemTransfer "Waiting for approval"
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/items/{id}/move [post]
+func (h *Handler) MoveItem(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	var req api_objects.MoveItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var inv db_models.Inventory
+	if err := h.DB.Model(&inv).Relation("Shelf").Where("inventory.id = ?", itemId).Select(); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	if inv.Archived() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "archived items cannot be moved"})
+		return
+	}
+	if req.Amount < 0 || req.Amount > inv.Amount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("amount must be between 1 and %d", inv.Amount)})
+		return
+	}
+	if req.Amount == 0 {
+		req.Amount = inv.Amount
+	}
+	unit, err := targetShelfUnit(h.DB, req.ShelfUnitID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "shelf unit not found"})
+		return
+	}
+	if unit.ID == inv.ShelfUnitID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "item is already on that shelf unit"})
+		return
+	}
+
+	userID := currentUserID(c)
+	now := time.Now()
+	transfer := &db_models.ItemTransfer{
+		InventoryID:      inv.ID,
+		Amount:           req.Amount,
+		FromShelfUnitID:  inv.ShelfUnitID,
+		ToShelfUnitID:    unit.ID,
+		FromOrganisation: inv.Shelf.OwnedBy,
+		ToOrganisation:   unit.Column.Shelf.OwnedBy,
+		Note:             req.Note,
+		State:            db_models.TransferPending,
+		RequestedBy:      userID,
+		SourceApprovedBy: userID,
+		SourceApprovedAt: now,
+		CreatedAt:        now,
+	}
+	if transfer.ToOrganisation == transfer.FromOrganisation {
+		transfer.TargetApprovedBy = userID
+		transfer.TargetApprovedAt = now
+	} else if userID != 0 && auth.TokenAllowsOrgAdmin(c, transfer.ToOrganisation) {
+		// The same check as RequireOrgAdmin: a token scoped to the source alone
+		// cannot approve for the target.
+		admin, err := h.hasSpecialRights(userID, transfer.ToOrganisation)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if admin {
+			transfer.TargetApprovedBy = userID
+			transfer.TargetApprovedAt = now
+		}
+	}
+
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		if !transfer.TargetApprovedAt.IsZero() {
+			if err := carryOut(tx, transfer, userID); err != nil {
+				return err
+			}
+		} else {
+			// Check now rather than let the other organisation approve a move that cannot happen.
+			committed, err := committedAmount(tx, inv.ID)
+			if err != nil {
+				return err
+			}
+			assets, err := tx.Model((*db_models.Asset)(nil)).Where("inventory_id = ?", inv.ID).Count()
+			if err != nil {
+				return err
+			}
+			if err := checkMoveAmount(inv, transfer.Amount, committed, assets, true); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Model(transfer).Insert()
+		return err
+	})
+	if errors.Is(err, errCannotMove) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionCreate, Entity: "item_transfer", EntityID: transfer.ID,
+		Organisation: transfer.FromOrganisation, After: transfer,
+	})
+	transfer.Inventory = &inv
+	status := http.StatusOK
+	if transfer.State == db_models.TransferPending {
+		status = http.StatusAccepted
+	}
+	c.JSON(status, toItemTransfer(*transfer))
+}
+
+// @Summary List the transfers of an item
+// @Description List the moves of an item, oldest first: those it was moved or split off from and those that moved it
+// @Tags items
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param id path int true "Inventory Item ID"
+// @Success 200 {array} api_objects.ItemTransfer
+// @Router /organisations/{orgId}/items/{id}/transfers [get]
+func (h *Handler) GetItemTransfers(c *gin.Context) {
+	itemId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		return
+	}
+	var transfers []db_models.ItemTransfer
+	err = h.DB.Model(&transfers).
+		Relation("Inventory").
+		Where("item_transfer.inventory_id = ?", itemId).
+		WhereOr("item_transfer.target_inventory_id = ?", itemId).
+		Order("item_transfer.id").
+		Select()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.ItemTransfer, 0, len(transfers))
+	for _, t := range transfers {
+		res = append(res, toItemTransfer(t))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// @Summary List the transfers of an organisation
+// @Description List the item moves from or to an organisation, newest first
+// @Tags transfers
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param state query string false "Only transfers in this state: pending, completed or rejected"
+// @Success 200 {array} api_objects.ItemTransfer
+// @Router /organisations/{orgId}/transfers [get]
+func (h *Handler) GetTransfers(c *gin.Context) {
+	org := c.Param("orgId")
+	var transfers []db_models.ItemTransfer
+	q := h.DB.Model(&transfers).
+		Relation("Inventory").
+		WhereGroup(func(q *pg.Query) (*pg.Query, error) {
+			return q.Where("item_transfer.from_organisation = ?", org).
+				WhereOr("item_transfer.to_organisation = ?", org), nil
+		}).
+		Order("item_transfer.id DESC")
+	if state := c.Query("state"); state != "" {
+		q = q.Where("item_transfer.state = ?", state)
+	}
+	if err := q.Select(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]api_objects.ItemTransfer, 0, len(transfers))
+	for _, t := range transfers {
+		res = append(res, toItemTransfer(t))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// decideTransfer loads a pending transfer of the organisation in :orgId for
+// update and hands it to decide inside a transaction. It answers the request.
+func (h *Handler) decideTransfer(c *gin.Context, decide func(tx *pg.Tx, t *db_models.ItemTransfer) error) (*db_models.ItemTransfer, bool) {
+	id, err := strconv.Atoi(c.Param("transferId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid transfer id"})
+		return nil, false
+	}
+	org := c.Param("orgId")
+	var transfer db_models.ItemTransfer
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		if err := tx.Model(&transfer).Where("id = ?", id).For("UPDATE").Select(); err != nil {
+			return err
+		}
+		if transfer.FromOrganisation != org && transfer.ToOrganisation != org {
+			return errNotTransferSide
+		}
+		if transfer.State != db_models.TransferPending {
+			return errTransferClosed
+		}
+		if err := decide(tx, &transfer); err != nil {
+			return err
+		}
+		_, err := tx.Model(&transfer).WherePK().Update()
+		return err
+	})
+	switch {
+	case errors.Is(err, pg.ErrNoRows), errors.Is(err, errNotTransferSide):
+		c.JSON(http.StatusNotFound, gin.H{"error": "transfer not found"})
+	case errors.Is(err, errTransferClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "state": transfer.State})
+	case errors.Is(err, errCannotMove):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		return &transfer, true
+	}
+	return nil, false
+}
+
+// @Summary Approve a transfer
+// @Description Approve a pending move for the organisation in the path. The item moves once both organisations approved; if it can no longer move as requested, the approval is refused.
+// @Tags transfers
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param transferId path int true "Transfer ID"
+// @Success 200 {object} api_objects.ItemTransfer
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/transfers/{transferId}/approve [post]
+func (h *Handler) ApproveTransfer(c *gin.Context) {
+	userID := currentUserID(c)
+	before := db_models.ItemTransfer{}
+	transfer, ok := h.decideTransfer(c, func(tx *pg.Tx, t *db_models.ItemTransfer) error {
+		before = *t
+		now := time.Now()
+		if t.FromOrganisation == c.Param("orgId") && t.SourceApprovedAt.IsZero() {
+			t.SourceApprovedBy = userID
+			t.SourceApprovedAt = now
+		}
+		if t.ToOrganisation == c.Param("orgId") && t.TargetApprovedAt.IsZero() {
+			t.TargetApprovedBy = userID
+			t.TargetApprovedAt = now
+		}
+		if t.SourceApprovedAt.IsZero() || t.TargetApprovedAt.IsZero() {
+			return nil
+		}
+		return carryOut(tx, t, userID)
+	})
+	if !ok {
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "item_transfer", EntityID: transfer.ID,
+		Organisation: c.Param("orgId"), Before: before, After: transfer,
+	})
+	c.JSON(http.StatusOK, toItemTransfer(*transfer))
+}
+
+// @Summary Reject a transfer
+// @Description Reject a pending move, or withdraw it on behalf of the organisation that asked for it
+// @Tags transfers
+// @Produce  json
+// @Param orgId path string true "Organisation name"
+// @Param transferId path int true "Transfer ID"
+// @Success 200 {object} api_objects.ItemTransfer
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/transfers/{transferId}/reject [post]
+func (h *Handler) RejectTransfer(c *gin.Context) {
+	before := db_models.ItemTransfer{}
+	transfer, ok := h.decideTransfer(c, func(_ *pg.Tx, t *db_models.ItemTransfer) error {
+		before = *t
+		t.State = db_models.TransferRejected
+		t.CompletedAt = time.Now()
+		return nil
+	})
+	if !ok {
+		return
+	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "item_transfer", EntityID: transfer.ID,
+		Organisation: c.Param("orgId"), Before: before, After: transfer,
+	})
+	c.JSON(http.StatusOK, toItemTransfer(*transfer))
+}
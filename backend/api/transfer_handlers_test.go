@@ -0,0 +1,264 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/api_objects"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+func TestCheckMoveAmount(t *testing.T) {
+	item := db_models.Inventory{Amount: 10}
+	consumable := db_models.Inventory{Amount: 10, IsConsumable: true}
+	testCases := []struct {
+		name      string
+		inv       db_models.Inventory
+		amount    int
+		committed int
+		assets    int
+		crossOrg  bool
+		ok        bool
+	}{
+		{"part of a free item", item, 4, 0, 0, false, true},
+		{"more than there is", item, 11, 0, 0, false, false},
+		{"nothing", item, 0, 0, 0, false, false},
+		{"reserved units stay behind", item, 8, 3, 0, false, false},
+		{"free units of a reserved item", item, 7, 3, 0, false, true},
+		{"whole reserved item within the organisation", item, 10, 3, 0, false, true},
+		{"whole reserved item to another organisation", item, 10, 3, 0, true, false},
+		{"part of an asset-backed item", item, 4, 0, 4, false, false},
+		{"whole asset-backed item", item, 10, 0, 10, true, true},
+		{"part of a requested consumable", consumable, 9, 5, 0, false, true},
+		{"requested consumable to another organisation", consumable, 9, 5, 0, true, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkMoveAmount(tc.inv, tc.amount, tc.committed, tc.assets, tc.crossOrg)
+			assert.Equal(t, tc.ok, err == nil, err)
+			if err != nil {
+				assert.True(t, errors.Is(err, errCannotMove))
+			}
+		})
+	}
+}
+
+func TestMoveItem(t *testing.T) {
+	router, dbCon := setupTestRouter()
+	defer dbCon.Close()
+
+	source := &db_models.Organisation{Name: "Move Source Org"}
+	target := &db_models.Organisation{Name: "Move Target Org"}
+	_, err := dbCon.Model(source, target).Insert()
+	assert.NoError(t, err)
+
+	hier := createTestHierarchy(t, dbCon)
+	hier.Shelf.OwnedBy = source.Name
+	_, err = dbCon.Model(hier.Shelf).WherePK().Update()
+	assert.NoError(t, err)
+	assert.NoError(t, db.ReconcileStock(dbCon, hier.Inventory.ID, 10, db_models.StockCorrection, "opening balance", 0))
+
+	// A second unit on the same shelf, and a shelf of the target organisation.
+	near := &db_models.ShelfUnit{ID: "MV-SU-1", ColumnID: hier.Column.ID, PositionInColumn: 1}
+	_, err = dbCon.Model(near).Insert()
+	assert.NoError(t, err)
+	shelf := &db_models.Shelf{ID: "MV-S-2", Name: "Target Shelf", OwnedBy: target.Name, RoomID: hier.Room.ID, UpdateDate: time.Now()}
+	_, err = dbCon.Model(shelf).Insert()
+	assert.NoError(t, err)
+	column := &db_models.Column{ID: "MV-C-2", ShelfID: shelf.ID}
+	_, err = dbCon.Model(column).Insert()
+	assert.NoError(t, err)
+	far := &db_models.ShelfUnit{ID: "MV-SU-2", ColumnID: column.ID}
+	_, err = dbCon.Model(far).Insert()
+	assert.NoError(t, err)
+
+	// An admin of both organisations, acting once with a token scoped to the source only.
+	admin := &db_models.User{Email: "move-admin@example.com", Name: "Move Admin"}
+	_, err = dbCon.Model(admin).Insert()
+	assert.NoError(t, err)
+	rights := []db_models.HasSpecialRightsFor{
+		{OrganisationName: source.Name, UserID: admin.ID},
+		{OrganisationName: target.Name, UserID: admin.ID},
+	}
+	_, err = dbCon.Model(&rights).Insert()
+	assert.NoError(t, err)
+	sourceToken := &db_models.APIToken{UserID: admin.ID, Scopes: []string{"org-admin:" + source.Name}}
+
+	var split []int
+	defer func() {
+		ids := append([]int{hier.Inventory.ID}, split...)
+		for _, id := range ids {
+			_, _ = dbCon.Model((*db_models.ItemTransfer)(nil)).Where("inventory_id = ? OR target_inventory_id = ?", id, id).Delete()
+			_, _ = dbCon.Model((*db_models.StockMovement)(nil)).Where("inventory_id = ?", id).Delete()
+		}
+		for _, id := range split {
+			_, _ = dbCon.Model((*db_models.Inventory)(nil)).Where("id = ?", id).Delete()
+		}
+		_, _ = dbCon.Model((*db_models.AuditLog)(nil)).Where("organisation_name IN (?, ?)", source.Name, target.Name).Delete()
+		_, _ = dbCon.Model(far).WherePK().Delete()
+		_, _ = dbCon.Model(column).WherePK().Delete()
+		_, _ = dbCon.Model(shelf).WherePK().Delete()
+		// The item may have been moved off the hierarchy; put it back for the cleanup.
+		_, _ = dbCon.Model(hier.Inventory).Column("shelf_unit_id", "shelf_id").WherePK().Update()
+		_, _ = dbCon.Model(near).WherePK().Delete()
+		cleanupTestHierarchy(t, dbCon, hier)
+		_, _ = dbCon.Model((*db_models.HasSpecialRightsFor)(nil)).Where("user_id = ?", admin.ID).Delete()
+		_, _ = dbCon.Model(admin).WherePK().Delete()
+		_, _ = dbCon.Model(source).WherePK().Delete()
+		_, _ = dbCon.Model(target).WherePK().Delete()
+	}()
+
+	h := NewHandler(dbCon, nil)
+	router.POST("/organisations/:orgId/items/:id/move", h.MoveItem)
+	router.GET("/organisations/:orgId/items/:id/transfers", h.GetItemTransfers)
+	router.GET("/organisations/:orgId/transfers", h.GetTransfers)
+	router.POST("/organisations/:orgId/transfers/:transferId/approve", h.ApproveTransfer)
+	router.POST("/organisations/:orgId/transfers/:transferId/reject", h.RejectTransfer)
+	router.DELETE("/organisations/:orgId/shelves/:shelfId", h.DeleteShelf)
+	router.POST("/session/organisations/:orgId/items/:id/move", withUser(admin), h.MoveItem)
+	router.POST("/token/organisations/:orgId/items/:id/move", withUser(admin), func(c *gin.Context) {
+		c.Set("apiToken", sourceToken)
+		c.Next()
+	}, h.MoveItem)
+
+	sourceURL := "/organisations/" + url.PathEscape(source.Name)
+	targetURL := "/organisations/" + url.PathEscape(target.Name)
+	itemURL := sourceURL + "/items/" + strconv.Itoa(hier.Inventory.ID)
+	do := func(method, path, body string) (*httptest.ResponseRecorder, api_objects.ItemTransfer) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var transfer api_objects.ItemTransfer
+		_ = json.Unmarshal(w.Body.Bytes(), &transfer)
+		return w, transfer
+	}
+	amountOf := func(id int) (int, string) {
+		var inv db_models.Inventory
+		assert.NoError(t, dbCon.Model(&inv).Where("id = ?", id).Select())
+		return inv.Amount, inv.ShelfUnitID
+	}
+
+	t.Run("invalid moves", func(t *testing.T) {
+		w, _ := do(http.MethodPost, itemURL+"/move", `{"shelfUnitId": "no-such-unit"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, _ = do(http.MethodPost, itemURL+"/move", `{"shelfUnitId": "H-SU-1"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, _ = do(http.MethodPost, itemURL+"/move", `{"shelfUnitId": "MV-SU-1", "amount": 11}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("partial move within the organisation splits the item", func(t *testing.T) {
+		w, transfer := do(http.MethodPost, itemURL+"/move", `{"shelfUnitId": "MV-SU-1", "amount": 3, "note": "second bin"}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, db_models.TransferCompleted, transfer.State)
+		assert.NotEqual(t, hier.Inventory.ID, transfer.TargetItemID)
+		split = append(split, transfer.TargetItemID)
+
+		amount, unit := amountOf(hier.Inventory.ID)
+		assert.Equal(t, 7, amount)
+		assert.Equal(t, hier.ShelfUnit.ID, unit)
+		amount, unit = amountOf(transfer.TargetItemID)
+		assert.Equal(t, 3, amount)
+		assert.Equal(t, near.ID, unit)
+		level, err := db.StockLevel(dbCon, transfer.TargetItemID)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, level)
+	})
+
+	var pending api_objects.ItemTransfer
+	t.Run("move to another organisation waits for approval", func(t *testing.T) {
+		var w *httptest.ResponseRecorder
+		w, pending = do(http.MethodPost, itemURL+"/move", `{"shelfUnitId": "MV-SU-2", "amount": 2}`)
+		assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		assert.Equal(t, db_models.TransferPending, pending.State)
+		assert.True(t, pending.SourceApproved)
+		assert.False(t, pending.TargetApproved)
+		amount, _ := amountOf(hier.Inventory.ID)
+		assert.Equal(t, 7, amount)
+
+		w = httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, targetURL+"/transfers?state=pending", nil)
+		router.ServeHTTP(w, req)
+		var list []api_objects.ItemTransfer
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		if assert.Len(t, list, 1) {
+			assert.Equal(t, pending.ID, list[0].ID)
+		}
+	})
+
+	t.Run("the target organisation approves", func(t *testing.T) {
+		path := "/transfers/" + strconv.Itoa(pending.ID) + "/approve"
+		w, _ := do(http.MethodPost, "/organisations/Elsewhere"+path, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w, transfer := do(http.MethodPost, targetURL+path, "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, db_models.TransferCompleted, transfer.State)
+		split = append(split, transfer.TargetItemID)
+		amount, unit := amountOf(transfer.TargetItemID)
+		assert.Equal(t, 2, amount)
+		assert.Equal(t, far.ID, unit)
+		amount, _ = amountOf(hier.Inventory.ID)
+		assert.Equal(t, 5, amount)
+
+		w, _ = do(http.MethodPost, targetURL+path, "")
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("a rejected move leaves the item", func(t *testing.T) {
+		w, transfer := do(http.MethodPost, itemURL+"/move", `{"shelfUnitId": "MV-SU-2"}`)
+		assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		w, transfer = do(http.MethodPost, targetURL+"/transfers/"+strconv.Itoa(transfer.ID)+"/reject", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, db_models.TransferRejected, transfer.State)
+		amount, unit := amountOf(hier.Inventory.ID)
+		assert.Equal(t, 5, amount)
+		assert.Equal(t, hier.ShelfUnit.ID, unit)
+	})
+
+	t.Run("history", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, itemURL+"/transfers", nil)
+		router.ServeHTTP(w, req)
+		var history []api_objects.ItemTransfer
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+		states := []string{}
+		for _, tr := range history {
+			states = append(states, tr.State)
+		}
+		assert.Equal(t, []string{db_models.TransferCompleted, db_models.TransferCompleted, db_models.TransferRejected}, states)
+	})
+
+	t.Run("an admin of both sides approves for the target only with a matching token", func(t *testing.T) {
+		w, transfer := do(http.MethodPost, "/token"+itemURL+"/move", `{"shelfUnitId": "MV-SU-2", "amount": 1}`)
+		assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		assert.False(t, transfer.TargetApproved, "the token is scoped to the source organisation")
+		w, _ = do(http.MethodPost, targetURL+"/transfers/"+strconv.Itoa(transfer.ID)+"/reject", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w, transfer = do(http.MethodPost, "/session"+itemURL+"/move", `{"shelfUnitId": "MV-SU-2", "amount": 1}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, db_models.TransferCompleted, transfer.State)
+		split = append(split, transfer.TargetItemID)
+	})
+
+	t.Run("moved items are not deleted with their shelf", func(t *testing.T) {
+		before, err := dbCon.Model((*db_models.ItemTransfer)(nil)).Where("to_organisation = ?", target.Name).Count()
+		assert.NoError(t, err)
+		w, _ := do(http.MethodDelete, targetURL+"/shelves/"+shelf.ID+"?cascade=true", "")
+		assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+		after, err := dbCon.Model((*db_models.ItemTransfer)(nil)).Where("to_organisation = ?", target.Name).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, before, after, "transfers are kept")
+	})
+}
@@ -1,15 +1,24 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 	"lagertool.com/main/api_objects"
+	"lagertool.com/main/audit"
 	"lagertool.com/main/db"
 	"lagertool.com/main/db_models"
 )
 
+var errBelowCommitted = errors.New("amount is below what is reserved or on loan")
+
 // @Summary Update a request
 // @Description Update the status of a request
 // @Tags requests
@@ -30,11 +39,19 @@ func (h *Handler) UpdateRequest(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	var before db_models.Request
+	_ = h.DB.Model(&before).Where("id = ?", requestId).Select()
 	err = db.UpdateRequest(h.DB, requestId, req.Outcome)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	after := before
+	after.State = req.Outcome
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "request", EntityID: requestId,
+		Organisation: before.OrganisationName, Before: before, After: after,
+	})
 	c.JSON(http.StatusAccepted, req)
 }
 
@@ -58,11 +75,14 @@ func (h *Handler) UpdateLoan(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	var before db_models.Loans
+	_ = h.DB.Model(&before).Relation("RequestItems.Request").Where("loans.id = ?", loanId).Select()
 	err = db.UpdateLoan(h.DB, loanId, req.ReturnedAt, true)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.recordLoanReturned(c, loanId, before, req.ReturnedAt)
 	c.JSON(http.StatusAccepted, req)
 }
 
@@ -88,6 +108,7 @@ func (h *Handler) UpdateLoanBulk(c *gin.Context) {
 	}
 	var dbRes []db_models.Loans
 	err = h.DB.Model(&dbRes).
+		Relation("RequestItems.Request").
 		Where("request_item_id IN (SELECT id FROM request_items WHERE request_id = ?)", requestId).
 		Select()
 	if err != nil {
@@ -100,18 +121,21 @@ func (h *Handler) UpdateLoanBulk(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		h.recordLoanReturned(c, loan.ID, loan, req.ReturnedAt)
 	}
 	c.JSON(http.StatusAccepted, req)
 }
 
 // @Summary Update an inventory item
-// @Description Update an inventory item's details
+// @Description Update the fields of an inventory item that are set in the body. A new shelf unit must belong to the same organisation, and the amount cannot drop below what is reserved or on loan.
 // @Tags items
 // @Accept  json
 // @Produce  json
 // @Param id path int true "Inventory Item ID"
 // @Param item body api_objects.UpdateItemRequest true "Update details"
 // @Success 200 {object} db_models.Inventory
+// @Failure 409 {object} map[string]string
+// @Router /organisations/{orgId}/items/{id} [patch]
 // @Router /organisations/{orgId}/items/{id} [put]
 func (h *Handler) UpdateItem(c *gin.Context) {
 	itemId, err := strconv.Atoi(c.Param("id"))
@@ -131,22 +155,176 @@ func (h *Handler) UpdateItem(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
 		return
 	}
+	before := inv
+	org, err := orgOfItem("id")(c, h.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
+	// Only the columns the request sets are written, so that concurrent edits of
+	// other fields and stock movements are not overwritten.
+	columns := []string{"update_date"}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name cannot be empty"})
+			return
+		}
+		inv.Name = name
+		columns = append(columns, "name")
+	}
+	if req.IsConsumable != nil {
+		inv.IsConsumable = *req.IsConsumable
+		columns = append(columns, "is_consumable")
+	}
+	if req.MinStock != nil {
+		inv.MinStock = *req.MinStock
+		columns = append(columns, "min_stock")
+	}
+	if req.ReorderQuantity != nil {
+		inv.ReorderQuantity = *req.ReorderQuantity
+		columns = append(columns, "reorder_quantity")
+	}
+	if !inv.IsConsumable && req.MinStock == nil && req.ReorderQuantity == nil {
+		// Thresholds only apply to consumables; drop them with the flag.
+		inv.MinStock, inv.ReorderQuantity, inv.LowStockSince = 0, 0, time.Time{}
+		columns = append(columns, "min_stock", "reorder_quantity", "low_stock_since")
+	}
+	if err := checkReorderSettings(inv.IsConsumable, inv.MinStock, inv.ReorderQuantity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if req.Amount != nil {
+		if *req.Amount < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "amount cannot be negative"})
+			return
+		}
 		inv.Amount = *req.Amount
+		columns = append(columns, "amount")
+	}
+	if inv.Amount != before.Amount || inv.IsConsumable && !before.IsConsumable {
+		assets, err := h.DB.Model((*db_models.Asset)(nil)).Where("inventory_id = ?", itemId).Count()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if assets > 0 && inv.IsConsumable {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "consumable items cannot have assets"})
+			return
+		}
+		if assets > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the amount of a serialized item follows its assets"})
+			return
+		}
 	}
 	if req.Note != nil {
 		inv.Note = *req.Note
+		columns = append(columns, "note")
+	}
+	if req.ShelfUnitID != nil && *req.ShelfUnitID != inv.ShelfUnitID {
+		var unit db_models.ShelfUnit
+		err := h.DB.Model(&unit).Relation("Column.Shelf").Where("shelf_unit.id = ?", *req.ShelfUnitID).Select()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "shelf unit not found"})
+			return
+		}
+		if unit.Column.Shelf.OwnedBy != org {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "shelf unit belongs to another organisation"})
+			return
+		}
+		inv.ShelfUnitID = unit.ID
+		inv.ShelfID = unit.Column.ShelfID
+		columns = append(columns, "shelf_unit_id", "shelf_id")
+	}
+	if req.CategoryID != nil {
+		ok, err := h.categoryBelongsTo(*req.CategoryID, org)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "category not found"})
+			return
+		}
+		inv.CategoryID = *req.CategoryID
+		columns = append(columns, "category_id")
 	}
-	if req.ShelfUnitID != nil {
-		inv.ShelfUnitID = *req.ShelfUnitID
+	if req.Tags != nil {
+		inv.Tags = normalizeTags(req.Tags)
+		columns = append(columns, "tags")
 	}
+	if req.Attributes != nil || inv.CategoryID != before.CategoryID {
+		values := req.Attributes
+		if values == nil {
+			// Keep what the new category still defines.
+			values, err = h.withoutUndefined(inv.CategoryID, inv.Attributes)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		attributes, ok := h.itemAttributes(c, inv.CategoryID, values)
+		if !ok {
+			return
+		}
+		inv.Attributes = attributes
+		columns = append(columns, "attributes")
+	}
+	inv.UpdateDate = time.Now()
 
-	_, err = h.DB.Model(&inv).WherePK().Update()
-	if err != nil {
+	var committed int
+	err = h.DB.RunInTransaction(c.Request.Context(), func(tx *pg.Tx) error {
+		// Re-read under lock: the amount may have moved since the checks above.
+		if err := tx.Model(&before).Where("id = ?", itemId).For("UPDATE").Select(); err != nil {
+			return err
+		}
+		amount, consumable := before.Amount, before.IsConsumable
+		if req.Amount != nil {
+			amount = *req.Amount
+		}
+		if req.IsConsumable != nil {
+			consumable = *req.IsConsumable
+		}
+		if amount < before.Amount {
+			var err error
+			if committed, err = committedAmount(tx, itemId); err != nil {
+				return err
+			}
+			if amount < committed {
+				return errBelowCommitted
+			}
+		}
+		if _, err := tx.Model(&inv).Column(columns...).WherePK().Update(); err != nil {
+			return err
+		}
+		if consumable && (amount != before.Amount || !before.IsConsumable) {
+			// Setting the amount of a consumable is recorded as a correction in its ledger.
+			err := db.ReconcileStock(tx, inv.ID, amount, db_models.StockCorrection, "amount edited", currentUserID(c))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(&inv).WherePK().Select()
+	})
+	switch {
+	case errors.Is(err, pg.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	case errors.Is(err, errBelowCommitted):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   err.Error(),
+			"details": fmt.Sprintf("%d units are reserved or on loan", committed),
+		})
+		return
+	case err != nil:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "inventory", EntityID: inv.ID,
+		Organisation: org, Before: before, After: inv,
+	})
 	c.JSON(http.StatusOK, inv)
 }
 
@@ -161,14 +339,19 @@ func (h *Handler) UpdateItem(c *gin.Context) {
 // @Success 200
 // @Router /users/{userId}/cart/items/{itemId} [put]
 func (h *Handler) UpdateCartItem(c *gin.Context) {
-	itemId, err := strconv.Atoi(c.Param("itemId"))
+	h.updateCartEntry(c, "inventory_id", "itemId")
+}
+
+// updateCartEntry sets the amount of the cart entry whose column matches the
+// path parameter param, i.e. an item or a kit.
+func (h *Handler) updateCartEntry(c *gin.Context, column string, param string) {
+	itemId, err := strconv.Atoi(c.Param(param))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid item id"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + strings.TrimSuffix(param, "Id") + " id"})
 		return
 	}
-	userId, err := strconv.Atoi(c.Param("userId"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+	userId, ok := actingUserID(c)
+	if !ok {
 		return
 	}
 	var req api_objects.UpdateCartItem
@@ -184,10 +367,47 @@ func (h *Handler) UpdateCartItem(c *gin.Context) {
 	}
 
 	var it db_models.ShoppingCartItem
-	res, err := h.DB.Model(&it).Set("amount = ?", req.Amount).Where("inventory_id = ?", itemId).Where("shopping_cart_id = ?", i.ID).Update()
+	res, err := h.DB.Model(&it).Set("amount = ?", req.Amount).Where("? = ?", pg.Ident(column), itemId).Where("shopping_cart_id = ?", i.ID).Update()
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
 		return
 	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "shopping_cart_item", EntityID: itemId,
+		After: gin.H{"user_id": userId, column: itemId, "amount": req.Amount},
+	})
 	c.JSON(http.StatusOK, res)
 }
+
+// committedAmount is how many units of an item are held by requests that were
+// not rejected and have not ended yet, or whose loans are not returned. Consumed
+// request items are left out as their units already left the stock.
+func committedAmount(con orm.DB, itemID int) (int, error) {
+	var committed int
+	err := con.Model((*db_models.RequestItems)(nil)).
+		ColumnExpr("COALESCE(SUM(request_items.amount), 0)").
+		Join("JOIN request ON request.id = request_items.request_id").
+		Where("request_items.inventory_id = ?", itemID).
+		Where("request.state != 'rejected'").
+		Where("NOT EXISTS (SELECT 1 FROM consumed WHERE consumed.request_item_id = request_items.id)").
+		Where("request.end_date >= ? OR EXISTS (SELECT 1 FROM loans WHERE loans.request_item_id = request_items.id AND loans.returned = false)", time.Now()).
+		Select(pg.Scan(&committed))
+	return committed, err
+}
+
+// recordLoanReturned audits a loan being marked as returned. before is the loan
+// as it was, loaded with RequestItems.Request for the organisation.
+func (h *Handler) recordLoanReturned(c *gin.Context, loanID int, before db_models.Loans, returnedAt time.Time) {
+	var org string
+	if before.RequestItems != nil && before.RequestItems.Request != nil {
+		org = before.RequestItems.Request.OrganisationName
+	}
+	before.RequestItems = nil
+	after := before
+	after.IsReturned = true
+	after.ReturnedAt = returnedAt
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionUpdate, Entity: "loans", EntityID: loanID,
+		Organisation: org, Before: before, After: after,
+	})
+}
@@ -1,8 +1,11 @@
 package api
 
 import (
+	"errors"
 	"time"
 
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 	"lagertool.com/main/api_objects"
 	"lagertool.com/main/db_models"
 )
@@ -12,6 +15,8 @@ func toBuilding(b db_models.Building) api_objects.Building {
 		ID:         b.ID,
 		Name:       b.Name,
 		Campus:     b.Campus,
+		GPS:        b.GPS,
+		OwnedBy:    b.OwnedBy,
 		UpdateDate: b.UpdateDate.Format(time.RFC3339),
 	}
 }
@@ -27,15 +32,188 @@ func toRoom(r db_models.Room) api_objects.Room {
 		Floor:      r.Floor,
 		Name:       r.Name,
 		Building:   building,
+		OwnedBy:    r.OwnedBy,
 		UpdateDate: r.UpdateDate.Format(time.RFC3339),
 	}
 }
 
+func toAPIToken(t db_models.APIToken) api_objects.APIToken {
+	res := api_objects.APIToken{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scopes:    t.Scopes,
+		CreatedAt: t.CreatedAt,
+	}
+	if !t.ExpiresAt.IsZero() {
+		res.ExpiresAt = &t.ExpiresAt
+	}
+	if !t.LastUsedAt.IsZero() {
+		res.LastUsedAt = &t.LastUsedAt
+	}
+	return res
+}
+
+func toAsset(a db_models.Asset, onLoan bool) api_objects.Asset {
+	res := api_objects.Asset{
+		ID:           a.ID,
+		ItemID:       a.InventoryID,
+		SerialNumber: a.SerialNumber,
+		AssetTag:     a.AssetTag,
+		Condition:    a.Condition,
+		Note:         a.Note,
+		OnLoan:       onLoan,
+	}
+	if !a.PurchaseDate.IsZero() {
+		res.PurchaseDate = &a.PurchaseDate
+	}
+	return res
+}
+
+// toCategory converts a category to its API representation.
+func toCategory(c db_models.Category) api_objects.Category {
+	return api_objects.Category{ID: c.ID, Name: c.Name, ParentID: c.ParentID}
+}
+
+// toCategoryRef is toCategory for the optional category of an item.
+func toCategoryRef(c *db_models.Category) *api_objects.Category {
+	if c == nil {
+		return nil
+	}
+	res := toCategory(*c)
+	return &res
+}
+
+func toAttributeDefinition(d db_models.AttributeDefinition) api_objects.AttributeDefinition {
+	return api_objects.AttributeDefinition{
+		ID:         d.ID,
+		CategoryID: d.CategoryID,
+		Key:        d.Key,
+		Label:      d.Label,
+		Type:       d.Type,
+		Unit:       d.Unit,
+		Options:    d.Options,
+		Required:   d.Required,
+	}
+}
+
+// toAttachment links the files of an attachment below the organisation the
+// item is listed under.
+func toAttachment(a db_models.Attachment, org string) api_objects.Attachment {
+	res := api_objects.Attachment{
+		ID:          a.ID,
+		FileName:    a.FileName,
+		ContentType: a.ContentType,
+		Size:        a.Size,
+		URL:         attachmentURL(org, a, "file"),
+		CreatedAt:   a.CreatedAt,
+	}
+	if a.ThumbnailKey != "" {
+		res.ThumbnailURL = attachmentURL(org, a, "thumbnail")
+	}
+	return res
+}
+
+func toStockMovement(m db_models.StockMovement, balance int) api_objects.StockMovement {
+	return api_objects.StockMovement{
+		ID:            m.ID,
+		Quantity:      m.Quantity,
+		Reason:        m.Reason,
+		Note:          m.Note,
+		RequestItemID: m.RequestItemID,
+		UserID:        m.UserID,
+		Balance:       balance,
+		CreatedAt:     m.CreatedAt,
+	}
+}
+
+func toItemTransfer(t db_models.ItemTransfer) api_objects.ItemTransfer {
+	res := api_objects.ItemTransfer{
+		ID:               t.ID,
+		ItemID:           t.InventoryID,
+		TargetItemID:     t.TargetInventoryID,
+		Amount:           t.Amount,
+		FromShelfUnitID:  t.FromShelfUnitID,
+		ToShelfUnitID:    t.ToShelfUnitID,
+		FromOrganisation: t.FromOrganisation,
+		ToOrganisation:   t.ToOrganisation,
+		Note:             t.Note,
+		State:            t.State,
+		RequestedBy:      t.RequestedBy,
+		SourceApproved:   !t.SourceApprovedAt.IsZero(),
+		TargetApproved:   !t.TargetApprovedAt.IsZero(),
+		CreatedAt:        t.CreatedAt,
+	}
+	if t.Inventory != nil {
+		res.ItemName = t.Inventory.Name
+	}
+	if !t.CompletedAt.IsZero() {
+		res.CompletedAt = &t.CompletedAt
+	}
+	return res
+}
+
+func toReorderItem(inv db_models.Inventory) api_objects.ReorderItem {
+	res := api_objects.ReorderItem{
+		ID:              inv.ID,
+		Name:            inv.Name,
+		Amount:          inv.Amount,
+		MinStock:        inv.MinStock,
+		ReorderQuantity: inv.ReorderQuantity,
+		OrderAmount:     orderAmount(inv),
+		Room:            toRoom(*inv.ShelfUnit.Column.Shelf.Room),
+		Building:        toBuilding(*inv.ShelfUnit.Column.Shelf.Room.Building),
+		ShelfElementID:  inv.ShelfUnitID,
+	}
+	if !inv.LowStockSince.IsZero() {
+		res.LowStockSince = &inv.LowStockSince
+	}
+	return res
+}
+
+func archivedAt(inv db_models.Inventory) *time.Time {
+	if !inv.Archived() {
+		return nil
+	}
+	return &inv.ArchivedAt
+}
+
+// isUniqueViolation reports whether err is a Postgres unique_violation.
+func isUniqueViolation(err error) bool {
+	var pgErr pg.Error
+	return errors.As(err, &pgErr) && pgErr.Field('C') == "23505"
+}
+
+func toAuditEntry(l db_models.AuditLog) api_objects.AuditEntry {
+	res := api_objects.AuditEntry{
+		ID:           l.ID,
+		ActorID:      l.ActorID,
+		Action:       l.Action,
+		Entity:       l.Entity,
+		EntityID:     l.EntityID,
+		Organisation: l.OrganisationName,
+		Before:       l.Before,
+		After:        l.After,
+		CreatedAt:    l.CreatedAt,
+	}
+	if l.Actor != nil {
+		res.ActorName = l.Actor.Name
+	}
+	if l.IP != nil {
+		res.IP = l.IP.String()
+	}
+	return res
+}
+
 func (h *Handler) GetShelfHelper(id string, orga string) (api_objects.Shelf, error) {
 	var shelf db_models.Shelf
 	err := h.DB.Model(&shelf).
 		Relation("Room.Building").
-		Relation("Columns.ShelfUnits").Where("shelf.id = ?", id).Where("shelf.owned_by = ?", orga).Select()
+		Relation("Columns", func(q *orm.Query) (*orm.Query, error) {
+			return q.Order("column.id"), nil
+		}).
+		Relation("Columns.ShelfUnits", func(q *orm.Query) (*orm.Query, error) {
+			return q.Order("shelf_unit.position_in_column"), nil
+		}).Where("shelf.id = ?", id).Where("shelf.owned_by = ?", orga).Select()
 	if err != nil {
 		return api_objects.Shelf{}, err
 	}
@@ -64,17 +242,43 @@ func (h *Handler) GetShelfHelper(id string, orga string) (api_objects.Shelf, err
 	return shelfObj, nil
 }
 
+// GetAvailable counts the units of an item that are free between start and end.
+// Consumables have their stock level, which the stock ledger keeps in Amount.
+// Serialized items count their usable assets instead of Amount, minus units still
+// out on loans whose request ended before the window (overdue returns).
 func (h *Handler) GetAvailable(invId int, start time.Time, end time.Time) (int, error) {
 	var dbInv db_models.Inventory
 	err := h.DB.Model(&dbInv).
-		Relation("RequestItems.Request").Where("inventory.id = ?", invId).Select()
+		Relation("RequestItems.Request").
+		Relation("Assets").
+		Where("inventory.id = ?", invId).Select()
 	if err != nil {
 		return 0, err
 	}
 	if dbInv.IsConsumable {
 		return dbInv.Amount, nil
 	}
+	total := dbInv.Amount
 	count := 0
+	if len(dbInv.Assets) > 0 {
+		total = 0
+		for _, a := range dbInv.Assets {
+			if a.Usable() {
+				total++
+			}
+		}
+		count, err = h.DB.Model((*db_models.Loans)(nil)).
+			Join("JOIN request_items ON request_items.id = loans.request_item_id").
+			Join("JOIN request ON request.id = request_items.request_id").
+			Where("request_items.inventory_id = ?", invId).
+			Where("loans.asset_id IS NOT NULL").
+			Where("loans.returned = false").
+			Where("request.end_date < ?", start).
+			Count()
+		if err != nil {
+			return 0, err
+		}
+	}
 	for _, reqItem := range dbInv.RequestItems {
 		if reqItem.Request.State == "rejected" {
 			continue
@@ -84,14 +288,16 @@ func (h *Handler) GetAvailable(invId int, start time.Time, end time.Time) (int,
 			count += reqItem.Amount
 		}
 	}
-	return dbInv.Amount - count, nil
+	return total - count, nil
 }
 
 func (h *Handler) GetInventoryItemHelper(id int, start time.Time, end time.Time) (api_objects.InventoryItem, error) {
 	var dbInv db_models.Inventory
 	var res api_objects.InventoryItem
 	err := h.DB.Model(&dbInv).
-		Relation("ShelfUnit.Column.Shelf.Room.Building").Where("inventory.id = ?", id).Select()
+		Relation("ShelfUnit.Column.Shelf.Room.Building").
+		Relation("Category").
+		Where("inventory.id = ?", id).Select()
 	if err != nil {
 		return api_objects.InventoryItem{}, err
 	}
@@ -106,6 +312,12 @@ func (h *Handler) GetInventoryItemHelper(id int, start time.Time, end time.Time)
 	res.Building = toBuilding(*dbInv.ShelfUnit.Column.Shelf.Room.Building)
 	res.ShelfID = dbInv.ShelfUnit.Column.Shelf.ID
 	res.ShelfElementID = dbInv.ShelfUnitID
+	res.Category = toCategoryRef(dbInv.Category)
+	res.Tags = dbInv.Tags
+	res.Attributes = dbInv.Attributes
+	res.ArchivedAt = archivedAt(dbInv)
+	res.MinStock = dbInv.MinStock
+	res.ReorderQuantity = dbInv.ReorderQuantity
 	return res, nil
 }
 
@@ -124,6 +336,24 @@ func (h *Handler) GetCartItemHelper(id int, start time.Time, end time.Time) (map
 
 	m := make(map[string][]api_objects.CartItem)
 	for _, item := range shoppingCart.ShoppingCartItems {
+		if item.KitID != 0 {
+			kit, err := h.loadKit(item.KitID)
+			if err != nil {
+				return nil, err
+			}
+			k, err := h.toKit(kit, start, end)
+			if err != nil {
+				return nil, err
+			}
+			var ci api_objects.CartItem
+			ci.ID = kit.ID
+			ci.Name = kit.Name
+			ci.Available = k.Available
+			ci.AmountSelected = item.Amount
+			ci.Kit = &k
+			m[kit.OrganisationName] = append(m[kit.OrganisationName], ci)
+			continue
+		}
 		if item.Inventory.ShelfUnit.Column.Shelf.Room.Building == nil {
 			var building db_models.Building
 			err = h.DB.Model(&building).
@@ -151,3 +381,12 @@ func (h *Handler) GetCartItemHelper(id int, start time.Time, end time.Time) (map
 	}
 	return m, nil
 }
+
+func toOrganisationAdmin(r db_models.HasSpecialRightsFor) api_objects.OrganisationAdmin {
+	res := api_objects.OrganisationAdmin{UserID: r.UserID, Source: r.Source}
+	if r.User != nil {
+		res.Name = r.User.Name
+		res.Email = r.User.Email
+	}
+	return res
+}
@@ -2,6 +2,14 @@ package api_objects
 
 import "time"
 
+type OrganisationRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type OrganisationAdminRequest struct {
+	UserID int `json:"userId" binding:"required"`
+}
+
 type BuildingRequest struct {
 	Name   string `json:"name" binding:"required"`
 	Campus string `json:"campus"`
@@ -13,6 +21,27 @@ type RoomRequest struct {
 	Number string `json:"number" binding:"required"`
 }
 
+// UpdateBuildingRequest changes only the fields that are set.
+type UpdateBuildingRequest struct {
+	Name   *string `json:"name"`
+	Campus *string `json:"campus"`
+	GPS    *string `json:"gps"`
+}
+
+// UpdateRoomRequest changes only the fields that are set.
+type UpdateRoomRequest struct {
+	Name       *string `json:"name"`
+	Floor      *string `json:"floor"`
+	Number     *string `json:"number"`
+	BuildingID *int    `json:"buildingId"`
+}
+
+// UpdateShelfRequest changes only the fields that are set.
+type UpdateShelfRequest struct {
+	Name   *string `json:"name"`
+	RoomID *int    `json:"roomId"`
+}
+
 type ShelfElementRequest struct {
 	ID   string `json:"id" binding:"required"`
 	Type string `json:"type" binding:"required"`
@@ -23,24 +52,55 @@ type ColumnElementRequest struct {
 	Elements []ShelfElementRequest `json:"elements" binding:"required"`
 }
 
+// ShelfLayoutRequest is the complete new layout of a shelf. Columns and
+// shelf units are listed in order; those left out are removed.
+type ShelfLayoutRequest struct {
+	Columns []ColumnElementRequest `json:"columns" binding:"required"`
+}
+
 type ShelfRequest struct {
 	ID      string                 `json:"id" binding:"required"`
 	Name    string                 `json:"name" binding:"required"`
 	Columns []ColumnElementRequest `json:"columns" binding:"required"`
 }
 
+// CartRequest adds either an inventory item (id) or a kit (kitId) to the cart.
 type CartRequest struct {
-	InvItemID   int `json:"id" binding:"required"`
+	InvItemID   int `json:"id"`
+	KitID       int `json:"kitId"`
 	NumSelected int `json:"numSelected" binding:"required"`
 }
 
+type KitRequest struct {
+	Name        string                `json:"name" binding:"required"`
+	Description string                `json:"description"`
+	Components  []KitComponentRequest `json:"components" binding:"required"`
+}
+
+type KitComponentRequest struct {
+	ItemID int `json:"itemId"`
+	Amount int `json:"amount"` // units of the item in one kit
+}
+
+type UpdateKitRequest struct {
+	Name        *string               `json:"name"`
+	Description *string               `json:"description"`
+	Components  []KitComponentRequest `json:"components"` // replaces all components; omit to keep them
+}
+
 type InventoryItemRequest struct {
-	Name         string `json:"name" binding:"required"`
-	Amount       int    `json:"amount" binding:"required"`
-	ShelfUnitID  string `json:"shelfUnitId" binding:"required"`
-	ShelfID      string `json:"shelfId" binding:"required"`
-	IsConsumable bool   `json:"isConsumable"`
-	Note         string `json:"note"`
+	Name         string                 `json:"name" binding:"required"`
+	Amount       int                    `json:"amount" binding:"required"`
+	ShelfUnitID  string                 `json:"shelfUnitId" binding:"required"`
+	ShelfID      string                 `json:"shelfId" binding:"required"`
+	IsConsumable bool                   `json:"isConsumable"`
+	Note         string                 `json:"note"`
+	CategoryID   int                    `json:"categoryId"`
+	Tags         []string               `json:"tags"`
+	Attributes   map[string]interface{} `json:"attributes"`
+	// Consumables only: reorder in batches of reorderQuantity below minStock
+	MinStock        int `json:"minStock"`
+	ReorderQuantity int `json:"reorderQuantity"`
 }
 
 type CheckoutRequest struct {
@@ -49,9 +109,9 @@ type CheckoutRequest struct {
 }
 
 type RequestReview struct {
-	UserID  int    `json:"user_id"`
-	Outcome string `json:"outcome"`
-	Note    string `json:"note"`
+	Outcome  string `json:"outcome"`
+	Note     string `json:"note"`
+	AssetIDs []int  `json:"assetIds"` // units to lend out on approval, one per requested unit of a serialized item
 }
 
 type UpdateRequest struct {
@@ -62,17 +122,88 @@ type UpdateLoan struct {
 	ReturnedAt time.Time `json:"returnedAt"`
 }
 
+// UpdateItemRequest changes only the fields that are set.
 type UpdateItemRequest struct {
-	Amount      *int    `json:"amount"`
-	Note        *string `json:"note"`
-	ShelfUnitID *string `json:"shelfUnitId"`
+	Name            *string  `json:"name"`
+	IsConsumable    *bool    `json:"isConsumable"`
+	Amount          *int     `json:"amount"`
+	Note            *string  `json:"note"`
+	ShelfUnitID     *string  `json:"shelfUnitId"`
+	CategoryID      *int     `json:"categoryId"` // 0 removes the category
+	MinStock        *int     `json:"minStock"`
+	ReorderQuantity *int     `json:"reorderQuantity"`
+	Tags            []string `json:"tags"` // replaces all tags; omit to keep them
+	// Replaces all attribute values; omit to keep them
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type CategoryRequest struct {
+	Name     string `json:"name" binding:"required"`
+	ParentID int    `json:"parentId"`
+}
+
+type UpdateCategoryRequest struct {
+	Name     *string `json:"name"`
+	ParentID *int    `json:"parentId"` // 0 makes it a root category
+}
+
+type AttributeDefinitionRequest struct {
+	Key      string   `json:"key" binding:"required"`
+	Label    string   `json:"label"`
+	Type     string   `json:"type" binding:"required"` // string, number, enum or boolean
+	Unit     string   `json:"unit"`
+	Options  []string `json:"options"`
+	Required bool     `json:"required"`
+}
+
+// UpdateAttributeDefinitionRequest cannot change the key or type, which existing values depend on.
+type UpdateAttributeDefinitionRequest struct {
+	Label    *string  `json:"label"`
+	Unit     *string  `json:"unit"`
+	Options  []string `json:"options"`
+	Required *bool    `json:"required"`
+}
+
+type AssetRequest struct {
+	SerialNumber string     `json:"serialNumber"`
+	AssetTag     string     `json:"assetTag"`
+	Condition    string     `json:"condition"` // new, good, worn, broken or lost; defaults to good
+	PurchaseDate *time.Time `json:"purchaseDate"`
+	Note         string     `json:"note"`
+}
+
+type UpdateAssetRequest struct {
+	SerialNumber *string    `json:"serialNumber"`
+	AssetTag     *string    `json:"assetTag"`
+	Condition    *string    `json:"condition"`
+	PurchaseDate *time.Time `json:"purchaseDate"`
+	Note         *string    `json:"note"`
+}
+
+type StockMovementRequest struct {
+	Quantity int    `json:"quantity" binding:"required"` // positive adds stock, negative removes it
+	Reason   string `json:"reason" binding:"required"`   // restock, consumed, lost, damaged, correction or transfer
+	Note     string `json:"note"`
+}
+
+// MoveItemRequest moves Amount units of an item to another shelf unit; an
+// Amount of 0 moves all of them.
+type MoveItemRequest struct {
+	ShelfUnitID string `json:"shelfUnitId" binding:"required"`
+	Amount      int    `json:"amount"`
+	Note        string `json:"note"`
 }
 
 type UserMessage struct {
-	UserID  int    `json:"userId"`
 	Message string `json:"message"`
 }
 
 type UpdateCartItem struct {
 	Amount int `json:"amount"`
 }
+
+type CreateAPIToken struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
@@ -1,6 +1,11 @@
 package api_objects
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"lagertool.com/main/db_models"
+)
 
 type Shelf struct {
 	ID       string        `json:"id"`
@@ -21,19 +26,68 @@ type ShelfElement struct {
 }
 
 type InventoryItem struct {
-	ID             int      `json:"id"`
-	Name           string   `json:"name"`
-	Amount         int      `json:"amount"`
-	Available      int      `json:"available"`
-	Building       Building `json:"building"`
-	Room           Room     `json:"room"`
-	ShelfID        string   `json:"shelfId"`
-	ShelfElementID string   `json:"shelfElementId"`
+	ID              int                    `json:"id"`
+	Name            string                 `json:"name"`
+	Amount          int                    `json:"amount"`
+	Available       int                    `json:"available"`
+	Building        Building               `json:"building"`
+	Room            Room                   `json:"room"`
+	ShelfID         string                 `json:"shelfId"`
+	ShelfElementID  string                 `json:"shelfElementId"`
+	Category        *Category              `json:"category,omitempty"`
+	Tags            []string               `json:"tags,omitempty"`
+	Attributes      map[string]interface{} `json:"attributes,omitempty"`
+	ArchivedAt      *time.Time             `json:"archivedAt,omitempty"`
+	MinStock        int                    `json:"minStock,omitempty"`
+	ReorderQuantity int                    `json:"reorderQuantity,omitempty"`
 }
 
 type InventoryItemWithShelf struct {
 	InventoryItem
-	Shelf Shelf `json:"shelf"`
+	Shelf                Shelf                 `json:"shelf"`
+	Assets               []Asset               `json:"assets,omitempty"`
+	AttributeDefinitions []AttributeDefinition `json:"attributeDefinitions,omitempty"`
+	Attachments          []Attachment          `json:"attachments,omitempty"`
+}
+
+type Attachment struct {
+	ID           int       `json:"id"`
+	FileName     string    `json:"fileName"`
+	ContentType  string    `json:"contentType"`
+	Size         int64     `json:"size"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnailUrl,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+type StockMovement struct {
+	ID            int       `json:"id"`
+	Quantity      int       `json:"quantity"`
+	Reason        string    `json:"reason"`
+	Note          string    `json:"note,omitempty"`
+	RequestItemID int       `json:"requestItemId,omitempty"`
+	UserID        int       `json:"userId,omitempty"`
+	Balance       int       `json:"balance"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type ItemTransfer struct {
+	ID               int        `json:"id"`
+	ItemID           int        `json:"itemId"`
+	ItemName         string     `json:"itemName,omitempty"`
+	TargetItemID     int        `json:"targetItemId,omitempty"` // the row the units ended up in
+	Amount           int        `json:"amount"`
+	FromShelfUnitID  string     `json:"fromShelfUnitId"`
+	ToShelfUnitID    string     `json:"toShelfUnitId"`
+	FromOrganisation string     `json:"fromOrganisation"`
+	ToOrganisation   string     `json:"toOrganisation"`
+	Note             string     `json:"note,omitempty"`
+	State            string     `json:"state"` // pending, completed or rejected
+	RequestedBy      int        `json:"requestedBy,omitempty"`
+	SourceApproved   bool       `json:"sourceApproved"`
+	TargetApproved   bool       `json:"targetApproved"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	CompletedAt      *time.Time `json:"completedAt,omitempty"`
 }
 
 type ShoppingCart struct {
@@ -41,9 +95,28 @@ type ShoppingCart struct {
 	Items        []CartItem `json:"items"`
 }
 
+// CartItem is an inventory item in the cart, or a kit when Kit is set. For a
+// kit, ID, Name and Available describe the kit as a whole.
 type CartItem struct {
 	InventoryItem
-	AmountSelected int `json:"amountSelected"`
+	AmountSelected int  `json:"amountSelected"`
+	Kit            *Kit `json:"kit,omitempty"`
+}
+
+type Kit struct {
+	ID          int            `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Available   int            `json:"available"` // how many complete kits are free
+	Components  []KitComponent `json:"components"`
+}
+
+type KitComponent struct {
+	ItemID    int    `json:"itemId"`
+	Name      string `json:"name"`
+	Amount    int    `json:"amount"`
+	Available int    `json:"available"`
+	Archived  bool   `json:"archived,omitempty"`
 }
 
 type Room struct {
@@ -52,6 +125,7 @@ type Room struct {
 	Floor      string   `json:"floor"`
 	Name       string   `json:"name"`
 	Building   Building `json:"building"`
+	OwnedBy    string   `json:"ownedBy,omitempty"`
 	UpdateDate string   `json:"updateDate"`
 }
 
@@ -59,21 +133,59 @@ type Building struct {
 	ID         int    `json:"id"`
 	Name       string `json:"name"`
 	Campus     string `json:"campus"`
+	GPS        string `json:"gps,omitempty"`
+	OwnedBy    string `json:"ownedBy,omitempty"`
 	UpdateDate string `json:"updateDate"`
 }
 
 type InventorySorted struct {
-	ID             int      `json:"id"`
-	Name           string   `json:"name"`
-	Amount         int      `json:"amount"`
-	Available      int      `json:"available"`
-	Room           Room     `json:"room"`
-	Building       Building `json:"building"`
-	ShelfElementID string   `json:"shelfElementId"`
+	ID             int                    `json:"id"`
+	Name           string                 `json:"name"`
+	Amount         int                    `json:"amount"`
+	Available      int                    `json:"available"`
+	Room           Room                   `json:"room"`
+	Building       Building               `json:"building"`
+	ShelfElementID string                 `json:"shelfElementId"`
+	Category       *Category              `json:"category,omitempty"`
+	Tags           []string               `json:"tags,omitempty"`
+	Attributes     map[string]interface{} `json:"attributes,omitempty"`
+	ArchivedAt     *time.Time             `json:"archivedAt,omitempty"`
+}
+
+type ReorderItem struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	Amount          int        `json:"amount"`
+	MinStock        int        `json:"minStock"`
+	ReorderQuantity int        `json:"reorderQuantity"`
+	OrderAmount     int        `json:"orderAmount"`
+	Room            Room       `json:"room"`
+	Building        Building   `json:"building"`
+	ShelfElementID  string     `json:"shelfElementId"`
+	LowStockSince   *time.Time `json:"lowStockSince,omitempty"`
+}
+
+type Category struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	ParentID int        `json:"parentId,omitempty"`
+	Children []Category `json:"children,omitempty"`
+}
+
+type AttributeDefinition struct {
+	ID         int      `json:"id"`
+	CategoryID int      `json:"categoryId"`
+	Key        string   `json:"key"`
+	Label      string   `json:"label"`
+	Type       string   `json:"type"`
+	Unit       string   `json:"unit,omitempty"`
+	Options    []string `json:"options,omitempty"`
+	Required   bool     `json:"required"`
 }
 
 type Message struct {
 	ID         int       `json:"id"`
+	RequestID  int       `json:"requestId,omitempty"`
 	AuthorName string    `json:"authorName"`
 	Message    string    `json:"message"`
 	IsAdmin    bool      `json:"isAdmin"`
@@ -118,3 +230,63 @@ type BorrowRequest struct {
 	Items         []BorrowItem    `json:"items"`
 	Messages      []BorrowMessage `json:"messages"`
 }
+
+type SessionInfo struct {
+	ID        string    `json:"id"` // opaque handle, not the cookie value`
+	UserIP    string    `json:"userIp"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Current   bool      `json:"current"`
+}
+
+// OrganisationAdmin is a user holding special rights for an organisation.
+// Source is "oidc" for rights granted by the login claim mapping.
+type OrganisationAdmin struct {
+	UserID int    `json:"userId"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	Source string `json:"source,omitempty"`
+}
+
+type Me struct {
+	User          db_models.User `json:"user"`
+	Organisations []string       `json:"organisations"`
+	Sessions      []SessionInfo  `json:"sessions"`
+	CSRFToken     string         `json:"csrfToken,omitempty"` // send back as X-CSRF-Token on POST/PUT/PATCH/DELETE
+}
+
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	Token      string     `json:"token,omitempty"` // only set in the response to the creation
+}
+
+type Asset struct {
+	ID           int        `json:"id"`
+	ItemID       int        `json:"itemId"`
+	SerialNumber string     `json:"serialNumber,omitempty"`
+	AssetTag     string     `json:"assetTag,omitempty"`
+	Condition    string     `json:"condition"`
+	PurchaseDate *time.Time `json:"purchaseDate,omitempty"`
+	Note         string     `json:"note,omitempty"`
+	OnLoan       bool       `json:"onLoan"`
+}
+
+type AuditEntry struct {
+	ID           int             `json:"id"`
+	ActorID      int             `json:"actorId,omitempty"`
+	ActorName    string          `json:"actorName,omitempty"`
+	Action       string          `json:"action"`
+	Entity       string          `json:"entity"`
+	EntityID     string          `json:"entityId"`
+	Organisation string          `json:"organisation,omitempty"`
+	Before       json.RawMessage `json:"before,omitempty"`
+	After        json.RawMessage `json:"after,omitempty"`
+	IP           string          `json:"ip,omitempty"`
+	CreatedAt    time.Time       `json:"createdAt"`
+}
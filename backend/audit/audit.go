@@ -0,0 +1,84 @@
+// Package audit records who changed what. Handlers call Record after a successful
+// change; the log is read back through GET /organisations/:orgId/audit, and
+// entries without an organisation (logins, logouts) through GET /audit.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10/orm"
+	"lagertool.com/main/db_models"
+)
+
+// Actions used across the API and auth handlers.
+const (
+	ActionCreate      = "create"
+	ActionUpdate      = "update"
+	ActionDelete      = "delete"
+	ActionLogin       = "login"
+	ActionLoginFailed = "login_failed"
+	ActionLogout      = "logout"
+)
+
+// Event is one state-changing action.
+type Event struct {
+	Action       string
+	Entity       string // table of the target, e.g. "inventory" or "request"
+	EntityID     any    // int or string ID, stored as text
+	Organisation string // empty for actions not tied to an organisation
+	ActorID      int    // defaults to the user in the context; 0 means anonymous
+	Before       any    // nil for creations
+	After        any    // nil for deletions
+}
+
+// Record writes ev to the audit log. A failing write is logged but does not fail
+// the request, as the change it describes has already been made.
+func Record(con orm.DB, c *gin.Context, ev Event) {
+	entry := newEntry(ev)
+	if entry.ActorID == 0 {
+		if v, ok := c.Get("user"); ok {
+			if user, ok := v.(*db_models.User); ok && user != nil {
+				entry.ActorID = user.ID
+			}
+		}
+	}
+	entry.IP = net.ParseIP(c.ClientIP())
+
+	if _, err := con.Model(entry).Insert(); err != nil {
+		log.Printf("audit: failed to record %s %s %s: %v", ev.Action, ev.Entity, entry.EntityID, err)
+	}
+}
+
+func newEntry(ev Event) *db_models.AuditLog {
+	entry := &db_models.AuditLog{
+		ActorID:          ev.ActorID,
+		Action:           ev.Action,
+		Entity:           ev.Entity,
+		OrganisationName: ev.Organisation,
+		Before:           snapshot(ev.Before),
+		After:            snapshot(ev.After),
+		CreatedAt:        time.Now(),
+	}
+	if ev.EntityID != nil {
+		entry.EntityID = fmt.Sprint(ev.EntityID)
+	}
+	return entry
+}
+
+// snapshot marshals v for a jsonb column. nil stays nil so that it is stored as NULL.
+func snapshot(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("audit: failed to marshal snapshot: %v", err)
+		return nil
+	}
+	return b
+}
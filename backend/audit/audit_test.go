@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEntry(t *testing.T) {
+	testCases := []struct {
+		name       string
+		event      Event
+		wantID     string
+		wantBefore string
+		wantAfter  string
+	}{
+		{
+			name:      "creation has no before",
+			event:     Event{Action: ActionCreate, Entity: "building", EntityID: 7, After: map[string]any{"name": "HG"}},
+			wantID:    "7",
+			wantAfter: `{"name":"HG"}`,
+		},
+		{
+			name:       "deletion has no after",
+			event:      Event{Action: ActionDelete, Entity: "shelf", EntityID: "HG-E-12", Before: map[string]any{"id": "HG-E-12"}},
+			wantID:     "HG-E-12",
+			wantBefore: `{"id":"HG-E-12"}`,
+		},
+		{
+			name:  "failed login has no entity id",
+			event: Event{Action: ActionLoginFailed, Entity: "session"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			entry := newEntry(tc.event)
+			assert.Equal(t, tc.event.Action, entry.Action)
+			assert.Equal(t, tc.event.Entity, entry.Entity)
+			assert.Equal(t, tc.wantID, entry.EntityID)
+			assertJSON(t, tc.wantBefore, entry.Before)
+			assertJSON(t, tc.wantAfter, entry.After)
+			assert.False(t, entry.CreatedAt.IsZero())
+		})
+	}
+}
+
+func assertJSON(t *testing.T, want string, got json.RawMessage) {
+	t.Helper()
+	if want == "" {
+		assert.Nil(t, got, "nil snapshots must stay nil so they are stored as NULL")
+		return
+	}
+	assert.JSONEq(t, want, string(got))
+}
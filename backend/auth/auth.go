@@ -15,7 +15,6 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 
@@ -24,6 +23,8 @@ import (
 	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
 	"golang.org/x/oauth2"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/config"
 	"lagertool.com/main/db_models"
 )
 
@@ -39,76 +40,122 @@ const (
 )
 
 var (
-	clientID           = os.Getenv("VSETH_CLIENT_ID")
-	clientSecret       = os.Getenv("VSETH_CLIENT_SECRET")
-	redirectURL        = envOr("OIDC_REDIRECT_URL", "https://localhost:8080/auth/eduid/callback") //fake domain
-	issuerURL          = envOr("OIDC_ISSUER_URL", "https://keycloak-fake.vis.ethz.ch/realms/VSETH")
-	postLogoutRedirect = envOr("OIDC_POST_LOGOUT_REDIRECT", "localhost:8080") //fake domain !!
-	cookieDomain       = envOr("COOKIE_DOMAIN", "localhost")
-	cookieSecure       = envOr("COOKIE_SECURE", "true") != "false"
-
-	flowSecret  = mustSecret("SESSION_SECRET", 32)
-	tokenSecret = mustSecret("TOKEN_ENCRYPTION_KEY", 32)
-
-	oauth2Config       *oauth2.Config
-	oidcProvider       *oidc.Provider
-	verifier           *oidc.IDTokenVerifier
-	endSessionEndpoint string
+	discoveryBackoffMin = 1 * time.Second
+	discoveryBackoffMax = 1 * time.Minute
 )
 
-func envOr(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
-	}
-	return def
+type AuthHandler struct {
+	DB        *pg.DB
+	providers map[string]*Provider
+
+	cookie      config.CookieConfig
+	orgMapping  []orgRule
+	flowSecret  []byte
+	tokenSecret []byte
 }
 
-func mustSecret(env string, size int) []byte {
-	if v := os.Getenv(env); v != "" {
-		b, err := base64.StdEncoding.DecodeString(v)
-		if err != nil {
-			log.Fatalf("%s must be base64-encoded: %v", env, err)
-		}
-		if len(b) < size {
-			log.Fatalf("%s must decode to at least %d bytes (got %d)", env, size, len(b))
-		}
-		return b[:size]
+// NewAuthHandler builds the handler from cfg. The providers are not usable until
+// StartDiscovery has reached them.
+func NewAuthHandler(db *pg.DB, cfg config.AuthConfig) (*AuthHandler, error) {
+	list := make([]*Provider, 0, len(cfg.Providers))
+	for _, pc := range cfg.Providers {
+		list = append(list, newProvider(pc))
 	}
-	log.Printf("⚠️  %s not set — using insecure dev fallback. Set it in production.", env)
-	h := sha256.Sum256([]byte("lagertool-dev-fallback-" + env))
-	return h[:size]
+	return NewAuthHandlerWithProviders(db, cfg, list...)
 }
 
-func init() {
-	var err error
-	oidcProvider, err = oidc.NewProvider(context.Background(), issuerURL)
+// NewAuthHandlerWithProviders takes its settings from cfg but uses the given
+// providers instead of cfg.Providers.
+func NewAuthHandlerWithProviders(db *pg.DB, cfg config.AuthConfig, list ...*Provider) (*AuthHandler, error) {
+	rules, err := parseOrgMapping(cfg.OrgMapping)
 	if err != nil {
-		log.Fatalf("Failed to initialize OIDC provider: %v", err)
+		return nil, fmt.Errorf("OIDC_ORG_MAPPING is invalid: %w", err)
+	}
+	flowSecret, err := secret("SESSION_SECRET", cfg.SessionSecret)
+	if err != nil {
+		return nil, err
+	}
+	tokenSecret, err := secret("TOKEN_ENCRYPTION_KEY", cfg.TokenEncryptionKey)
+	if err != nil {
+		return nil, err
 	}
 
-	var meta struct {
-		EndSession string `json:"end_session_endpoint"`
+	h := &AuthHandler{
+		DB:          db,
+		providers:   map[string]*Provider{},
+		cookie:      cfg.Cookie,
+		orgMapping:  rules,
+		flowSecret:  flowSecret,
+		tokenSecret: tokenSecret,
 	}
-	if err := oidcProvider.Claims(&meta); err == nil {
-		endSessionEndpoint = meta.EndSession
+	for _, p := range list {
+		h.providers[p.Name] = p
 	}
+	return h, nil
+}
 
-	oauth2Config = &oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectURL,
-		Scopes:       []string{oidc.ScopeOpenID, "profile", "email", oidc.ScopeOfflineAccess},
-		Endpoint:     oidcProvider.Endpoint(),
+func secret(env, value string) ([]byte, error) {
+	b, err := config.DecodeSecret(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", env, err)
+	}
+	if b != nil {
+		return b, nil
 	}
-	verifier = oidcProvider.Verifier(&oidc.Config{ClientID: clientID})
+	if gin.Mode() != gin.TestMode {
+		log.Printf("⚠️  %s not set — using insecure dev fallback. Set it in production.", env)
+	}
+	sum := sha256.Sum256([]byte("lagertool-dev-fallback-" + env))
+	return sum[:], nil
 }
 
-type AuthHandler struct {
-	DB *pg.DB
+// StartDiscovery runs OIDC discovery for every provider in the background,
+// retrying with backoff. Until a provider is discovered its login and callback
+// answer 503; the rest of the API is unaffected.
+func (h *AuthHandler) StartDiscovery(ctx context.Context) {
+	for _, p := range h.providers {
+		if p.Ready() {
+			continue
+		}
+		go p.discoverWithRetry(ctx)
+	}
+}
+
+// provider returns the provider named by the :provider path parameter and its
+// discovered configuration, answering 404 or 503 itself.
+func (h *AuthHandler) provider(c *gin.Context) (*Provider, *discovery, bool) {
+	p, ok := h.providers[c.Param("provider")]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown identity provider"})
+		return nil, nil, false
+	}
+	d := p.discovered.Load()
+	if d == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "identity provider unavailable", "details": "discovery has not succeeded yet"})
+		return nil, nil, false
+	}
+	return p, d, true
 }
 
-func NewAuthHandler(db *pg.DB) *AuthHandler {
-	return &AuthHandler{DB: db}
+// providerForIssuer returns the provider a user logged in with, or nil if it is
+// no longer configured.
+func (h *AuthHandler) providerForIssuer(issuer string) *Provider {
+	for _, p := range h.providers {
+		if p.IssuerURL == issuer {
+			return p
+		}
+	}
+	return nil
+}
+
+// cookieDomainFor is the domain session cookies of user are scoped to.
+func (h *AuthHandler) cookieDomainFor(user *db_models.User) string {
+	if user != nil {
+		if p := h.providerForIssuer(user.Issuer); p != nil {
+			return p.CookieDomain
+		}
+	}
+	return h.cookie.Domain
 }
 
 func (h *AuthHandler) StartSessionCleanup(ctx context.Context) {
@@ -134,6 +181,10 @@ func (h *AuthHandler) StartSessionCleanup(ctx context.Context) {
 }
 
 func (h *AuthHandler) LoginHandler(c *gin.Context) {
+	p, d, ok := h.provider(c)
+	if !ok {
+		return
+	}
 	state := uuid.New().String()
 	nonce := uuid.New().String()
 	verifierStr, challenge, err := newPKCE()
@@ -146,17 +197,20 @@ func (h *AuthHandler) LoginHandler(c *gin.Context) {
 		State:        state,
 		Nonce:        nonce,
 		CodeVerifier: verifierStr,
+		Provider:     p.Name,
 		Exp:          time.Now().Add(oauthFlowLifetime).Unix(),
 	}
-	token, err := signFlow(flow)
+	token, err := h.signFlow(flow)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not sign flow state"})
 		return
 	}
+	// Lax whatever the configured policy: the cookie must survive the top-level
+	// redirect back from the provider.
 	c.SetSameSite(http.SameSiteLaxMode)
-	c.SetCookie(oauthFlowCookie, token, int(oauthFlowLifetime.Seconds()), "/", cookieDomain, cookieSecure, true)
+	c.SetCookie(oauthFlowCookie, token, int(oauthFlowLifetime.Seconds()), "/", p.CookieDomain, h.cookie.Secure, true)
 
-	authURL := oauth2Config.AuthCodeURL(state,
+	authURL := d.oauth2Config.AuthCodeURL(state,
 		oidc.Nonce(nonce),
 		oauth2.SetAuthURLParam("code_challenge", challenge),
 		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
@@ -166,23 +220,31 @@ func (h *AuthHandler) LoginHandler(c *gin.Context) {
 
 func (h *AuthHandler) CallbackHandler(c *gin.Context) {
 	ctx := c.Request.Context()
+	p, d, ok := h.provider(c)
+	if !ok {
+		return
+	}
 
 	rawFlow, err := c.Cookie(oauthFlowCookie)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing oauth flow cookie"})
 		return
 	}
-	flow, err := verifyFlow(rawFlow)
+	flow, err := h.verifyFlow(rawFlow)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid oauth flow", "details": err.Error()})
 		return
 	}
 	// Single-use: clear the flow cookie immediately.
 	c.SetSameSite(http.SameSiteLaxMode)
-	c.SetCookie(oauthFlowCookie, "", -1, "/", cookieDomain, cookieSecure, true)
+	c.SetCookie(oauthFlowCookie, "", -1, "/", p.CookieDomain, h.cookie.Secure, true)
 
+	if flow.Provider != p.Name {
+		h.loginFailed(c, p, http.StatusBadRequest, gin.H{"error": "provider mismatch"})
+		return
+	}
 	if c.Query("state") != flow.State {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "state mismatch"})
+		h.loginFailed(c, p, http.StatusBadRequest, gin.H{"error": "state mismatch"})
 		return
 	}
 	code := c.Query("code")
@@ -191,7 +253,7 @@ func (h *AuthHandler) CallbackHandler(c *gin.Context) {
 		return
 	}
 
-	oauth2Token, err := oauth2Config.Exchange(ctx, code,
+	oauth2Token, err := d.oauth2Config.Exchange(ctx, code,
 		oauth2.SetAuthURLParam("code_verifier", flow.CodeVerifier),
 	)
 	if err != nil {
@@ -203,13 +265,13 @@ func (h *AuthHandler) CallbackHandler(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "no id_token in response"})
 		return
 	}
-	idToken, err := verifier.Verify(ctx, rawIDToken)
+	idToken, err := d.verifier.Verify(ctx, rawIDToken)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "id token validation failed", "details": err.Error()})
+		h.loginFailed(c, p, http.StatusUnauthorized, gin.H{"error": "id token validation failed", "details": err.Error()})
 		return
 	}
 	if idToken.Nonce != flow.Nonce {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "nonce mismatch"})
+		h.loginFailed(c, p, http.StatusUnauthorized, gin.H{"error": "nonce mismatch"})
 		return
 	}
 
@@ -217,29 +279,33 @@ func (h *AuthHandler) CallbackHandler(c *gin.Context) {
 		Sub   string `json:"sub"`
 		Name  string `json:"name"`
 		Email string `json:"email"`
+		roleClaims
 	}
 	if err := idToken.Claims(&claims); err != nil {
 		log.Printf("failed to extract claims: %v", err)
 	}
 
-	encAccess, err := encryptToken(oauth2Token.AccessToken)
+	encAccess, err := h.encryptToken(oauth2Token.AccessToken)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "token encryption failed"})
 		return
 	}
-	encRefresh, err := encryptToken(oauth2Token.RefreshToken)
+	encRefresh, err := h.encryptToken(oauth2Token.RefreshToken)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "token encryption failed"})
 		return
 	}
-	encIDToken, err := encryptToken(rawIDToken)
+	encIDToken, err := h.encryptToken(rawIDToken)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "token encryption failed"})
 		return
 	}
 
 	var user db_models.User
-	err = h.DB.Model(&user).Where("subject = ?", claims.Sub).Limit(1).Select()
+	err = h.DB.Model(&user).
+		Where("issuer = ?", idToken.Issuer).
+		Where("subject = ?", claims.Sub).
+		Limit(1).Select()
 	switch {
 	case errors.Is(err, pg.ErrNoRows):
 		user = db_models.User{
@@ -261,7 +327,6 @@ func (h *AuthHandler) CallbackHandler(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "user lookup failed", "details": err.Error()})
 		return
 	default:
-		user.Issuer = idToken.Issuer
 		user.Email = claims.Email
 		user.Name = claims.Name
 		user.AccessToken = encAccess
@@ -274,8 +339,24 @@ func (h *AuthHandler) CallbackHandler(c *gin.Context) {
 		}
 	}
 
+	// Without rules there is nothing to sync; revoking every oidc grant would lock
+	// admins out as soon as the mapping is left unset.
+	if len(h.orgMapping) > 0 {
+		if err := h.syncOrganisations(c, user.ID, organisationsFor(h.orgMapping, claims.roleClaims)); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "organisation sync failed", "details": err.Error()})
+			return
+		}
+	}
+
+	token, tokenHash, handle, err := NewSessionToken()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "session token generation failed", "details": err.Error()})
+		return
+	}
 	now := time.Now()
 	session := db_models.Session{
+		TokenHash: tokenHash,
+		Handle:    handle,
 		UserID:    user.ID,
 		CreatedAt: now,
 		ExpiresAt: now.Add(sessionLifetime),
@@ -290,21 +371,43 @@ func (h *AuthHandler) CallbackHandler(c *gin.Context) {
 	if err := h.enforceSessionCap(user.ID); err != nil {
 		log.Printf("session cap enforcement failed for user %d: %v", user.ID, err)
 	}
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionLogin, Entity: "session", EntityID: session.Handle, ActorID: user.ID,
+		After: gin.H{"provider": p.Name, "user_agent": session.UserAgent},
+	})
 
-	c.SetSameSite(http.SameSiteLaxMode)
-	c.SetCookie(sessionCookie, fmt.Sprint(session.ID), int(sessionLifetime.Seconds()), "/", cookieDomain, cookieSecure, true)
+	c.SetSameSite(h.cookie.SameSiteMode())
+	c.SetCookie(sessionCookie, token, int(sessionLifetime.Seconds()), "/", p.CookieDomain, h.cookie.Secure, true)
+	h.setCSRFCookie(c, session.ID, p.CookieDomain)
 	c.JSON(http.StatusOK, gin.H{"message": "authentication successful"})
 }
 
+// loginFailed rejects a callback that failed validation and audits the attempt.
+// Nobody is logged in yet, so the entry has no actor.
+func (h *AuthHandler) loginFailed(c *gin.Context, p *Provider, status int, body gin.H) {
+	audit.Record(h.DB, c, audit.Event{
+		Action: audit.ActionLoginFailed, Entity: "session",
+		After: gin.H{"provider": p.Name, "reason": body["error"], "details": body["details"]},
+	})
+	c.AbortWithStatusJSON(status, body)
+}
+
 func (h *AuthHandler) LogoutHandler(c *gin.Context) {
-	sessionID, err := c.Cookie(sessionCookie)
+	// The local session can be ended even while the provider is unreachable, so
+	// this does not go through h.provider.
+	p, ok := h.providers[c.Param("provider")]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown identity provider"})
+		return
+	}
+	token, err := c.Cookie(sessionCookie)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "no session cookie"})
 		return
 	}
 
 	var session db_models.Session
-	err = h.DB.Model(&session).Where("session_id = ?", sessionID).Limit(1).Select()
+	err = h.DB.Model(&session).Where("token_hash = ?", HashSessionToken(token)).Limit(1).Select()
 	if err != nil && !errors.Is(err, pg.ErrNoRows) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "session lookup failed", "details": err.Error()})
 		return
@@ -315,25 +418,31 @@ func (h *AuthHandler) LogoutHandler(c *gin.Context) {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to delete session", "details": err.Error()})
 			return
 		}
+		audit.Record(h.DB, c, audit.Event{
+			Action: audit.ActionLogout, Entity: "session", EntityID: session.Handle, ActorID: session.UserID,
+			Before: gin.H{"provider": p.Name, "user_agent": session.UserAgent},
+		})
 	}
 
-	c.SetSameSite(http.SameSiteLaxMode)
-	c.SetCookie(sessionCookie, "", -1, "/", cookieDomain, cookieSecure, true)
+	c.SetSameSite(h.cookie.SameSiteMode())
+	c.SetCookie(sessionCookie, "", -1, "/", p.CookieDomain, h.cookie.Secure, true)
+	c.SetCookie(csrfCookie, "", -1, "/", p.CookieDomain, h.cookie.Secure, false)
 
-	if endSessionEndpoint == "" {
+	d := p.discovered.Load()
+	if d == nil || d.endSessionEndpoint == "" {
 		c.JSON(http.StatusOK, gin.H{"message": "logged out (no end_session_endpoint advertised by IdP)"})
 		return
 	}
 
-	logoutURL, err := url.Parse(endSessionEndpoint)
+	logoutURL, err := url.Parse(d.endSessionEndpoint)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{"message": "logged out (bad end_session_endpoint)"})
 		return
 	}
 	q := logoutURL.Query()
-	q.Set("post_logout_redirect_uri", postLogoutRedirect)
-	q.Set("client_id", clientID)
-	if hint, err := decryptToken(session.IDToken); err == nil && hint != "" {
+	q.Set("post_logout_redirect_uri", p.PostLogoutRedirect)
+	q.Set("client_id", p.ClientID)
+	if hint, err := h.decryptToken(session.IDToken); err == nil && hint != "" {
 		q.Set("id_token_hint", hint)
 	}
 	logoutURL.RawQuery = q.Encode()
@@ -345,14 +454,19 @@ func (h *AuthHandler) AuthMiddleware(usingAuth bool) gin.HandlerFunc {
 		return func(c *gin.Context) { c.Next() }
 	}
 	return func(c *gin.Context) {
-		sessionID, err := c.Cookie(sessionCookie)
+		if raw, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			h.authenticateToken(c, strings.TrimSpace(raw))
+			return
+		}
+
+		token, err := c.Cookie(sessionCookie)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "no session cookie"})
 			return
 		}
 
 		var session db_models.Session
-		err = h.DB.Model(&session).Relation("User").Where("session.session_id = ?", sessionID).First()
+		err = h.DB.Model(&session).Relation("User").Where("session.token_hash = ?", HashSessionToken(token)).First()
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid session"})
 			return
@@ -376,8 +490,8 @@ func (h *AuthHandler) AuthMiddleware(usingAuth bool) gin.HandlerFunc {
 				Where("session_id = ?", session.ID).
 				Update(); err == nil {
 				session.ExpiresAt = newExpiry
-				c.SetSameSite(http.SameSiteLaxMode)
-				c.SetCookie(sessionCookie, fmt.Sprint(session.ID), int(sessionLifetime.Seconds()), "/", cookieDomain, cookieSecure, true)
+				c.SetSameSite(h.cookie.SameSiteMode())
+				c.SetCookie(sessionCookie, token, int(sessionLifetime.Seconds()), "/", h.cookieDomainFor(session.User), h.cookie.Secure, true)
 			}
 		}
 
@@ -394,20 +508,28 @@ func (h *AuthHandler) refreshIfNeeded(ctx context.Context, user *db_models.User)
 	if user.RefreshToken == "" {
 		return nil
 	}
-	refresh, err := decryptToken(user.RefreshToken)
+	p := h.providerForIssuer(user.Issuer)
+	if p == nil {
+		return fmt.Errorf("no provider configured for issuer %s", user.Issuer)
+	}
+	d := p.discovered.Load()
+	if d == nil {
+		return fmt.Errorf("provider %s is not discovered yet", p.Name)
+	}
+	refresh, err := h.decryptToken(user.RefreshToken)
 	if err != nil {
 		return fmt.Errorf("decrypt refresh token: %w", err)
 	}
-	src := oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: refresh})
+	src := d.oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: refresh})
 	tok, err := src.Token()
 	if err != nil {
 		return fmt.Errorf("refresh: %w", err)
 	}
-	encAccess, err := encryptToken(tok.AccessToken)
+	encAccess, err := h.encryptToken(tok.AccessToken)
 	if err != nil {
 		return err
 	}
-	encRefresh, err := encryptToken(tok.RefreshToken)
+	encRefresh, err := h.encryptToken(tok.RefreshToken)
 	if err != nil {
 		return err
 	}
@@ -444,27 +566,28 @@ type flowState struct {
 	State        string `json:"s"`
 	Nonce        string `json:"n"`
 	CodeVerifier string `json:"v"`
+	Provider     string `json:"p"`
 	Exp          int64  `json:"e"`
 }
 
-func signFlow(s flowState) (string, error) {
+func (h *AuthHandler) signFlow(s flowState) (string, error) {
 	payload, err := json.Marshal(s)
 	if err != nil {
 		return "", err
 	}
 	body := base64.RawURLEncoding.EncodeToString(payload)
-	mac := hmac.New(sha256.New, flowSecret)
+	mac := hmac.New(sha256.New, h.flowSecret)
 	mac.Write([]byte(body))
 	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 	return body + "." + sig, nil
 }
 
-func verifyFlow(token string) (*flowState, error) {
+func (h *AuthHandler) verifyFlow(token string) (*flowState, error) {
 	parts := strings.SplitN(token, ".", 2)
 	if len(parts) != 2 {
 		return nil, errors.New("malformed flow token")
 	}
-	mac := hmac.New(sha256.New, flowSecret)
+	mac := hmac.New(sha256.New, h.flowSecret)
 	mac.Write([]byte(parts[0]))
 	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 	if !hmac.Equal([]byte(parts[1]), []byte(expected)) {
@@ -495,11 +618,11 @@ func newPKCE() (verifier, challenge string, err error) {
 	return verifier, challenge, nil
 }
 
-func encryptToken(plain string) (string, error) {
+func (h *AuthHandler) encryptToken(plain string) (string, error) {
 	if plain == "" {
 		return "", nil
 	}
-	block, err := aes.NewCipher(tokenSecret)
+	block, err := aes.NewCipher(h.tokenSecret)
 	if err != nil {
 		return "", err
 	}
@@ -515,7 +638,7 @@ func encryptToken(plain string) (string, error) {
 	return base64.StdEncoding.EncodeToString(ct), nil
 }
 
-func decryptToken(encoded string) (string, error) {
+func (h *AuthHandler) decryptToken(encoded string) (string, error) {
 	if encoded == "" {
 		return "", nil
 	}
@@ -523,7 +646,7 @@ func decryptToken(encoded string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	block, err := aes.NewCipher(tokenSecret)
+	block, err := aes.NewCipher(h.tokenSecret)
 	if err != nil {
 		return "", err
 	}
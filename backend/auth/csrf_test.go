@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/db_models"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newTestHandler(t, nil)
+
+	session := &db_models.Session{ID: 42, User: &db_models.User{ID: 1}}
+	token := &db_models.APIToken{ID: 7, Scopes: []string{ScopeWrite}}
+
+	newRouter := func(ctx map[string]any) *gin.Engine {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			for k, v := range ctx {
+				c.Set(k, v)
+			}
+		}, h.CSRFMiddleware(true))
+		router.Any("/thing", func(c *gin.Context) { c.Status(http.StatusOK) })
+		return router
+	}
+
+	testCases := []struct {
+		name   string
+		method string
+		header string
+		ctx    map[string]any
+		status int
+	}{
+		{name: "safe method needs no token", method: "GET", ctx: map[string]any{"session": session}, status: http.StatusOK},
+		{name: "missing token", method: "POST", ctx: map[string]any{"session": session}, status: http.StatusForbidden},
+		{name: "token of another session", method: "DELETE", header: h.CSRFToken(43), ctx: map[string]any{"session": session}, status: http.StatusForbidden},
+		{name: "garbage token", method: "PUT", header: "nope", ctx: map[string]any{"session": session}, status: http.StatusForbidden},
+		{name: "valid token", method: "POST", header: h.CSRFToken(42), ctx: map[string]any{"session": session}, status: http.StatusOK},
+		{name: "bearer requests are exempt", method: "POST", ctx: map[string]any{"apiToken": token}, status: http.StatusOK},
+		{name: "no credentials", method: "POST", ctx: map[string]any{}, status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, "/thing", nil)
+			if tc.header != "" {
+				req.Header.Set(csrfHeader, tc.header)
+			}
+			w := httptest.NewRecorder()
+			newRouter(tc.ctx).ServeHTTP(w, req)
+			assert.Equal(t, tc.status, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestIssueCSRF(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := newTestHandler(t, nil)
+
+	router := gin.New()
+	router.GET("/me", func(c *gin.Context) {
+		c.Set("session", &db_models.Session{ID: 42, User: &db_models.User{ID: 1}})
+	}, h.IssueCSRF, func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("csrfToken"))
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, h.CSRFToken(42), w.Body.String())
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookie {
+			cookie = c
+		}
+	}
+	if assert.NotNil(t, cookie) {
+		assert.Equal(t, h.CSRFToken(42), cookie.Value)
+		assert.False(t, cookie.HttpOnly, "the frontend must be able to read the token")
+	}
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// rsaKeySet verifies RS256 tokens against a fixed public key, standing in for
+// the provider's JWKS endpoint.
+type rsaKeySet struct {
+	key *rsa.PublicKey
+}
+
+func (k rsaKeySet) VerifySignature(_ context.Context, jwt string) ([]byte, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed jwt")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(k.key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+func TestProviderUnavailableUntilDiscovered(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Refuse the first two discovery attempts, as a Keycloak that is still booting would.
+	var attempts atomic.Int32
+	mock := newMockOIDC(t, "lagertool", "sub")
+	inner := mock.Config.Handler
+	mock.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/openid-configuration") && attempts.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+
+	oldMin, oldMax := discoveryBackoffMin, discoveryBackoffMax
+	discoveryBackoffMin, discoveryBackoffMax = 10*time.Millisecond, 20*time.Millisecond
+	defer func() { discoveryBackoffMin, discoveryBackoffMax = oldMin, oldMax }()
+
+	p := &Provider{Name: "vis", IssuerURL: mock.URL, ClientID: "lagertool", CookieDomain: "localhost"}
+	h := newTestHandler(t, nil, p)
+	router := gin.New()
+	router.GET("/auth/:provider/login", h.LoginHandler)
+	router.GET("/auth/:provider/callback", h.CallbackHandler)
+
+	get := func(url string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, get("/auth/vis/login"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/auth/vis/callback?state=x&code=y"))
+	assert.Equal(t, http.StatusNotFound, get("/auth/other/login"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.StartDiscovery(ctx)
+
+	assert.Eventually(t, p.Ready, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(3), attempts.Load())
+	assert.Equal(t, http.StatusTemporaryRedirect, get("/auth/vis/login"))
+}
+
+func TestInjectedProvider(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock := newMockOIDC(t, "lagertool", "sub")
+	mock.Close() // nothing may be fetched from the network
+
+	p := &Provider{
+		Name:      "static",
+		IssuerURL: mock.URL,
+		ClientID:  "lagertool",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  "https://idp.example/auth",
+			TokenURL: "https://idp.example/token",
+		},
+		KeySet:       rsaKeySet{key: &mock.key.PublicKey},
+		CookieDomain: "localhost",
+	}
+	assert.NoError(t, p.Discover(context.Background()))
+	h := newTestHandler(t, nil, p)
+
+	router := gin.New()
+	router.GET("/auth/:provider/login", h.LoginHandler)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/auth/static/login", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code, w.Body.String())
+	assert.True(t, strings.HasPrefix(w.Header().Get("Location"), "https://idp.example/auth?"))
+
+	idToken, err := p.discovered.Load().verifier.Verify(context.Background(), mock.idToken(t, "nonce"))
+	assert.NoError(t, err)
+	assert.Equal(t, "sub", idToken.Subject)
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"lagertool.com/main/audit"
+	"lagertool.com/main/db_models"
+)
+
+// grantSourceOIDC marks has_special_rights_for rows managed by the login sync.
+// Rows with any other source were granted by hand and are never revoked here.
+const grantSourceOIDC = "oidc"
+
+// orgRule grants admin rights for org to anyone whose token carries the claim.
+//
+//	group:/VIS/Lagertool=VIS          member of the Keycloak group (full path)
+//	realm_role:lagertool-admin=VSETH  realm role from realm_access.roles
+//	client_role:lagertool/admin=VIS   client role from resource_access.<client>.roles
+type orgRule struct {
+	Kind  string
+	Value string
+	Org   string
+}
+
+// roleClaims are the Keycloak claims the mapping looks at. The client needs the
+// "groups", "realm roles" and "client roles" mappers added to the ID token.
+type roleClaims struct {
+	RealmAccess struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"`
+	ResourceAccess map[string]struct {
+		Roles []string `json:"roles"`
+	} `json:"resource_access"`
+	Groups []string `json:"groups"`
+}
+
+// parseOrgMapping reads a comma separated list of kind:value=Organisation rules.
+func parseOrgMapping(spec string) ([]orgRule, error) {
+	var rules []orgRule
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		kind, rest, ok := strings.Cut(raw, ":")
+		if !ok {
+			return nil, fmt.Errorf("rule %q: missing kind", raw)
+		}
+		i := strings.LastIndex(rest, "=")
+		if i <= 0 || i == len(rest)-1 {
+			return nil, fmt.Errorf("rule %q: expected <value>=<organisation>", raw)
+		}
+		rule := orgRule{Kind: kind, Value: rest[:i], Org: strings.TrimSpace(rest[i+1:])}
+		switch rule.Kind {
+		case "group", "realm_role":
+		case "client_role":
+			if !strings.Contains(rule.Value, "/") {
+				return nil, fmt.Errorf("rule %q: client roles are written as <client>/<role>", raw)
+			}
+		default:
+			return nil, fmt.Errorf("rule %q: unknown kind %q", raw, rule.Kind)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// organisationsFor returns the sorted, de-duplicated organisations the claims grant rights for.
+func organisationsFor(rules []orgRule, claims roleClaims) []string {
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		if !claims.has(rule) {
+			continue
+		}
+		seen[rule.Org] = true
+	}
+	orgs := make([]string, 0, len(seen))
+	for org := range seen {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+	return orgs
+}
+
+func (rc roleClaims) has(rule orgRule) bool {
+	switch rule.Kind {
+	case "group":
+		for _, g := range rc.Groups {
+			if g == rule.Value {
+				return true
+			}
+		}
+	case "realm_role":
+		for _, r := range rc.RealmAccess.Roles {
+			if r == rule.Value {
+				return true
+			}
+		}
+	case "client_role":
+		client, role, _ := strings.Cut(rule.Value, "/")
+		for _, r := range rc.ResourceAccess[client].Roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// planGrantSync compares the user's current grants with the organisations the token
+// maps to. Grants that were not made by the sync are left alone, even if the token
+// no longer maps to them.
+func planGrantSync(current []db_models.HasSpecialRightsFor, want []string) (grant, revoke []string) {
+	have := map[string]bool{}
+	for _, g := range current {
+		have[g.OrganisationName] = true
+	}
+	wanted := map[string]bool{}
+	for _, org := range want {
+		wanted[org] = true
+		if !have[org] {
+			grant = append(grant, org)
+		}
+	}
+	for _, g := range current {
+		if g.Source == grantSourceOIDC && !wanted[g.OrganisationName] {
+			revoke = append(revoke, g.OrganisationName)
+		}
+	}
+	return grant, revoke
+}
+
+// syncOrganisations brings the oidc-sourced grants of a user in line with the
+// organisations their token maps to, creating missing organisation rows. Every
+// grant and revocation is audited with the user as actor.
+func (h *AuthHandler) syncOrganisations(c *gin.Context, userID int, orgs []string) error {
+	return h.DB.RunInTransaction(h.DB.Context(), func(tx *pg.Tx) error {
+		var current []db_models.HasSpecialRightsFor
+		err := tx.Model(&current).Where("user_id = ?", userID).Select()
+		if err != nil {
+			return err
+		}
+		grant, revoke := planGrantSync(current, orgs)
+
+		for _, org := range grant {
+			_, err = tx.Model(&db_models.Organisation{Name: org}).OnConflict("DO NOTHING").Insert()
+			if err != nil {
+				return err
+			}
+			rights := &db_models.HasSpecialRightsFor{
+				OrganisationName: org,
+				UserID:           userID,
+				Source:           grantSourceOIDC,
+			}
+			if _, err = tx.Model(rights).Insert(); err != nil {
+				return err
+			}
+			audit.Record(tx, c, audit.Event{
+				Action: audit.ActionCreate, Entity: "has_special_rights_for", EntityID: userID,
+				Organisation: org, ActorID: userID, After: rights,
+			})
+		}
+		if len(revoke) > 0 {
+			_, err = tx.Model((*db_models.HasSpecialRightsFor)(nil)).
+				Where("user_id = ?", userID).
+				Where("source = ?", grantSourceOIDC).
+				Where("organisation_name IN (?)", pg.In(revoke)).
+				Delete()
+			if err != nil {
+				return err
+			}
+		}
+		for _, org := range revoke {
+			audit.Record(tx, c, audit.Event{
+				Action: audit.ActionDelete, Entity: "has_special_rights_for", EntityID: userID,
+				Organisation: org, ActorID: userID,
+				Before: db_models.HasSpecialRightsFor{OrganisationName: org, UserID: userID, Source: grantSourceOIDC},
+			})
+		}
+		return nil
+	})
+}
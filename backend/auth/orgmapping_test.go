@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/db_models"
+)
+
+func TestParseOrgMapping(t *testing.T) {
+	testCases := []struct {
+		name    string
+		spec    string
+		want    []orgRule
+		wantErr bool
+	}{
+		{name: "empty", spec: "", want: nil},
+		{
+			name: "all kinds",
+			spec: "group:/VIS/Lagertool=VIS, realm_role:lagertool-admin=VSETH,client_role:lagertool/admin=AMIV",
+			want: []orgRule{
+				{Kind: "group", Value: "/VIS/Lagertool", Org: "VIS"},
+				{Kind: "realm_role", Value: "lagertool-admin", Org: "VSETH"},
+				{Kind: "client_role", Value: "lagertool/admin", Org: "AMIV"},
+			},
+		},
+		{name: "organisation with spaces", spec: "group:/x=Some Org", want: []orgRule{{Kind: "group", Value: "/x", Org: "Some Org"}}},
+		{name: "missing kind", spec: "VIS", wantErr: true},
+		{name: "missing organisation", spec: "group:/VIS=", wantErr: true},
+		{name: "missing value", spec: "group:=VIS", wantErr: true},
+		{name: "unknown kind", spec: "scope:admin=VIS", wantErr: true},
+		{name: "client role without client", spec: "client_role:admin=VIS", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseOrgMapping(tc.spec)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestOrganisationsFor(t *testing.T) {
+	rules, err := parseOrgMapping("group:/VIS/Lagertool=VIS,realm_role:lagertool-admin=VSETH,client_role:lagertool/admin=AMIV,group:/VSETH/Board=VSETH")
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		claims string
+		want   []string
+	}{
+		{name: "no claims", claims: `{}`, want: []string{}},
+		{name: "group", claims: `{"groups": ["/VIS/Lagertool", "/VIS/Other"]}`, want: []string{"VIS"}},
+		{name: "realm role", claims: `{"realm_access": {"roles": ["offline_access", "lagertool-admin"]}}`, want: []string{"VSETH"}},
+		{name: "client role", claims: `{"resource_access": {"lagertool": {"roles": ["admin"]}}}`, want: []string{"AMIV"}},
+		{name: "role of another client", claims: `{"resource_access": {"other": {"roles": ["admin"]}}}`, want: []string{}},
+		{
+			name:   "several rules for the same organisation",
+			claims: `{"groups": ["/VSETH/Board", "/VIS/Lagertool"], "realm_access": {"roles": ["lagertool-admin"]}}`,
+			want:   []string{"VIS", "VSETH"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var claims roleClaims
+			assert.NoError(t, json.Unmarshal([]byte(tc.claims), &claims))
+			assert.Equal(t, tc.want, organisationsFor(rules, claims))
+		})
+	}
+}
+
+func TestPlanGrantSync(t *testing.T) {
+	current := []db_models.HasSpecialRightsFor{
+		{OrganisationName: "VIS", Source: grantSourceOIDC},
+		{OrganisationName: "AMIV", Source: grantSourceOIDC},
+		{OrganisationName: "VSETH"},
+	}
+
+	testCases := []struct {
+		name       string
+		want       []string
+		wantGrant  []string
+		wantRevoke []string
+	}{
+		{name: "unchanged", want: []string{"AMIV", "VIS"}},
+		{name: "group removed in keycloak", want: []string{"VIS"}, wantRevoke: []string{"AMIV"}},
+		{name: "new group", want: []string{"AMIV", "VIS", "VMP"}, wantGrant: []string{"VMP"}},
+		{name: "manual grants are kept", want: nil, wantRevoke: []string{"VIS", "AMIV"}},
+		{name: "manual grant is not duplicated", want: []string{"AMIV", "VIS", "VSETH"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			grant, revoke := planGrantSync(current, tc.want)
+			assert.Equal(t, tc.wantGrant, grant)
+			assert.Equal(t, tc.wantRevoke, revoke)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"lagertool.com/main/config"
+)
+
+// Provider is one OpenID Connect identity provider users can log in with, e.g.
+// the VSETH or the VIS Keycloak realm.
+type Provider struct {
+	Name               string
+	IssuerURL          string
+	ClientID           string
+	ClientSecret       string
+	RedirectURL        string
+	PostLogoutRedirect string
+	CookieDomain       string
+
+	// Endpoint and KeySet, when both set, configure the provider without fetching
+	// the discovery document, e.g. to test handlers offline.
+	Endpoint           oauth2.Endpoint
+	KeySet             oidc.KeySet
+	EndSessionEndpoint string
+
+	discovered atomic.Pointer[discovery]
+}
+
+// discovery is what a provider learns from its discovery document. It is swapped
+// in as a whole once available, so handlers never see half a configuration.
+type discovery struct {
+	oauth2Config       *oauth2.Config
+	verifier           *oidc.IDTokenVerifier
+	endSessionEndpoint string
+}
+
+// Discover fetches the provider's discovery document and sets up the OAuth2
+// client and ID token verifier from it.
+func (p *Provider) Discover(ctx context.Context) error {
+	if p.KeySet != nil && p.Endpoint.TokenURL != "" {
+		p.discovered.Store(&discovery{
+			oauth2Config:       p.oauth2Config(p.Endpoint),
+			verifier:           oidc.NewVerifier(p.IssuerURL, p.KeySet, &oidc.Config{ClientID: p.ClientID}),
+			endSessionEndpoint: p.EndSessionEndpoint,
+		})
+		return nil
+	}
+
+	op, err := oidc.NewProvider(ctx, p.IssuerURL)
+	if err != nil {
+		return fmt.Errorf("provider %s: %w", p.Name, err)
+	}
+	d := &discovery{
+		oauth2Config:       p.oauth2Config(op.Endpoint()),
+		verifier:           op.Verifier(&oidc.Config{ClientID: p.ClientID}),
+		endSessionEndpoint: p.EndSessionEndpoint,
+	}
+	var meta struct {
+		EndSession string `json:"end_session_endpoint"`
+	}
+	if err := op.Claims(&meta); err == nil && meta.EndSession != "" {
+		d.endSessionEndpoint = meta.EndSession
+	}
+	p.discovered.Store(d)
+	return nil
+}
+
+// Ready reports whether discovery has succeeded.
+func (p *Provider) Ready() bool {
+	return p.discovered.Load() != nil
+}
+
+func (p *Provider) oauth2Config(endpoint oauth2.Endpoint) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  p.RedirectURL,
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email", oidc.ScopeOfflineAccess},
+		Endpoint:     endpoint,
+	}
+}
+
+// discoverWithRetry keeps calling Discover with exponential backoff until it
+// succeeds or ctx is cancelled.
+func (p *Provider) discoverWithRetry(ctx context.Context) {
+	backoff := discoveryBackoffMin
+	for {
+		err := p.Discover(ctx)
+		if err == nil {
+			log.Printf("OIDC provider %s ready", p.Name)
+			return
+		}
+		log.Printf("OIDC discovery failed, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, discoveryBackoffMax)
+	}
+}
+
+func newProvider(cfg config.OIDCProvider) *Provider {
+	return &Provider{
+		Name:               cfg.Name,
+		IssuerURL:          cfg.IssuerURL,
+		ClientID:           cfg.ClientID,
+		ClientSecret:       cfg.ClientSecret,
+		RedirectURL:        cfg.RedirectURL,
+		PostLogoutRedirect: cfg.PostLogoutRedirect,
+		CookieDomain:       cfg.CookieDomain,
+	}
+}
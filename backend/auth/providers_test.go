@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/config"
+	"lagertool.com/main/db"
+	"lagertool.com/main/db_models"
+)
+
+// newTestHandler builds a handler with the test cookie policy and the given providers.
+func newTestHandler(t *testing.T, db *pg.DB, list ...*Provider) *AuthHandler {
+	cfg := config.AuthConfig{Cookie: config.CookieConfig{Domain: "localhost", SameSite: "lax"}}
+	h, err := NewAuthHandlerWithProviders(db, cfg, list...)
+	assert.NoError(t, err)
+	return h
+}
+
+func TestNewAuthHandler(t *testing.T) {
+	cfg := config.AuthConfig{
+		Providers: []config.OIDCProvider{{Name: "vis", IssuerURL: "https://auth.vis.ethz.ch/realms/VIS", ClientID: "lagertool"}},
+		Cookie:    config.CookieConfig{Domain: "lagertool.ch", Secure: true, SameSite: "strict"},
+	}
+	h, err := NewAuthHandler(nil, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://auth.vis.ethz.ch/realms/VIS", h.providers["vis"].IssuerURL)
+	assert.False(t, h.providers["vis"].Ready(), "discovery only happens in StartDiscovery")
+	assert.Equal(t, "lagertool.ch", h.cookieDomainFor(nil))
+
+	cfg.OrgMapping = "group:/VIS"
+	_, err = NewAuthHandler(nil, cfg)
+	assert.ErrorContains(t, err, "OIDC_ORG_MAPPING")
+
+	cfg.OrgMapping = ""
+	cfg.SessionSecret = "c2hvcnQ="
+	_, err = NewAuthHandler(nil, cfg)
+	assert.ErrorContains(t, err, "SESSION_SECRET")
+}
+
+// mockOIDC is a minimal OpenID Connect provider: discovery, JWKS and an
+// authorization-code token endpoint with PKCE, issuing RS256 ID tokens.
+type mockOIDC struct {
+	*httptest.Server
+	clientID string
+	subject  string
+	key      *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]pendingCode
+}
+
+type pendingCode struct {
+	nonce     string
+	challenge string
+}
+
+func newMockOIDC(t *testing.T, clientID, subject string) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	m := &mockOIDC{clientID: clientID, subject: subject, key: key, codes: map[string]pendingCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/auth",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"end_session_endpoint":                  m.URL + "/logout",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		m.mu.Lock()
+		pending, ok := m.codes[r.PostForm.Get("code")]
+		delete(m.codes, r.PostForm.Get("code"))
+		m.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != pending.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "access-" + m.subject,
+			"refresh_token": "refresh-" + m.subject,
+			"token_type":    "Bearer",
+			"expires_in":    300,
+			"id_token":      m.idToken(t, pending.nonce),
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize plays the user logging in at the provider and returns the
+// callback query the provider would redirect back with.
+func (m *mockOIDC) authorize(t *testing.T, authURL string) url.Values {
+	u, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	q := u.Query()
+	code := "code-" + q.Get("state")
+	m.mu.Lock()
+	m.codes[code] = pendingCode{nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	m.mu.Unlock()
+	return url.Values{"state": {q.Get("state")}, "code": {code}}
+}
+
+func (m *mockOIDC) idToken(t *testing.T, nonce string) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   m.URL,
+		"sub":   m.subject,
+		"aud":   m.clientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		"nonce": nonce,
+		"name":  "Mock User",
+		"email": "mock@example.com",
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (m *mockOIDC) provider(t *testing.T, name string) *Provider {
+	p := &Provider{
+		Name:         name,
+		IssuerURL:    m.URL,
+		ClientID:     m.clientID,
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/auth/" + name + "/callback",
+		CookieDomain: "localhost",
+	}
+	assert.NoError(t, p.Discover(context.Background()))
+	return p
+}
+
+func TestMultipleProviders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dbCon, err := db.NewDBConn(config.Load())
+	if err != nil {
+		panic("Failed to connect to test database: " + err.Error())
+	}
+	defer dbCon.Close()
+	db.InitDB(dbCon)
+
+	// Both realms hand out the same subject; they must still be different users.
+	vis := newMockOIDC(t, "lagertool", "shared-subject")
+	vseth := newMockOIDC(t, "lagertool", "shared-subject")
+	h := newTestHandler(t, dbCon, vis.provider(t, "vis"), vseth.provider(t, "vseth"))
+
+	router := gin.New()
+	router.GET("/auth/:provider/login", h.LoginHandler)
+	router.GET("/auth/:provider/callback", h.CallbackHandler)
+
+	defer func() {
+		var ids []int
+		_ = dbCon.Model((*db_models.User)(nil)).Column("id").
+			Where("issuer IN (?)", pg.In([]string{vis.URL, vseth.URL})).Select(&ids)
+		if len(ids) > 0 {
+			_, _ = dbCon.Model((*db_models.Session)(nil)).Where("user_id IN (?)", pg.In(ids)).Delete()
+			_, _ = dbCon.Model((*db_models.User)(nil)).Where("id IN (?)", pg.In(ids)).Delete()
+		}
+	}()
+
+	login := func(name string) (*http.Cookie, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/auth/"+name+"/login", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusTemporaryRedirect, w.Code, w.Body.String())
+		for _, c := range w.Result().Cookies() {
+			if c.Name == oauthFlowCookie {
+				return c, w.Header().Get("Location")
+			}
+		}
+		t.Fatalf("no flow cookie set by %s login", name)
+		return nil, ""
+	}
+	callback := func(name string, flow *http.Cookie, query url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/auth/"+name+"/callback?"+query.Encode(), nil)
+		req.AddCookie(flow)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("unknown provider", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/auth/nope/login", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("login redirects to the named provider", func(t *testing.T) {
+		_, location := login("vis")
+		assert.Contains(t, location, vis.URL+"/auth?")
+		assert.Contains(t, location, "code_challenge_method=S256")
+	})
+
+	t.Run("flow of one provider is refused by another", func(t *testing.T) {
+		flow, location := login("vis")
+		w := callback("vseth", flow, vis.authorize(t, location))
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	})
+
+	t.Run("users are keyed by issuer and subject", func(t *testing.T) {
+		for _, m := range []struct {
+			name string
+			srv  *mockOIDC
+		}{{"vis", vis}, {"vseth", vseth}, {"vis", vis}} {
+			flow, location := login(m.name)
+			w := callback(m.name, flow, m.srv.authorize(t, location))
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		}
+
+		var users []db_models.User
+		err := dbCon.Model(&users).Where("subject = ?", "shared-subject").
+			Where("issuer IN (?)", pg.In([]string{vis.URL, vseth.URL})).Select()
+		assert.NoError(t, err)
+		assert.Len(t, users, 2)
+	})
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"lagertool.com/main/db_models"
+)
+
+const (
+	apiTokenPrefix = "lgt_"
+
+	// ScopeRead only allows safe methods (GET, HEAD, OPTIONS).
+	ScopeRead = "read"
+	// ScopeWrite allows everything the user may do, except acting as an org admin.
+	ScopeWrite = "write"
+	// ScopeOrgAdminPrefix followed by an organisation name allows acting as an
+	// admin of that organisation, provided the user still holds the rights.
+	ScopeOrgAdminPrefix = "org-admin:"
+	// ScopeSuperAdmin allows acting as one of the configured super-admins,
+	// provided the user is still listed.
+	ScopeSuperAdmin = "super-admin"
+)
+
+// NewAPIToken returns a fresh token and the hash to store for it.
+func NewAPIToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashAPIToken(token), nil
+}
+
+// NewSessionToken returns the cookie value of a new session, the hash to store
+// for it and the opaque handle the session is shown and revoked under.
+func NewSessionToken() (token, hash, handle string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return "", "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashSessionToken(token), hex.EncodeToString(id), nil
+}
+
+// HashSessionToken is the sha256 stored for a session cookie, as for API tokens.
+func HashSessionToken(token string) string {
+	return HashAPIToken(token)
+}
+
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidScope reports whether scope is one of read, write, super-admin or org-admin:<org>.
+func ValidScope(scope string) bool {
+	if scope == ScopeRead || scope == ScopeWrite || scope == ScopeSuperAdmin {
+		return true
+	}
+	org, ok := strings.CutPrefix(scope, ScopeOrgAdminPrefix)
+	return ok && org != ""
+}
+
+// APITokenFromContext returns the token the request was authenticated with, or
+// nil for cookie sessions.
+func APITokenFromContext(c *gin.Context) *db_models.APIToken {
+	v, ok := c.Get("apiToken")
+	if !ok {
+		return nil
+	}
+	token, _ := v.(*db_models.APIToken)
+	return token
+}
+
+// TokenAllowsOrgAdmin reports whether the request may act as an admin of org as
+// far as its credentials go. Cookie sessions always may; tokens need the
+// org-admin scope for that organisation. The user's own rights are checked separately.
+func TokenAllowsOrgAdmin(c *gin.Context, org string) bool {
+	token := APITokenFromContext(c)
+	if token == nil {
+		return true
+	}
+	return hasScope(token, ScopeOrgAdminPrefix+org)
+}
+
+// TokenAllowsAnyOrgAdmin is TokenAllowsOrgAdmin for routes not tied to one organisation.
+func TokenAllowsAnyOrgAdmin(c *gin.Context) bool {
+	token := APITokenFromContext(c)
+	if token == nil {
+		return true
+	}
+	for _, s := range token.Scopes {
+		if strings.HasPrefix(s, ScopeOrgAdminPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenAllowsSuperAdmin is TokenAllowsOrgAdmin for the super-admin routes.
+func TokenAllowsSuperAdmin(c *gin.Context) bool {
+	token := APITokenFromContext(c)
+	if token == nil {
+		return true
+	}
+	return hasScope(token, ScopeSuperAdmin)
+}
+
+func hasScope(token *db_models.APIToken, scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// readOnly reports whether the token may only be used with safe methods.
+func readOnly(token *db_models.APIToken) bool {
+	for _, s := range token.Scopes {
+		if s == ScopeWrite || s == ScopeSuperAdmin || strings.HasPrefix(s, ScopeOrgAdminPrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// authenticateToken is the AuthMiddleware path for "Authorization: Bearer" requests.
+func (h *AuthHandler) authenticateToken(c *gin.Context, raw string) {
+	var token db_models.APIToken
+	err := h.DB.Model(&token).Relation("User").Where("token_hash = ?", HashAPIToken(raw)).First()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return
+	}
+	if !token.ExpiresAt.IsZero() && time.Now().After(token.ExpiresAt) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token expired"})
+		return
+	}
+	if readOnly(&token) && !safeMethod(c.Request.Method) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "details": "token is read-only"})
+		return
+	}
+
+	_, _ = h.DB.Model((*db_models.APIToken)(nil)).
+		Set("last_used_at = ?", time.Now()).
+		Where("id = ?", token.ID).
+		Update()
+
+	c.Set("user", token.User)
+	c.Set("apiToken", &token)
+	c.Next()
+}
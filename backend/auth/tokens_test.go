@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/db_models"
+)
+
+func TestNewAPIToken(t *testing.T) {
+	token, hash, err := NewAPIToken()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, apiTokenPrefix))
+	assert.Equal(t, HashAPIToken(token), hash)
+	assert.NotContains(t, hash, token)
+
+	other, _, err := NewAPIToken()
+	assert.NoError(t, err)
+	assert.NotEqual(t, token, other)
+}
+
+func TestNewSessionToken(t *testing.T) {
+	token, hash, handle, err := NewSessionToken()
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(token), 43) // 32 bytes, base64url
+	assert.Equal(t, HashSessionToken(token), hash)
+	assert.NotEqual(t, token, handle)
+
+	other, _, otherHandle, err := NewSessionToken()
+	assert.NoError(t, err)
+	assert.NotEqual(t, token, other)
+	assert.NotEqual(t, handle, otherHandle)
+}
+
+func TestTokenScopes(t *testing.T) {
+	testCases := []struct {
+		scopes   []string
+		valid    bool
+		readOnly bool
+	}{
+		{scopes: []string{"read"}, valid: true, readOnly: true},
+		{scopes: []string{"write"}, valid: true, readOnly: false},
+		{scopes: []string{"read", "org-admin:VIS"}, valid: true, readOnly: false},
+		{scopes: []string{"super-admin"}, valid: true, readOnly: false},
+		{scopes: []string{"org-admin:"}, valid: false},
+		{scopes: []string{"admin"}, valid: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.scopes, ","), func(t *testing.T) {
+			valid := true
+			for _, s := range tc.scopes {
+				valid = valid && ValidScope(s)
+			}
+			assert.Equal(t, tc.valid, valid)
+			if tc.valid {
+				assert.Equal(t, tc.readOnly, readOnly(&db_models.APIToken{Scopes: tc.scopes}))
+			}
+		})
+	}
+}
@@ -1,8 +1,16 @@
 package config
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -10,9 +18,17 @@ import (
 
 // Config holds all application configuration
 type Config struct {
-	DB    DatabaseConfig
-	Slack SlackConfig
-	App   AppSettings
+	DB        DatabaseConfig
+	Slack     SlackConfig
+	App       AppSettings
+	Auth      AuthConfig
+	CORS      CORSConfig
+	RateLimit RateLimitConfig
+	Storage   StorageConfig
+
+	// Proxies whose X-Forwarded-For header is believed, as IPs or CIDRs. Nil
+	// means none, so the client IP is always the address of the connection.
+	TrustedProxies []string
 }
 
 // DatabaseConfig holds database configuration
@@ -34,6 +50,60 @@ type AppSettings struct {
 	Port string
 }
 
+// AuthConfig holds the identity providers, secrets and cookie policy used by the auth package
+type AuthConfig struct {
+	Providers  []OIDCProvider
+	OrgMapping string // see auth.parseOrgMapping
+
+	// Emails of users who may create organisations and read the audit entries
+	// not tied to an organisation.
+	SuperAdmins []string
+
+	// Base64-encoded, at least 32 bytes after decoding. Empty means an insecure dev fallback.
+	SessionSecret      string
+	TokenEncryptionKey string
+
+	Cookie CookieConfig
+}
+
+// OIDCProvider holds the settings of one identity provider
+type OIDCProvider struct {
+	Name               string
+	IssuerURL          string
+	ClientID           string
+	ClientSecret       string
+	RedirectURL        string
+	PostLogoutRedirect string
+	CookieDomain       string
+}
+
+// CookieConfig holds the attributes of the session and CSRF cookies
+type CookieConfig struct {
+	Domain   string
+	Secure   bool
+	SameSite string // lax, strict or none
+}
+
+// CORSConfig holds the origins allowed to call the API with credentials
+type CORSConfig struct {
+	AllowedOrigins []string
+}
+
+// RateLimitConfig holds the request budget of each route group as
+// "<requests>/<period>", e.g. "20/1m". An empty value or "0" turns the limit off.
+type RateLimitConfig struct {
+	Auth    string // /auth/*, per client IP
+	Search  string // /search/*, per client IP
+	API     string // protected routes, per user
+	APIByIP string // protected routes, per client IP and before authentication
+}
+
+// StorageConfig holds where uploaded attachments are kept and how large they may be
+type StorageConfig struct {
+	Dir         string
+	MaxUploadMB int
+}
+
 var App *Config
 
 // Load loads configuration from environment variables
@@ -73,11 +143,205 @@ func Load() *Config {
 		App: AppSettings{
 			Port: getEnv("APP_PORT", "8000"),
 		},
+		Auth: loadAuth(os.Getenv),
+		CORS: CORSConfig{
+			AllowedOrigins: splitList(getEnv("CORS_ALLOWED_ORIGINS", "http://localhost:5173")),
+		},
+		RateLimit: RateLimitConfig{
+			Auth:    getEnv("RATE_LIMIT_AUTH", "20/1m"),
+			Search:  getEnv("RATE_LIMIT_SEARCH", "60/1m"),
+			API:     getEnv("RATE_LIMIT_API", "600/1m"),
+			APIByIP: getEnv("RATE_LIMIT_API_IP", "1200/1m"),
+		},
+		Storage: StorageConfig{
+			Dir:         getEnv("STORAGE_DIR", "uploads"),
+			MaxUploadMB: getEnvInt("MAX_UPLOAD_MB", 10),
+		},
+		TrustedProxies: splitList(getEnv("TRUSTED_PROXIES", "")),
+	}
+
+	// Tests run over plain HTTP against httptest, so cookies must not be Secure.
+	if gin.Mode() == gin.TestMode {
+		App.Auth.Cookie.Secure = false
 	}
 
 	return App
 }
 
+// loadAuth reads the auth settings. OIDC_PROVIDERS is a comma separated list of
+// names; each name reads OIDC_<NAME>_ISSUER_URL, _CLIENT_ID, _CLIENT_SECRET,
+// _REDIRECT_URL, _POST_LOGOUT_REDIRECT and _COOKIE_DOMAIN. Without OIDC_PROVIDERS
+// a single "eduid" provider is configured from the older VSETH_CLIENT_ID /
+// OIDC_ISSUER_URL variables, so existing deployments keep their /auth/eduid/* URLs.
+func loadAuth(getenv func(string) string) AuthConfig {
+	or := func(key, def string) string {
+		if v := getenv(key); v != "" {
+			return v
+		}
+		return def
+	}
+
+	cfg := AuthConfig{
+		OrgMapping:         getenv("OIDC_ORG_MAPPING"),
+		SuperAdmins:        splitList(getenv("SUPER_ADMINS")),
+		SessionSecret:      getenv("SESSION_SECRET"),
+		TokenEncryptionKey: getenv("TOKEN_ENCRYPTION_KEY"),
+		Cookie: CookieConfig{
+			Domain:   or("COOKIE_DOMAIN", "localhost"),
+			Secure:   or("COOKIE_SECURE", "true") != "false",
+			SameSite: strings.ToLower(or("COOKIE_SAMESITE", "lax")),
+		},
+	}
+
+	names := splitList(getenv("OIDC_PROVIDERS"))
+	if len(names) == 0 {
+		cfg.Providers = []OIDCProvider{{
+			Name:               "eduid",
+			IssuerURL:          or("OIDC_ISSUER_URL", "https://keycloak-fake.vis.ethz.ch/realms/VSETH"),
+			ClientID:           getenv("VSETH_CLIENT_ID"),
+			ClientSecret:       getenv("VSETH_CLIENT_SECRET"),
+			RedirectURL:        or("OIDC_REDIRECT_URL", "https://localhost:8080/auth/eduid/callback"), //fake domain
+			PostLogoutRedirect: or("OIDC_POST_LOGOUT_REDIRECT", "localhost:8080"),                     //fake domain !!
+			CookieDomain:       cfg.Cookie.Domain,
+		}}
+		return cfg
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg.Providers = append(cfg.Providers, OIDCProvider{
+			Name:               name,
+			IssuerURL:          getenv(prefix + "ISSUER_URL"),
+			ClientID:           getenv(prefix + "CLIENT_ID"),
+			ClientSecret:       getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:        or(prefix+"REDIRECT_URL", "https://localhost:8080/auth/"+name+"/callback"),
+			PostLogoutRedirect: or(prefix+"POST_LOGOUT_REDIRECT", "localhost:8080"),
+			CookieDomain:       or(prefix+"COOKIE_DOMAIN", cfg.Cookie.Domain),
+		})
+	}
+	return cfg
+}
+
+// Validate reports every setting that would make the server misbehave, so that
+// main can refuse to start instead of failing on the first login.
+func (c *Config) Validate() error {
+	var errs []error
+
+	seen := map[string]bool{}
+	for _, p := range c.Auth.Providers {
+		if seen[p.Name] {
+			errs = append(errs, fmt.Errorf("OIDC provider %s is listed twice", p.Name))
+		}
+		seen[p.Name] = true
+		if p.IssuerURL == "" || p.ClientID == "" {
+			errs = append(errs, fmt.Errorf("OIDC provider %s needs an issuer URL and a client ID", p.Name))
+		}
+	}
+
+	for _, s := range []struct{ env, value string }{
+		{"SESSION_SECRET", c.Auth.SessionSecret},
+		{"TOKEN_ENCRYPTION_KEY", c.Auth.TokenEncryptionKey},
+	} {
+		if _, err := DecodeSecret(s.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+		}
+	}
+
+	switch c.Auth.Cookie.SameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.Auth.Cookie.Secure {
+			errs = append(errs, errors.New("COOKIE_SAMESITE=none requires COOKIE_SECURE=true"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("COOKIE_SAMESITE must be lax, strict or none, got %q", c.Auth.Cookie.SameSite))
+	}
+
+	// Cookies are sent cross-origin, and browsers refuse credentials for a wildcard origin.
+	if len(c.CORS.AllowedOrigins) == 0 {
+		errs = append(errs, errors.New("CORS_ALLOWED_ORIGINS must list at least one origin"))
+	}
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			errs = append(errs, errors.New("CORS_ALLOWED_ORIGINS cannot be * because credentials are allowed"))
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("CORS origin %q must look like https://host[:port]", origin))
+		}
+	}
+
+	for _, r := range []struct{ env, value string }{
+		{"RATE_LIMIT_AUTH", c.RateLimit.Auth},
+		{"RATE_LIMIT_SEARCH", c.RateLimit.Search},
+		{"RATE_LIMIT_API", c.RateLimit.API},
+		{"RATE_LIMIT_API_IP", c.RateLimit.APIByIP},
+	} {
+		if _, _, err := ParseRate(r.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.env, err))
+		}
+	}
+
+	if c.Storage.Dir == "" {
+		errs = append(errs, errors.New("STORAGE_DIR must not be empty"))
+	}
+	if c.Storage.MaxUploadMB <= 0 {
+		errs = append(errs, errors.New("MAX_UPLOAD_MB must be a positive number of megabytes"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ParseRate parses a RateLimitConfig value such as "20/1m". requests is 0 when
+// the limit is turned off.
+func ParseRate(spec string) (requests int, per time.Duration, err error) {
+	if spec == "" || spec == "0" {
+		return 0, 0, nil
+	}
+	n, d, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("must look like <requests>/<period>, e.g. 20/1m, got %q", spec)
+	}
+	requests, err = strconv.Atoi(n)
+	if err != nil || requests < 0 {
+		return 0, 0, fmt.Errorf("invalid request count %q", n)
+	}
+	per, err = time.ParseDuration(d)
+	if err != nil || per <= 0 {
+		return 0, 0, fmt.Errorf("invalid period %q", d)
+	}
+	return requests, per, nil
+}
+
+// SameSiteMode converts the configured SameSite value for http.Cookie.
+func (c CookieConfig) SameSiteMode() http.SameSite {
+	switch c.SameSite {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// DecodeSecret decodes a base64 secret of at least 32 bytes and returns its first
+// 32 bytes. An empty value decodes to nil, meaning no secret is configured.
+func DecodeSecret(value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("must be base64-encoded")
+	}
+	if len(b) < 32 {
+		return nil, fmt.Errorf("must decode to at least 32 bytes (got %d)", len(b))
+	}
+	return b[:32], nil
+}
+
 // getEnv retrieves environment variable or returns default value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -85,3 +349,27 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvInt is getEnv for integers. A value that is not a number yields 0, which
+// Validate reports.
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
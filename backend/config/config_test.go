@@ -0,0 +1,152 @@
+package config
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAuth(t *testing.T) {
+	testCases := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{name: "legacy single provider", env: map[string]string{"VSETH_CLIENT_ID": "lagertool"}, want: []string{"eduid"}},
+		{
+			name: "named providers",
+			env: map[string]string{
+				"OIDC_PROVIDERS":        "vseth, VIS",
+				"OIDC_VSETH_ISSUER_URL": "https://auth.vseth.ethz.ch/realms/VSETH",
+				"OIDC_VSETH_CLIENT_ID":  "lagertool",
+				"OIDC_VIS_ISSUER_URL":   "https://auth.vis.ethz.ch/realms/VIS",
+				"OIDC_VIS_CLIENT_ID":    "lagertool",
+			},
+			want: []string{"vseth", "vis"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := loadAuth(func(key string) string { return tc.env[key] })
+			var names []string
+			for _, p := range cfg.Providers {
+				names = append(names, p.Name)
+			}
+			assert.Equal(t, tc.want, names)
+		})
+	}
+
+	cfg := loadAuth(func(key string) string {
+		return map[string]string{
+			"OIDC_PROVIDERS":         "vis",
+			"OIDC_VIS_ISSUER_URL":    "https://auth.vis.ethz.ch/realms/VIS",
+			"OIDC_VIS_CLIENT_ID":     "lagertool",
+			"OIDC_VIS_COOKIE_DOMAIN": "vis.ethz.ch",
+			"COOKIE_SAMESITE":        "None",
+			"COOKIE_SECURE":          "false",
+			"SUPER_ADMINS":           "root@vis.ethz.ch, ops@vis.ethz.ch",
+		}[key]
+	})
+	assert.Equal(t, "vis.ethz.ch", cfg.Providers[0].CookieDomain)
+	assert.Equal(t, "https://localhost:8080/auth/vis/callback", cfg.Providers[0].RedirectURL)
+	assert.Equal(t, CookieConfig{Domain: "localhost", Secure: false, SameSite: "none"}, cfg.Cookie)
+	assert.Equal(t, []string{"root@vis.ethz.ch", "ops@vis.ethz.ch"}, cfg.SuperAdmins)
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			Auth: AuthConfig{
+				Providers: []OIDCProvider{{Name: "vis", IssuerURL: "https://auth.vis.ethz.ch/realms/VIS", ClientID: "lagertool"}},
+				Cookie:    CookieConfig{Domain: "lagertool.ch", Secure: true, SameSite: "lax"},
+			},
+			CORS:      CORSConfig{AllowedOrigins: []string{"https://lagertool.ch", "http://localhost:5173"}},
+			RateLimit: RateLimitConfig{Auth: "20/1m", Search: "60/1m", API: "600/1m", APIByIP: "1200/1m"},
+			Storage:   StorageConfig{Dir: "uploads", MaxUploadMB: 10},
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr string
+	}{
+		{name: "valid", modify: func(*Config) {}},
+		{name: "wildcard origin", modify: func(c *Config) { c.CORS.AllowedOrigins = []string{"*"} }, wantErr: "cannot be *"},
+		{name: "no origins", modify: func(c *Config) { c.CORS.AllowedOrigins = nil }, wantErr: "at least one origin"},
+		{name: "origin with path", modify: func(c *Config) { c.CORS.AllowedOrigins = []string{"https://lagertool.ch/app"} }, wantErr: "must look like"},
+		{name: "unknown samesite", modify: func(c *Config) { c.Auth.Cookie.SameSite = "sometimes" }, wantErr: "COOKIE_SAMESITE"},
+		{
+			name:    "samesite none without secure",
+			modify:  func(c *Config) { c.Auth.Cookie.SameSite, c.Auth.Cookie.Secure = "none", false },
+			wantErr: "requires COOKIE_SECURE",
+		},
+		{name: "provider without client", modify: func(c *Config) { c.Auth.Providers[0].ClientID = "" }, wantErr: "needs an issuer URL and a client ID"},
+		{
+			name:    "duplicate provider",
+			modify:  func(c *Config) { c.Auth.Providers = append(c.Auth.Providers, c.Auth.Providers[0]) },
+			wantErr: "listed twice",
+		},
+		{name: "short secret", modify: func(c *Config) { c.Auth.SessionSecret = "c2hvcnQ=" }, wantErr: "SESSION_SECRET"},
+		{name: "secret not base64", modify: func(c *Config) { c.Auth.TokenEncryptionKey = "not base64!" }, wantErr: "TOKEN_ENCRYPTION_KEY"},
+		{name: "rate limit off", modify: func(c *Config) { c.RateLimit.Search = "0" }},
+		{name: "rate limit without period", modify: func(c *Config) { c.RateLimit.Auth = "20" }, wantErr: "RATE_LIMIT_AUTH"},
+		{name: "ip rate limit without period", modify: func(c *Config) { c.RateLimit.APIByIP = "1200" }, wantErr: "RATE_LIMIT_API_IP"},
+		{name: "no upload size", modify: func(c *Config) { c.Storage.MaxUploadMB = 0 }, wantErr: "MAX_UPLOAD_MB"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := valid()
+			tc.modify(cfg)
+			err := cfg.Validate()
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSameSiteMode(t *testing.T) {
+	assert.Equal(t, http.SameSiteLaxMode, CookieConfig{SameSite: "lax"}.SameSiteMode())
+	assert.Equal(t, http.SameSiteStrictMode, CookieConfig{SameSite: "strict"}.SameSiteMode())
+	assert.Equal(t, http.SameSiteNoneMode, CookieConfig{SameSite: "none"}.SameSiteMode())
+}
+
+func TestParseRate(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		requests int
+		per      time.Duration
+		wantErr  bool
+	}{
+		{spec: "20/1m", requests: 20, per: time.Minute},
+		{spec: "5/30s", requests: 5, per: 30 * time.Second},
+		{spec: "", requests: 0},
+		{spec: "0", requests: 0},
+		{spec: "20", wantErr: true},
+		{spec: "many/1m", wantErr: true},
+		{spec: "20/minute", wantErr: true},
+		{spec: "20/0s", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			requests, per, err := ParseRate(tc.spec)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.requests, requests)
+			assert.Equal(t, tc.per, per)
+		})
+	}
+}
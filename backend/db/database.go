@@ -35,11 +35,48 @@ func NewDBConn(cfg *config.Config) (con *pg.DB, err error) {
 	return con, nil
 }
 
+// columnMigrations add the columns introduced after a table was first created.
+// CreateTable with IfNotExists leaves existing tables alone, so every new column
+// on an existing model needs an idempotent ALTER here.
+var columnMigrations = []string{
+	`ALTER TABLE session ADD COLUMN IF NOT EXISTS token_hash text UNIQUE`,
+	`ALTER TABLE session ADD COLUMN IF NOT EXISTS handle text UNIQUE`,
+	// Sessions from before token_hash were looked up by their guessable ID; end them.
+	`DELETE FROM session WHERE token_hash IS NULL`,
+	`CREATE SEQUENCE IF NOT EXISTS session_session_id_seq OWNED BY session.session_id`,
+	`ALTER TABLE session ALTER COLUMN session_id SET DEFAULT nextval('session_session_id_seq')`,
+	`SELECT setval('session_session_id_seq', COALESCE((SELECT max(session_id) FROM session), 0) + 1, false)`,
+	`ALTER TABLE has_special_rights_for ADD COLUMN IF NOT EXISTS source text`,
+	`ALTER TABLE loans ADD COLUMN IF NOT EXISTS asset_id bigint REFERENCES asset (id)`,
+	`ALTER TABLE "Inventory" ADD COLUMN IF NOT EXISTS category_id bigint REFERENCES category (id)`,
+	`ALTER TABLE "Inventory" ADD COLUMN IF NOT EXISTS tags text[]`,
+	`ALTER TABLE "Inventory" ADD COLUMN IF NOT EXISTS attributes jsonb`,
+	`ALTER TABLE "Inventory" ADD COLUMN IF NOT EXISTS archived_at timestamptz`,
+	`ALTER TABLE "Inventory" ADD COLUMN IF NOT EXISTS min_stock bigint`,
+	`ALTER TABLE "Inventory" ADD COLUMN IF NOT EXISTS reorder_quantity bigint`,
+	`ALTER TABLE "Inventory" ADD COLUMN IF NOT EXISTS low_stock_since timestamptz`,
+	`ALTER TABLE shopping_cart_items ADD COLUMN IF NOT EXISTS kit_id bigint REFERENCES kit (id)`,
+	`ALTER TABLE request_items ADD COLUMN IF NOT EXISTS kit_id bigint`,
+	`ALTER TABLE building ADD COLUMN IF NOT EXISTS owned_by text REFERENCES organisations (name)`,
+	`ALTER TABLE room ADD COLUMN IF NOT EXISTS owned_by text REFERENCES organisations (name)`,
+	// Rooms and buildings whose shelves all belong to one organisation go to it.
+	`UPDATE room SET owned_by = s.owner
+	FROM (SELECT room_id, min(owned_by) AS owner FROM shelf
+		WHERE owned_by IS NOT NULL GROUP BY room_id HAVING count(DISTINCT owned_by) = 1) s
+	WHERE room.id = s.room_id AND room.owned_by IS NULL`,
+	`UPDATE building SET owned_by = s.owner
+	FROM (SELECT room.building_id, min(shelf.owned_by) AS owner FROM shelf JOIN room ON room.id = shelf.room_id
+		WHERE shelf.owned_by IS NOT NULL GROUP BY room.building_id HAVING count(DISTINCT shelf.owned_by) = 1) s
+	WHERE building.id = s.building_id AND building.owned_by IS NULL`,
+}
+
 func InitDB(con *pg.DB) {
 	models := []interface{}{
 		(*db_models.Organisation)(nil),
 		(*db_models.User)(nil),
 		(*db_models.Session)(nil),
+		(*db_models.APIToken)(nil),
+		(*db_models.AuditLog)(nil),
 		(*db_models.HasSpecialRightsFor)(nil),
 		(*db_models.Building)(nil),
 		(*db_models.Room)(nil),
@@ -47,7 +84,13 @@ func InitDB(con *pg.DB) {
 		(*db_models.Column)(nil),
 		(*db_models.ShelfUnit)(nil),
 		//(*db_models.Item)(nil),
+		(*db_models.Category)(nil),
+		(*db_models.AttributeDefinition)(nil),
 		(*db_models.Inventory)(nil),
+		(*db_models.Asset)(nil),
+		(*db_models.Attachment)(nil),
+		(*db_models.Kit)(nil),
+		(*db_models.KitComponent)(nil),
 		(*db_models.ShoppingCart)(nil),
 		(*db_models.ShoppingCartItem)(nil),
 		(*db_models.Request)(nil),
@@ -55,6 +98,8 @@ func InitDB(con *pg.DB) {
 		(*db_models.RequestReview)(nil),
 		(*db_models.Loans)(nil),
 		(*db_models.Consumed)(nil),
+		(*db_models.StockMovement)(nil),
+		(*db_models.ItemTransfer)(nil),
 		(*db_models.UserRequestMessage)(nil),
 	}
 
@@ -72,6 +117,18 @@ func InitDB(con *pg.DB) {
 		}
 	}
 
+	for _, migration := range columnMigrations {
+		if _, err := con.Exec(migration); err != nil {
+			log.Fatalf("❌ Error running migration %q: %v", migration, err)
+		}
+	}
+
+	if n, err := BackfillStock(con); err != nil {
+		log.Fatalf("❌ Error backfilling the stock ledger: %v", err)
+	} else if n > 0 {
+		log.Printf("✅ Opened the stock ledger for %d consumable items", n)
+	}
+
 	log.Println("✅ Database tables initialized and migrations completed successfully.")
 }
 
@@ -142,6 +199,9 @@ func InsertDummyData(con *pg.DB) {
 	if _, err := con.Model(consumed).Insert(); err != nil {
 		log.Fatalf("Insert Consumed failed: %v", err)
 	}
+	if _, err := BackfillStock(con); err != nil {
+		log.Fatalf("Backfill stock ledger failed: %v", err)
+	}
 
 	log.Println("✅ Dummy data inserted successfully")
 }
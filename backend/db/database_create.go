@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 	"lagertool.com/main/db_models"
 )
 
@@ -20,10 +21,11 @@ type ColumnInput struct {
 	Elements []ShelfElementInput
 }
 
-func CreateBuilding(con *pg.DB, name string, campus string) (*db_models.Building, error) {
+func CreateBuilding(con *pg.DB, name string, campus string, ownedBy string) (*db_models.Building, error) {
 	building := &db_models.Building{
 		Name:       name,
 		Campus:     campus,
+		OwnedBy:    ownedBy,
 		UpdateDate: time.Now(),
 	}
 
@@ -31,12 +33,13 @@ func CreateBuilding(con *pg.DB, name string, campus string) (*db_models.Building
 	return building, err
 }
 
-func CreateRoom(con *pg.DB, name string, floor string, number string, buildingID int) (*db_models.Room, error) {
+func CreateRoom(con *pg.DB, name string, floor string, number string, buildingID int, ownedBy string) (*db_models.Room, error) {
 	room := &db_models.Room{
 		Name:       name,
 		Floor:      floor,
 		Number:     number,
 		BuildingID: buildingID,
+		OwnedBy:    ownedBy,
 		UpdateDate: time.Now(),
 	}
 	_, err := con.Model(room).Insert()
@@ -68,13 +71,9 @@ func CreateShelf(con *pg.DB, id string, name string, ownedBy string, roomID int,
 		shelf.Columns = append(shelf.Columns, *col) //is this necessary?
 
 		for pos, element := range column.Elements {
-			suType := 0
-			if element.Type != "slim" {
-				suType = 1
-			}
 			el := &db_models.ShelfUnit{
 				ID:               element.ID,
-				Type:             suType,
+				Type:             unitType(element.Type),
 				PositionInColumn: pos,
 				ColumnID:         col.ID,
 			}
@@ -88,16 +87,23 @@ func CreateShelf(con *pg.DB, id string, name string, ownedBy string, roomID int,
 	return shelf, nil
 }
 
-func CreateCartItem(con *pg.DB, itemID int, num_selected int, userID int) (*db_models.ShoppingCartItem, error) {
+// userCart returns the shopping cart of a user, creating it on first use.
+func userCart(con *pg.DB, userID int) (*db_models.ShoppingCart, error) {
 	cart := &db_models.ShoppingCart{}
 	err := con.Model(cart).Where("user_id = ?", userID).Select()
 	if errors.Is(err, pg.ErrNoRows) {
 		cart.UserID = userID
 		_, err = con.Model(cart).Insert()
-		if err != nil {
-			return nil, err
-		}
-	} else if err != nil {
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+func CreateCartItem(con *pg.DB, itemID int, num_selected int, userID int) (*db_models.ShoppingCartItem, error) {
+	cart, err := userCart(con, userID)
+	if err != nil {
 		return nil, err
 	}
 
@@ -113,15 +119,20 @@ func CreateCartItem(con *pg.DB, itemID int, num_selected int, userID int) (*db_m
 	return shoppingCartItem, nil
 }
 
-func CreateInventoryItem(con *pg.DB, name string, amount int, shelfUnitID string, isConsumable bool, note string, shelfId string) (*db_models.Inventory, error) {
+func CreateInventoryItem(con orm.DB, name string, amount int, shelfUnitID string, isConsumable bool, note string, shelfId string, categoryID int, tags []string, attributes map[string]interface{}, minStock int, reorderQuantity int) (*db_models.Inventory, error) {
 	inv := &db_models.Inventory{
-		Name:         name,
-		IsConsumable: isConsumable,
-		Amount:       amount,
-		ShelfUnitID:  shelfUnitID,
-		UpdateDate:   time.Now(),
-		Note:         note,
-		ShelfID:      shelfId,
+		Name:            name,
+		IsConsumable:    isConsumable,
+		Amount:          amount,
+		ShelfUnitID:     shelfUnitID,
+		UpdateDate:      time.Now(),
+		Note:            note,
+		ShelfID:         shelfId,
+		CategoryID:      categoryID,
+		Tags:            tags,
+		Attributes:      attributes,
+		MinStock:        minStock,
+		ReorderQuantity: reorderQuantity,
 	}
 	_, err := con.Model(inv).Insert()
 	if err != nil {
@@ -130,6 +141,57 @@ func CreateInventoryItem(con *pg.DB, name string, amount int, shelfUnitID string
 	return inv, nil
 }
 
+// CreateCartKit adds num_selected copies of a kit to a user's cart as one entry.
+func CreateCartKit(con *pg.DB, kitID int, num_selected int, userID int) (*db_models.ShoppingCartItem, error) {
+	cart, err := userCart(con, userID)
+	if err != nil {
+		return nil, err
+	}
+	shoppingCartItem := &db_models.ShoppingCartItem{
+		Amount:         num_selected,
+		KitID:          kitID,
+		ShoppingCartID: cart.ID,
+	}
+	_, err = con.Model(shoppingCartItem).Insert()
+	if err != nil {
+		return nil, err
+	}
+	return shoppingCartItem, nil
+}
+
+// CreateKit inserts a kit with its components.
+func CreateKit(con orm.DB, kit *db_models.Kit) error {
+	kit.UpdateDate = time.Now()
+	if _, err := con.Model(kit).Insert(); err != nil {
+		return err
+	}
+	return SetKitComponents(con, kit)
+}
+
+// SetKitComponents replaces the stored components of a kit with kit.Components.
+func SetKitComponents(con orm.DB, kit *db_models.Kit) error {
+	_, err := con.Model((*db_models.KitComponent)(nil)).Where("kit_id = ?", kit.ID).Delete()
+	if err != nil {
+		return err
+	}
+	for i := range kit.Components {
+		kit.Components[i].ID = 0
+		kit.Components[i].KitID = kit.ID
+	}
+	_, err = con.Model(&kit.Components).Insert()
+	return err
+}
+
+func CreateCategory(con *pg.DB, name string, organisation string, parentID int) (*db_models.Category, error) {
+	category := &db_models.Category{
+		Name:             name,
+		OrganisationName: organisation,
+		ParentID:         parentID,
+	}
+	_, err := con.Model(category).Insert()
+	return category, err
+}
+
 func CreateRequest(con *pg.DB, request *db_models.Request) error {
 	_, err := con.Model(request).Insert()
 	if err != nil {
@@ -146,17 +208,17 @@ func CreateRequestItem(con *pg.DB, request db_models.RequestItems) error {
 	return nil
 }
 
-func CreateRequestReview(con *pg.DB, request *db_models.RequestReview) error {
+func CreateRequestReview(con orm.DB, request *db_models.RequestReview) error {
 	_, err := con.Model(request).Insert()
 	return err
 }
 
-func Create_loans(con *pg.DB, loan *db_models.Loans) error {
+func Create_loans(con orm.DB, loan *db_models.Loans) error {
 	_, err := con.Model(loan).Insert()
 	return err
 }
 
-func Create_consumed(con *pg.DB, consumed *db_models.Consumed) error {
+func Create_consumed(con orm.DB, consumed *db_models.Consumed) error {
 	_, err := con.Model(consumed).Insert()
 	return err
 }
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"lagertool.com/main/db_models"
+)
+
+var (
+	// ErrOrganisationExists is returned when an organisation is created or
+	// renamed to a name that is already taken.
+	ErrOrganisationExists = errors.New("organisation already exists")
+	// ErrOrganisationInUse is returned by DeleteOrganisation while the
+	// organisation still owns locations, categories, kits or borrow requests.
+	ErrOrganisationInUse = errors.New("organisation still owns data")
+)
+
+// orgScopePrefix mirrors auth.ScopeOrgAdminPrefix, which cannot be imported
+// here without an import cycle.
+const orgScopePrefix = "org-admin:"
+
+// orgReferences are the columns holding an organisation name. Rows of the
+// tables marked owned keep an organisation from being deleted.
+var orgReferences = []struct {
+	model  interface{}
+	table  string
+	column string
+	owned  bool
+}{
+	{(*db_models.Building)(nil), "building", "owned_by", true},
+	{(*db_models.Room)(nil), "room", "owned_by", true},
+	{(*db_models.Shelf)(nil), "shelf", "owned_by", true},
+	{(*db_models.Request)(nil), "request", "organisation_name", true},
+	{(*db_models.Category)(nil), "category", "organisation_name", true},
+	{(*db_models.Kit)(nil), "kit", "organisation_name", true},
+	{(*db_models.HasSpecialRightsFor)(nil), "has_special_rights_for", "organisation_name", false},
+	{(*db_models.AuditLog)(nil), "audit_log", "organisation_name", false},
+	{(*db_models.ItemTransfer)(nil), "item_transfer", "from_organisation", false},
+	{(*db_models.ItemTransfer)(nil), "item_transfer", "to_organisation", false},
+}
+
+// CreateOrganisation inserts an organisation and, unless adminID is 0, makes
+// that user its first admin.
+func CreateOrganisation(con orm.DB, name string, adminID int) (*db_models.Organisation, error) {
+	org := &db_models.Organisation{Name: name}
+	res, err := con.Model(org).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected() == 0 {
+		return nil, ErrOrganisationExists
+	}
+	if adminID != 0 {
+		_, err = con.Model(&db_models.HasSpecialRightsFor{OrganisationName: name, UserID: adminID}).Insert()
+	}
+	return org, err
+}
+
+// RenameOrganisation moves everything that refers to an organisation over to
+// its new name. The name is the primary key and is referenced by foreign keys,
+// so the new row is inserted first and the old one deleted last. Call it
+// inside a transaction.
+func RenameOrganisation(con orm.DB, from, to string) error {
+	exists, err := con.Model((*db_models.Organisation)(nil)).Where("name = ?", from).Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return pg.ErrNoRows
+	}
+	res, err := con.Model(&db_models.Organisation{Name: to}).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrOrganisationExists
+	}
+	for _, ref := range orgReferences {
+		_, err := con.Model(ref.model).
+			Set("? = ?", pg.Ident(ref.column), to).
+			Where("? = ?", pg.Ident(ref.column), from).
+			Update()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = con.Exec(`UPDATE api_token SET scopes = array_replace(scopes, ?, ?) WHERE ? = ANY(scopes)`,
+		orgScopePrefix+from, orgScopePrefix+to, orgScopePrefix+from)
+	if err != nil {
+		return err
+	}
+	_, err = con.Model((*db_models.Organisation)(nil)).Where("name = ?", from).Delete()
+	return err
+}
+
+// DeleteOrganisation removes an organisation with its admin rights and the
+// API token scopes naming it. It refuses with ErrOrganisationInUse while the
+// organisation owns anything else; the audit log keeps its entries.
+func DeleteOrganisation(con orm.DB, name string) error {
+	var owned []string
+	for _, ref := range orgReferences {
+		if !ref.owned {
+			continue
+		}
+		exists, err := con.Model(ref.model).Where("? = ?", pg.Ident(ref.column), name).Exists()
+		if err != nil {
+			return err
+		}
+		if exists {
+			owned = append(owned, ref.table)
+		}
+	}
+	if len(owned) > 0 {
+		return fmt.Errorf("%w: %s", ErrOrganisationInUse, strings.Join(owned, ", "))
+	}
+	if _, err := con.Model((*db_models.HasSpecialRightsFor)(nil)).Where("organisation_name = ?", name).Delete(); err != nil {
+		return err
+	}
+	_, err := con.Exec(`UPDATE api_token SET scopes = array_remove(scopes, ?) WHERE ? = ANY(scopes)`,
+		orgScopePrefix+name, orgScopePrefix+name)
+	if err != nil {
+		return err
+	}
+	res, err := con.Model((*db_models.Organisation)(nil)).Where("name = ?", name).Delete()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pg.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"lagertool.com/main/db_models"
+)
+
+var (
+	// ErrUnitNotEmpty is returned by SetShelfLayout when the new layout drops a
+	// shelf unit that still holds inventory.
+	ErrUnitNotEmpty = errors.New("shelf unit still holds inventory")
+	// ErrLayoutIDTaken is returned by SetShelfLayout when a column or shelf unit
+	// ID of the new layout already belongs to another shelf.
+	ErrLayoutIDTaken = errors.New("id is used by another shelf")
+)
+
+// unitType maps the "slim" and "high" element types of the API to ShelfUnit.Type.
+func unitType(t string) int {
+	if t == "slim" {
+		return 0
+	}
+	return 1
+}
+
+// SetShelfLayout makes the columns and shelf units of a shelf match columns:
+// missing columns and units are created, units are moved to their column and
+// position and given their type, and columns and units not listed are deleted.
+// Units keep their ID, so the items on them stay where they are. Call it inside
+// a transaction so a refused layout leaves the shelf untouched.
+func SetShelfLayout(con orm.DB, shelfID string, columns []ColumnInput) error {
+	var existingCols []db_models.Column
+	if err := con.Model(&existingCols).Where("shelf_id = ?", shelfID).Select(); err != nil {
+		return err
+	}
+	var existingUnits []db_models.ShelfUnit
+	err := con.Model(&existingUnits).
+		Join(`JOIN "column" ON "column".id = shelf_unit.column_id`).
+		Where(`"column".shelf_id = ?`, shelfID).
+		Select()
+	if err != nil {
+		return err
+	}
+
+	var colIDs, unitIDs []string
+	wantUnits := map[string]bool{}
+	for _, col := range columns {
+		colIDs = append(colIDs, col.ID)
+		for _, el := range col.Elements {
+			unitIDs = append(unitIDs, el.ID)
+			wantUnits[el.ID] = true
+		}
+	}
+	if len(colIDs) > 0 {
+		var taken []string
+		err := con.Model((*db_models.Column)(nil)).Column("id").
+			Where("id IN (?)", pg.In(colIDs)).
+			Where("shelf_id <> ?", shelfID).
+			Select(&taken)
+		if err != nil {
+			return err
+		}
+		if len(taken) > 0 {
+			return fmt.Errorf("%w: column %s", ErrLayoutIDTaken, strings.Join(taken, ", "))
+		}
+	}
+	if len(unitIDs) > 0 {
+		var taken []string
+		err := con.Model((*db_models.ShelfUnit)(nil)).Column("shelf_unit.id").
+			Join(`JOIN "column" ON "column".id = shelf_unit.column_id`).
+			Where("shelf_unit.id IN (?)", pg.In(unitIDs)).
+			Where(`"column".shelf_id <> ?`, shelfID).
+			Select(&taken)
+		if err != nil {
+			return err
+		}
+		if len(taken) > 0 {
+			return fmt.Errorf("%w: shelf unit %s", ErrLayoutIDTaken, strings.Join(taken, ", "))
+		}
+	}
+
+	var removed []string
+	have := map[string]bool{}
+	for _, u := range existingUnits {
+		have[u.ID] = true
+		if !wantUnits[u.ID] {
+			removed = append(removed, u.ID)
+		}
+	}
+	if len(removed) > 0 {
+		var occupied []string
+		err := con.Model((*db_models.Inventory)(nil)).ColumnExpr("DISTINCT shelf_unit_id").
+			Where("shelf_unit_id IN (?)", pg.In(removed)).
+			Select(&occupied)
+		if err != nil {
+			return err
+		}
+		if len(occupied) > 0 {
+			return fmt.Errorf("%w: %s", ErrUnitNotEmpty, strings.Join(occupied, ", "))
+		}
+		if _, err := con.Model((*db_models.ShelfUnit)(nil)).Where("id IN (?)", pg.In(removed)).Delete(); err != nil {
+			return err
+		}
+	}
+
+	haveCol := map[string]bool{}
+	for _, c := range existingCols {
+		haveCol[c.ID] = true
+	}
+	for _, col := range columns {
+		if !haveCol[col.ID] {
+			if _, err := con.Model(&db_models.Column{ID: col.ID, ShelfID: shelfID}).Insert(); err != nil {
+				return err
+			}
+		}
+		for pos, el := range col.Elements {
+			unit := &db_models.ShelfUnit{
+				ID:               el.ID,
+				Type:             unitType(el.Type),
+				PositionInColumn: pos,
+				ColumnID:         col.ID,
+			}
+			if have[el.ID] {
+				_, err = con.Model(unit).Column("type", "position_in_column", "column_id").WherePK().Update()
+			} else {
+				_, err = con.Model(unit).Insert()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	wantCol := map[string]bool{}
+	for _, id := range colIDs {
+		wantCol[id] = true
+	}
+	for _, c := range existingCols {
+		if wantCol[c.ID] {
+			continue
+		}
+		if _, err := con.Model(&c).WherePK().Delete(); err != nil {
+			return err
+		}
+	}
+
+	_, err = con.Model((*db_models.Shelf)(nil)).Set("update_date = ?", time.Now()).Where("id = ?", shelfID).Update()
+	return err
+}
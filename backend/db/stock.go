@@ -0,0 +1,105 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"lagertool.com/main/db_models"
+)
+
+// ErrInsufficientStock is returned by PostStockMovement when a movement would
+// take the stock of an item below zero.
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// StockLevel sums the stock ledger of an item.
+func StockLevel(con orm.DB, itemID int) (int, error) {
+	var level int
+	_, err := con.QueryOne(pg.Scan(&level),
+		`SELECT COALESCE(SUM(quantity), 0) FROM stock_movement WHERE inventory_id = ?`, itemID)
+	return level, err
+}
+
+// PostStockMovement appends a movement to the ledger and sets the item's Amount
+// to the new stock level. Call it inside a transaction: the item row is locked
+// so that concurrent movements cannot both pass the stock check.
+func PostStockMovement(con orm.DB, m *db_models.StockMovement) error {
+	var inv db_models.Inventory
+	err := con.Model(&inv).Column("id").Where("id = ?", m.InventoryID).For("UPDATE").Select()
+	if err != nil {
+		return err
+	}
+	level, err := StockLevel(con, m.InventoryID)
+	if err != nil {
+		return err
+	}
+	if level+m.Quantity < 0 {
+		return ErrInsufficientStock
+	}
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now()
+	}
+	if _, err := con.Model(m).Insert(); err != nil {
+		return err
+	}
+	_, err = con.Model(&inv).
+		Set("amount = ?", level+m.Quantity).
+		Set("update_date = ?", m.CreatedAt).
+		WherePK().
+		Update()
+	return err
+}
+
+// ReconcileStock posts a movement that brings the ledger of an item to amount,
+// e.g. when an admin sets the amount directly. Nothing is posted when the
+// ledger already matches.
+func ReconcileStock(con orm.DB, itemID int, amount int, reason string, note string, userID int) error {
+	level, err := StockLevel(con, itemID)
+	if err != nil {
+		return err
+	}
+	if level == amount {
+		return nil
+	}
+	return PostStockMovement(con, &db_models.StockMovement{
+		InventoryID: itemID,
+		Quantity:    amount - level,
+		Reason:      reason,
+		Note:        note,
+		UserID:      userID,
+	})
+}
+
+// lowStock matches consumables whose stock is below their minimum.
+const lowStock = `is_consumable AND archived_at IS NULL AND amount < COALESCE(min_stock, 0)`
+
+// FlagLowStock sets low_stock_since on consumables that fell below their
+// minimum stock and clears it on those that were restocked. It returns the
+// items that were flagged by this call.
+func FlagLowStock(con orm.DB) ([]db_models.Inventory, error) {
+	_, err := con.Exec(`UPDATE "Inventory" SET low_stock_since = NULL WHERE low_stock_since IS NOT NULL AND NOT (` + lowStock + `)`)
+	if err != nil {
+		return nil, err
+	}
+	var flagged []db_models.Inventory
+	_, err = con.Query(&flagged, `UPDATE "Inventory" SET low_stock_since = now()
+		WHERE low_stock_since IS NULL AND `+lowStock+` RETURNING id, name, amount, min_stock`)
+	return flagged, err
+}
+
+// BackfillStock opens the ledger of consumable items that were created before
+// it existed, with their current amount as the opening balance.
+func BackfillStock(con *pg.DB) (int, error) {
+	res, err := con.Exec(`
+		INSERT INTO stock_movement (inventory_id, quantity, reason, note, created_at)
+		SELECT i.id, i.amount, ?, 'opening balance', now()
+		FROM "Inventory" AS i
+		WHERE i.is_consumable AND i.amount <> 0
+		  AND NOT EXISTS (SELECT 1 FROM stock_movement AS m WHERE m.inventory_id = i.id)`,
+		db_models.StockCorrection)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
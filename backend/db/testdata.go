@@ -49,6 +49,7 @@ func GetDummyData() (
 	// 3️⃣ Session
 	session := &db_models.Session{
 		ID:        1,
+		Handle:    "dummy-session",
 		UserID:    user.ID,
 		CreatedAt: now.Add(-2 * time.Hour),
 		ExpiresAt: now.Add(24 * time.Hour),
@@ -62,6 +63,7 @@ func GetDummyData() (
 		Name:       "Science Building",
 		GPS:        "37.7749,-122.4194",
 		Campus:     "Main Campus",
+		OwnedBy:    org.Name,
 		UpdateDate: now,
 	}
 
@@ -71,6 +73,7 @@ func GetDummyData() (
 		Floor:      "1",
 		Name:       "Chemistry Lab",
 		BuildingID: building.ID,
+		OwnedBy:    org.Name,
 		UpdateDate: now,
 		Building:   building,
 	}
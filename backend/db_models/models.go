@@ -1,6 +1,7 @@
 package db_models
 
 import (
+	"encoding/json"
 	"net"
 	"time"
 )
@@ -25,7 +26,9 @@ type User struct {
 
 type Session struct {
 	tableName struct{}  `pg:"session"`
-	ID        int       `json:"session_id" pg:"session_id"`
+	ID        int       `json:"-" pg:"session_id,pk"`
+	TokenHash string    `json:"-" pg:"token_hash,unique"`  // sha256 of the cookie value
+	Handle    string    `json:"handle" pg:"handle,unique"` // opaque ID the session is listed and revoked under
 	UserID    int       `json:"user_id" pg:"user_id"`
 	CreatedAt time.Time `json:"created_at" pg:"created_at"`
 	ExpiresAt time.Time `json:"expires_at" pg:"expires_at"`
@@ -36,22 +39,64 @@ type Session struct {
 	User *User `json:"user" pg:"rel:has-one,fk:user_id"`
 }
 
+// APIToken is a personal access token for scripts and kiosks. Only the sha256 of
+// the token is stored; the token itself is shown once when it is created.
+type APIToken struct {
+	tableName  struct{}  `pg:"api_token"`
+	ID         int       `json:"id" pg:"id,pk"`
+	UserID     int       `json:"user_id" pg:"user_id"`
+	Name       string    `json:"name" pg:"name"`
+	TokenHash  string    `json:"-" pg:"token_hash,unique"`
+	Scopes     []string  `json:"scopes" pg:"scopes,array"`
+	CreatedAt  time.Time `json:"created_at" pg:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at" pg:"expires_at"` // zero means no expiry
+	LastUsedAt time.Time `json:"last_used_at" pg:"last_used_at"`
+
+	User *User `json:"user" pg:"rel:has-one,fk:user_id"`
+}
+
+// AuditLog is one entry of the audit trail written by package audit. Before and
+// After are JSON snapshots of the target; Before is null for creations and After
+// for deletions. ActorID is 0 (NULL) for anonymous events such as failed logins.
+type AuditLog struct {
+	tableName        struct{}        `pg:"audit_log"`
+	ID               int             `json:"id" pg:"id,pk"`
+	ActorID          int             `json:"actor_id" pg:"actor_id"`
+	Action           string          `json:"action" pg:"action"`
+	Entity           string          `json:"entity" pg:"entity"`
+	EntityID         string          `json:"entity_id" pg:"entity_id"`
+	OrganisationName string          `json:"organisation_name" pg:"organisation_name"`
+	Before           json.RawMessage `json:"before" pg:"before"`
+	After            json.RawMessage `json:"after" pg:"after"`
+	IP               net.IP          `json:"ip" pg:"ip"`
+	CreatedAt        time.Time       `json:"created_at" pg:"created_at"`
+
+	Actor *User `json:"actor" pg:"rel:has-one,fk:actor_id"`
+}
+
 type HasSpecialRightsFor struct {
 	tableName        struct{} `pg:"has_special_rights_for"`
 	OrganisationName string   `json:"organisation-name" pg:"organisation_name, pk"`
 	UserID           int      `json:"user_id" pg:"user_id, pk"`
+	Source           string   `json:"source" pg:"source"` // "oidc" if granted by the login claim mapping, empty if granted by hand
 
 	Organisation *Organisation `json:"organisation" pg:"rel:has-one,fk:organisation_name"`
 	User         *User         `json:"user" pg:"rel:has-one,fk:user_id"`
 }
 
+// Building and Room are owned by the organisation that created them. Rows from
+// before ownership was recorded have no owner and are shared: they are listed for
+// every organisation with shelves in them.
 type Building struct {
 	tableName  struct{}  `pg:"building"`
 	ID         int       `json:"id" pg:"id,pk"`
 	Name       string    `json:"name" pg:"name"`
 	GPS        string    `json:"gps" pg:"gps"`
 	Campus     string    `json:"campus" pg:"campus"`
+	OwnedBy    string    `json:"owned_by" pg:"owned_by"`
 	UpdateDate time.Time `json:"update_date" pg:"update_date"`
+
+	Organisation *Organisation `json:"organisation" pg:"rel:has-one,fk:owned_by"`
 }
 
 type Room struct {
@@ -61,9 +106,11 @@ type Room struct {
 	Floor      string    `json:"floor" pg:"floor"`
 	Name       string    `json:"name" pg:"name"`
 	BuildingID int       `json:"building_id" pg:"building_id"`
+	OwnedBy    string    `json:"owned_by" pg:"owned_by"`
 	UpdateDate time.Time `json:"update_date" pg:"update_date"`
 
-	Building *Building `json:"building" pg:"rel:has-one,fk:building_id"`
+	Building     *Building     `json:"building" pg:"rel:has-one,fk:building_id"`
+	Organisation *Organisation `json:"organisation" pg:"rel:has-one,fk:owned_by"`
 }
 
 type Shelf struct {
@@ -106,13 +153,16 @@ type ShoppingCart struct {
 	ShoppingCartItems []ShoppingCartItem `json:"shopping_cart_items" pg:"rel:has-many,fk:shopping_cart_id"`
 }
 
+// ShoppingCartItem is either an inventory item or, when KitID is set, a whole kit.
 type ShoppingCartItem struct {
 	ID             int `json:"id" pg:"id,pk"`
 	Amount         int `json:"amount" pg:"amount"`
-	InventoryID    int `json:"inventory_id" pg:"inventory_id"`
+	InventoryID    int `json:"inventory_id,omitempty" pg:"inventory_id"`
+	KitID          int `json:"kit_id,omitempty" pg:"kit_id"`
 	ShoppingCartID int `json:"shopping_cart_id" pg:"shopping_cart_id"`
 
 	Inventory    *Inventory   `json:"inventory" pg:"rel:has-one,fk:inventory_id"`
+	Kit          *Kit         `json:"kit" pg:"rel:has-one,fk:kit_id"`
 	ShoppingCart ShoppingCart `json:"shopping_cart" pg:"rel:has-one,fk:shopping_cart_id"`
 }
 
@@ -126,10 +176,142 @@ type Inventory struct {
 	Note         string    `json:"note" pg:"note"`
 	Name         string    `json:"name" pg:"name"`
 	IsConsumable bool      `json:"is_consumable" pg:"is_consumable"`
-
+	CategoryID   int       `json:"category_id" pg:"category_id"`
+	Tags         []string  `json:"tags" pg:"tags,array"`
+	// Attributes holds the values of the attributes defined for the item's category.
+	Attributes map[string]interface{} `json:"attributes" pg:"attributes,type:jsonb"`
+	// ArchivedAt is set when the item was archived instead of deleted, so that
+	// requests and loans keep pointing at it.
+	ArchivedAt time.Time `json:"archived_at,omitempty" pg:"archived_at"`
+	// MinStock is the stock level below which a consumable has to be reordered,
+	// in batches of ReorderQuantity. LowStockSince is set by the reorder check.
+	MinStock        int       `json:"min_stock" pg:"min_stock"`
+	ReorderQuantity int       `json:"reorder_quantity" pg:"reorder_quantity"`
+	LowStockSince   time.Time `json:"low_stock_since,omitempty" pg:"low_stock_since"`
+
+	Category     *Category      `json:"category" pg:"rel:has-one,fk:category_id"`
 	Shelf        *Shelf         `json:"shelf" pg:"rel:has-one,fk:shelf_id"`
 	ShelfUnit    *ShelfUnit     `json:"shelf_unit" pg:"rel:has-one,fk:shelf_unit_id"`
 	RequestItems []RequestItems `json:"request_item" pg:"rel:has-many,fk:inventory_id"`
+	Assets       []Asset        `json:"assets" pg:"rel:has-many,fk:inventory_id"`
+}
+
+// Archived reports whether the item was archived.
+func (i Inventory) Archived() bool {
+	return !i.ArchivedAt.IsZero()
+}
+
+// Category is a node in an organisation's category tree. Root categories have no parent.
+type Category struct {
+	tableName        struct{} `pg:"category"`
+	ID               int      `json:"id" pg:"id,pk"`
+	Name             string   `json:"name" pg:"name"`
+	OrganisationName string   `json:"organisation_name" pg:"organisation_name"`
+	ParentID         int      `json:"parent_id" pg:"parent_id"`
+
+	Organisation *Organisation `json:"organisation" pg:"rel:has-one,fk:organisation_name"`
+	Parent       *Category     `json:"parent" pg:"rel:has-one,fk:parent_id"`
+}
+
+// Attribute types
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeEnum    = "enum"
+	AttributeBoolean = "boolean"
+)
+
+// AttributeDefinition describes a custom field of the items in a category and
+// its subcategories. Options lists the allowed values of an enum, Unit is shown
+// next to a number.
+type AttributeDefinition struct {
+	tableName  struct{} `pg:"attribute_definition"`
+	ID         int      `json:"id" pg:"id,pk"`
+	CategoryID int      `json:"category_id" pg:"category_id,unique:category_key"`
+	Key        string   `json:"key" pg:"key,unique:category_key"`
+	Label      string   `json:"label" pg:"label"`
+	Type       string   `json:"type" pg:"type"`
+	Unit       string   `json:"unit" pg:"unit"`
+	Options    []string `json:"options" pg:"options,array"`
+	Required   bool     `json:"required" pg:"required,use_zero"`
+
+	Category *Category `json:"category" pg:"rel:has-one,fk:category_id"`
+}
+
+// Kit is a set of inventory items that is borrowed as one unit, e.g. a camera
+// kit made of a body, two lenses, a battery and a bag.
+type Kit struct {
+	tableName        struct{}  `pg:"kit"`
+	ID               int       `json:"id" pg:"id,pk"`
+	Name             string    `json:"name" pg:"name"`
+	Description      string    `json:"description" pg:"description"`
+	OrganisationName string    `json:"organisation_name" pg:"organisation_name"`
+	UpdateDate       time.Time `json:"update_date" pg:"update_date"`
+
+	Organisation *Organisation  `json:"organisation" pg:"rel:has-one,fk:organisation_name"`
+	Components   []KitComponent `json:"components" pg:"rel:has-many,fk:kit_id"`
+}
+
+// KitComponent says how many units of an inventory item one kit contains.
+type KitComponent struct {
+	tableName   struct{} `pg:"kit_component"`
+	ID          int      `json:"id" pg:"id,pk"`
+	KitID       int      `json:"kit_id" pg:"kit_id,unique:kit_item"`
+	InventoryID int      `json:"inventory_id" pg:"inventory_id,unique:kit_item"`
+	Amount      int      `json:"amount" pg:"amount"`
+
+	Kit       *Kit       `json:"kit" pg:"rel:has-one,fk:kit_id"`
+	Inventory *Inventory `json:"inventory" pg:"rel:has-one,fk:inventory_id"`
+}
+
+// Asset conditions. Broken and lost units are not lent out.
+const (
+	ConditionNew    = "new"
+	ConditionGood   = "good"
+	ConditionWorn   = "worn"
+	ConditionBroken = "broken"
+	ConditionLost   = "lost"
+)
+
+// Asset is one individually tracked unit of an inventory item, e.g. one of five
+// oscilloscopes. An item with assets is serialized: its availability is counted
+// in units and loans can be bound to a specific unit.
+type Asset struct {
+	tableName    struct{}  `pg:"asset"`
+	ID           int       `json:"id" pg:"id,pk"`
+	InventoryID  int       `json:"inventory_id" pg:"inventory_id"`
+	SerialNumber string    `json:"serial_number" pg:"serial_number"`
+	AssetTag     string    `json:"asset_tag" pg:"asset_tag,unique"`
+	Condition    string    `json:"condition" pg:"condition"`
+	PurchaseDate time.Time `json:"purchase_date" pg:"purchase_date"`
+	Note         string    `json:"note" pg:"note"`
+	CreatedAt    time.Time `json:"created_at" pg:"created_at"`
+
+	Inventory *Inventory `json:"inventory" pg:"rel:has-one,fk:inventory_id"`
+}
+
+// Attachment is a file attached to an inventory item, e.g. a photo or a manual.
+// The content lives in the storage.Store under StorageKey; images also get a
+// thumbnail under ThumbnailKey.
+type Attachment struct {
+	tableName    struct{}  `pg:"attachment"`
+	ID           int       `json:"id" pg:"id,pk"`
+	InventoryID  int       `json:"inventory_id" pg:"inventory_id"`
+	FileName     string    `json:"file_name" pg:"file_name"`
+	ContentType  string    `json:"content_type" pg:"content_type"`
+	Size         int64     `json:"size" pg:"size"`
+	StorageKey   string    `json:"-" pg:"storage_key"`
+	ThumbnailKey string    `json:"-" pg:"thumbnail_key"`
+	UploadedBy   int       `json:"uploaded_by" pg:"uploaded_by"`
+	CreatedAt    time.Time `json:"created_at" pg:"created_at"`
+
+	Inventory *Inventory `json:"inventory" pg:"rel:has-one,fk:inventory_id"`
+	Uploader  *User      `json:"uploader" pg:"rel:has-one,fk:uploaded_by"`
+}
+
+// Usable reports whether the unit can be lent out.
+func (a Asset) Usable() bool {
+	return a.Condition != ConditionBroken && a.Condition != ConditionLost
 }
 
 type Request struct {
@@ -155,6 +337,9 @@ type RequestItems struct {
 	RequestID   int      `json:"request_id" pg:"request_id"`
 	InventoryID int      `json:"inventory_id" pg:"inventory_id"`
 	Amount      int      `json:"amount" pg:"amount"`
+	// KitID is the kit the item was borrowed with, if any. It is kept when
+	// the kit is deleted later.
+	KitID int `json:"kit_id,omitempty" pg:"kit_id"`
 
 	Request   *Request   `json:"request" pg:"rel:has-one,fk:request_id"`
 	Inventory *Inventory `json:"inventory" pg:"rel:has-one,fk:inventory_id"`
@@ -188,10 +373,41 @@ type Loans struct {
 	tableName     struct{}  `pg:"loans"`
 	ID            int       `json:"id" pg:"id,pk"`
 	RequestItemID int       `json:"request_item_id" pg:"request_item_id"`
+	AssetID       int       `json:"asset_id,omitempty" pg:"asset_id"` // the unit lent out, 0 for bulk items
 	IsReturned    bool      `json:"returned" pg:"returned,use_zero"`
 	ReturnedAt    time.Time `json:"returned_at,omitempty" pg:"returned_at"`
 
 	RequestItems *RequestItems `pg:"rel:belongs-to,fk:request_item_id"`
+	Asset        *Asset        `json:"asset,omitempty" pg:"rel:has-one,fk:asset_id"`
+}
+
+// Stock movement reasons.
+const (
+	StockRestock    = "restock"
+	StockConsumed   = "consumed"
+	StockLost       = "lost"
+	StockDamaged    = "damaged"
+	StockCorrection = "correction"
+	StockTransfer   = "transfer"
+)
+
+// StockMovement is one entry in the append-only stock ledger of a consumable
+// item. Quantity is positive for stock coming in and negative for stock going
+// out; the item's Amount is the sum of its movements.
+type StockMovement struct {
+	tableName     struct{}  `pg:"stock_movement"`
+	ID            int       `json:"id" pg:"id,pk"`
+	InventoryID   int       `json:"inventory_id" pg:"inventory_id"`
+	Quantity      int       `json:"quantity" pg:"quantity,use_zero"`
+	Reason        string    `json:"reason" pg:"reason"`
+	Note          string    `json:"note" pg:"note"`
+	RequestItemID int       `json:"request_item_id,omitempty" pg:"request_item_id"`
+	UserID        int       `json:"user_id,omitempty" pg:"user_id"`
+	CreatedAt     time.Time `json:"created_at" pg:"created_at"`
+
+	Inventory   *Inventory    `json:"inventory" pg:"rel:has-one,fk:inventory_id"`
+	RequestItem *RequestItems `json:"request_item" pg:"rel:has-one,fk:request_item_id"`
+	User        *User         `json:"user" pg:"rel:has-one,fk:user_id"`
 }
 
 type Consumed struct {
@@ -201,3 +417,39 @@ type Consumed struct {
 
 	RequestItems *RequestItems `json:"request_items" pg:"rel:belongs-to,fk:request_item_id"`
 }
+
+// Item transfer states. Moves within an organisation complete at once; moves to
+// a shelf unit of another organisation wait for the admins of both sides.
+const (
+	TransferPending   = "pending"
+	TransferCompleted = "completed"
+	TransferRejected  = "rejected"
+)
+
+// ItemTransfer records Amount units of an item moving from one shelf unit to
+// another. TargetInventoryID is the row the units ended up in: the item itself
+// when all of it moved, a new row split off from it otherwise. Shelf units and
+// organisations are kept as plain values so the history outlives them.
+type ItemTransfer struct {
+	tableName         struct{}  `pg:"item_transfer"`
+	ID                int       `json:"id" pg:"id,pk"`
+	InventoryID       int       `json:"inventory_id" pg:"inventory_id"`
+	TargetInventoryID int       `json:"target_inventory_id,omitempty" pg:"target_inventory_id"`
+	Amount            int       `json:"amount" pg:"amount"`
+	FromShelfUnitID   string    `json:"from_shelf_unit_id" pg:"from_shelf_unit_id"`
+	ToShelfUnitID     string    `json:"to_shelf_unit_id" pg:"to_shelf_unit_id"`
+	FromOrganisation  string    `json:"from_organisation" pg:"from_organisation"`
+	ToOrganisation    string    `json:"to_organisation" pg:"to_organisation"`
+	Note              string    `json:"note" pg:"note"`
+	State             string    `json:"state" pg:"state"`
+	RequestedBy       int       `json:"requested_by,omitempty" pg:"requested_by"`
+	SourceApprovedBy  int       `json:"source_approved_by,omitempty" pg:"source_approved_by"`
+	SourceApprovedAt  time.Time `json:"source_approved_at,omitempty" pg:"source_approved_at"`
+	TargetApprovedBy  int       `json:"target_approved_by,omitempty" pg:"target_approved_by"`
+	TargetApprovedAt  time.Time `json:"target_approved_at,omitempty" pg:"target_approved_at"`
+	CreatedAt         time.Time `json:"created_at" pg:"created_at"`
+	CompletedAt       time.Time `json:"completed_at,omitempty" pg:"completed_at"` // when it was carried out or rejected
+
+	Inventory       *Inventory `json:"inventory" pg:"rel:has-one,fk:inventory_id"`
+	TargetInventory *Inventory `json:"target_inventory" pg:"rel:has-one,fk:target_inventory_id"`
+}
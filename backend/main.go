@@ -40,13 +40,21 @@ func main() {
 
 	// Load configuration from .env file
 	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
 	router := gin.Default()
+	// Rate limits and audit entries key on the client IP, so only believe
+	// X-Forwarded-For when it comes from one of our own proxies.
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 	// Configure CORS middleware
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"}, // Allow all origins, or specify your frontend URL
+		AllowOrigins:     cfg.CORS.AllowedOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "X-CSRF-Token"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 	}))
@@ -67,11 +75,17 @@ func main() {
 		db.InsertDummyData(dbConnection)
 	}
 	if !*noserver {
-		api.SetupRoutes(router, dbConnection, cfg, *using_auth)
-
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		auth.NewAuthHandler(dbConnection).StartSessionCleanup(ctx)
+
+		authHandler, err := auth.NewAuthHandler(dbConnection, cfg.Auth)
+		if err != nil {
+			log.Fatal("Auth setup failed: ", err)
+		}
+		authHandler.StartDiscovery(ctx)
+		authHandler.StartSessionCleanup(ctx)
+		api.StartReorderCheck(ctx, dbConnection)
+		api.SetupRoutes(router, dbConnection, cfg, authHandler, *using_auth)
 
 		// Swagger endpoint
 		router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
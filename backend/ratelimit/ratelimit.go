@@ -0,0 +1,121 @@
+// Package ratelimit throttles clients per key (IP address or user). The Limiter
+// interface is what the middleware talks to, so a shared backend such as Redis
+// can replace the in-memory TokenBucket when the API runs on several instances.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"lagertool.com/main/db_models"
+)
+
+// Limiter decides whether the client identified by key may make another request.
+// When it may not, retryAfter says how long it has to wait.
+type Limiter interface {
+	Allow(key string) (ok bool, retryAfter time.Duration)
+}
+
+// KeyFunc identifies the client a request is counted against.
+type KeyFunc func(c *gin.Context) string
+
+// ByIP counts requests per client IP.
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByUser counts requests per logged-in user and falls back to the client IP. It
+// must run after auth.AuthMiddleware.
+func ByUser(c *gin.Context) string {
+	if v, ok := c.Get("user"); ok {
+		if user, ok := v.(*db_models.User); ok && user != nil {
+			return fmt.Sprintf("user:%d", user.ID)
+		}
+	}
+	return ByIP(c)
+}
+
+// Middleware rejects requests over the limit with 429 and a Retry-After header.
+func Middleware(l Limiter, key KeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, retryAfter := l.Allow(key(c))
+		if !ok {
+			seconds := strconv.Itoa(max(int(math.Ceil(retryAfter.Seconds())), 1))
+			c.Header("Retry-After", seconds)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests", "details": "retry after " + seconds + "s"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// TokenBucket is an in-memory Limiter. Every key gets a bucket of `requests`
+// tokens that refills evenly over `per`, so short bursts are allowed as long as
+// the average stays below the limit.
+type TokenBucket struct {
+	rate  float64 // tokens per second
+	burst float64
+	per   time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket allows each key `requests` requests per `per`.
+func NewTokenBucket(requests int, per time.Duration) *TokenBucket {
+	return &TokenBucket{
+		rate:    float64(requests) / per.Seconds(),
+		burst:   float64(requests),
+		per:     per,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+func (l *TokenBucket) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that have been idle for a whole period; they would be
+// full again anyway. It runs at most once per period to keep Allow cheap.
+func (l *TokenBucket) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.per {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.per {
+			delete(l.buckets, key)
+		}
+	}
+}
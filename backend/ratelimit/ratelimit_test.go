@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"lagertool.com/main/db_models"
+)
+
+// fakeClock lets the tests move time forward by hand.
+type fakeClock struct{ t time.Time }
+
+func (f *fakeClock) now() time.Time          { return f.t }
+func (f *fakeClock) advance(d time.Duration) { f.t = f.t.Add(d) }
+
+func newTestBucket(requests int, per time.Duration) (*TokenBucket, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewTokenBucket(requests, per)
+	l.now = clock.now
+	return l, clock
+}
+
+func TestTokenBucket(t *testing.T) {
+	l, clock := newTestBucket(3, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok, "request %d is within the burst", i+1)
+	}
+	ok, retryAfter := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 20*time.Second, retryAfter)
+
+	ok, _ = l.Allow("b")
+	assert.True(t, ok, "keys have separate buckets")
+
+	clock.advance(20 * time.Second)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok, "one token refilled after a third of the period")
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok, "the bucket does not refill beyond the burst")
+	}
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+}
+
+func TestTokenBucketSweep(t *testing.T) {
+	l, clock := newTestBucket(1, time.Minute)
+	l.Allow("a")
+	l.Allow("b")
+	assert.Len(t, l.buckets, 2)
+
+	clock.advance(2 * time.Minute)
+	l.Allow("c")
+	assert.Len(t, l.buckets, 1, "idle buckets are forgotten")
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l, _ := newTestBucket(1, 10*time.Second)
+
+	router := gin.New()
+	router.GET("/search", Middleware(l, ByIP), func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/me", func(c *gin.Context) {
+		c.Set("user", &db_models.User{ID: 7})
+		c.Next()
+	}, Middleware(l, ByUser), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	get := func(path, ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, get("/search", "10.0.0.1").Code)
+	w := get("/search", "10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, get("/search", "10.0.0.2").Code, "other clients are not affected")
+
+	assert.Equal(t, http.StatusOK, get("/me", "10.0.0.1").Code, "users are counted apart from their IP")
+	assert.Equal(t, http.StatusTooManyRequests, get("/me", "10.0.0.3").Code, "the same user from another IP")
+}
+
+func TestByIPIgnoresUntrustedForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name    string
+		proxies []string
+		want    int // status of the second request with a different X-Forwarded-For
+	}{
+		{name: "no trusted proxies", proxies: nil, want: http.StatusTooManyRequests},
+		{name: "request from a trusted proxy", proxies: []string{"10.0.0.1"}, want: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, _ := newTestBucket(1, 10*time.Second)
+			router := gin.New()
+			assert.NoError(t, router.SetTrustedProxies(tc.proxies))
+			router.GET("/auth", Middleware(l, ByIP), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			get := func(forwardedFor string) int {
+				req, _ := http.NewRequest("GET", "/auth", nil)
+				req.RemoteAddr = "10.0.0.1:1234"
+				req.Header.Set("X-Forwarded-For", forwardedFor)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			assert.Equal(t, http.StatusOK, get("203.0.113.1"))
+			assert.Equal(t, tc.want, get("203.0.113.2"))
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	store := NewLocal(t.TempDir())
+
+	assert.NoError(t, store.Put(ctx, "attachments/1/manual.pdf", bytes.NewReader([]byte("%PDF-1.4"))))
+	f, err := store.Open(ctx, "attachments/1/manual.pdf")
+	if assert.NoError(t, err) {
+		content, _ := io.ReadAll(f)
+		f.Close()
+		assert.Equal(t, "%PDF-1.4", string(content))
+	}
+
+	assert.NoError(t, store.Delete(ctx, "attachments/1/manual.pdf"))
+	_, err = store.Open(ctx, "attachments/1/manual.pdf")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, store.Delete(ctx, "attachments/1/manual.pdf"), "deleting twice is fine")
+
+	for _, key := range []string{"", "../secret", "/etc/passwd", "a/../../b"} {
+		assert.Error(t, store.Put(ctx, key, bytes.NewReader(nil)), key)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	encode := func(w, h int) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.Set(x, y, color.RGBA{R: 200, A: 255})
+			}
+		}
+		var buf bytes.Buffer
+		assert.NoError(t, png.Encode(&buf, img))
+		return buf.Bytes()
+	}
+
+	testCases := []struct {
+		name          string
+		width, height int
+		wantW, wantH  int
+	}{
+		{name: "landscape", width: 800, height: 400, wantW: 200, wantH: 100},
+		{name: "portrait", width: 300, height: 600, wantW: 100, wantH: 200},
+		{name: "small stays", width: 50, height: 20, wantW: 50, wantH: 20},
+		{name: "thin line", width: 1000, height: 1, wantW: 200, wantH: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			thumb, err := Thumbnail(encode(tc.width, tc.height), 200)
+			if !assert.NoError(t, err) {
+				return
+			}
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(thumb))
+			assert.NoError(t, err)
+			assert.Equal(t, "jpeg", format)
+			assert.Equal(t, tc.wantW, cfg.Width)
+			assert.Equal(t, tc.wantH, cfg.Height)
+		})
+	}
+
+	t.Run("transparent becomes white", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 400, 400))))
+		thumb, err := Thumbnail(buf.Bytes(), 200)
+		if !assert.NoError(t, err) {
+			return
+		}
+		img, err := jpeg.Decode(bytes.NewReader(thumb))
+		assert.NoError(t, err)
+		r, g, b, _ := img.At(100, 100).RGBA()
+		assert.Greater(t, min(r, g, b), uint32(0xf000))
+	})
+
+	_, err := Thumbnail([]byte("%PDF-1.4"), 200)
+	assert.Error(t, err)
+}
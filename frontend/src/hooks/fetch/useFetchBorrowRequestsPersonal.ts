@@ -2,8 +2,7 @@ import useFetch from "@/hooks/fetch/useFetch"
 import type { BorrowRequest } from "@/types/borrowRequest"
 
 function useFetchBorrowRequestsPersonal() {
-  const userId = 1
-  return useFetch<BorrowRequest[]>(`/borrow_requests?userId=${userId}`)
+  return useFetch<BorrowRequest[]>(`/me/requests`)
 }
 
 export default useFetchBorrowRequestsPersonal